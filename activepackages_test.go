@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// activePackagesSource returns an organization with an active package carrying the
+// _id of its boughtPackages document and one without an _id
+func activePackagesSource() cannedSource {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	item := bson.M{"name": "Invoices", "code": 101}
+	return cannedSource{"organizations": {bson.M{
+		"_id": selfTestID(10), "created_at": created, "name": "Alpha LLC",
+		"active_packages": bson.A{
+			bson.M{"_id": selfTestID(40), "bought_at": created,
+				"package": bson.M{"_id": selfTestID(2), "price": 100.0, "items": bson.A{item}}},
+			bson.M{"bought_at": created,
+				"package": bson.M{"_id": selfTestID(3), "price": 200.0, "items": bson.A{item}}},
+		},
+	}}}
+}
+
+func TestActivePackagesKeyedByEmbeddedID(t *testing.T) {
+	derived := uuid.NewSHA1(uuid.NameSpaceOID, []byte(selfTestID(10).Hex()+"/"+selfTestID(3).Hex())).String()
+	want := []string{selfTestID(40).Hex(), derived}
+
+	// Every run maps an active package to the same bought_packages and
+	// bought_package_items ids, so a re-run finds the rows of the first
+	for run := 1; run <= 2; run++ {
+		m, dir := newOutputMigrator(t, activePackagesSource(), Options{})
+		if _, err := m.migrateActivePackages(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		packages := outputRows(t, m, dir, (&models.BoughtPackage{}).TableName())
+		items := outputRows(t, m, dir, (&models.BoughtPackageItem{}).TableName())
+		if len(packages) != len(want) || len(items) != len(want) {
+			t.Fatalf("run %d: %d packages and %d items, expected %d of each", run, len(packages), len(items), len(want))
+		}
+		for i, id := range want {
+			if packages[i]["id"] != id {
+				t.Errorf("run %d: package %d has id %v, expected %s", run, i, packages[i]["id"], id)
+			}
+			if items[i]["id"] != childRowID(id, 101) || items[i]["bought_package_id"] != id {
+				t.Errorf("run %d: item %d is %v %v, expected %s of %s", run, i, items[i]["id"], items[i]["bought_package_id"], childRowID(id, 101), id)
+			}
+		}
+	}
+}
+
+func TestActivePackagesUpsertOnEmbeddedID(t *testing.T) {
+	m, statements := newDryRunMigrator(t, activePackagesSource(), Options{OnConflict: onConflictUpdate})
+	if _, err := m.migrateActivePackages(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var upsert string
+	for _, s := range *statements {
+		if strings.Contains(s, "INSERT INTO `bought_packages`") {
+			upsert = s
+		}
+	}
+	if !strings.Contains(upsert, "ON DUPLICATE KEY UPDATE") || !strings.Contains(upsert, "`price`=VALUES(`price`)") {
+		t.Errorf("bought_packages are not upserted on their id: %s", upsert)
+	}
+}
+
+func TestActivePackagesCheckpointedApart(t *testing.T) {
+	source := &filterRecorder{cannedSource: activePackagesSource()}
+	m, _ := newDryRunMigrator(t, source, Options{})
+	m.checkpoint = &checkpoint{Collections: map[string]*collectionProgress{
+		"organizations": {LastID: selfTestID(99).Hex()},
+	}}
+	if _, err := m.migrateActivePackages(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if filter := source.filter.(bson.M); filter["_id"] != nil {
+		t.Errorf("the checkpoint of organizations restricts the active packages: %v", filter)
+	}
+	if p := m.checkpoint.progress("organizations.active_packages"); p == nil || p.LastID != selfTestID(10).Hex() {
+		t.Errorf("active packages checkpoint is %+v, expected the last organization", p)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultBatchSize is the number of rows sent per INSERT unless -batch-size is set
+const defaultBatchSize = 500
+
+// batch accumulates the mapped rows of one parent table and inserts them with
+// CreateInBatches. Rows already present in MySQL are filtered out once per flush
+// instead of with one existence query per document.
+type batch[T any] struct {
+	m          *Migrator
+	db         *gorm.DB
+	collection string
+	table      string
+
+	ids  []string
+	rows []T
+	docs []bson.Raw
+	// lastID is the _id of the last queued source document, see checkpoint
+	lastID string
+	// flushedAt is when the batch was created or last flushed, see full
+	flushedAt time.Time
+
+	moved   int
+	skipped int
+	// updated counts the moved rows that overwrote an existing row and unchanged the
+	// skipped ones whose row_hash matched, both with -on-conflict update
+	updated   int
+	unchanged int
+}
+
+// newBatch creates the batch of a collection, continuing the counters of a resumed run
+func newBatch[T any](m *Migrator, db *gorm.DB, collection, table string) *batch[T] {
+	b := &batch[T]{m: m, db: db, collection: collection, table: table, flushedAt: time.Now()}
+	if p := m.checkpoint.progress(collection); p != nil {
+		b.moved, b.skipped = p.Moved, p.Skipped
+	}
+	return b
+}
+
+// add queues row for insertion. The source document is only retained when presence
+// tracking is enabled for the collection or failed records are stored, since the
+// cursor reuses its buffer.
+func (b *batch[T]) add(id string, row T, doc bson.Raw) {
+	b.lastID = documentID(doc)
+	if len(b.m.opts.PresenceFields[b.collection]) > 0 || b.m.opts.OutputErrorsToMySQL || b.m.opts.SkipErrors {
+		doc = append(bson.Raw(nil), doc...)
+	} else {
+		doc = nil
+	}
+	b.ids = append(b.ids, id)
+	b.rows = append(b.rows, row)
+	b.docs = append(b.docs, doc)
+}
+
+// full reports whether the batch reached the configured batch size, or holds rows
+// queued for longer than -commit-interval
+func (b *batch[T]) full() bool {
+	return len(b.rows) >= b.m.opts.BatchSize || (len(b.rows) > 0 && b.m.commitDue(b.flushedAt))
+}
+
+// commitDue reports whether -commit-interval has passed since a batch was last
+// flushed. It is checked as documents arrive and, while the cursor stalls, by the
+// ticker of a commitCursor.
+func (m *Migrator) commitDue(flushedAt time.Time) bool {
+	return m.opts.CommitInterval > 0 && time.Since(flushedAt) >= m.opts.CommitInterval
+}
+
+// commitCursor iterates a source cursor for a migration loop writing batches. With
+// -commit-interval, cur.Next runs on a reader goroutine while Next waits for it with
+// a ticker, calling flush on the loop's goroutine every interval, so rows queued
+// before the cursor stalls are committed on schedule instead of with the next
+// document. cur.Current is only read by the loop between two calls of Next, when the
+// reader is idle. Without -commit-interval Next is cur.Next.
+type commitCursor struct {
+	cur      documentCursor
+	interval time.Duration
+	// flush writes the batches of the loop that are due, see batch.full
+	flush func() error
+
+	requests chan struct{}
+	results  chan bool
+	cancel   context.CancelFunc
+	err      error
+}
+
+// documentCursor is the part of *mongo.Cursor a commitCursor advances
+type documentCursor interface {
+	Next(ctx context.Context) bool
+}
+
+// commitCursor returns the commitCursor of a migration loop over cur; the loop calls
+// Close when it ends and returns Err
+func (m *Migrator) commitCursor(ctx context.Context, cur *mongo.Cursor, flush func() error) *commitCursor {
+	return newCommitCursor(ctx, cur, m.opts.CommitInterval, flush)
+}
+
+func newCommitCursor(ctx context.Context, cur documentCursor, interval time.Duration, flush func() error) *commitCursor {
+	c := &commitCursor{cur: cur, interval: interval, flush: flush}
+	if interval <= 0 {
+		return c
+	}
+	// Cancelled when a flush fails, to end a pending cur.Next
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.requests = make(chan struct{})
+	c.results = make(chan bool)
+	go func() {
+		defer close(c.results)
+		for range c.requests {
+			c.results <- cur.Next(ctx)
+		}
+	}()
+	return c
+}
+
+// Next advances the cursor like cur.Next, flushing due batches while it waits. It
+// returns false once a flush failed, see Err.
+func (c *commitCursor) Next(ctx context.Context) bool {
+	if c.requests == nil {
+		return c.cur.Next(ctx)
+	}
+	if c.err != nil {
+		return false
+	}
+	c.requests <- struct{}{}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ok := <-c.results:
+			return ok
+		case <-ticker.C:
+			if err := c.flush(); err != nil {
+				c.err = err
+				c.cancel()
+				<-c.results
+				return false
+			}
+		}
+	}
+}
+
+// Err returns the error of the flush that stopped Next
+func (c *commitCursor) Err() error {
+	return c.err
+}
+
+// Close stops the reader goroutine; the cursor itself is closed by its owner
+func (c *commitCursor) Close() {
+	if c.requests == nil {
+		return
+	}
+	close(c.requests)
+	for range c.results {
+	}
+	c.cancel()
+}
+
+// flush inserts the queued rows that are not in MySQL yet and resets the batch. It
+// returns the ids of the inserted rows and of the rows that already existed.
+func (b *batch[T]) flush() (inserted, existing map[string]bool, err error) {
+	if len(b.rows) == 0 {
+		return nil, nil, nil
+	}
+	defer b.reset()
+	movedBefore, skippedBefore := b.moved, b.skipped
+	defer func() {
+		b.m.metrics.rows(b.collection, b.moved-movedBefore, b.skipped-skippedBefore)
+	}()
+
+	if err := roundMoney(b.m, b.db, b.rows); err != nil {
+		return nil, nil, err
+	}
+	hashes, err := setRowHashes(b.db, b.rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if b.m.capture != nil {
+		// Verifying: every row counts as inserted so its children are mapped too
+		if err := captureRows(b.m.capture, b.rows); err != nil {
+			return nil, nil, err
+		}
+		inserted = make(map[string]bool, len(b.ids))
+		for _, id := range b.ids {
+			inserted[id] = true
+		}
+		return inserted, nil, nil
+	}
+
+	existing, err = existingRecords(b.m, b.collection, b.table, b.ids, b.rows)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s existence check failed: %w", b.table, err)
+	}
+
+	orphans, err := findOrphans(b.m, b.collection, b.ids, b.rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Existing rows whose source did not change are left as they are
+	var stored map[string]string
+	if b.m.opts.OnConflict == onConflictUpdate && hashes != nil && len(existing) > 0 && len(b.m.opts.DedupKeys[b.collection]) == 0 {
+		if stored, err = storedHashes(b.db, b.table, b.ids); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	inserted = make(map[string]bool, len(b.rows))
+	rows := make([]T, 0, len(b.rows))
+	queued := make([]int, 0, len(b.rows))
+	for i, row := range b.rows {
+		if existing[b.ids[i]] && b.m.opts.OnConflict != onConflictUpdate {
+			b.skipped++
+			continue
+		}
+		if existing[b.ids[i]] && stored != nil && stored[b.ids[i]] == hashes[i] {
+			// The hash does not cover child rows, so they are still written
+			inserted[b.ids[i]] = true
+			b.skipped++
+			b.unchanged++
+			continue
+		}
+		if o, ok := orphans[b.ids[i]]; ok {
+			if err := b.m.handleOrphan(b.collection, b.ids[i], o, row); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		inserted[b.ids[i]] = true
+		rows = append(rows, row)
+		queued = append(queued, i)
+	}
+
+	if len(rows) > 0 && b.m.output != nil {
+		if err := writeJSONL(b.m.output, b.db, rows); err != nil {
+			return nil, nil, err
+		}
+		b.moved += len(rows)
+	} else if len(rows) > 0 {
+		b.m.limiter.wait(len(rows))
+		// Rows inserted by someone else since the existence check are dropped by the
+		// conflict clause and counted as skipped
+		result := b.db.Clauses(b.m.onConflict(b.collection, new(T))).CreateInBatches(rows, b.m.opts.BatchSize)
+		if err := result.Error; err != nil {
+			slog.Error("batch insert failed", "collection", b.collection, "table", b.table, "rows", len(rows), "error", err)
+			if !b.m.opts.SkipErrors {
+				for _, i := range queued {
+					b.m.recordFailure(b.collection, b.ids[i], b.docs[i], err)
+				}
+				return nil, nil, fmt.Errorf("%s batch insert failed: %w", b.table, err)
+			}
+			b.insertEach(queued, inserted, existing)
+		} else if b.m.opts.OnConflict == onConflictUpdate {
+			// MySQL reports 2 affected rows per update and 0 per unchanged row
+			b.moved += len(rows)
+			for _, i := range queued {
+				if existing[b.ids[i]] {
+					b.updated++
+				}
+			}
+		} else {
+			b.moved += int(result.RowsAffected)
+			b.skipped += len(rows) - int(result.RowsAffected)
+		}
+	}
+
+	for i, doc := range b.docs {
+		if doc == nil || !inserted[b.ids[i]] {
+			continue
+		}
+		if err := b.m.recordPresence(b.db, b.collection, b.table, b.ids[i], doc); err != nil {
+			return nil, nil, err
+		}
+	}
+	return inserted, existing, nil
+}
+
+// insertEach retries the queued rows of a failed batch one at a time so -skip-errors
+// quarantines only the rows MySQL rejects, removing them from inserted
+func (b *batch[T]) insertEach(queued []int, inserted, existing map[string]bool) {
+	for _, i := range queued {
+		result := b.db.Clauses(b.m.onConflict(b.collection, new(T))).Create(&b.rows[i])
+		if err := result.Error; err != nil {
+			slog.Error("insert failed", "collection", b.collection, "table", b.table, "id", b.ids[i], "error", err)
+			b.m.recordFailure(b.collection, b.ids[i], b.docs[i], err)
+			delete(inserted, b.ids[i])
+			continue
+		}
+		if b.m.opts.OnConflict == onConflictUpdate {
+			b.moved++
+			if existing[b.ids[i]] {
+				b.updated++
+			}
+			continue
+		}
+		b.moved += int(result.RowsAffected)
+		b.skipped += 1 - int(result.RowsAffected)
+	}
+}
+
+// save flushes the batch and checkpoints it. Collections with child tables call flush
+// and checkpoint separately, once the children are written too.
+func (b *batch[T]) save() error {
+	if _, _, err := b.flush(); err != nil {
+		return err
+	}
+	return b.checkpoint()
+}
+
+// checkpoint records that every queued source document has been written
+func (b *batch[T]) checkpoint() error {
+	return b.m.checkpoint.advance(b.collection, b.lastID, b.moved, b.skipped)
+}
+
+// reset empties the batch keeping the capacity of its slices, so memory stays flat
+// over a collection
+func (b *batch[T]) reset() {
+	// Release the retained documents, the array itself is reused
+	clear(b.docs)
+	b.ids = b.ids[:0]
+	b.rows = b.rows[:0]
+	b.docs = b.docs[:0]
+	b.flushedAt = time.Now()
+}
+
+// existingRecords returns which of ids are already migrated with a single query per
+// batch: id IN (...) for collections deduplicated on the primary key, a tuple IN on
+// the dedup key columns otherwise.
+func existingRecords[T any](m *Migrator, collection, table string, ids []string, rows []T) (map[string]bool, error) {
+	columns, ok := m.opts.DedupKeys[collection]
+	if !ok {
+		return existingIDs(m.mysql.GetDB(), table, ids)
+	}
+	return existingKeys(m, collection, table, columns, ids, rows)
+}
+
+// existingIDs returns the subset of ids present in table
+func existingIDs(db *gorm.DB, table string, ids []string) (map[string]bool, error) {
+	var found []string
+	if err := db.Table(table).Where("id IN ?", ids).Pluck("id", &found).Error; err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(found))
+	for _, id := range found {
+		existing[id] = true
+	}
+	return existing, nil
+}
+
+// childRows accumulates the rows of a child table with their parent id until the
+// parent batch has been flushed.
+type childRows[T any] struct {
+	parents []string
+	rows    []T
+	// conflict is the unique key targeted by the insert conflict clause; empty
+	// targets the primary key
+	conflict []clause.Column
+}
+
+func (c *childRows[T]) add(parentID string, row T) {
+	c.parents = append(c.parents, parentID)
+	c.rows = append(c.rows, row)
+}
+
+// insert inserts the queued rows accepted by keep (all rows when keep is nil), ignoring
+// conflicts with existing keys, then resets the queue. It returns the number of rows
+// inserted and of rows ignored for a conflict.
+func (c *childRows[T]) insert(m *Migrator, db *gorm.DB, keep func(parentID string, row T) bool) (inserted, ignored int, err error) {
+	defer func() {
+		c.parents = c.parents[:0]
+		c.rows = c.rows[:0]
+	}()
+
+	rows := make([]T, 0, len(c.rows))
+	for i, row := range c.rows {
+		if keep == nil || keep(c.parents[i], row) {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 || m.capture != nil {
+		return 0, 0, nil
+	}
+	if err := roundMoney(m, db, rows); err != nil {
+		return 0, 0, err
+	}
+	if m.output != nil {
+		if err := writeJSONL(m.output, db, rows); err != nil {
+			return 0, 0, err
+		}
+		return len(rows), 0, nil
+	}
+	m.limiter.wait(len(rows))
+	n, err := insertIgnore(db, rows, m.opts.BatchSize, c.conflict...)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(n), len(rows) - int(n), nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"migrate-tool/models"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+// newDryRunMigrator returns a migrator over source whose target database only builds
+// statements, and the SQL of the INSERTs and DELETEs it runs
+func newDryRunMigrator(t *testing.T, source sourceDatabase, opts Options) (*Migrator, *[]string) {
+	t.Helper()
+	target, err := models.NewDryRunDatabase(models.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statements []string
+	record := func(tx *gorm.DB) {
+		statements = append(statements, tx.Statement.SQL.String())
+	}
+	callbacks := target.GetDB().Callback()
+	if err := callbacks.Create().After("gorm:create").Register("test:record_sql", record); err != nil {
+		t.Fatal(err)
+	}
+	if err := callbacks.Delete().After("gorm:delete").Register("test:record_sql", record); err != nil {
+		t.Fatal(err)
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	m := newMigrator(source, target, opts)
+	// A dry run has no tables to look up, take them as migrated
+	for _, model := range models.Models() {
+		stmt := &gorm.Statement{DB: target.GetDB()}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		m.tables[stmt.Schema.Table] = true
+	}
+	return m, &statements
+}
+
+// flushDuplicates flushes rows whose ids a crashed run already inserted: the existence
+// check of the dry run finds none of them and its INSERT affects no rows, as the
+// conflict clause of MySQL does for a duplicate primary key
+func flushDuplicates[T any](t *testing.T, collection, table string, ids []string, rows []T) (*batch[T], []string) {
+	t.Helper()
+	m, inserts := newDryRunMigrator(t, cannedSource{}, Options{})
+	b := newBatch[T](m, m.mysql.GetDB(), collection, table)
+	for i := range rows {
+		b.add(ids[i], rows[i], bson.Raw(nil))
+	}
+	if _, _, err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b, *inserts
+}
+
+func TestBatchFlushSkipsDuplicatePrimaryKeys(t *testing.T) {
+	ids := []string{selfTestID(1).Hex(), selfTestID(2).Hex()}
+	tests := []struct {
+		table string
+		flush func() (moved, skipped int, inserts []string)
+	}{
+		{"charges", func() (int, int, []string) {
+			b, inserts := flushDuplicates(t, "charges", "charges", ids, []models.Charge{{ID: ids[0]}, {ID: ids[1]}})
+			return b.moved, b.skipped, inserts
+		}},
+		{"payments", func() (int, int, []string) {
+			b, inserts := flushDuplicates(t, "payments", "payments", ids, []models.Payment{{ID: ids[0]}, {ID: ids[1]}})
+			return b.moved, b.skipped, inserts
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			moved, skipped, inserts := tt.flush()
+			if len(inserts) != 1 {
+				t.Fatalf("ran %d INSERTs, expected 1", len(inserts))
+			}
+			if !strings.Contains(inserts[0], "ON DUPLICATE KEY UPDATE") {
+				t.Errorf("INSERT has no conflict clause: %s", inserts[0])
+			}
+			if moved != 0 || skipped != len(ids) {
+				t.Errorf("moved %d skipped %d, expected 0 and %d", moved, skipped, len(ids))
+			}
+		})
+	}
+}
+
+func TestBatchCommitsSlowTrickleOnSchedule(t *testing.T) {
+	const interval = time.Minute
+	tests := []struct {
+		name string
+		// gap is how long the cursor waits before each document
+		gap     time.Duration
+		commits int
+	}{
+		{"no interval passes", 0, 0},
+		{"interval every second document", interval / 2, 3},
+		{"interval before every document", interval, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, inserts := newDryRunMigrator(t, cannedSource{}, Options{BatchSize: 100, CommitInterval: interval})
+			b := newBatch[models.Payment](m, m.mysql.GetDB(), "payments", "payments")
+			for i := 1; i <= 6; i++ {
+				b.flushedAt = b.flushedAt.Add(-tt.gap)
+				id := selfTestID(i).Hex()
+				b.add(id, models.Payment{ID: id}, bson.Raw(nil))
+				if b.full() {
+					if err := b.save(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if len(*inserts) != tt.commits {
+				t.Errorf("committed %d times before the end, expected %d", len(*inserts), tt.commits)
+			}
+			if err := b.save(); err != nil {
+				t.Fatal(err)
+			}
+			// The dry run affects no rows, so they count as skipped
+			if b.moved+b.skipped != 6 {
+				t.Errorf("wrote %d rows, expected 6", b.moved+b.skipped)
+			}
+		})
+	}
+}
+
+// stallingCursor is a cursor over documents that stalls before the document at stall
+// until resume is closed or the context is cancelled, like a getMore waiting on the
+// server
+type stallingCursor struct {
+	*mongo.Cursor
+	stall  int
+	resume <-chan struct{}
+	read   int
+	// timedOut is set when the stall ended without resume
+	timedOut bool
+}
+
+func (c *stallingCursor) Next(ctx context.Context) bool {
+	if c.read == c.stall {
+		select {
+		case <-c.resume:
+		case <-ctx.Done():
+			return false
+		case <-time.After(5 * time.Second):
+			c.timedOut = true
+		}
+	}
+	c.read++
+	return c.Cursor.Next(ctx)
+}
+
+func newStallingCursor(t *testing.T, n, stall int, resume <-chan struct{}) *stallingCursor {
+	t.Helper()
+	var docs []interface{}
+	for i := 1; i <= n; i++ {
+		docs = append(docs, bson.M{"_id": selfTestID(i)})
+	}
+	cur, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &stallingCursor{Cursor: cur, stall: stall, resume: resume}
+}
+
+func TestCommitCursorFlushesDuringStall(t *testing.T) {
+	m, inserts := newDryRunMigrator(t, cannedSource{}, Options{BatchSize: 100, CommitInterval: 10 * time.Millisecond})
+	b := newBatch[models.Payment](m, m.mysql.GetDB(), "payments", "payments")
+	flushed := make(chan struct{})
+	flushDue := func() error {
+		if !b.full() {
+			return nil
+		}
+		if err := b.save(); err != nil {
+			return err
+		}
+		if len(*inserts) == 1 {
+			close(flushed)
+		}
+		return nil
+	}
+
+	// The cursor stalls after two documents until they are committed
+	cur := newStallingCursor(t, 3, 2, flushed)
+	docs := newCommitCursor(context.Background(), cur, m.opts.CommitInterval, flushDue)
+	defer docs.Close()
+	for docs.Next(context.Background()) {
+		id := documentID(cur.Current)
+		b.add(id, models.Payment{ID: id}, cur.Current)
+		if err := flushDue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := docs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if cur.timedOut {
+		t.Fatal("the rows queued before the stall were not committed while the cursor waited")
+	}
+	if err := b.save(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*inserts) != 2 || strings.Count((*inserts)[0], "),(") != 1 {
+		t.Errorf("inserted %q, expected the two rows read before the stall and then the third", *inserts)
+	}
+}
+
+func TestCommitCursorStopsOnFlushError(t *testing.T) {
+	errFlush := errors.New("connection lost")
+	cur := newStallingCursor(t, 3, 1, make(chan struct{}))
+	docs := newCommitCursor(context.Background(), cur, 10*time.Millisecond, func() error { return errFlush })
+	defer docs.Close()
+	read := 0
+	for docs.Next(context.Background()) {
+		read++
+	}
+	if read != 1 || !errors.Is(docs.Err(), errFlush) {
+		t.Errorf("read %d documents and ended with %v, expected 1 and the flush error", read, docs.Err())
+	}
+	if cur.timedOut {
+		t.Error("the failed flush did not cancel the stalled read")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"migrate-tool/models"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBoughtPackageItemsStableAcrossRuns(t *testing.T) {
+	source := cannedSource{"boughtPackages": selfTestDocuments()["boughtPackages"]}
+	table := (&models.BoughtPackageItem{}).TableName()
+
+	var first []string
+	for run := 1; run <= 2; run++ {
+		m, dir := newOutputMigrator(t, source, Options{})
+		if _, err := m.migrateBoughtPackages(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, row := range outputRows(t, m, dir, table) {
+			ids = append(ids, row["id"].(string))
+		}
+		if run == 1 {
+			first = ids
+			continue
+		}
+		if strings.Join(ids, ",") != strings.Join(first, ",") {
+			t.Errorf("run %d wrote items %v, the first run %v", run, ids, first)
+		}
+	}
+	if len(first) != 1 || first[0] != childRowID(selfTestID(40).Hex(), 101) {
+		t.Errorf("items %v, expected the item of code 101", first)
+	}
+}
+
+func TestBoughtPackageItemsIgnoreExistingKeys(t *testing.T) {
+	m, statements := newDryRunMigrator(t, cannedSource{"boughtPackages": selfTestDocuments()["boughtPackages"]}, Options{})
+	if _, err := m.migrateBoughtPackages(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	inserts := 0
+	for _, s := range *statements {
+		if !strings.Contains(s, "INSERT INTO `bought_package_items`") {
+			continue
+		}
+		inserts++
+		if !strings.Contains(s, "ON DUPLICATE KEY UPDATE") {
+			t.Errorf("bought_package_items insert has no conflict clause: %s", s)
+		}
+	}
+	if inserts == 0 {
+		t.Error("no bought_package_items insert")
+	}
+}
+
+func TestExportSchemaSQLToStdout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	err = exportSchemaSQL("-", "InnoDB", "", false)
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "CREATE TABLE `bought_package_items`") {
+		t.Errorf("stdout has no schema: %.200s", out)
+	}
+	if _, err := os.Stat("-"); err == nil {
+		os.Remove("-")
+		t.Error("the schema was written to a file named -")
+	}
+}
+
+func TestBoughtPriceSource(t *testing.T) {
+	// The canned bought package was paid 99000 for a package priced 120000
+	source := cannedSource{"boughtPackages": selfTestDocuments()["boughtPackages"]}
+	tests := []struct {
+		source string
+		price  float64
+	}{
+		{"", 99000},
+		{boughtPriceSourcePaid, 99000},
+		{boughtPriceSourcePackage, 120000},
+	}
+	for _, tt := range tests {
+		m, dir := newOutputMigrator(t, source, Options{BoughtPriceSource: tt.source})
+		if _, err := m.migrateBoughtPackages(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		rows := outputRows(t, m, dir, (&models.BoughtPackage{}).TableName())
+		if len(rows) != 1 || rows[0]["price"] != tt.price {
+			t.Errorf("-bought-price-source %q migrated %v, expected price %v", tt.source, rows, tt.price)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"migrate-tool/models"
+)
+
+// Policies for charges that reference more than one item
+const (
+	chargeItemsPrimary = "primary"
+	chargeItemsSplit   = "split"
+)
+
+// chargeItem is a package item embedded in a charge document
+type chargeItem struct {
+	Name               string  `bson:"name"`
+	Code               int     `bson:"code"`
+	IsOverLimitAllowed bool    `bson:"is_over_limit_allowed"`
+	OverLimitPrice     float64 `bson:"over_limit_price"`
+	IsUnlimited        bool    `bson:"is_unlimited"`
+	Limit              int     `bson:"limit"`
+}
+
+// chargeItems merges the single item field and the items array. The single item comes
+// first and array entries repeating its code are dropped.
+func chargeItems(item chargeItem, items []chargeItem) []chargeItem {
+	if item == (chargeItem{}) {
+		return items
+	}
+	merged := []chargeItem{item}
+	for _, other := range items {
+		if other.Code != item.Code {
+			merged = append(merged, other)
+		}
+	}
+	return merged
+}
+
+// applyChargeItemsPolicy returns the charge rows to insert for the given items. The
+// primary policy keeps one row for the first item; the split policy adds a row per
+// further item with id <charge id>-<n>, carrying the price on the first row only so
+// totals are not inflated.
+func applyChargeItemsPolicy(charge models.Charge, items []chargeItem, policy string) []models.Charge {
+	rows := []models.Charge{charge}
+	if policy != chargeItemsSplit {
+		return rows
+	}
+	for i := 1; i < len(items); i++ {
+		row := charge
+		row.ID = fmt.Sprintf("%s-%d", charge.ID, i)
+		row.Price = 0
+		row.BoughtPackageItemCode = items[i].Code
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestChargeDateSource(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	signed := time.Date(2024, 2, 20, 0, 0, 0, 0, time.UTC)
+	ancient := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	charge := func(fields bson.M) bson.M {
+		doc := bson.M{"_id": selfTestID(50), "created_at": created, "price": 500.0, "organization": bson.M{"_id": selfTestID(10)}}
+		for k, v := range fields {
+			doc[k] = v
+		}
+		return doc
+	}
+	tests := []struct {
+		name   string
+		doc    bson.M
+		source models.ChargeDateSource
+		date1  *time.Time
+	}{
+		{"document date", charge(bson.M{"roaming_invoice": bson.M{"_id": "INV-1", "date": signed}}), models.ChargeDateDocument, &signed},
+		{"document without a date", charge(bson.M{"roaming_invoice": bson.M{"_id": "INV-1"}}), models.ChargeDateCreatedAtFallback, &created},
+		{"no document", charge(nil), models.ChargeDateCreatedAtFallback, &created},
+		{"document date out of range", charge(bson.M{"roaming_invoice": bson.M{"_id": "INV-1", "date": ancient}}), models.ChargeDateNone, nil},
+	}
+	m := newMigrator(cannedSource{}, nil, Options{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := m.transformCharge(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			row := c.rows[0]
+			if row.DateSource != tt.source {
+				t.Errorf("date_source is %s, expected %s", row.DateSource, tt.source)
+			}
+			if (row.Date1 == nil) != (tt.date1 == nil) || (row.Date1 != nil && !row.Date1.Equal(*tt.date1)) {
+				t.Errorf("date1 is %v, expected %v", row.Date1, tt.date1)
+			}
+		})
+	}
+}
+
+func TestLongChargeRefs(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	org := bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}
+	pkg := bson.M{"_id": selfTestID(2), "name": "Start"}
+	number := strings.Repeat("9", models.ChargeRefSize+6)
+	source := cannedSource{"charges": {
+		bson.M{"_id": selfTestID(50), "created_at": created, "price": 500.0, "organization": org, "package": pkg,
+			"roaming_invoice": bson.M{"_id": "INV-1", "number": "1"}},
+		bson.M{"_id": selfTestID(51), "created_at": created, "price": 500.0, "organization": org, "package": pkg,
+			"roaming_invoice": bson.M{"_id": "INV-2", "number": number}},
+	}}
+	long := selfTestID(51).Hex()
+	tests := []struct {
+		policy  string
+		err     bool
+		numbers map[string]string
+		failed  int
+	}{
+		{longRefTruncate, false, map[string]string{selfTestID(50).Hex(): "1", long: number[:models.ChargeRefSize]}, 0},
+		{longRefSkip, false, map[string]string{selfTestID(50).Hex(): "1"}, 1},
+		{longRefFail, true, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			db, target := newMemoryTarget(t)
+			m := newMemoryMigrator(t, db, source, Options{LongChargeRefs: tt.policy, OutputErrorsToMySQL: true})
+			_, err := m.migrateCharges(context.Background())
+			if (err != nil) != tt.err {
+				t.Fatalf("error is %v, expected one: %v", err, tt.err)
+			}
+			if tt.err {
+				if !strings.Contains(err.Error(), "number") {
+					t.Errorf("error %q does not name the column", err)
+				}
+				return
+			}
+			numbers := make(map[string]string)
+			for _, row := range target.rows((&models.Charge{}).TableName()) {
+				numbers[row["id"].(string)] = row["number"].(string)
+			}
+			if len(numbers) != len(tt.numbers) {
+				t.Fatalf("charges hold numbers %v, expected %v", numbers, tt.numbers)
+			}
+			for id, want := range tt.numbers {
+				if numbers[id] != want {
+					t.Errorf("charge %s has number %q, expected %q", id, numbers[id], want)
+				}
+			}
+			failures := target.rows((&models.MigrationError{}).TableName())
+			if len(failures) != tt.failed || (tt.failed > 0 && failures[0]["record_id"] != long) {
+				t.Errorf("recorded failures %v, expected %d for %s", failures, tt.failed, long)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultCheckpointInterval is the -checkpoint-interval unless set: the number of
+// records written between checkpoint writes
+const defaultCheckpointInterval = "5000"
+
+// checkpointInterval is how often the checkpoint file is written: once Records
+// records were written since the last write, or once Every has passed
+type checkpointInterval struct {
+	Records int
+	Every   time.Duration
+}
+
+// parseCheckpointInterval reads a -checkpoint-interval, a record count such as 5000
+// or a duration such as 30s
+func parseCheckpointInterval(s string) (checkpointInterval, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return checkpointInterval{}, fmt.Errorf("invalid checkpoint interval %q, expected a positive record count", s)
+		}
+		return checkpointInterval{Records: n}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return checkpointInterval{}, fmt.Errorf("invalid checkpoint interval %q, expected a record count or a duration", s)
+	}
+	return checkpointInterval{Every: d}, nil
+}
+
+// collectionProgress is the checkpointed state of one collection
+type collectionProgress struct {
+	LastID  string `json:"last_id"`
+	Moved   int    `json:"moved"`
+	Skipped int    `json:"skipped"`
+}
+
+// checkpoint persists per-collection progress to a JSON file so an interrupted run
+// resumes after the last document whose batch was fully written. A nil checkpoint
+// disables resuming.
+type checkpoint struct {
+	mu       sync.Mutex
+	path     string
+	interval checkpointInterval
+	// pending counts the records written and savedAt is when the file was written
+	pending int
+	savedAt time.Time
+
+	Collections map[string]*collectionProgress `json:"collections"`
+}
+
+// loadCheckpoint reads the checkpoint at path, starting empty when the file does not
+// exist or restart is set. It returns nil when path is empty.
+func loadCheckpoint(path string, interval checkpointInterval, restart bool) (*checkpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if interval == (checkpointInterval{}) {
+		interval, _ = parseCheckpointInterval(defaultCheckpointInterval)
+	}
+	c := &checkpoint{path: path, interval: interval, savedAt: time.Now(), Collections: make(map[string]*collectionProgress)}
+	if restart {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %w", path, err)
+	}
+	if c.Collections == nil {
+		c.Collections = make(map[string]*collectionProgress)
+	}
+	return c, nil
+}
+
+// progress returns the checkpointed state of collection, or nil if there is none
+func (c *checkpoint) progress(collection string) *collectionProgress {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Collections[collection]
+}
+
+// advance records that every document of collection up to lastID has been written,
+// saving the file when the interval is reached
+func (c *checkpoint) advance(collection, lastID string, moved, skipped int) error {
+	if c == nil || lastID == "" {
+		return nil
+	}
+	c.mu.Lock()
+	written := moved + skipped
+	if prev := c.Collections[collection]; prev != nil {
+		written -= prev.Moved + prev.Skipped
+	}
+	c.Collections[collection] = &collectionProgress{LastID: lastID, Moved: moved, Skipped: skipped}
+	c.pending += written
+	due := (c.interval.Records > 0 && c.pending >= c.interval.Records) ||
+		(c.interval.Every > 0 && time.Since(c.savedAt) >= c.interval.Every)
+	c.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return c.save()
+}
+
+// stage returns an in-memory copy of the checkpoint that never writes the file, used
+// to collect the progress of a transaction until it commits
+func (c *checkpoint) stage() *checkpoint {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	staged := &checkpoint{Collections: make(map[string]*collectionProgress, len(c.Collections))}
+	for collection, p := range c.Collections {
+		staged.Collections[collection] = p
+	}
+	return staged
+}
+
+// commit copies the progress collected by a staged checkpoint and saves the file
+func (c *checkpoint) commit(staged *checkpoint) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	for collection, p := range staged.Collections {
+		c.Collections[collection] = p
+	}
+	c.mu.Unlock()
+	return c.save()
+}
+
+// save writes the checkpoint atomically through a temporary file
+func (c *checkpoint) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	c.pending = 0
+	c.savedAt = time.Now()
+	return nil
+}
+
+// find opens a cursor over collection sorted by _id, restricted to the -since/-until window
+// and starting after the checkpointed _id of the collection when there is one
+func (m *Migrator) find(ctx context.Context, collection string, filter bson.M, extra ...*options.FindOptions) (*mongo.Cursor, error) {
+	return m.findAs(ctx, collection, collection, filter, extra...)
+}
+
+// findAs is find for a second pass over collection, such as the embedded active
+// packages of organizations, whose checkpoint, watermark and -verify sample are kept
+// under key instead of the collection
+func (m *Migrator) findAs(ctx context.Context, key, collection string, filter bson.M, extra ...*options.FindOptions) (*mongo.Cursor, error) {
+	m.applyDateWindow(collection, filter)
+	if err := m.applyWatermark(ctx, key, collection, filter); err != nil {
+		return nil, err
+	}
+	if ids, ok := m.sample[key]; ok {
+		restrict(filter, "_id", bson.M{"$in": ids})
+	}
+	if p := m.checkpoint.progress(key); p != nil {
+		var lastID interface{} = p.LastID
+		if oid, err := primitive.ObjectIDFromHex(p.LastID); err == nil {
+			lastID = oid
+		}
+		restrict(filter, "_id", bson.M{"$gt": lastID})
+		slog.Info("resuming from checkpoint", "collection", key, "after_id", p.LastID)
+	}
+	m.excludeDeleted(ctx, collection, filter)
+	opts := append([]*options.FindOptions{m.findOptions().SetSort(bson.D{{Key: "_id", Value: 1}})}, extra...)
+	return m.collection(collection).Find(ctx, filter, opts...)
+}
+
+// restrict adds the condition cond on field to filter, combined by $and with the
+// condition already on the field instead of replacing it
+func restrict(filter bson.M, field string, cond interface{}) {
+	existing, ok := filter[field]
+	if !ok {
+		filter[field] = cond
+		return
+	}
+	delete(filter, field)
+	and, _ := filter["$and"].(bson.A)
+	filter["$and"] = append(and, bson.M{field: existing}, bson.M{field: cond})
+}
+
+// cursorErr returns why the iteration of a migration cursor ended: the context error
+// when ctx is done, the cursor error when the cursor died, e.g. on a network error or
+// a cursor timeout, and nil at the end of the collection. Without it a dead cursor
+// would pass for a complete collection.
+func cursorErr(ctx context.Context, cur *mongo.Cursor, collection string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("reading %s failed: %w", collection, err)
+	}
+	return nil
+}
+
+// findOptions returns the options shared by the migration cursors: the number of
+// documents fetched per getMore round trip when -mongo-batch-size is set and the
+// number of documents read when -limit is set
+func (m *Migrator) findOptions() *options.FindOptions {
+	opts := options.Find()
+	if m.opts.MongoBatchSize > 0 {
+		opts.SetBatchSize(m.opts.MongoBatchSize)
+	}
+	if m.opts.Limit > 0 {
+		opts.SetLimit(m.opts.Limit)
+	}
+	return opts
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// filterRecorder is a canned source remembering the filter of the last Find
+type filterRecorder struct {
+	cannedSource
+	filter interface{}
+}
+
+func (r *filterRecorder) collection(name string) sourceCollection {
+	return &recordingCollection{cannedCollection{name: name, docs: r.cannedSource[name]}, r}
+}
+
+type recordingCollection struct {
+	cannedCollection
+	r *filterRecorder
+}
+
+func (c *recordingCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	c.r.filter = filter
+	return c.cannedCollection.Find(ctx, filter, opts...)
+}
+
+func TestParseCheckpointInterval(t *testing.T) {
+	tests := []struct {
+		value string
+		want  checkpointInterval
+		err   bool
+	}{
+		{"5000", checkpointInterval{Records: 5000}, false},
+		{"30s", checkpointInterval{Every: 30 * time.Second}, false},
+		{"2m", checkpointInterval{Every: 2 * time.Minute}, false},
+		{"0", checkpointInterval{}, true},
+		{"-5", checkpointInterval{}, true},
+		{"-1s", checkpointInterval{}, true},
+		{"often", checkpointInterval{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCheckpointInterval(tt.value)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseCheckpointInterval(%q) = %+v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestCheckpointSavesAfterRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	c, err := loadCheckpoint(path, checkpointInterval{Records: 100}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := func() bool {
+		_, err := os.Stat(path)
+		return !errors.Is(err, fs.ErrNotExist)
+	}
+
+	// Counters are totals per collection, so only their growth counts
+	steps := []struct {
+		collection     string
+		moved, skipped int
+		saved          bool
+	}{
+		{"payments", 40, 0, false},
+		{"payments", 80, 10, false},
+		{"charges", 5, 0, false},
+		{"payments", 90, 10, true},
+	}
+	for i, step := range steps {
+		if err := c.advance(step.collection, "id", step.moved, step.skipped); err != nil {
+			t.Fatal(err)
+		}
+		if saved() != step.saved {
+			t.Fatalf("step %d: saved is %v, expected %v", i, saved(), step.saved)
+		}
+	}
+}
+
+func TestCheckpointSavesAfterDuration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	c, err := loadCheckpoint(path, checkpointInterval{Every: time.Hour}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.advance("payments", "id", 1_000_000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("checkpoint written before the interval passed")
+	}
+	c.savedAt = time.Now().Add(-2 * time.Hour)
+	if err := c.advance("payments", "id2", 1_000_001, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("checkpoint not written after the interval: %v", err)
+	}
+}
+
+func TestFindCombinesSampleAndCheckpoint(t *testing.T) {
+	source := &filterRecorder{cannedSource: cannedSource{}}
+	m, _ := newDryRunMigrator(t, source, Options{})
+	sample := []interface{}{selfTestID(1), selfTestID(5), selfTestID(9)}
+	m.sample = map[string][]interface{}{"payments": sample}
+	m.checkpoint = &checkpoint{Collections: map[string]*collectionProgress{
+		"payments": {LastID: selfTestID(4).Hex()},
+	}}
+
+	cur, err := m.find(context.Background(), "payments", bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur.Close(context.Background())
+
+	want := bson.M{"$and": bson.A{
+		bson.M{"_id": bson.M{"$in": sample}},
+		bson.M{"_id": bson.M{"$gt": selfTestID(4)}},
+	}}
+	if !reflect.DeepEqual(source.filter, want) {
+		t.Errorf("filter is %v, expected %v", source.filter, want)
+	}
+}
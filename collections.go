@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultCollections are the source collections read by the migrators. These names
+// also identify the collections in flags, checkpoints, metrics and logs, whatever
+// the collections are called in a deployment, see CollectionNames.
+var defaultCollections = []string{
+	"services",
+	"organizations",
+	"packages",
+	"boughtPackages",
+	"charges",
+	"payments",
+	"paymeTransactions",
+	"organizationBalanceBindings",
+	"creditUpdates",
+	"bankPaymentsAutoApplyErrors",
+}
+
+// CollectionNames maps a default collection name to the name the collection has in
+// the source database; collections without an entry keep their default name
+type CollectionNames map[string]string
+
+// resolve returns the source database name of the default collection name
+func (n CollectionNames) resolve(name string) string {
+	if actual, ok := n[name]; ok {
+		return actual
+	}
+	return name
+}
+
+// parseCollectionNames parses comma-separated default=actual pairs, e.g.
+// "boughtPackages=bought_packages". Unknown default names are an error listing the
+// valid ones.
+func parseCollectionNames(spec string) (CollectionNames, error) {
+	known := make(map[string]bool, len(defaultCollections))
+	for _, name := range defaultCollections {
+		known[name] = true
+	}
+	names := make(CollectionNames)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, actual, ok := strings.Cut(entry, "=")
+		name, actual = strings.TrimSpace(name), strings.TrimSpace(actual)
+		if !ok || actual == "" {
+			return nil, fmt.Errorf("expected collection=name, got %q", entry)
+		}
+		if !known[name] {
+			valid := append([]string(nil), defaultCollections...)
+			sort.Strings(valid)
+			return nil, fmt.Errorf("unknown collection %q, expected one of %s", name, strings.Join(valid, ", "))
+		}
+		names[name] = actual
+	}
+	return names, nil
+}
+
+// collection returns the source collection of the default collection name
+func (m *Migrator) collection(name string) sourceCollection {
+	return m.source.collection(m.opts.Collections.resolve(name))
+}
+
+// listCollections prints every collection of the source database with its document
+// count and whether the tool migrates it, followed by the migrated collections the
+// source database does not have
+func listCollections(ctx context.Context, mdb *mongo.Database, names CollectionNames) error {
+	actual, err := mdb.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return fmt.Errorf("could not list collections: %w", err)
+	}
+	sort.Strings(actual)
+
+	migrated := make(map[string]string, len(defaultCollections))
+	for _, name := range defaultCollections {
+		migrated[names.resolve(name)] = name
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTION\tDOCUMENTS\tSTATUS")
+	for _, name := range actual {
+		status := "unmapped"
+		if def, ok := migrated[name]; ok {
+			status = "migrated"
+			if def != name {
+				status += " as " + def
+			}
+			delete(migrated, name)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", name, mongoCount(ctx, mdb.Collection(name)), status)
+	}
+	for _, name := range defaultCollections {
+		if _, ok := migrated[names.resolve(name)]; ok {
+			fmt.Fprintf(w, "%s\t-\tmissing\n", names.resolve(name))
+		}
+	}
+	return w.Flush()
+}
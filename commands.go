@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"migrate-tool/models"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// command is a subcommand of the tool, run with the arguments following its name
+type command struct {
+	name, summary string
+	run           func(fs *flag.FlagSet, args []string)
+}
+
+// commands are the subcommands in the order usage lists them
+var commands = []command{
+	{"migrate", "create the target tables and migrate the source collections (the default before subcommands existed)", runMigrate},
+	{"verify", "map a sample of documents again and compare them with the migrated rows", runVerify},
+	{"reconcile", "compare the source document counts with the target row counts", runReconcile},
+	{"truncate", "empty every target table, keeping the schema", runTruncate},
+	{"list", "list the source collections with their document counts", runList},
+}
+
+// usage prints the subcommands to out
+func usage(out io.Writer) {
+	fmt.Fprintf(out, "%s\n\nusage: migrate-tool <command> [flags]\n\ncommands:\n", versionString())
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", c.name, c.summary)
+	}
+	w.Flush()
+	fmt.Fprintln(out, "\nRun migrate-tool <command> -h for the flags of a command.")
+}
+
+// findCommand returns the command named by the first of args and the arguments it
+// runs with. Scripts written before the subcommands pass the migrate flags alone, so
+// args starting with a flag run migrate with all of them.
+func findCommand(args []string) (command, []string, bool) {
+	name, rest := args[0], args[1:]
+	if strings.HasPrefix(name, "-") {
+		name, rest = "migrate", args
+	}
+	for _, c := range commands {
+		if c.name == name {
+			return c, rest, true
+		}
+	}
+	return command{}, nil, false
+}
+
+// newFlagSet returns the flag set c.run registers its flags on, exiting on a parse
+// error
+func newFlagSet(c command) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: migrate-tool %s [flags]\n\n%s\n\nflags:\n", c.name, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// commonFlags are the connection and logging flags every subcommand accepts
+// (explicit flag > -config file > environment variable > default)
+type commonFlags struct {
+	configPath string
+
+	mongoURI, mongoURIFile, mongoDB             string
+	mongoTLS                                    bool
+	mongoCAFile, mongoAuthSource, mongoReadPref string
+	mongoConnectTimeout                         time.Duration
+	collectionNames                             string
+
+	mysqlUser, mysqlPass, mysqlPassFile, mysqlAddr, mysqlDB string
+	tz, targetDriver, mysqlParams, tablePrefix              string
+	maxOpenConns, maxIdleConns                              int
+	connMaxLifetime                                         time.Duration
+
+	quiet               bool
+	logFormat, logLevel string
+
+	// Set by setup
+	collections CollectionNames
+	location    *time.Location
+}
+
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.configPath, "config", "", "YAML file with the connection and run settings, see config.example.yaml")
+	fs.StringVar(&c.mongoURI, "mongo-uri", getEnv("MONGO_URI", "mongodb://localhost:27017"), "MongoDB connection URI")
+	fs.StringVar(&c.mongoURIFile, "mongo-uri-file", getEnv("MONGO_URI_FILE", ""),
+		"file holding the MongoDB connection URI, read instead of -mongo-uri so credentials stay out of the process list")
+	fs.StringVar(&c.mongoDB, "mongo-db", getEnv("MONGO_DB", "billing_service"), "MongoDB database name")
+	fs.BoolVar(&c.mongoTLS, "mongo-tls", false, "connect to MongoDB over TLS (implied by -mongo-ca-file)")
+	fs.StringVar(&c.mongoCAFile, "mongo-ca-file", getEnv("MONGO_CA_FILE", ""), "PEM file with the CA certificates used to verify the MongoDB server")
+	fs.StringVar(&c.collectionNames, "collection-names", "",
+		"comma-separated collection=name pairs for source collections named differently in this deployment, e.g. boughtPackages=bought_packages")
+	fs.StringVar(&c.mongoAuthSource, "mongo-auth-source", getEnv("MONGO_AUTH_SOURCE", ""), "database the MongoDB user is authenticated against, e.g. admin")
+	fs.StringVar(&c.mongoReadPref, "mongo-read-preference", getEnv("MONGO_READ_PREFERENCE", ""),
+		"read preference of the migration reads: primary, primaryPreferred, secondary, secondaryPreferred or nearest (default: the URI's, else primary); "+
+			"secondaries may lag the primary, so documents written just before the run or inside the -since/-until window may be missed")
+	fs.DurationVar(&c.mongoConnectTimeout, "mongo-connect-timeout", 10*time.Second, "how long to wait for the MongoDB server before giving up")
+	fs.StringVar(&c.mysqlUser, "mysql-user", getEnv("MYSQL_USER", "root"), "MySQL user")
+	fs.StringVar(&c.mysqlPass, "mysql-pass", getEnv("MYSQL_PASS", ""), "MySQL password")
+	fs.StringVar(&c.mysqlPassFile, "mysql-pass-file", getEnv("MYSQL_PASS_FILE", ""),
+		"file holding the MySQL password, read instead of -mysql-pass so it stays out of the shell history and process list")
+	fs.StringVar(&c.mysqlAddr, "mysql-addr", getEnv("MYSQL_ADDR", "127.0.0.1:3306"), "MySQL address (host:port)")
+	fs.StringVar(&c.mysqlDB, "mysql-db", getEnv("MYSQL_DB", "billing_service"), "MySQL database name")
+	fs.StringVar(&c.tz, "tz", getEnv("TZ", "UTC"), "time zone used by the MySQL connection (loc parameter)")
+	fs.StringVar(&c.targetDriver, "target-driver", getEnv("TARGET_DRIVER", models.DriverMySQL),
+		"target database driver: mysql or postgres (the -mysql-* connection flags apply to both)")
+	// The migration writes on one connection at a time; the others serve the
+	// migration lock, which holds one for the whole run, and migration_errors writes
+	fs.IntVar(&c.maxOpenConns, "mysql-max-open-conns", 4, "maximum open connections to the target database (0 = unlimited)")
+	fs.IntVar(&c.maxIdleConns, "mysql-max-idle-conns", 4, "maximum idle connections kept in the pool")
+	fs.DurationVar(&c.connMaxLifetime, "mysql-conn-max-lifetime", 30*time.Minute,
+		"close pooled connections older than this, below the server's wait_timeout (0 = never)")
+	fs.StringVar(&c.mysqlParams, "mysql-params", getEnv("MYSQL_PARAMS", ""),
+		"extra DSN parameters as a query string, e.g. tls=true&timeout=30s&readTimeout=1m; they override the defaults (charset, parseTime, loc)")
+	fs.StringVar(&c.tablePrefix, "table-prefix", getEnv("TABLE_PREFIX", ""),
+		"prefix of every target table and foreign key name, e.g. tenantA_, for several source databases migrated into one target database")
+	fs.BoolVar(&c.quiet, "quiet", false, "suppress progress logs; only warnings and errors are printed (same as -log-level warn)")
+	fs.StringVar(&c.logFormat, "log-format", "text", "log output format: text or json")
+	fs.StringVar(&c.logLevel, "log-level", "info", "minimum log level: debug, info, warn or error")
+}
+
+// setup runs once fs is parsed: it applies -config, installs the logger, reads the
+// secret files and validates the connection settings, exiting on an error
+func (c *commonFlags) setup(fs *flag.FlagSet) {
+	if c.configPath != "" {
+		if err := applyConfigFile(fs, c.configPath); err != nil {
+			fatal("failed to load config", "error", err)
+		}
+	}
+	if err := setupLogger(c.logFormat, c.logLevel, c.quiet); err != nil {
+		fatal("invalid logging options", "error", err)
+	}
+	if !tablePrefixPattern.MatchString(c.tablePrefix) {
+		fatal("invalid -table-prefix, only letters, digits and _ are allowed", "prefix", c.tablePrefix)
+	}
+	// Before any table name is taken
+	models.SetTablePrefix(c.tablePrefix)
+	if err := readSecrets(fs,
+		secret{flag: "mongo-uri", fileFlag: "mongo-uri-file", value: &c.mongoURI, file: &c.mongoURIFile},
+		secret{flag: "mysql-pass", fileFlag: "mysql-pass-file", value: &c.mysqlPass, file: &c.mysqlPassFile},
+	); err != nil {
+		fatal("invalid credentials", "error", err)
+	}
+	slog.Info(versionString())
+	if c.maxOpenConns < 0 || c.maxIdleConns < 0 || c.connMaxLifetime < 0 {
+		fatal("connection pool settings must not be negative")
+	}
+	if _, err := url.ParseQuery(c.mysqlParams); err != nil {
+		fatal("invalid -mysql-params, expected a query string such as tls=true&timeout=30s", "error", err)
+	}
+	location, err := loadLocation(c.tz)
+	if err != nil {
+		fatal("invalid -tz, expected an IANA time zone such as Asia/Tashkent or UTC", "value", c.tz, "error", err)
+	}
+	c.location = location
+	if c.collections, err = parseCollectionNames(c.collectionNames); err != nil {
+		fatal("invalid -collection-names", "error", err)
+	}
+}
+
+// loadLocation loads the -tz time zone. An empty name is rejected rather than taken
+// as UTC, as time.LoadLocation does, since it is a typo more often than not.
+func loadLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return nil, fmt.Errorf("no time zone")
+	}
+	return time.LoadLocation(tz)
+}
+
+// connectMongo connects to the source database, pinging it to fail fast on an
+// unreachable host. The returned function disconnects.
+func (c *commonFlags) connectMongo() (*mongo.Database, func()) {
+	if c.mongoURI == "" {
+		fatal("MongoDB URI is required")
+	}
+	clientOpts, err := mongoClientOptions(c.mongoURI, c.mongoTLS, c.mongoCAFile, c.mongoAuthSource, c.mongoReadPref, c.mongoConnectTimeout)
+	if err != nil {
+		fatal("invalid MongoDB options", "error", err)
+	}
+	client, err := mongo.Connect(context.TODO(), clientOpts)
+	if err != nil {
+		fatal("failed to connect to MongoDB", "error", err)
+	}
+	// Connect is lazy, so ping to fail fast on an unreachable host
+	pingCtx, cancelPing := context.WithTimeout(context.Background(), c.mongoConnectTimeout)
+	err = client.Ping(pingCtx, nil)
+	cancelPing()
+	if err != nil {
+		fatal("failed to connect to MongoDB", "error", err)
+	}
+	return client.Database(c.mongoDB), func() {
+		if err := client.Disconnect(context.TODO()); err != nil {
+			slog.Warn("error disconnecting from MongoDB", "error", err)
+		}
+	}
+}
+
+// targetConfig returns the connection settings of the target database; migrate adds
+// the settings of the tables it creates
+func (c *commonFlags) targetConfig() models.Config {
+	return models.Config{
+		Driver:          c.targetDriver,
+		Username:        c.mysqlUser,
+		Password:        c.mysqlPass,
+		Addr:            c.mysqlAddr,
+		Database:        c.mysqlDB,
+		Timezone:        c.tz,
+		MaxOpenConns:    c.maxOpenConns,
+		MaxIdleConns:    c.maxIdleConns,
+		ConnMaxLifetime: c.connMaxLifetime,
+		Params:          c.mysqlParams,
+	}
+}
+
+// connectTarget connects to the target database with cfg
+func (c *commonFlags) connectTarget(cfg models.Config) models.Database {
+	if c.mysqlPass == "" {
+		fatal("MySQL password is required")
+	}
+	db, err := models.NewDatabase(cfg)
+	if err != nil {
+		fatal("failed to connect to the target database", "driver", cfg.Driver, "error", err)
+	}
+	return db
+}
+
+// lockFlags are the flags of the subcommands writing to the target database
+type lockFlags struct {
+	enabled bool
+	timeout time.Duration
+}
+
+func (l *lockFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&l.enabled, "migration-lock", true, "hold a MySQL advisory lock during the run so concurrent migrations of the same database cannot overlap")
+	fs.DurationVar(&l.timeout, "lock-timeout", 0, "how long to wait for the migration lock held by another run (0 = abort at once, negative = wait forever)")
+}
+
+// check validates the lock settings against the connection pool of c
+func (l *lockFlags) check(c *commonFlags) {
+	if c.maxOpenConns == 1 && l.enabled {
+		fatal("-mysql-max-open-conns must be at least 2 with -migration-lock, which holds a connection for the whole run")
+	}
+}
+
+// acquire takes the migration lock of the database and table prefix of c, unless
+// -migration-lock is off. The returned function releases it.
+func (l *lockFlags) acquire(c *commonFlags, db models.Database) func() {
+	if !l.enabled {
+		return func() {}
+	}
+	// Tenants sharing a database under different prefixes do not block each other
+	lockName := "migrate-tool:" + c.mysqlDB + ":" + c.tablePrefix
+	release, err := acquireMigrationLock(context.Background(), db, lockName, l.timeout)
+	if err != nil {
+		fatal("failed to acquire migration lock", "error", err)
+	}
+	return release
+}
+
+// runList prints the source collections, or with -counts the documents and embedded
+// arrays behind every table
+func runList(fs *flag.FlagSet, args []string) {
+	var common commonFlags
+	common.register(fs)
+	counts := fs.Bool("counts", false,
+		"print the source document and embedded array counts behind every table and the estimated total rows instead")
+	fs.Parse(args)
+	common.setup(fs)
+
+	mdb, disconnect := common.connectMongo()
+	defer disconnect()
+	if *counts {
+		if err := countSource(context.Background(), mdb, common.collections); err != nil {
+			fatal("counting the source failed", "error", err)
+		}
+		return
+	}
+	if err := listCollections(context.Background(), mdb, common.collections); err != nil {
+		fatal("listing collections failed", "error", err)
+	}
+}
+
+// runVerify checks an earlier migration: it maps a sample of documents per collection
+// with the mapping flags of that migration and compares them with the stored rows
+func runVerify(fs *flag.FlagSet, args []string) {
+	var common commonFlags
+	common.register(fs)
+	var opts Options
+	var mapping mappingFlags
+	mapping.register(fs, &opts)
+	sample := fs.Int("sample", 100, "number of random documents compared per collection")
+	maxMismatches := fs.Int("max-mismatches", 0, "number of mismatched rows tolerated before exiting with status 4")
+	fs.Parse(args)
+	common.setup(fs)
+	mapping.apply(&opts, &common)
+	if *sample <= 0 {
+		fatal("-sample must be positive", "value", *sample)
+	}
+
+	mdb, disconnect := common.connectMongo()
+	defer disconnect()
+	cfg := common.targetConfig()
+	cfg.MoneyAsDecimal = opts.MoneyAsDecimal
+	db := common.connectTarget(cfg)
+
+	mismatched, err := verify(context.Background(), mdb, db, opts, *sample)
+	if err != nil {
+		fatal("verification failed", "error", err)
+	}
+	if mismatched > *maxMismatches {
+		slog.Error("migrated rows differ from their source documents", "mismatched", mismatched, "allowed", *maxMismatches)
+		os.Exit(exitVerifyMismatch)
+	}
+	slog.Info("verification passed", "mismatched", mismatched)
+}
+
+// runReconcile compares the source counts with the target row counts and, with
+// -totals, the organization totals with their migrated payments and credit updates
+func runReconcile(fs *flag.FlagSet, args []string) {
+	var common commonFlags
+	common.register(fs)
+	opts := Options{Reconcile: true}
+	totals := fs.Bool("totals", false,
+		"also report organizations whose total_payments or credit_amount differ from their payments and credit updates")
+	fs.Float64Var(&opts.ReconcileTolerance, "tolerance", 0.01, "largest difference -totals accepts between a stored and a derived total")
+	fs.Parse(args)
+	common.setup(fs)
+	opts.Collections = common.collections
+
+	mdb, disconnect := common.connectMongo()
+	defer disconnect()
+	db := common.connectTarget(common.targetConfig())
+
+	ctx := context.Background()
+	matched, err := reconcile(ctx, mdb, db, opts.Collections, reconcileScope{})
+	if err != nil {
+		fatal("reconciliation failed", "error", err)
+	}
+	if *totals {
+		if _, err := NewMigratorWithClients(mdb, db, opts).reconcileOrganizationTotals(ctx); err != nil {
+			fatal("reconciliation failed", "error", err)
+		}
+	}
+	if !matched {
+		slog.Error("row counts differ from the source")
+		os.Exit(exitCountMismatch)
+	}
+}
+
+// runTruncate empties every target table under the migration lock
+func runTruncate(fs *flag.FlagSet, args []string) {
+	var common commonFlags
+	common.register(fs)
+	var lock lockFlags
+	lock.register(fs)
+	fs.Parse(args)
+	common.setup(fs)
+	lock.check(&common)
+
+	db := common.connectTarget(common.targetConfig())
+	release := lock.acquire(&common, db)
+	defer release()
+	if err := truncateTables(db); err != nil {
+		fatal("truncate failed", "error", err)
+	}
+	slog.Info("truncate completed successfully")
+}
+
+// mappingFlags decide which documents are read and how they become rows. migrate and
+// verify share them, so a verification maps documents like the migration it checks.
+type mappingFlags struct {
+	since, until, minDate, maxDate string
+	paymentMethodLabels            string
+	only, skip, tablesPath         string
+}
+
+func (f *mappingFlags) register(fs *flag.FlagSet, opts *Options) {
+	fs.IntVar(&opts.MaxDocSize, "max-doc-size", 0, "skip and report Mongo documents larger than this many bytes (0 = no limit)")
+	fs.BoolVar(&opts.MergeOrgsByINN, "merge-orgs-by-inn", false,
+		"migrate only the oldest organization per INN and re-point references to its duplicates (balances of duplicates are not added)")
+	fs.StringVar(&f.since, "since", "", "only migrate documents created at or after this RFC3339 time")
+	fs.StringVar(&f.until, "until", "", "only migrate documents created before this RFC3339 time")
+	fs.StringVar(&f.minDate, "min-date", "",
+		"earliest RFC3339 time migrated into optional date columns; earlier ones are written as NULL (default 1970-01-01 in -tz)")
+	fs.StringVar(&f.maxDate, "max-date", "",
+		"latest RFC3339 time migrated into optional date columns; later ones are written as NULL (default the end of 2100 in -tz)")
+	fs.BoolVar(&opts.ExcludeDeleted, "exclude-deleted", false,
+		"leave out the documents flagged is_deleted: true of organizations, packages, bought packages, charges and balance bindings, logging how many per collection")
+	fs.StringVar(&opts.EmptyPayerInn, "empty-payer-inn", emptyInnKeep,
+		"what happens to bank payment auto-apply errors without a payer INN: keep (migrated with an empty payer_inn) or skip")
+	fs.StringVar(&opts.BoughtPriceSource, "bought-price-source", boughtPriceSourcePaid,
+		"price migrated for bought packages: paid (the document's own price) or package (package.price, the list price)")
+	fs.StringVar(&opts.LongChargeRefs, "long-charge-refs", longRefFail,
+		"what happens to a charge whose object_id or number exceeds its 64-character column: truncate (cut and log it), skip (record the charge in migration_errors) or fail (a decode error, quarantined by -skip-errors)")
+	fs.StringVar(&opts.ChargeItems, "charge-items", chargeItemsPrimary,
+		"how charges with several items are migrated: primary (first item only) or split (one charge per item)")
+	fs.BoolVar(&opts.EnumAsString, "enum-as-string", false,
+		"also write the payment method and Payme transaction state and reason as readable labels in method_label, state_label and reason_label")
+	fs.StringVar(&f.paymentMethodLabels, "payment-method-labels", "",
+		"comma-separated method=label pairs naming the payment methods for -enum-as-string, e.g. 1=cash,2=bank_transfer")
+	fs.StringVar(&opts.IDFormat, "id-format", idFormatHex,
+		"format of the target ids: hex (the ObjectID) or uuid (a UUIDv5 derived from it; references are mapped the same way)")
+	fs.BoolVar(&opts.MoneyAsDecimal, "money-as-decimal", false,
+		"create the money columns (balances, amounts, prices, credit_amount) as DECIMAL(20,2) instead of DOUBLE and round migrated values to cents, "+
+			"logging every value that held a fraction of a cent")
+	fs.StringVar(&f.only, "only", "", "comma-separated migrations to run, e.g. charges,payments (default: all; implies -preserve-tables)")
+	fs.StringVar(&f.skip, "skip", "", "comma-separated migrations to leave out (implies -preserve-tables)")
+	fs.StringVar(&f.tablesPath, "tables", "",
+		"YAML file listing extra flat collections copied field by field into tables of their own, see tables.example.yaml; each runs as a migration named after its table")
+}
+
+// apply parses the mapping flags into opts, exiting on an invalid value
+func (f *mappingFlags) apply(opts *Options, common *commonFlags) {
+	opts.Dates.Location = common.location
+	opts.Collections = common.collections
+	var err error
+	opts.PaymentMethods, err = parseEnumLabels(f.paymentMethodLabels)
+	if err != nil {
+		fatal("invalid -payment-method-labels", "error", err)
+	}
+	if f.tablesPath != "" {
+		if opts.GenericTables, err = loadGenericTables(f.tablesPath); err != nil {
+			fatal("invalid -tables", "error", err)
+		}
+	}
+	opts.Only = splitList(f.only)
+	opts.Skip = splitList(f.skip)
+	if _, err := selectMigrations(*opts); err != nil {
+		fatal("invalid -only or -skip", "error", err)
+	}
+
+	if opts.ChargeItems != chargeItemsPrimary && opts.ChargeItems != chargeItemsSplit {
+		fatal("invalid -charge-items, expected "+chargeItemsPrimary+" or "+chargeItemsSplit, "value", opts.ChargeItems)
+	}
+	if opts.LongChargeRefs != longRefTruncate && opts.LongChargeRefs != longRefSkip && opts.LongChargeRefs != longRefFail {
+		fatal("invalid -long-charge-refs, expected "+longRefTruncate+", "+longRefSkip+" or "+longRefFail, "value", opts.LongChargeRefs)
+	}
+	if opts.IDFormat != idFormatHex && opts.IDFormat != idFormatUUID {
+		fatal("invalid -id-format, expected "+idFormatHex+" or "+idFormatUUID, "value", opts.IDFormat)
+	}
+	if opts.BoughtPriceSource != boughtPriceSourcePaid && opts.BoughtPriceSource != boughtPriceSourcePackage {
+		fatal("invalid -bought-price-source, expected "+boughtPriceSourcePaid+" or "+boughtPriceSourcePackage, "value", opts.BoughtPriceSource)
+	}
+	if opts.EmptyPayerInn != emptyInnKeep && opts.EmptyPayerInn != emptyInnSkip {
+		fatal("invalid -empty-payer-inn, expected "+emptyInnKeep+" or "+emptyInnSkip, "value", opts.EmptyPayerInn)
+	}
+	for _, bound := range []struct {
+		flag  string
+		value string
+		t     *time.Time
+	}{
+		{"since", f.since, &opts.Since},
+		{"until", f.until, &opts.Until},
+		{"min-date", f.minDate, &opts.Dates.Min},
+		{"max-date", f.maxDate, &opts.Dates.Max},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			fatal("invalid -"+bound.flag+", expected an RFC3339 time", "value", bound.value, "error", err)
+		}
+		*bound.t = t
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Since.Before(opts.Until) {
+		fatal("-since must be before -until")
+	}
+	if min, max := opts.Dates.bounds(); !min.Before(max) {
+		fatal("-min-date must be before -max-date", "min", min, "max", max)
+	}
+}
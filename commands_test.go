@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectionSettings are the commonFlags resolved from the environment
+type connectionSettings struct {
+	mongoURI, mongoDB, mysqlUser, mysqlPass, mysqlAddr, mysqlDB, tz string
+}
+
+func TestConnectionFlagPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want connectionSettings
+	}{
+		{
+			name: "defaults",
+			want: connectionSettings{mongoURI: "mongodb://localhost:27017", mongoDB: "billing_service", mysqlUser: "root",
+				mysqlAddr: "127.0.0.1:3306", mysqlDB: "billing_service", tz: "UTC"},
+		},
+		{
+			name: "environment",
+			env: map[string]string{"MONGO_URI": "mongodb://mongo:27017", "MONGO_DB": "billing", "MYSQL_USER": "migrator",
+				"MYSQL_PASS": "secret", "MYSQL_ADDR": "mysql:3306", "MYSQL_DB": "billing", "TZ": "Asia/Tashkent"},
+			want: connectionSettings{mongoURI: "mongodb://mongo:27017", mongoDB: "billing", mysqlUser: "migrator", mysqlPass: "secret",
+				mysqlAddr: "mysql:3306", mysqlDB: "billing", tz: "Asia/Tashkent"},
+		},
+		{
+			name: "flags over environment",
+			env:  map[string]string{"MONGO_DB": "billing", "MYSQL_USER": "migrator", "TZ": "Asia/Tashkent"},
+			args: []string{"-mongo-db", "archive", "-mysql-user", "admin"},
+			want: connectionSettings{mongoURI: "mongodb://localhost:27017", mongoDB: "archive", mysqlUser: "admin",
+				mysqlAddr: "127.0.0.1:3306", mysqlDB: "billing_service", tz: "Asia/Tashkent"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"MONGO_URI", "MONGO_DB", "MYSQL_USER", "MYSQL_PASS", "MYSQL_ADDR", "MYSQL_DB", "TZ"} {
+				t.Setenv(key, tt.env[key])
+			}
+			var c commonFlags
+			fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+			c.register(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			got := connectionSettings{mongoURI: c.mongoURI, mongoDB: c.mongoDB, mysqlUser: c.mysqlUser, mysqlPass: c.mysqlPass,
+				mysqlAddr: c.mysqlAddr, mysqlDB: c.mysqlDB, tz: c.tz}
+			if got != tt.want {
+				t.Errorf("resolved %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		name string
+		rest []string
+		ok   bool
+	}{
+		{[]string{"verify", "-sample", "10"}, "verify", []string{"-sample", "10"}, true},
+		{[]string{"list"}, "list", []string{}, true},
+		{[]string{"-dry-run", "-only", "charges"}, "migrate", []string{"-dry-run", "-only", "charges"}, true},
+		{[]string{"migrat"}, "", nil, false},
+	}
+	for _, tt := range tests {
+		c, rest, ok := findCommand(tt.args)
+		if ok != tt.ok || c.name != tt.name || strings.Join(rest, " ") != strings.Join(tt.rest, " ") {
+			t.Errorf("findCommand(%q) = %s, %q, %v, expected %s, %q, %v", tt.args, c.name, rest, ok, tt.name, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestUsageListsCommands(t *testing.T) {
+	var out bytes.Buffer
+	usage(&out)
+	for _, c := range commands {
+		if !strings.Contains(out.String(), "  "+c.name+" ") || !strings.Contains(out.String(), c.summary) {
+			t.Errorf("usage does not list %s:\n%s", c.name, out.String())
+		}
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	for _, c := range commands {
+		var out bytes.Buffer
+		fs := newFlagSet(c)
+		fs.SetOutput(&out)
+		var common commonFlags
+		common.register(fs)
+		if err := fs.Parse([]string{"-mysql-db", "archive", "-tz", "Asia/Tashkent", "extra"}); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if common.mysqlDB != "archive" || common.tz != "Asia/Tashkent" || fs.Arg(0) != "extra" {
+			t.Errorf("%s: parsed -mysql-db %q, -tz %q and arguments %q", c.name, common.mysqlDB, common.tz, fs.Args())
+		}
+		fs.Usage()
+		if !strings.HasPrefix(out.String(), "usage: migrate-tool "+c.name+" [flags]") || !strings.Contains(out.String(), "-mongo-uri") {
+			t.Errorf("%s: usage is\n%s", c.name, out.String())
+		}
+	}
+}
+
+func TestMappingFlags(t *testing.T) {
+	var opts Options
+	var mapping mappingFlags
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	mapping.register(fs, &opts)
+	err := fs.Parse([]string{"-since", "2024-01-01T00:00:00Z", "-until", "2024-07-01T00:00:00+05:00",
+		"-only", "charges, payments", "-long-charge-refs", "truncate", "-payment-method-labels", "1=cash,2=bank_transfer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping.apply(&opts, &commonFlags{location: time.UTC})
+	if want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); !opts.Since.Equal(want) {
+		t.Errorf("-since is %v, expected %v", opts.Since, want)
+	}
+	if want := time.Date(2024, 6, 30, 19, 0, 0, 0, time.UTC); !opts.Until.Equal(want) {
+		t.Errorf("-until is %v, expected %v", opts.Until, want)
+	}
+	if strings.Join(opts.Only, ",") != "charges,payments" {
+		t.Errorf("-only is %q", opts.Only)
+	}
+	if opts.LongChargeRefs != longRefTruncate || opts.ChargeItems != chargeItemsPrimary || opts.IDFormat != idFormatHex {
+		t.Errorf("policies are %s, %s and %s", opts.LongChargeRefs, opts.ChargeItems, opts.IDFormat)
+	}
+	if opts.PaymentMethods[2] != "bank_transfer" {
+		t.Errorf("payment method labels are %v", opts.PaymentMethods)
+	}
+}
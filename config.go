@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the YAML file read by -config, see config.example.yaml. Every setting
+// maps to a flag; a flag given on the command line overrides the file, and the file
+// overrides the environment variables and defaults.
+type fileConfig struct {
+	Mongo struct {
+		URI            string `yaml:"uri"`
+		URIFile        string `yaml:"uri_file"`
+		DB             string `yaml:"db"`
+		TLS            *bool  `yaml:"tls"`
+		CAFile         string `yaml:"ca_file"`
+		AuthSource     string `yaml:"auth_source"`
+		ReadPreference string `yaml:"read_preference"`
+		ConnectTimeout string `yaml:"connect_timeout"`
+		// Collections maps default collection names to the deployment's, like
+		// -collection-names
+		Collections map[string]string `yaml:"collections"`
+	} `yaml:"mongo"`
+	Target struct {
+		Driver   string `yaml:"driver"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		// PasswordFile is read instead of Password, like -mysql-pass-file
+		PasswordFile string `yaml:"password_file"`
+		Addr         string `yaml:"addr"`
+		DB           string `yaml:"db"`
+		Engine       string `yaml:"engine"`
+		IDCollation  string `yaml:"id_collation"`
+		// MoneyAsDecimal stores the money columns as DECIMAL, like -money-as-decimal
+		MoneyAsDecimal *bool `yaml:"money_as_decimal"`
+		// AutoDedupe deletes duplicate keys blocking a new unique index, like -auto-dedupe
+		AutoDedupe *bool `yaml:"auto_dedupe"`
+		// MaxOpenConns, MaxIdleConns and ConnMaxLifetime tune the connection pool
+		MaxOpenConns    *int   `yaml:"max_open_conns"`
+		MaxIdleConns    *int   `yaml:"max_idle_conns"`
+		ConnMaxLifetime string `yaml:"conn_max_lifetime"`
+		// Params are extra DSN parameters as a query string, like -mysql-params
+		Params   string `yaml:"params"`
+		CreateDB *bool  `yaml:"create_db"`
+		// TablePrefix prefixes every table name, like -table-prefix
+		TablePrefix string `yaml:"table_prefix"`
+	} `yaml:"target"`
+	Timezone          string `yaml:"tz"`
+	BatchSize         *int   `yaml:"batch_size"`
+	MongoBatchSize    *int   `yaml:"mongo_batch_size"`
+	TransformWorkers  *int   `yaml:"transform_workers"`
+	Shards            *int   `yaml:"shards"`
+	RateLimit         *int   `yaml:"rate_limit"`
+	ProgressEvery     *int64 `yaml:"progress_every"`
+	LogFormat         string `yaml:"log_format"`
+	LogLevel          string `yaml:"log_level"`
+	CollectionTimeout string `yaml:"collection_timeout"`
+	CommitInterval    string `yaml:"commit_interval"`
+	CheckpointFile    string `yaml:"checkpoint_file"`
+	SummaryFile       string `yaml:"summary_file"`
+	Output            string `yaml:"output"`
+	SkipErrors        *bool  `yaml:"skip_errors"`
+	ContinueOnError   *bool  `yaml:"continue_on_error"`
+	TxPerCollection   *bool  `yaml:"tx_per_collection"`
+	PreserveTables    *bool  `yaml:"preserve_tables"`
+	Incremental       *bool  `yaml:"incremental"`
+	ExcludeDeleted    *bool  `yaml:"exclude_deleted"`
+	// Tables is the -tables file of extra flat collections
+	Tables string `yaml:"tables"`
+	// Only and Skip select migrations by name like -only and -skip
+	Only []string `yaml:"only"`
+	Skip []string `yaml:"skip"`
+}
+
+// loadConfigFile parses the YAML file at path, rejecting unknown keys
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var cfg fileConfig
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// validate checks the values flag parsing would not catch with a clear message
+func (c *fileConfig) validate() error {
+	if c.Mongo.ConnectTimeout != "" {
+		if _, err := time.ParseDuration(c.Mongo.ConnectTimeout); err != nil {
+			return fmt.Errorf("mongo.connect_timeout: expected a duration such as 10s, got %q", c.Mongo.ConnectTimeout)
+		}
+	}
+	if c.CollectionTimeout != "" {
+		if _, err := time.ParseDuration(c.CollectionTimeout); err != nil {
+			return fmt.Errorf("collection_timeout: expected a duration such as 30m, got %q", c.CollectionTimeout)
+		}
+	}
+	if c.CommitInterval != "" {
+		if _, err := time.ParseDuration(c.CommitInterval); err != nil {
+			return fmt.Errorf("commit_interval: expected a duration such as 30s, got %q", c.CommitInterval)
+		}
+	}
+	if c.Target.ConnMaxLifetime != "" {
+		if _, err := time.ParseDuration(c.Target.ConnMaxLifetime); err != nil {
+			return fmt.Errorf("target.conn_max_lifetime: expected a duration such as 30m, got %q", c.Target.ConnMaxLifetime)
+		}
+	}
+	if c.BatchSize != nil && *c.BatchSize <= 0 {
+		return fmt.Errorf("batch_size must be positive, got %d", *c.BatchSize)
+	}
+	if c.RateLimit != nil && *c.RateLimit < 0 {
+		return fmt.Errorf("rate_limit must not be negative, got %d", *c.RateLimit)
+	}
+	if c.ProgressEvery != nil && *c.ProgressEvery < 0 {
+		return fmt.Errorf("progress_every must not be negative, got %d", *c.ProgressEvery)
+	}
+	return nil
+}
+
+// flagValues returns the settings present in the file keyed by flag name
+func (c *fileConfig) flagValues() map[string]string {
+	values := make(map[string]string)
+	setString := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			values[name] = strconv.FormatBool(*value)
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			values[name] = strconv.Itoa(*value)
+		}
+	}
+
+	setString("mongo-uri", c.Mongo.URI)
+	setString("mongo-uri-file", c.Mongo.URIFile)
+	setString("mongo-db", c.Mongo.DB)
+	setBool("mongo-tls", c.Mongo.TLS)
+	setString("mongo-ca-file", c.Mongo.CAFile)
+	setString("mongo-auth-source", c.Mongo.AuthSource)
+	setString("mongo-read-preference", c.Mongo.ReadPreference)
+	setString("mongo-connect-timeout", c.Mongo.ConnectTimeout)
+	collections := make([]string, 0, len(c.Mongo.Collections))
+	for name, actual := range c.Mongo.Collections {
+		collections = append(collections, name+"="+actual)
+	}
+	sort.Strings(collections)
+	setString("collection-names", strings.Join(collections, ","))
+	setString("target-driver", c.Target.Driver)
+	setString("mysql-user", c.Target.User)
+	setString("mysql-pass", c.Target.Password)
+	setString("mysql-pass-file", c.Target.PasswordFile)
+	setString("mysql-addr", c.Target.Addr)
+	setString("mysql-db", c.Target.DB)
+	setString("mysql-engine", c.Target.Engine)
+	setString("id-collation", c.Target.IDCollation)
+	setBool("money-as-decimal", c.Target.MoneyAsDecimal)
+	setBool("auto-dedupe", c.Target.AutoDedupe)
+	setInt("mysql-max-open-conns", c.Target.MaxOpenConns)
+	setInt("mysql-max-idle-conns", c.Target.MaxIdleConns)
+	setString("mysql-conn-max-lifetime", c.Target.ConnMaxLifetime)
+	setString("mysql-params", c.Target.Params)
+	setString("table-prefix", c.Target.TablePrefix)
+	setBool("create-db", c.Target.CreateDB)
+	setString("tz", c.Timezone)
+	setInt("batch-size", c.BatchSize)
+	setInt("mongo-batch-size", c.MongoBatchSize)
+	setInt("transform-workers", c.TransformWorkers)
+	setInt("shards", c.Shards)
+	setInt("rate-limit", c.RateLimit)
+	if c.ProgressEvery != nil {
+		values["progress-every"] = strconv.FormatInt(*c.ProgressEvery, 10)
+	}
+	setString("log-format", c.LogFormat)
+	setString("log-level", c.LogLevel)
+	setString("collection-timeout", c.CollectionTimeout)
+	setString("commit-interval", c.CommitInterval)
+	setString("checkpoint-file", c.CheckpointFile)
+	setString("summary-file", c.SummaryFile)
+	setString("output", c.Output)
+	setBool("skip-errors", c.SkipErrors)
+	setBool("continue-on-error", c.ContinueOnError)
+	setBool("tx-per-collection", c.TxPerCollection)
+	setBool("preserve-tables", c.PreserveTables)
+	setBool("incremental", c.Incremental)
+	setBool("exclude-deleted", c.ExcludeDeleted)
+	setString("tables", c.Tables)
+	setString("only", strings.Join(c.Only, ","))
+	setString("skip", strings.Join(c.Skip, ","))
+	return values
+}
+
+// applyConfigFile sets every flag of fs the file at path has a value for and that
+// was not given on the command line. Settings of the other subcommands are ignored.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for name, value := range cfg.flagValues() {
+		if explicit[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid config %s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// secret is a flag whose value may instead be read from the file named by its -file
+// flag, keeping it out of the command line and the process list
+type secret struct {
+	flag, fileFlag string
+	value, file    *string
+}
+
+// readSecrets replaces the value of every secret whose file is set with the contents
+// of that file, without the trailing newline. The file wins over the environment
+// variable; giving both a file and the value itself, as a flag or in -config, is an
+// error.
+func readSecrets(fs *flag.FlagSet, secrets ...secret) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, s := range secrets {
+		if *s.file == "" {
+			continue
+		}
+		if explicit[s.flag] {
+			return fmt.Errorf("-%s and -%s cannot both be given", s.flag, s.fileFlag)
+		}
+		data, err := os.ReadFile(*s.file)
+		if err != nil {
+			return fmt.Errorf("could not read -%s: %w", s.fileFlag, err)
+		}
+		*s.value = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
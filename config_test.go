@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// writeConfig writes a -config file holding content and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileRoundTrip(t *testing.T) {
+	cfg, err := loadConfigFile("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := loadConfigFile(writeConfig(t, string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, again) {
+		t.Errorf("config changed after a round trip:\n%+v\n%+v", cfg, again)
+	}
+	if !reflect.DeepEqual(cfg.flagValues(), again.flagValues()) {
+		t.Errorf("flag values changed after a round trip")
+	}
+}
+
+func TestApplyConfigFileFlagsOverride(t *testing.T) {
+	path := writeConfig(t, `
+mongo:
+  db: from_file
+  collections:
+    boughtPackages: bought_packages
+    charges: charge_log
+target:
+  user: file_user
+batch_size: 250
+only: [services, charges]
+`)
+	t.Setenv("MYSQL_ADDR", "")
+	var c commonFlags
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	c.register(fs)
+	batchSize := fs.Int("batch-size", defaultBatchSize, "")
+	if err := fs.Parse([]string{"-mysql-user", "cli_user"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"mongo-db", c.mongoDB, "from_file"},
+		{"mysql-user", c.mysqlUser, "cli_user"},
+		{"collection-names", c.collectionNames, "boughtPackages=bought_packages,charges=charge_log"},
+		{"batch-size", *batchSize, 250},
+		{"mysql-addr", c.mysqlAddr, "127.0.0.1:3306"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("-%s is %v, expected %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigFileRejects(t *testing.T) {
+	tests := []struct {
+		content string
+		problem string
+	}{
+		{"mongo:\n  database: billing\n", "database"},
+		{"commit_interval: often\n", "commit_interval"},
+		{"batch_size: 0\n", "batch_size"},
+		{"target:\n  conn_max_lifetime: 5\n", "conn_max_lifetime"},
+	}
+	for _, tt := range tests {
+		_, err := loadConfigFile(writeConfig(t, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("loading %q returned %v, expected an error about %s", tt.content, err, tt.problem)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errCursorLost stands for a cursor that died mid-iteration, e.g. killed on the server
+var errCursorLost = errors.New("cursor id 42 not found")
+
+// failingSource is a canned source whose migration cursors fail after the shape check
+type failingSource struct {
+	cannedSource
+}
+
+func (s failingSource) collection(name string) sourceCollection {
+	return &failingCollection{cannedCollection{name: name, docs: s.cannedSource[name]}}
+}
+
+type failingCollection struct {
+	cannedCollection
+}
+
+// Find fails the migration cursor, which has no limit, and serves the shape check.
+// The canned cursor reports its error from the first Next on, so none of the
+// documents are read, as if the connection dropped before the first getMore.
+func (c *failingCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	for _, o := range opts {
+		if o.Limit != nil {
+			return c.cannedCollection.Find(ctx, filter, opts...)
+		}
+	}
+	return mongo.NewCursorFromDocuments(c.docs, errCursorLost, nil)
+}
+
+func TestMigrationFailsOnCursorError(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	org := bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}
+	source := failingSource{cannedSource{
+		"services": {bson.M{"_id": selfTestID(1), "name": "Roaming", "code": "roaming"}},
+		"payments": {bson.M{"_id": selfTestID(60), "created_at": created, "amount": 100.0, "organization": org}},
+		"charges":  {bson.M{"_id": selfTestID(50), "created_at": created, "price": 500.0, "organization": org}},
+	}}
+	tests := []struct {
+		name    string
+		opts    Options
+		migrate func(*Migrator, context.Context) (CollectionStats, error)
+	}{
+		{"services", Options{}, (*Migrator).migrateServices},
+		{"payments", Options{}, (*Migrator).migratePayments},
+		{"charges", Options{}, (*Migrator).migrateCharges},
+		{"charges with transform workers", Options{TransformWorkers: 4}, (*Migrator).migrateCharges},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newOutputMigrator(t, source, tt.opts)
+			if _, err := tt.migrate(m, context.Background()); !errors.Is(err, errCursorLost) {
+				t.Errorf("error is %v, expected the cursor error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// DateValidator decides which source times are migrated. Times outside [Min, Max]
+// are written as NULL; a zero Min or Max keeps the default bound of 1970-01-01 or
+// the end of 2100 in Location.
+type DateValidator struct {
+	// Location is the -tz time zone the target stores times in; migrated times are
+	// converted to it. nil keeps them as decoded (UTC).
+	Location *time.Location
+	// Min and Max are the -min-date and -max-date bounds, both inclusive
+	Min, Max time.Time
+}
+
+// bounds returns the bounds in effect
+func (v DateValidator) bounds() (time.Time, time.Time) {
+	loc := v.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	min, max := v.Min, v.Max
+	if min.IsZero() {
+		min = time.Date(1970, time.January, 1, 0, 0, 0, 0, loc)
+	}
+	if max.IsZero() {
+		max = time.Date(2101, time.January, 1, 0, 0, 0, 0, loc).Add(-time.Nanosecond)
+	}
+	return min, max
+}
+
+// Validate returns t in Location, or nil for a zero time or one outside the bounds.
+// The default bounds are taken in Location, the one the target column stores the
+// time in, so a time at the edge of the range is judged by its stored value. A
+// rejected time is logged at debug level with the collection and id of its document.
+func (v DateValidator) Validate(t time.Time, collection, id string) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	if v.Location != nil {
+		t = t.In(v.Location)
+	}
+	min, max := v.bounds()
+	if t.Before(min) || t.After(max) {
+		slog.Debug("date out of range, migrated as NULL", "collection", collection, "id", id, "value", t, "min", min, "max", max)
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCreatedAtOrObjectID(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	minted := time.Date(2021, 7, 15, 12, 0, 0, 0, time.UTC)
+	id := primitive.NewObjectIDFromTimestamp(minted)
+	if got := createdAtOrObjectID(created, id); !got.Equal(created) {
+		t.Errorf("created_at is %v, expected %v", got, created)
+	}
+	if got := createdAtOrObjectID(time.Time{}, id); !got.Equal(minted) {
+		t.Errorf("created_at is %v, expected the ObjectID time %v", got, minted)
+	}
+}
+
+func TestMigratePaymentWithoutCreatedAt(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	minted := time.Date(2021, 7, 15, 12, 0, 0, 0, time.UTC)
+	org := bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}
+	legacy := primitive.NewObjectIDFromTimestamp(minted)
+	source := cannedSource{"payments": {
+		bson.M{"_id": selfTestID(60), "created_at": created, "amount": 100.0, "organization": org},
+		bson.M{"_id": legacy, "amount": 200.0, "organization": org},
+	}}
+	m, dir := newOutputMigrator(t, source, Options{})
+	if _, err := m.migratePayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rows := outputRows(t, m, dir, "payments")
+	if len(rows) != 2 {
+		t.Fatalf("wrote %d payments, expected 2", len(rows))
+	}
+	for i, want := range []time.Time{created, minted} {
+		if got := rows[i]["created_at"]; got != want.Format(time.RFC3339) {
+			t.Errorf("payment %d created_at is %v, expected %v", i, got, want)
+		}
+	}
+}
+
+func TestLoadLocation(t *testing.T) {
+	tests := []struct {
+		tz  string
+		err bool
+	}{
+		{"Asia/Tashkent", false},
+		{"UTC", false},
+		{"Asia/Tashkend", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		loc, err := loadLocation(tt.tz)
+		if (err != nil) != tt.err {
+			t.Errorf("loadLocation(%q) returned %v", tt.tz, err)
+		}
+		if err == nil && loc.String() != tt.tz {
+			t.Errorf("loadLocation(%q) loaded %s", tt.tz, loc)
+		}
+	}
+}
+
+func TestDateValidatorLocation(t *testing.T) {
+	tashkent, err := loadLocation("Asia/Tashkent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1970-01-01 01:00 in Tashkent, before the default bound in UTC
+	early := time.Date(1969, 12, 31, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		location *time.Location
+		want     *time.Time
+	}{
+		{"UTC", nil, nil},
+		{"Tashkent", tashkent, &early},
+	}
+	for _, tt := range tests {
+		got := DateValidator{Location: tt.location}.Validate(early, "payments", "id")
+		if (got == nil) != (tt.want == nil) {
+			t.Fatalf("%s: validated %v, expected %v", tt.name, got, tt.want)
+		}
+		if got != nil && (!got.Equal(*tt.want) || got.Location() != tt.location) {
+			t.Errorf("%s: validated %v, expected %v in %s", tt.name, got, tt.want, tt.location)
+		}
+	}
+}
+
+func TestDateValidatorBounds(t *testing.T) {
+	min := time.Date(1950, 1, 1, 0, 0, 0, 0, time.UTC)
+	max := time.Date(2200, 12, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		validator DateValidator
+		t         time.Time
+		valid     bool
+	}{
+		{"zero time", DateValidator{}, time.Time{}, false},
+		{"default lower bound", DateValidator{}, time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"before the default lower bound", DateValidator{}, time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), false},
+		{"default upper bound", DateValidator{}, time.Date(2100, 12, 31, 23, 59, 59, 0, time.UTC), true},
+		{"after the default upper bound", DateValidator{}, time.Date(2101, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"-min-date is inclusive", DateValidator{Min: min}, min, true},
+		{"before -min-date", DateValidator{Min: min}, min.Add(-time.Second), false},
+		{"old date within -min-date", DateValidator{Min: min}, time.Date(1960, 5, 1, 0, 0, 0, 0, time.UTC), true},
+		{"-max-date is inclusive", DateValidator{Max: max}, max, true},
+		{"after -max-date", DateValidator{Max: max}, max.Add(time.Second), false},
+		{"future date within -max-date", DateValidator{Max: max}, time.Date(2150, 1, 1, 0, 0, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.validator.Validate(tt.t, "payments", "id")
+			if (got != nil) != tt.valid {
+				t.Errorf("Validate(%v) = %v, expected valid: %v", tt.t, got, tt.valid)
+			}
+		})
+	}
+}
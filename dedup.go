@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"migrate-tool/models"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// batchModels maps the collections written through a batch to the model of their
+// parent table, whose columns the -dedup-keys and -conflict-columns name
+var batchModels = map[string]interface{}{
+	"services":                      &models.Service{},
+	"organizations":                 &models.Organization{},
+	"packages":                      &models.Package{},
+	"boughtPackages":                &models.BoughtPackage{},
+	"organizations.active_packages": &models.BoughtPackage{},
+	"charges":                       &models.Charge{},
+	"payments":                      &models.Payment{},
+	"paymeTransactions":             &models.PaymeTransaction{},
+	"organizationBalanceBindings":   &models.OrganizationBalanceBinding{},
+	"creditUpdates":                 &models.CreditUpdates{},
+	"bankPaymentsAutoApplyErrors":   &models.BankPaymentAutoApplyError{},
+}
+
+// parseDedupKeys parses a comma-separated list of collection=col1+col2 entries,
+// rejecting the collections without a batch and the columns their model lacks
+func parseDedupKeys(spec string) (map[string][]string, error) {
+	keys := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ",") {
+		collection, columns, ok := strings.Cut(entry, "=")
+		collection, columns = strings.TrimSpace(collection), strings.TrimSpace(columns)
+		if !ok || collection == "" || columns == "" {
+			continue
+		}
+		model, ok := batchModels[collection]
+		if !ok {
+			return nil, fmt.Errorf("unknown collection %q", collection)
+		}
+		s, err := schema.Parse(model, &sync.Map{}, schema.NamingStrategy{})
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range strings.Split(columns, "+") {
+			if column = strings.TrimSpace(column); column == "" {
+				continue
+			}
+			if s.LookUpField(column) == nil {
+				return nil, fmt.Errorf("unknown column %q of %s", column, collection)
+			}
+			keys[collection] = append(keys[collection], column)
+		}
+	}
+	return keys, nil
+}
+
+// recordExists checks if the mapped model is already present in MySQL using the dedup
+// key configured for the collection, or the primary key when none is configured. Key
+// values are read from the model itself, so a business key can combine any target
+// columns computed from the source document.
+func (m *Migrator) recordExists(collection string, model interface{}) bool {
+	db := m.mysql.GetDB()
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		slog.Warn("could not parse model", "collection", collection, "error", err)
+		return false
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(model))
+	columns, ok := m.opts.DedupKeys[collection]
+	if !ok {
+		id, _ := stmt.Schema.PrioritizedPrimaryField.ValueOf(context.Background(), value)
+		return checkRecordExists(m.mysql, stmt.Schema.Table, fmt.Sprint(id))
+	}
+
+	query := db.Table(stmt.Schema.Table)
+	for _, column := range columns {
+		field := stmt.Schema.LookUpField(column)
+		if field == nil {
+			slog.Warn("unknown dedup column", "collection", collection, "column", column)
+			return false
+		}
+		fieldValue, _ := field.ValueOf(context.Background(), value)
+		query = query.Where(clause.Eq{Column: clause.Column{Name: field.DBName}, Value: fieldValue})
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		slog.Warn("could not check existence", "table", stmt.Schema.Table, "key", strings.Join(columns, "+"), "error", err)
+		return false
+	}
+	return count > 0
+}
+
+// existingKeys returns, by id, the rows whose dedup key columns already hold the same
+// values in table, using one (col1, col2, ...) IN (...) query for all rows. A row
+// with a NULL key value never matches IN, so it is checked on its own by
+// recordExists.
+func existingKeys[T any](m *Migrator, collection, table string, columns, ids []string, rows []T) (map[string]bool, error) {
+	found := make(map[string]bool)
+	if len(rows) == 0 {
+		return found, nil
+	}
+	db := m.mysql.GetDB()
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&rows[0]); err != nil {
+		return nil, err
+	}
+	fields := make([]*schema.Field, len(columns))
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		if fields[i] = stmt.Schema.LookUpField(column); fields[i] == nil {
+			slog.Warn("unknown dedup column", "collection", collection, "column", column)
+			return found, nil
+		}
+		quoted[i] = stmt.Quote(fields[i].DBName)
+	}
+
+	// byKey maps the key values of a row to the ids of the rows having them
+	byKey := make(map[string][]string, len(rows))
+	tuples := make([][]interface{}, 0, len(rows))
+	for i := range rows {
+		value := reflect.ValueOf(rows[i])
+		tuple := make([]interface{}, len(fields))
+		null := false
+		for j, field := range fields {
+			fieldValue, _ := field.ValueOf(context.Background(), value)
+			if rv := reflect.ValueOf(fieldValue); !rv.IsValid() || rv.Kind() == reflect.Ptr && rv.IsNil() {
+				null = true
+			}
+			tuple[j] = fieldValue
+		}
+		if null {
+			if m.recordExists(collection, &rows[i]) {
+				found[ids[i]] = true
+			}
+			continue
+		}
+		key := dedupKey(tuple)
+		if byKey[key] == nil {
+			tuples = append(tuples, tuple)
+		}
+		byKey[key] = append(byKey[key], ids[i])
+	}
+	if len(tuples) == 0 {
+		return found, nil
+	}
+
+	var existing []map[string]interface{}
+	if err := db.Table(table).Select(quoted).
+		Where("("+strings.Join(quoted, ", ")+") IN ?", tuples).
+		Find(&existing).Error; err != nil {
+		return nil, fmt.Errorf("could not check existence on %s: %w", strings.Join(columns, "+"), err)
+	}
+	for _, row := range existing {
+		tuple := make([]interface{}, len(fields))
+		for j, field := range fields {
+			tuple[j] = row[field.DBName]
+		}
+		for _, id := range byKey[dedupKey(tuple)] {
+			found[id] = true
+		}
+	}
+	return found, nil
+}
+
+// dedupKey renders key column values the same way whether they come from a model or
+// from a row scanned by the database driver
+func dedupKey(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		rv := reflect.ValueOf(v)
+		for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+			rv = rv.Elem()
+		}
+		if rv.IsValid() {
+			v = rv.Interface()
+		}
+		switch v := v.(type) {
+		case []byte:
+			parts[i] = string(v)
+		case bool:
+			// MySQL returns booleans as tinyint
+			parts[i] = "0"
+			if v {
+				parts[i] = "1"
+			}
+		case time.Time:
+			parts[i] = v.UTC().Format(time.RFC3339Nano)
+		default:
+			parts[i] = fmt.Sprint(v)
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// Conflict policies of -on-conflict for parent rows that already exist
+const (
+	onConflictSkip   = "skip"
+	onConflictUpdate = "update"
+)
+
+// onConflict returns the clause that makes inserts of model rows into the collection's
+// table skip rows whose conflict target already exists, so concurrent runs cannot
+// insert the same record twice even if both passed the existence check. With
+// -on-conflict update every other column of the existing row, created_at included,
+// is overwritten with the mapped values instead.
+func (m *Migrator) onConflict(collection string, model interface{}) clause.OnConflict {
+	conflict := clause.OnConflict{DoNothing: true}
+	for _, column := range m.opts.ConflictColumns[collection] {
+		conflict.Columns = append(conflict.Columns, clause.Column{Name: column})
+	}
+	if m.opts.OnConflict != onConflictUpdate {
+		return conflict
+	}
+
+	stmt := &gorm.Statement{DB: m.mysql.GetDB()}
+	if err := stmt.Parse(model); err != nil {
+		slog.Warn("could not parse model, skipping existing rows", "collection", collection, "error", err)
+		return conflict
+	}
+	keys := make(map[string]bool)
+	for _, column := range m.opts.ConflictColumns[collection] {
+		keys[column] = true
+	}
+	var update []string
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName != "" && !field.PrimaryKey && !keys[field.DBName] {
+			update = append(update, field.DBName)
+		}
+	}
+	conflict.DoNothing = false
+	conflict.DoUpdates = clause.AssignmentColumns(update)
+	if len(conflict.Columns) == 0 {
+		for _, field := range stmt.Schema.PrimaryFields {
+			conflict.Columns = append(conflict.Columns, clause.Column{Name: field.DBName})
+		}
+	}
+	return conflict
+}
+
+// insertIgnore inserts value, a row or a slice of rows in batches of batchSize,
+// keeping the existing row wherever one collides on the conflict columns (the primary
+// key when empty) or a unique key. It returns how many rows were inserted; the others
+// were ignored. MySQL reports no affected row for an ignored one.
+func insertIgnore(tx *gorm.DB, value interface{}, batchSize int, conflict ...clause.Column) (int64, error) {
+	result := tx.Clauses(clause.OnConflict{Columns: conflict, DoNothing: true}).CreateInBatches(value, batchSize)
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"migrate-tool/models"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestParseDedupKeys(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string][]string
+		err  bool
+	}{
+		{"", map[string][]string{}, false},
+		{"charges=organization_id+type+object_id", map[string][]string{"charges": {"organization_id", "type", "object_id"}}, false},
+		{" charges = organization_id + type , services=code", map[string][]string{"charges": {"organization_id", "type"}, "services": {"code"}}, false},
+		{"payments=", map[string][]string{}, false},
+		{"charge=organization_id", nil, true},
+		{"charges=organisation_id", nil, true},
+		{"services=code+inn", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDedupKeys(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("parseDedupKeys(%q) error %v, expected error %v", tt.spec, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDedupKeys(%q) = %v, expected %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestInsertIgnoreCountsInsertedRows(t *testing.T) {
+	db, target := newMemoryTarget(t)
+	pkg := selfTestID(2).Hex()
+	item := func(id string, code int) models.PackageItem {
+		return models.PackageItem{ID: id, PackageId: pkg, Name: "item", Code: code}
+	}
+	tests := []struct {
+		name     string
+		rows     []models.PackageItem
+		inserted int64
+	}{
+		{"new rows", []models.PackageItem{item("a", 101), item("b", 102)}, 2},
+		{"same primary keys", []models.PackageItem{item("a", 101), item("b", 102)}, 0},
+		{"same unique key", []models.PackageItem{item("c", 101), item("d", 103)}, 1},
+	}
+	for _, tt := range tests {
+		inserted, err := insertIgnore(db.GetDB(), tt.rows, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inserted != tt.inserted {
+			t.Errorf("%s: inserted %d rows, expected %d", tt.name, inserted, tt.inserted)
+		}
+	}
+	if rows := target.rows((&models.PackageItem{}).TableName()); len(rows) != 3 {
+		t.Errorf("package_items has %d rows, expected 3", len(rows))
+	}
+}
+
+func TestDedupKeyMatchesScannedValues(t *testing.T) {
+	tashkent := time.FixedZone("Asia/Tashkent", 5*60*60)
+	created := time.Date(2024, 3, 1, 14, 30, 0, 0, tashkent)
+	org := selfTestID(10).Hex()
+	tests := []struct {
+		name           string
+		model, scanned []interface{}
+	}{
+		{"strings", []interface{}{org, "roaming_invoice"}, []interface{}{[]byte(org), []byte("roaming_invoice")}},
+		{"pointer", []interface{}{&org}, []interface{}{[]byte(org)}},
+		{"numbers", []interface{}{101, uint8(2)}, []interface{}{int64(101), int64(2)}},
+		{"booleans", []interface{}{true, false}, []interface{}{int64(1), int64(0)}},
+		{"time", []interface{}{created}, []interface{}{created.UTC()}},
+	}
+	for _, tt := range tests {
+		if model, scanned := dedupKey(tt.model), dedupKey(tt.scanned); model != scanned {
+			t.Errorf("%s: model key %q differs from scanned key %q", tt.name, model, scanned)
+		}
+	}
+	if dedupKey([]interface{}{"a", "bc"}) == dedupKey([]interface{}{"ab", "c"}) {
+		t.Error("keys split differently across columns collide")
+	}
+}
+
+// dedupCharges returns n charges whose dedup key is their organization and object_id
+func dedupCharges(n int) []models.Charge {
+	charges := make([]models.Charge, n)
+	for i := range charges {
+		charges[i] = models.Charge{ID: fmt.Sprintf("c%05d", i), OrganizationId: fmt.Sprintf("o%d", i%7),
+			ObjectId: fmt.Sprintf("doc%05d", i), CreatedAt: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	return charges
+}
+
+func TestDedupKeysCheckedOncePerFlush(t *testing.T) {
+	const rows, batchSize = 10000, 1000
+	m, _ := newDryRunMigrator(t, cannedSource{}, Options{BatchSize: batchSize,
+		DedupKeys: map[string][]string{"charges": {"organization_id", "object_id"}}})
+	var checks []string
+	count := func(tx *gorm.DB) {
+		if sql := tx.Statement.SQL.String(); strings.Contains(sql, ") IN (") {
+			checks = append(checks, sql)
+		}
+	}
+	if err := m.mysql.GetDB().Callback().Query().After("gorm:query").Register("test:count_checks", count); err != nil {
+		t.Fatal(err)
+	}
+
+	charges := newBatch[models.Charge](m, m.mysql.GetDB(), "charges", (&models.Charge{}).TableName())
+	for _, row := range dedupCharges(rows) {
+		charges.add(row.ID, row, nil)
+		if charges.full() {
+			if err := charges.save(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := charges.save(); err != nil {
+		t.Fatal(err)
+	}
+	// Checked row by row, the same rows would take one query each
+	if len(checks) != rows/batchSize {
+		t.Errorf("%d rows took %d existence queries, expected one per flush: %d", rows, len(checks), rows/batchSize)
+	}
+	if want := "WHERE (`organization_id`, `object_id`) IN (("; len(checks) > 0 && !strings.Contains(checks[0], want) {
+		t.Errorf("existence query is %s, expected a tuple IN", checks[0])
+	}
+}
+
+func TestDedupKeysSkipSeededRows(t *testing.T) {
+	db, target := newMemoryTarget(t)
+	m := newMemoryMigrator(t, db, cannedSource{}, Options{BatchSize: 10,
+		DedupKeys: map[string][]string{"charges": {"organization_id", "object_id"}}})
+	seeded := dedupCharges(2)
+	for i := range seeded {
+		// Same business key under another id, as left by an earlier run
+		seeded[i].ID = "old" + seeded[i].ID
+	}
+	if err := db.GetDB().Create(&seeded).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	charges := newBatch[models.Charge](m, db.GetDB(), "charges", (&models.Charge{}).TableName())
+	for _, row := range dedupCharges(5) {
+		charges.add(row.ID, row, nil)
+	}
+	if err := charges.save(); err != nil {
+		t.Fatal(err)
+	}
+	if charges.moved != 3 || charges.skipped != 2 {
+		t.Errorf("moved %d and skipped %d, expected 3 and 2", charges.moved, charges.skipped)
+	}
+	if rows := target.rows((&models.Charge{}).TableName()); len(rows) != 5 {
+		t.Errorf("charges holds %d rows, expected the 2 seeded and 3 new", len(rows))
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// softDeletedCollections flag deleted documents with is_deleted instead of removing
+// them; -exclude-deleted leaves those documents out
+var softDeletedCollections = map[string]bool{
+	"organizations":               true,
+	"packages":                    true,
+	"boughtPackages":              true,
+	"charges":                     true,
+	"organizationBalanceBindings": true,
+}
+
+// excludeDeleted restricts filter, with -exclude-deleted, to the documents of
+// collection not flagged is_deleted, logging how many the rest of filter matched that
+// it leaves out. Collections without the flag are not touched.
+func (m *Migrator) excludeDeleted(ctx context.Context, collection string, filter bson.M) {
+	if !m.opts.ExcludeDeleted || !softDeletedCollections[collection] {
+		return
+	}
+	deleted := bson.M{}
+	for key, value := range filter {
+		deleted[key] = value
+	}
+	deleted["is_deleted"] = true
+	excluded, err := m.collection(collection).CountDocuments(ctx, deleted)
+	if err != nil {
+		slog.Warn("could not count deleted documents", "collection", collection, "error", err)
+	} else {
+		slog.Info("excluding deleted documents", "collection", collection, "excluded", excluded)
+	}
+	filter["is_deleted"] = bson.M{"$ne": true}
+}
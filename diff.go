@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"migrate-tool/models"
+	"os"
+	"reflect"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+// diffCounts are the -diff results of one collection
+type diffCounts struct {
+	collection string
+	// identical and divergent count the mapped rows already in the target, new those
+	// a migration would insert
+	identical, divergent, new int
+}
+
+// diff maps every document of the selected collections like the migration would and
+// compares the rows that already exist in the target column by column, logging each
+// differing column. Nothing is written. It prints the identical, divergent and new
+// rows per collection, showing what -on-conflict update would change. Like -verify it
+// covers the parent rows of the collections in verifiedCollections.
+func diff(ctx context.Context, mdb *mongo.Database, db models.Database, opts Options) error {
+	opts.CheckRefs = false
+	opts.OutputErrorsToMySQL = false
+	opts.CheckpointFile = ""
+	opts.Output = ""
+	opts.Shards = 1
+	opts.Incremental = false
+	d := NewMigratorWithClients(mdb, db, opts)
+	selected, err := selectMigrations(opts)
+	if err != nil {
+		return err
+	}
+
+	var results []diffCounts
+	for _, mig := range selected {
+		if mig.name == "organization-merges" {
+			// Re-pointed organization ids must match the migration
+			if _, err := mig.fn(d, ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		collection, ok := verifiedCollections[mig.name]
+		if !ok {
+			continue
+		}
+
+		counts := diffCounts{collection: collection}
+		d.capture = &rowCapture{flushed: func(rows []interface{}) error {
+			return diffRows(ctx, db.GetDB(), collection, rows, &counts)
+		}}
+		if _, err := mig.fn(d, ctx); err != nil {
+			return fmt.Errorf("could not map %s: %w", collection, err)
+		}
+		slog.Info("diffed", "collection", collection, "identical", counts.identical, "divergent", counts.divergent, "new", counts.new)
+		results = append(results, counts)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTION\tIDENTICAL\tDIVERGENT\tNEW")
+	for _, c := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", c.collection, c.identical, c.divergent, c.new)
+	}
+	return w.Flush()
+}
+
+// diffRows loads the stored rows of one flushed batch with a single query and counts
+// every mapped row as new, identical or divergent. The row_hash column is left out:
+// it only differs when another column does, or when it was never filled in.
+func diffRows(ctx context.Context, db *gorm.DB, collection string, rows []interface{}, counts *diffCounts) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(rows[0]); err != nil {
+		return err
+	}
+	pk := stmt.Schema.PrioritizedPrimaryField
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		id, _ := pk.ValueOf(ctx, reflect.ValueOf(row).Elem())
+		ids[i] = fmt.Sprint(id)
+	}
+
+	stored := reflect.New(reflect.SliceOf(reflect.TypeOf(rows[0]).Elem()))
+	if err := db.WithContext(ctx).Table(stmt.Schema.Table).Where(pk.DBName+" IN ?", ids).Find(stored.Interface()).Error; err != nil {
+		return fmt.Errorf("could not load %s: %w", stmt.Schema.Table, err)
+	}
+	byID := make(map[string]reflect.Value, stored.Elem().Len())
+	for i := 0; i < stored.Elem().Len(); i++ {
+		row := stored.Elem().Index(i)
+		id, _ := pk.ValueOf(ctx, row)
+		byID[fmt.Sprint(id)] = row
+	}
+
+	for i, row := range rows {
+		target, ok := byID[ids[i]]
+		if !ok {
+			counts.new++
+			continue
+		}
+		divergent := false
+		for _, d := range columnDiffs(ctx, stmt.Schema, ids[i], reflect.ValueOf(row).Elem(), target) {
+			if d.column == rowHashColumn {
+				continue
+			}
+			divergent = true
+			slog.Info("diff", "collection", collection, "table", d.table, "id", d.id, "field", d.column, "source", d.source, "target", d.target)
+		}
+		if divergent {
+			counts.divergent++
+		} else {
+			counts.identical++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// skipOversized reports whether doc exceeds Options.MaxDocSize. It checks the raw BSON
+// length so pathological documents (huge embedded arrays) are never decoded. Skipped
+// ids are kept as a set since organizations are scanned by more than one migration.
+func (m *Migrator) skipOversized(collection string, doc bson.Raw) bool {
+	if !m.tooLarge(doc) {
+		return false
+	}
+	maxDocSize := m.opts.MaxDocSize
+	id := doc.Lookup("_id").String()
+	if m.oversized[collection] == nil {
+		m.oversized[collection] = make(map[string]bool)
+	}
+	if !m.oversized[collection][id] {
+		slog.Warn("skipping oversized document", "collection", collection, "id", id, "bytes", len(doc), "max_doc_size", maxDocSize)
+	}
+	m.oversized[collection][id] = true
+	return true
+}
+
+// tooLarge reports whether doc exceeds Options.MaxDocSize without recording it, so
+// the -transform-workers goroutines can check it before decoding
+func (m *Migrator) tooLarge(doc bson.Raw) bool {
+	return m.opts.MaxDocSize > 0 && len(doc) > m.opts.MaxDocSize
+}
+
+// reportOversized logs how many documents were skipped by the size guard
+func (m *Migrator) reportOversized() {
+	for collection, ids := range m.oversized {
+		slog.Warn("skipped oversized documents", "collection", collection, "skipped", len(ids), "max_doc_size", m.opts.MaxDocSize)
+	}
+}
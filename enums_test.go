@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseEnumLabels(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[int]string
+		err  bool
+	}{
+		{"", map[int]string{}, false},
+		{"1=cash, 2 = card,", map[int]string{1: "cash", 2: "card"}, false},
+		{"-1=refund", map[int]string{-1: "refund"}, false},
+		{"cash", nil, true},
+		{"one=cash", nil, true},
+		{"1=", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseEnumLabels(tt.spec)
+		if (err != nil) != tt.err || (!tt.err && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseEnumLabels(%q) = %v, %v", tt.spec, got, err)
+		}
+	}
+}
+
+func TestPaymentMethodLabels(t *testing.T) {
+	org := bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}
+	source := cannedSource{"payments": {
+		bson.M{"_id": selfTestID(60), "created_at": time.Now(), "amount": 100.0, "organization": org, "method": 1},
+		bson.M{"_id": selfTestID(61), "created_at": time.Now(), "amount": 200.0, "organization": org, "method": 9},
+	}}
+	tests := []struct {
+		name   string
+		opts   Options
+		labels []interface{}
+	}{
+		{"numbers only", Options{}, []interface{}{nil, nil}},
+		{"labels", Options{EnumAsString: true, PaymentMethods: map[int]string{1: "cash"}}, []interface{}{"cash", "unknown(9)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, dir := newOutputMigrator(t, source, tt.opts)
+			if _, err := m.migratePayments(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			rows := outputRows(t, m, dir, "payments")
+			methods := []float64{1, 9}
+			for i, row := range rows {
+				if row["method_label"] != tt.labels[i] {
+					t.Errorf("payment %d method_label is %v, expected %v", i, row["method_label"], tt.labels[i])
+				}
+				if row["method"] != methods[i] {
+					t.Errorf("payment %d method is %v, expected it kept", i, row["method"])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"migrate-tool/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// documentID returns the _id of a raw document as a hex string when it is an ObjectID
+// and as the plain value when it is a string
+func documentID(doc bson.Raw) string {
+	value, err := doc.LookupErr("_id")
+	if err != nil {
+		return ""
+	}
+	if id, ok := value.ObjectIDOK(); ok {
+		return id.Hex()
+	}
+	if id, ok := value.StringValueOK(); ok {
+		return id
+	}
+	return value.String()
+}
+
+// maxFailureDocument caps the extended JSON kept per failed document so it fits a
+// MySQL TEXT column
+const maxFailureDocument = 65535
+
+// recordFailure stores a failed record and its source document in migration_errors
+// when -output-errors-to-mysql or -skip-errors is set. Failing to record is only
+// logged so the original error stays the one reported.
+func (m *Migrator) recordFailure(collection, id string, doc bson.Raw, cause error) {
+	m.failed[collection]++
+	m.metrics.fail(collection)
+	m.storeFailure(collection, id, doc, cause)
+}
+
+// decodeFailed logs a source document that could not be decoded by its _id, with the
+// whole document as extended JSON at debug level, and records it as failed, so a
+// schema surprise can be looked at without running again
+func (m *Migrator) decodeFailed(collection string, doc bson.Raw, err error) {
+	id := documentID(doc)
+	slog.Error("decode failed", "collection", collection, "id", id, "error", err)
+	slog.Debug("undecodable document", "collection", collection, "id", id, "document", doc.String())
+	m.recordFailure(collection, id, doc, err)
+}
+
+// storeFailure writes a record to migration_errors when -output-errors-to-mysql or
+// -skip-errors is set
+func (m *Migrator) storeFailure(collection, id string, doc bson.Raw, cause error) {
+	if !m.opts.OutputErrorsToMySQL && !m.opts.SkipErrors {
+		return
+	}
+	failure := models.MigrationError{
+		CreatedAt:  time.Now(),
+		Collection: collection,
+		RecordID:   id,
+		Error:      cause.Error(),
+	}
+	if doc != nil {
+		failure.Document = doc.String()
+		if len(failure.Document) > maxFailureDocument {
+			failure.Document = failure.Document[:maxFailureDocument]
+		}
+	}
+	if err := m.failures.GetDB().Create(&failure).Error; err != nil {
+		slog.Warn("could not record failure", "collection", collection, "id", id, "error", err)
+	}
+}
+
+// reportFailures logs how many records per collection were quarantined by -skip-errors
+func (m *Migrator) reportFailures() {
+	for collection, count := range m.failed {
+		slog.Warn("quarantined failed records", "collection", collection, "failed", count, "table", (&models.MigrationError{}).TableName())
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"migrate-tool/models"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// Column types of a generic table field
+const (
+	genericString = "string"
+	genericText   = "text"
+	genericInt    = "int"
+	genericFloat  = "float"
+	genericBool   = "bool"
+	genericTime   = "time"
+)
+
+// genericColumnTypes maps the column types of -tables to the Go types the table is
+// created from; pointers so a missing or null field is NULL
+var genericColumnTypes = map[string]reflect.Type{
+	genericString: reflect.TypeOf((*string)(nil)),
+	genericText:   reflect.TypeOf((*string)(nil)),
+	genericInt:    reflect.TypeOf((*int64)(nil)),
+	genericFloat:  reflect.TypeOf((*float64)(nil)),
+	genericBool:   reflect.TypeOf((*bool)(nil)),
+	genericTime:   reflect.TypeOf((*time.Time)(nil)),
+}
+
+// identifier matches the table and column names of -tables, which are used in SQL
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// tablePrefixPattern matches the -table-prefix values, which are used in SQL
+var tablePrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_]{0,32}$`)
+
+// genericField copies the scalar at Source, a dotted path, into Column
+type genericField struct {
+	Source string `yaml:"source"`
+	Column string `yaml:"column"`
+	// Type is one of string (default, up to 255 characters), text, int, float, bool
+	// or time
+	Type string `yaml:"type"`
+}
+
+// genericRoute sends the documents whose Field, a dotted path, equals Equals to
+// Table instead of the table of their genericTable, with the same columns
+type genericRoute struct {
+	Field  string `yaml:"field"`
+	Equals string `yaml:"equals"`
+	Table  string `yaml:"table"`
+}
+
+// genericTable is a flat collection copied by migrateGeneric into a table of its own,
+// see tables.example.yaml. The _id of every document becomes the id column. Table is
+// also the name of its migration; the table itself carries the -table-prefix. Routes
+// split the collection over further tables by rule, the first matching route wins.
+type genericTable struct {
+	Collection string         `yaml:"collection"`
+	Table      string         `yaml:"table"`
+	Fields     []genericField `yaml:"fields"`
+	Routes     []genericRoute `yaml:"routes"`
+}
+
+// loadGenericTables reads the -tables file at path
+func loadGenericTables(path string) ([]genericTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var tables []genericTable
+	if err := dec.Decode(&tables); err != nil {
+		return nil, fmt.Errorf("invalid tables file %s: %w", path, err)
+	}
+
+	// A table may not reuse the name of a built-in migration or table
+	builtin := make(map[string]bool, len(migrations)+len(countExpectations()))
+	for _, mig := range migrations {
+		builtin[mig.name] = true
+	}
+	for _, e := range countExpectations() {
+		builtin[e.table] = true
+	}
+	seen := make(map[string]bool, len(tables))
+	for i := range tables {
+		t := &tables[i]
+		if t.Collection == "" {
+			return nil, fmt.Errorf("invalid tables file %s: table %d has no collection", path, i+1)
+		}
+		if t.Table == "" {
+			t.Table = t.Collection
+		}
+		if !identifier.MatchString(t.Table) {
+			return nil, fmt.Errorf("invalid tables file %s: invalid table name %q", path, t.Table)
+		}
+		if builtin[models.TablePrefix()+t.Table] || seen[t.Table] {
+			return nil, fmt.Errorf("invalid tables file %s: table %s is already migrated", path, t.Table)
+		}
+		seen[t.Table] = true
+		for _, r := range t.Routes {
+			if r.Field == "" || !identifier.MatchString(r.Table) {
+				return nil, fmt.Errorf("invalid tables file %s: %s: invalid route field %q table %q", path, t.Table, r.Field, r.Table)
+			}
+			if builtin[models.TablePrefix()+r.Table] || seen[r.Table] {
+				return nil, fmt.Errorf("invalid tables file %s: table %s is already migrated", path, r.Table)
+			}
+			seen[r.Table] = true
+		}
+		if err := t.validateFields(); err != nil {
+			return nil, fmt.Errorf("invalid tables file %s: %s: %w", path, t.Table, err)
+		}
+	}
+	return tables, nil
+}
+
+// validateFields checks the columns of t, defaulting their type to string
+func (t *genericTable) validateFields() error {
+	if len(t.Fields) == 0 {
+		return errors.New("no fields")
+	}
+	columns := map[string]bool{"id": true}
+	for i := range t.Fields {
+		f := &t.Fields[i]
+		if f.Column == "" {
+			f.Column = strings.ReplaceAll(f.Source, ".", "_")
+		}
+		if f.Source == "" || !identifier.MatchString(f.Column) {
+			return fmt.Errorf("invalid field source %q column %q", f.Source, f.Column)
+		}
+		if columns[f.Column] {
+			return fmt.Errorf("column %s is mapped twice or is the id", f.Column)
+		}
+		columns[f.Column] = true
+		if f.Type == "" {
+			f.Type = genericString
+		}
+		if _, ok := genericColumnTypes[f.Type]; !ok {
+			return fmt.Errorf("column %s: unknown type %q, expected string, text, int, float, bool or time", f.Column, f.Type)
+		}
+	}
+	return nil
+}
+
+// model returns a struct of the columns of t, which only the table is created from;
+// the rows themselves are written as column maps
+func (t genericTable) model() interface{} {
+	fields := []reflect.StructField{{
+		Name: "ID",
+		Type: reflect.TypeOf(""),
+		Tag:  `gorm:"primaryKey;column:id;size:36;not null"`,
+	}}
+	for i, f := range t.Fields {
+		tag := "column:" + f.Column
+		switch f.Type {
+		case genericString:
+			tag += ";size:255"
+		case genericText:
+			tag += ";type:text"
+		}
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("F%d", i),
+			Type: genericColumnTypes[f.Type],
+			Tag:  reflect.StructTag(`gorm:"` + tag + `"`),
+		})
+	}
+	return reflect.New(reflect.StructOf(fields)).Interface()
+}
+
+// splitter returns the router picking the table of each document of t, unprefixed
+func (t genericTable) splitter() *splitter[bson.Raw] {
+	routes := make([]splitRoute[bson.Raw], 0, len(t.Routes))
+	for _, r := range t.Routes {
+		path, equals := strings.Split(r.Field, "."), r.Equals
+		routes = append(routes, splitRoute[bson.Raw]{table: r.Table, match: func(doc bson.Raw) bool {
+			value, err := doc.LookupErr(path...)
+			if err != nil {
+				return false
+			}
+			s, ok := rawString(value)
+			return ok && s == equals
+		}})
+	}
+	return newSplitter(t.Table, routes...)
+}
+
+// migration returns the step migrating t, named after its table
+func (t genericTable) migration() migration {
+	return migration{name: t.Table, fn: func(m *Migrator, ctx context.Context) (CollectionStats, error) {
+		return m.migrateGeneric(ctx, t)
+	}}
+}
+
+// genericValue converts the value of a field to the Go value of its column type;
+// nil for a missing or null field
+func (m *Migrator) genericValue(f genericField, value bson.RawValue, collection, id string) (interface{}, error) {
+	if value.Type == bsontype.Null || value.Type == bsontype.Undefined {
+		return nil, nil
+	}
+	switch f.Type {
+	case genericString, genericText:
+		if s, ok := rawString(value); ok {
+			return s, nil
+		}
+	case genericInt:
+		if n, ok := value.AsInt64OK(); ok {
+			return n, nil
+		}
+	case genericFloat:
+		switch value.Type {
+		case bsontype.Double:
+			return value.Double(), nil
+		case bsontype.Int32, bsontype.Int64:
+			return float64(value.AsInt64()), nil
+		}
+	case genericBool:
+		if b, ok := value.BooleanOK(); ok {
+			return b, nil
+		}
+	case genericTime:
+		if t, ok := value.TimeOK(); ok {
+			if valid := m.opts.Dates.Validate(t, collection, id); valid != nil {
+				return *valid, nil
+			}
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: cannot read a %s as %s", f.Source, value.Type, f.Type)
+}
+
+// rawString returns a string, ObjectID, number or boolean value as text
+func rawString(value bson.RawValue) (string, bool) {
+	if s, ok := value.StringValueOK(); ok {
+		return s, true
+	}
+	if oid, ok := value.ObjectIDOK(); ok {
+		return oid.Hex(), true
+	}
+	if value.IsNumber() || value.Type == bsontype.Boolean {
+		return strings.Trim(value.String(), `"`), true
+	}
+	return "", false
+}
+
+// genericRow maps doc into the columns of t
+func (m *Migrator) genericRow(t genericTable, doc bson.Raw) (string, map[string]interface{}, error) {
+	idValue, err := doc.LookupErr("_id")
+	if err != nil {
+		return "", nil, errors.New("document has no _id")
+	}
+	id := documentID(doc)
+	if oid, ok := idValue.ObjectIDOK(); ok {
+		id = m.rowID(oid)
+	}
+	row := map[string]interface{}{"id": id}
+	for _, f := range t.Fields {
+		value, err := doc.LookupErr(strings.Split(f.Source, ".")...)
+		if err != nil {
+			row[f.Column] = nil
+			continue
+		}
+		if row[f.Column], err = m.genericValue(f, value, t.Collection, id); err != nil {
+			return id, nil, err
+		}
+	}
+	return id, row, nil
+}
+
+// migrateGeneric copies the scalar fields of a flat collection into the table of t,
+// created or extended from its field list, and the documents matching a route into
+// the table of the route. Documents already migrated are skipped by id, like the
+// dedicated migrators do.
+func (m *Migrator) migrateGeneric(ctx context.Context, t genericTable) (CollectionStats, error) {
+	coll := m.collection(t.Collection)
+	srcCount := mongoCount(ctx, coll)
+	db := m.mysql.GetDB()
+	split := t.splitter()
+	model := t.model()
+	batches := make(map[string]*genericBatch)
+	for _, name := range split.tables() {
+		table := models.TablePrefix() + name
+		batches[name] = &genericBatch{table: table}
+		if m.output == nil && m.capture == nil {
+			if err := db.Table(table).AutoMigrate(model); err != nil {
+				return CollectionStats{}, fmt.Errorf("could not create %s: %w", table, err)
+			}
+		}
+	}
+	own := batches[t.Table]
+	dstBefore := mysqlCount(m.mysql, own.table)
+	slog.Info("starting", "collection", t.Collection, "mongo", srcCount, "mysql_before", dstBefore)
+
+	cur, err := m.find(ctx, t.Collection, bson.M{})
+	if err != nil {
+		return CollectionStats{}, err
+	}
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	// The checkpoint holds the totals of the collection, resumed into its own table
+	if p := m.checkpoint.progress(t.Collection); p != nil {
+		own.moved, own.skipped = p.Moved, p.Skipped
+	}
+	pending := 0
+	lastID := ""
+	flushedAt := time.Now()
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		defer func() {
+			pending = 0
+			flushedAt = time.Now()
+		}()
+		moved, skipped := 0, 0
+		for _, name := range split.tables() {
+			b := batches[name]
+			if err := m.flushGeneric(db, model, b); err != nil {
+				return err
+			}
+			moved, skipped = moved+b.moved, skipped+b.skipped
+		}
+		if m.capture != nil || m.output != nil {
+			return nil
+		}
+		return m.checkpoint.advance(t.Collection, lastID, moved, skipped)
+	}
+
+	progress := m.newProgress(t.Collection, srcCount)
+	flushDue := func() error {
+		if pending >= m.opts.BatchSize || m.commitDue(flushedAt) {
+			return flush()
+		}
+		return nil
+	}
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized(t.Collection, cur.Current) {
+			continue
+		}
+		id, row, err := m.genericRow(t, cur.Current)
+		if err != nil {
+			m.decodeFailed(t.Collection, cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
+		}
+		b := batches[split.route(cur.Current)]
+		b.ids = append(b.ids, id)
+		b.rows = append(b.rows, row)
+		pending++
+		lastID = documentID(cur.Current)
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
+		}
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := flush(); err != nil {
+		return CollectionStats{}, err
+	}
+
+	var stats CollectionStats
+	for _, name := range split.tables() {
+		b := batches[name]
+		result := MigrationResult{Collection: t.Collection, Table: b.table,
+			Moved: b.moved, Skipped: b.skipped, DestAfter: mysqlCount(m.mysql, b.table)}
+		if b == own {
+			result.Source, result.Failed = srcCount, m.failed[t.Collection]
+		}
+		stats.add(result)
+	}
+	return stats, cursorErr(ctx, cur, t.Collection)
+}
+
+// genericBatch holds the rows of one table of a generic migration until they are
+// flushed, and the counters of the table
+type genericBatch struct {
+	table          string
+	ids            []string
+	rows           []map[string]interface{}
+	moved, skipped int
+}
+
+// flushGeneric writes the rows of b, skipping the ids already in its table
+func (m *Migrator) flushGeneric(db *gorm.DB, model interface{}, b *genericBatch) error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+	defer func() { b.ids, b.rows = b.ids[:0], b.rows[:0] }()
+	if m.capture != nil {
+		return nil
+	}
+	if m.output != nil {
+		b.moved += len(b.rows)
+		return m.output.writeRows(b.table, b.rows)
+	}
+	existing, err := existingIDs(db, b.table, b.ids)
+	if err != nil {
+		return err
+	}
+	insert := make([]map[string]interface{}, 0, len(b.rows))
+	for i, row := range b.rows {
+		if existing[b.ids[i]] {
+			b.skipped++
+			continue
+		}
+		insert = append(insert, row)
+	}
+	if len(insert) == 0 {
+		return nil
+	}
+	m.limiter.wait(len(insert))
+	// The model gives the conflict clause the primary key the maps lack
+	n, err := insertIgnore(db.Table(b.table).Model(model), insert, m.opts.BatchSize)
+	if err != nil {
+		return fmt.Errorf("%s batch insert failed: %w", b.table, err)
+	}
+	b.moved += int(n)
+	b.skipped += len(insert) - int(n)
+	return nil
+}
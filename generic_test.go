@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// newOutputMigrator returns a migrator reading source and writing -output files into a
+// temporary directory, with neither MongoDB nor a target database
+func newOutputMigrator(t *testing.T, source sourceDatabase, opts Options) (*Migrator, string) {
+	t.Helper()
+	target, err := models.NewDryRunDatabase(models.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Output = t.TempDir()
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 2
+	}
+	m := newMigrator(source, target, opts)
+	if m.output, err = newJSONLOutput(opts.Output); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.output.Close() })
+	return m, opts.Output
+}
+
+// outputRows closes the output files of m and reads the rows written to table
+func outputRows(t *testing.T, m *Migrator, dir, table string) []map[string]interface{} {
+	t.Helper()
+	if err := m.output.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readJSONLRows(filepath.Join(dir, table+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestMigrateGenericRoutesDocumentsToTables(t *testing.T) {
+	source := cannedSource{"notifications": {
+		bson.M{"_id": selfTestID(1), "kind": "sms", "text": "one"},
+		bson.M{"_id": selfTestID(2), "kind": "email", "text": "two"},
+		bson.M{"_id": selfTestID(3), "kind": "sms", "text": "three"},
+		bson.M{"_id": selfTestID(4), "text": "four"},
+		bson.M{"_id": selfTestID(5), "kind": "push", "text": "five"},
+	}}
+	table := genericTable{
+		Collection: "notifications",
+		Table:      "notifications",
+		Fields:     []genericField{{Source: "kind"}, {Source: "text", Type: genericText}},
+		Routes: []genericRoute{
+			{Field: "kind", Equals: "sms", Table: "sms_notifications"},
+			{Field: "kind", Equals: "push", Table: "push_notifications"},
+		},
+	}
+	if err := table.validateFields(); err != nil {
+		t.Fatal(err)
+	}
+	m, dir := newOutputMigrator(t, source, Options{})
+	stats, err := m.migrateGeneric(context.Background(), table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		table string
+		texts []string
+	}{
+		{"notifications", []string{"two", "four"}},
+		{"sms_notifications", []string{"one", "three"}},
+		{"push_notifications", []string{"five"}},
+	}
+	moved := 0
+	for _, tt := range tests {
+		rows := outputRows(t, m, dir, tt.table)
+		if len(rows) != len(tt.texts) {
+			t.Fatalf("%s has %d rows, expected %d", tt.table, len(rows), len(tt.texts))
+		}
+		for i, row := range rows {
+			if row["text"] != tt.texts[i] {
+				t.Errorf("%s row %d text is %v, expected %s", tt.table, i, row["text"], tt.texts[i])
+			}
+		}
+		moved += len(tt.texts)
+	}
+	got := 0
+	for _, r := range stats.Tables {
+		got += r.Moved
+	}
+	if got != moved {
+		t.Errorf("moved %d rows, expected %d", got, moved)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Target id formats of -id-format
+const (
+	idFormatHex  = "hex"
+	idFormatUUID = "uuid"
+)
+
+// zeroUUID is the id written for an absent embedded reference with -id-format uuid
+var zeroUUID = uuid.Nil.String()
+
+// rowID returns the target id of the source ObjectID id: its hex string, or with
+// -id-format uuid the UUIDv5 of that hex string. The mapping only depends on id, so
+// a reference and the row it points at always agree, across runs too. An absent
+// reference (the zero ObjectID) stays recognizable as zeroObjectIDHex or zeroUUID.
+func (m *Migrator) rowID(id primitive.ObjectID) string {
+	return formatRowID(m.opts.IDFormat, id)
+}
+
+// rowIDHex is rowID for an id stored as a hex string; other strings are kept as is
+func (m *Migrator) rowIDHex(id string) string {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return id
+	}
+	return m.rowID(oid)
+}
+
+func formatRowID(format string, id primitive.ObjectID) string {
+	if format != idFormatUUID {
+		return id.Hex()
+	}
+	if id.IsZero() {
+		return zeroUUID
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(id.Hex())).String()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFormatRowID(t *testing.T) {
+	id := selfTestID(10)
+	if got := formatRowID(idFormatHex, id); got != id.Hex() {
+		t.Errorf("hex id is %s, expected %s", got, id.Hex())
+	}
+	first := formatRowID(idFormatUUID, id)
+	if _, err := uuid.Parse(first); err != nil {
+		t.Errorf("%s is not a UUID: %v", first, err)
+	}
+	// Parsed again from its hex string, as a later run would
+	again, _ := primitive.ObjectIDFromHex(id.Hex())
+	if got := formatRowID(idFormatUUID, again); got != first {
+		t.Errorf("the same ObjectID maps to %s and %s", first, got)
+	}
+	if other := formatRowID(idFormatUUID, selfTestID(11)); other == first {
+		t.Errorf("two ObjectIDs map to %s", first)
+	}
+	if got := formatRowID(idFormatUUID, primitive.NilObjectID); got != zeroUUID {
+		t.Errorf("the zero ObjectID maps to %s, expected %s", got, zeroUUID)
+	}
+}
+
+func TestRowIDHex(t *testing.T) {
+	m := newMigrator(cannedSource{}, nil, Options{IDFormat: idFormatUUID})
+	if got := m.rowIDHex(selfTestID(10).Hex()); got != m.rowID(selfTestID(10)) {
+		t.Errorf("hex string maps to %s, expected %s", got, m.rowID(selfTestID(10)))
+	}
+	if got := m.rowIDHex("INV-1"); got != "INV-1" {
+		t.Errorf("non-hex id maps to %s, expected it unchanged", got)
+	}
+}
+
+func TestUUIDReferencesLineUp(t *testing.T) {
+	source := cannedSource{"payments": {bson.M{
+		"_id": selfTestID(60), "created_at": time.Now(), "amount": 100.0,
+		"organization": bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}, "account": bson.M{"_id": selfTestID(20)},
+	}}}
+	m, dir := newOutputMigrator(t, source, Options{IDFormat: idFormatUUID})
+	if _, err := m.migratePayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rows := outputRows(t, m, dir, "payments")
+	if len(rows) != 1 {
+		t.Fatalf("wrote %d payments, expected 1", len(rows))
+	}
+	for column, id := range map[string]primitive.ObjectID{"id": selfTestID(60), "organization_id": selfTestID(10), "account_id": selfTestID(20)} {
+		if want := formatRowID(idFormatUUID, id); rows[0][column] != want {
+			t.Errorf("%s is %v, expected %s", column, rows[0][column], want)
+		}
+	}
+}
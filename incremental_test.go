@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestApplyWatermarkCountsUndatedDocuments(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var logs bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	m, _ := newDryRunMigrator(t, shardedCharges(), Options{Incremental: true})
+	filter := bson.M{}
+	if err := m.applyWatermark(context.Background(), "charges", "charges", filter); err != nil {
+		t.Fatal(err)
+	}
+	newest := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	if window, _ := filter["created_at"].(bson.M); window == nil || !window["$lte"].(time.Time).Equal(newest) {
+		t.Errorf("filter is %v, expected created_at up to %v", filter, newest)
+	}
+	if !strings.Contains(logs.String(), `msg="documents without created_at are not migrated by -incremental" collection=charges documents=1`) {
+		t.Errorf("the undated charge was not reported:\n%s", logs.String())
+	}
+}
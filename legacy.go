@@ -0,0 +1,90 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// legacyShape converts a root field stored in an older shape into its current shape.
+// It reports false when the value is not in the legacy shape it handles.
+type legacyShape func(value bson.RawValue) (interface{}, bool)
+
+// referenceByID upgrades a bare ObjectID (or its hex string) to an embedded document
+// holding it under key
+func referenceByID(key string) legacyShape {
+	return func(value bson.RawValue) (interface{}, bool) {
+		switch value.Type {
+		case bson.TypeObjectID:
+			return bson.D{{Key: key, Value: value.ObjectID()}}, true
+		case bson.TypeString:
+			id, err := primitive.ObjectIDFromHex(value.StringValue())
+			if err != nil {
+				return nil, false
+			}
+			return bson.D{{Key: key, Value: id}}, true
+		}
+		return nil, false
+	}
+}
+
+// stringAs upgrades a bare string to an embedded document holding it under key
+func stringAs(key string) legacyShape {
+	return func(value bson.RawValue) (interface{}, bool) {
+		if value.Type != bson.TypeString {
+			return nil, false
+		}
+		return bson.D{{Key: key, Value: value.StringValue()}}, true
+	}
+}
+
+// legacyShapes lists the root fields whose type changed over the collections' history
+var legacyShapes = map[string]legacyShape{
+	"organization":        referenceByID("_id"),
+	"package":             referenceByID("_id"),
+	"account":             referenceByID("_id"),
+	"payer_organization":  referenceByID("id"),
+	"target_organization": referenceByID("id"),
+	"service":             stringAs("code"),
+	"offer_info":          stringAs("number"),
+}
+
+// decodeDocument decodes doc into v. When the typed decode fails, known fields stored
+// in a legacy shape are rewritten into the current shape and the decode is retried, so
+// collections with historical type changes migrate fully. The original error is
+// returned if no legacy field applies or the retry fails as well.
+func decodeDocument(doc bson.Raw, v interface{}) error {
+	err := bson.Unmarshal(doc, v)
+	if err == nil {
+		return nil
+	}
+
+	elements, elemErr := doc.Elements()
+	if elemErr != nil {
+		return err
+	}
+	upgraded := make(bson.D, 0, len(elements))
+	changed := false
+	for _, element := range elements {
+		key, value := element.Key(), element.Value()
+		if shape, ok := legacyShapes[key]; ok {
+			if current, ok := shape(value); ok {
+				upgraded = append(upgraded, bson.E{Key: key, Value: current})
+				changed = true
+				continue
+			}
+		}
+		upgraded = append(upgraded, bson.E{Key: key, Value: value})
+	}
+	if !changed {
+		return err
+	}
+
+	raw, marshalErr := bson.Marshal(upgraded)
+	if marshalErr != nil {
+		return err
+	}
+	if retryErr := bson.Unmarshal(raw, v); retryErr != nil {
+		return err
+	}
+	return nil
+}
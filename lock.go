@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"migrate-tool/models"
+	"time"
+)
+
+// acquireMigrationLock takes the advisory lock name on a dedicated connection, waiting
+// up to timeout for a concurrent run to release it (a negative timeout waits forever).
+// The lock lives as long as the connection, so it is also released when the process
+// dies; the returned function releases it explicitly.
+func acquireMigrationLock(ctx context.Context, db models.Database, name string, timeout time.Duration) (func(), error) {
+	sqlDB, err := db.GetDB().DB()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	acquire, release := mysqlLock(conn, name, timeout)
+	if db.GetDB().Dialector.Name() == models.DriverPostgres {
+		acquire, release = postgresLock(conn, name, timeout)
+	}
+	if err := acquire(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return func() {
+		if err := release(context.Background()); err != nil {
+			slog.Warn("could not release migration lock", "lock", name, "error", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+type lockFunc func(ctx context.Context) error
+
+// mysqlLock uses GET_LOCK, which waits for whole seconds
+func mysqlLock(conn *sql.Conn, name string, timeout time.Duration) (acquire, release lockFunc) {
+	acquire = func(ctx context.Context) error {
+		seconds := int(timeout.Seconds())
+		if timeout < 0 {
+			seconds = -1
+		}
+		var acquired sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, seconds).Scan(&acquired); err != nil {
+			return err
+		}
+		if !acquired.Valid || acquired.Int64 != 1 {
+			return fmt.Errorf("lock %q is held by another migration (waited %s)", name, timeout)
+		}
+		return nil
+	}
+	release = func(ctx context.Context) error {
+		_, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+		return err
+	}
+	return acquire, release
+}
+
+// postgresLock uses a session advisory lock keyed by the hash of name; the wait is
+// bounded by lock_timeout
+func postgresLock(conn *sql.Conn, name string, timeout time.Duration) (acquire, release lockFunc) {
+	acquire = func(ctx context.Context) error {
+		if timeout == 0 {
+			var acquired bool
+			if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&acquired); err != nil {
+				return err
+			}
+			if !acquired {
+				return fmt.Errorf("lock %q is held by another migration", name)
+			}
+			return nil
+		}
+
+		wait := timeout.Milliseconds()
+		if timeout < 0 {
+			wait = 0
+		}
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET lock_timeout = %d", wait)); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), "RESET lock_timeout")
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext($1))", name); err != nil {
+			return fmt.Errorf("lock %q is held by another migration (waited %s): %w", name, timeout, err)
+		}
+		return nil
+	}
+	release = func(ctx context.Context) error {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", name)
+		return err
+	}
+	return acquire, release
+}
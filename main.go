@@ -2,10 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math"
 	"migrate-tool/models"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,83 +25,442 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"gorm.io/gorm/clause"
 )
 
-const (
-	EDIInvoiceType                 = 1
-	EDIReturnInvoiceType           = 2
-	EDIAttorneyType                = 3
-	RoamingInvoiceType             = 4
-	RoamingHybridInvoiceType       = 5
-	RoamingConstructionInvoiceType = 6
-	RoamingWaybillType             = 7
-	RoamingContractType            = 8
-	RoamingEmpowermentType         = 9
-	RoamingVerificationActType     = 10
-	RoamingActType                 = 11
-	RoamingWaybillV2Type           = 12
-	FreeFormDocumentType           = 13
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
+// versionString describes the build printed by -version and logged by every run
+func versionString() string {
+	return fmt.Sprintf("migrate-tool %s (commit %s, built %s)", version, commit, buildDate)
+}
+
 func main() {
+	// A missing .env is fine: every setting can also come from flags or the environment
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fatal("error loading .env file", "error", err)
+	}
+
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	switch name {
+	case "-version", "--version", "version":
+		fmt.Println(versionString())
+		return
+	case "-h", "-help", "--help", "help":
+		usage(os.Stderr)
+		return
+	}
+	if strings.HasPrefix(name, "-") {
+		slog.Warn("no command given, running migrate; name it explicitly as in migrate-tool migrate " + name)
+	}
+	if c, args, ok := findCommand(os.Args[1:]); ok {
+		c.run(newFlagSet(c), args)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
 
-	err := godotenv.Load()
+// runMigrate creates the target tables and migrates the selected collections, then
+// reconciles the counts. Its -self-test, -dump-mapping, -export-schema-sql,
+// -timezone-audit and -diff modes exit before migrating.
+func runMigrate(fs *flag.FlagSet, args []string) {
+	var common commonFlags
+	common.register(fs)
+	var opts Options
+	var mapping mappingFlags
+	mapping.register(fs, &opts)
+	var lock lockFlags
+	lock.register(fs)
+	mysqlEngine := fs.String("mysql-engine", getEnv("MYSQL_ENGINE", ""),
+		"table options for created MySQL tables, e.g. \"InnoDB\" or \"ENGINE=InnoDB ROW_FORMAT=DYNAMIC\"")
+	idCollation := fs.String("id-collation", getEnv("MYSQL_ID_COLLATION", ""),
+		"collation of every id and *_id column, e.g. utf8mb4_bin or utf8mb4_general_ci (default: table default)")
+	autoDedupe := fs.Bool("auto-dedupe", false,
+		"when a unique index is added to a kept table holding duplicate keys, delete the duplicates keeping the row with the lowest id (default: report them and abort)")
+	withFKs := fs.Bool("with-fks", false,
+		"add foreign keys from the child tables (demo uses, package items, bonus packages, bought package items) to their parents")
+	createDB := fs.Bool("create-db", false, "create the MySQL database (utf8mb4) when it does not exist")
+	pprofAddr := fs.String("pprof-addr", "", "serve net/http/pprof at http://<addr>/debug/pprof/ during the migration, e.g. localhost:6060")
+	cpuProfile := fs.String("cpuprofile", "", "write a CPU profile of the migration to this file")
+	memProfile := fs.String("memprofile", "", "write a heap profile to this file when the migration ends")
+	metricsAddr := fs.String("metrics-addr", "", "serve Prometheus metrics at http://<addr>/metrics during the migration, e.g. :9090")
+	exportSchemaPath := fs.String("export-schema-sql", "", "write the CREATE TABLE statements for all models to this file (- for stdout) and exit")
+	trackPresence := fs.String("track-presence", "",
+		"comma-separated collection.field list whose null vs missing state is recorded in field_presence, e.g. organizations.inn")
+	dedupSpec := fs.String("dedup-keys", "",
+		"per-collection columns used to detect existing records, e.g. charges=organization_id+type+object_id (default: id)")
+	tzAuditSample := fs.Int64("timezone-audit", 0,
+		"print a created_at timezone conversion audit for this many documents per collection and exit")
+	fs.BoolVar(&opts.AutoMigrate, "auto-migrate", false,
+		"with -preserve-tables, add model columns missing from the existing tables instead of aborting; also creates a missing table a migration needs")
+	preserveTables := fs.Bool("preserve-tables", false,
+		"keep existing target tables and their extra columns instead of dropping and recreating them")
+	selfTestOnly := fs.Bool("self-test", false,
+		"migrate a built-in set of canned documents to JSONL files, check the rows and exit; needs neither MongoDB nor a target database")
+	dumpMappingPath := fs.String("dump-mapping", "", "write the source field to target column mapping as JSON to this file (- for stdout) and exit")
+	fs.BoolVar(&opts.DedupeInn, "dedupe-inn", false,
+		"report organizations sharing a non-empty INN with an earlier organization (they are still migrated)")
+	fs.BoolVar(&opts.Reconcile, "reconcile", false,
+		"after migrating, report organizations whose total_payments or credit_amount differ from their payments and credit updates")
+	fs.Float64Var(&opts.ReconcileTolerance, "reconcile-tolerance", 0.01, "largest difference -reconcile accepts between a stored and a derived total")
+	fs.BoolVar(&opts.Incremental, "incremental", false,
+		"only migrate documents created after the watermark of their collection in sync_state, then advance it (implies -preserve-tables; bought packages, which have no created_at, are skipped, and so are other documents without one, whose count is logged)")
+	fs.BoolVar(&opts.CheckRefs, "check-refs", false,
+		"check per batch that referenced organizations, packages, bought packages and payments exist before inserting")
+	fs.StringVar(&opts.OnOrphan, "on-orphan", onOrphanSkip,
+		"what -check-refs does with rows referencing a missing parent: skip or quarantine (keep them in orphan_records)")
+	fs.IntVar(&opts.RateLimit, "rate-limit", 0, "maximum number of records written to MySQL per second (0 = unlimited)")
+	conflictSpec := fs.String("conflict-columns", "",
+		"per-collection unique columns used as the insert conflict target, e.g. charges=organization_id+type+object_id (default: id)")
+	fs.StringVar(&opts.OnConflict, "on-conflict", onConflictSkip,
+		"what happens to parent rows that already exist: skip, or update (upsert them with the mapped values, counted as moved; rows whose row_hash matches are left unchanged)")
+	fs.Int64Var(&opts.Limit, "limit", 0,
+		"migrate at most this many documents per collection, for a quick end-to-end check (0 = all); combine with -output to write nothing")
+	fs.IntVar(&opts.BatchSize, "batch-size", defaultBatchSize, "number of rows inserted per batch")
+	fs.DurationVar(&opts.CommitInterval, "commit-interval", 0,
+		"also flush a batch that has been filling for this long, e.g. 30s, so slow collections commit and checkpoint regularly (0 = only full batches)")
+	fs.IntVar(&opts.TransformWorkers, "transform-workers", 1,
+		"goroutines decoding and transforming charges documents while one reads the cursor and one writes in source order")
+	fs.IntVar(&opts.Shards, "shards", 1,
+		"split charges into this many created_at ranges migrated concurrently, each with its own cursor and batches (cannot be combined with -tx-per-collection or -checkpoint-file; -limit applies per shard)")
+	mongoBatchSize := fs.Int("mongo-batch-size", 0,
+		"documents fetched from MongoDB per cursor round trip (0 = server default); independent of -batch-size, which sets the rows per insert")
+	fs.Int64Var(&opts.ProgressEvery, "progress-every", defaultProgressEvery,
+		"log processed/total, rate and ETA every this many documents read per collection (0 = off)")
+	fs.BoolVar(&opts.TxPerCollection, "tx-per-collection", false,
+		"migrate each collection in a single transaction that is rolled back on error (needs enough undo space for the largest collection)")
+	fs.BoolVar(&opts.ContinueOnError, "continue-on-error", false,
+		"when a migration fails, log it and run the remaining ones, skipping those that depend on it; the run still exits nonzero")
+	fs.DurationVar(&opts.CollectionTimeout, "collection-timeout", 0,
+		"abort a migration running longer than this, e.g. 30m (0 = no limit); with -skip-errors the run continues without it and its dependents, and still exits nonzero")
+	summaryFile := fs.String("summary-file", "",
+		"write a JSON summary of the run (per table source, moved, skipped, failed, dest_after and duration_ms, plus totals) to this file")
+	fs.StringVar(&opts.CheckpointFile, "checkpoint-file", "",
+		"JSON file recording the last migrated _id and counters per collection; an interrupted run resumes from it")
+	checkpointEvery := fs.String("checkpoint-interval", defaultCheckpointInterval,
+		"write the -checkpoint-file after this many records, e.g. 5000, or this much time, e.g. 30s; smaller values redo less work after a crash at the cost of more writes")
+	fs.BoolVar(&opts.Restart, "restart", false, "ignore an existing -checkpoint-file and migrate every collection from the start")
+	fs.BoolVar(&opts.OutputErrorsToMySQL, "output-errors-to-mysql", false,
+		"record failed records (collection, id, error, timestamp) in the migration_errors table")
+	fs.BoolVar(&opts.SkipErrors, "skip-errors", false,
+		"quarantine documents that fail to decode or insert in migration_errors and continue instead of aborting")
+	fs.StringVar(&opts.Output, "output", "",
+		"write the mapped rows to <table>.jsonl files in this directory instead of the target database (no database server is used)")
+	verifySample := fs.Int("verify", 0,
+		"after migrating, map this many random documents per collection again and compare every column with the migrated row (0 = off)")
+	verifyMaxMismatches := fs.Int("verify-max-mismatches", 0, "number of mismatched rows -verify tolerates before exiting with status 4")
+	diffOnly := fs.Bool("diff", false,
+		"map every document like the migration would and log the columns where rows already in the target differ, then print the identical, divergent and new rows per collection and exit without writing")
+	orphanScan := fs.Bool("scan-orphans", false,
+		"after migrating, report the rows of every table whose foreign key points at a missing parent, with a few example ids (nothing is deleted)")
+	fs.Parse(args)
+	common.setup(fs)
+	mapping.apply(&opts, &common)
+	lock.check(&common)
+
+	var err error
+	if opts.DedupKeys, err = parseDedupKeys(*dedupSpec); err != nil {
+		fatal("invalid -dedup-keys", "error", err)
+	}
+	if opts.ConflictColumns, err = parseDedupKeys(*conflictSpec); err != nil {
+		fatal("invalid -conflict-columns", "error", err)
+	}
+	opts.PresenceFields = parsePresenceFields(*trackPresence)
+	if opts.Limit < 0 {
+		fatal("invalid -limit", "value", opts.Limit)
+	}
+	if opts.CommitInterval < 0 {
+		fatal("invalid -commit-interval", "value", opts.CommitInterval)
+	}
+	interval, err := parseCheckpointInterval(*checkpointEvery)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("invalid -checkpoint-interval", "error", err)
+	}
+	opts.CheckpointInterval = interval
+	if opts.CollectionTimeout < 0 {
+		fatal("invalid -collection-timeout", "value", opts.CollectionTimeout)
+	}
+	if *mongoBatchSize < 0 || *mongoBatchSize > math.MaxInt32 {
+		fatal("invalid -mongo-batch-size", "value", *mongoBatchSize)
+	}
+	opts.MongoBatchSize = int32(*mongoBatchSize)
+	if reason := keepTablesReason(opts); reason != "" && !*preserveTables {
+		slog.Info("keeping existing tables since " + reason)
+		*preserveTables = true
+	}
+
+	if *selfTestOnly {
+		if err := selfTest(context.Background()); err != nil {
+			fatal("self-test failed", "error", err)
+		}
+		slog.Info("self-test passed")
+		return
 	}
 
-	// Flags
-	mongoURI := os.Getenv("MONGO_URI")
-	mongoDBName := os.Getenv("MONGO_DB")
-	mysqlUser := os.Getenv("MYSQL_USER")
-	mysqlPass := os.Getenv("MYSQL_PASS")
-	mysqlAddr := os.Getenv("MYSQL_ADDR")
-	mysqlDBName := os.Getenv("MYSQL_DB")
-	tz := os.Getenv("TZ")
+	if *dumpMappingPath != "" {
+		if err := writeMapping(*dumpMappingPath); err != nil {
+			fatal("failed to dump mapping", "error", err)
+		}
+		return
+	}
+
+	if *exportSchemaPath != "" {
+		if err := exportSchemaSQL(*exportSchemaPath, *mysqlEngine, *idCollation, opts.MoneyAsDecimal); err != nil {
+			fatal("failed to export schema", "error", err)
+		}
+		slog.Info("schema written", "path", *exportSchemaPath)
+		return
+	}
 
 	// Validate required parameters
-	if mongoURI == "" {
-		log.Fatal("MongoDB URI is required")
+	if opts.OnConflict != onConflictSkip && opts.OnConflict != onConflictUpdate {
+		fatal("invalid -on-conflict, expected "+onConflictSkip+" or "+onConflictUpdate, "value", opts.OnConflict)
+	}
+	if opts.OnOrphan != onOrphanSkip && opts.OnOrphan != onOrphanQuarantine {
+		fatal("invalid -on-orphan, expected "+onOrphanSkip+" or "+onOrphanQuarantine, "value", opts.OnOrphan)
+	}
+	if opts.Output != "" && (opts.TxPerCollection || opts.CheckpointFile != "") {
+		fatal("-output cannot be combined with -tx-per-collection or -checkpoint-file")
+	}
+	if opts.Shards < 1 {
+		fatal("-shards must be at least 1", "value", opts.Shards)
+	}
+	if opts.Shards > 1 && (opts.TxPerCollection || opts.CheckpointFile != "") {
+		fatal("-shards cannot be combined with -tx-per-collection or -checkpoint-file")
+	}
+	if opts.Output != "" && opts.Incremental {
+		fatal("-output cannot be combined with -incremental, whose watermarks are stored in the target database")
+	}
+
+	slog.Info("starting migration", "mongo_db", common.mongoDB, "mysql_user", common.mysqlUser, "mysql_addr", common.mysqlAddr, "mysql_db", common.mysqlDB)
+
+	mdb, disconnect := common.connectMongo()
+	defer disconnect()
+
+	targetConfig := common.targetConfig()
+	targetConfig.Engine = *mysqlEngine
+	targetConfig.IDCollation = *idCollation
+	targetConfig.WithFKs = *withFKs
+	targetConfig.MoneyAsDecimal = opts.MoneyAsDecimal
+	targetConfig.AutoDedupe = *autoDedupe
+	targetConfig.CreateDB = *createDB
+	if opts.Output != "" {
+		if err := exportJSONL(mdb, targetConfig, opts); err != nil {
+			fatal("export failed", "error", err)
+		}
+		slog.Info("export completed successfully", "output", opts.Output)
+		return
+	}
+	mysql := common.connectTarget(targetConfig)
+
+	if *tzAuditSample > 0 {
+		if err := timezoneAudit(context.Background(), mdb, mysql, opts, common.tz, *tzAuditSample); err != nil {
+			fatal("timezone audit failed", "error", err)
+		}
+		return
+	}
+
+	if *diffOnly {
+		if err := diff(context.Background(), mdb, mysql, opts); err != nil {
+			fatal("diff failed", "error", err)
+		}
+		return
 	}
-	if mysqlPass == "" {
-		log.Fatal("MySQL password is required")
+
+	release := lock.acquire(&common, mysql)
+	defer release()
+
+	// Kept tables must already have every model column, unless -auto-migrate may add them
+	if *preserveTables {
+		diff, err := mysql.ValidateSchema()
+		for _, column := range diff.ExtraColumns {
+			slog.Warn("column not in the models is kept", "column", column)
+		}
+		var mismatch *models.SchemaMismatchError
+		if errors.As(err, &mismatch) && opts.AutoMigrate {
+			slog.Info("adding missing columns", "columns", strings.Join(mismatch.Missing, ", "))
+		} else if err != nil {
+			fatal("target schema does not match the models, rerun with -auto-migrate to add the missing columns", "error", err)
+		}
 	}
 
-	log.Printf("Starting migration from MongoDB (%s/%s) to MySQL (%s@%s/%s)",
-		mongoURI, mongoDBName, mysqlUser, mysqlAddr, mysqlDBName)
+	// Run migrations
+	if err := mysql.Migrate(!*preserveTables); err != nil {
+		fatal("failed to run migrations", "error", err)
+	}
 
-	// Connect to MongoDB
-	mongoClient, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongoURI))
+	// Migrate data. On SIGINT/SIGTERM the current batch is finished and the run stops.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	migrator := NewMigratorWithClients(mdb, mysql, opts)
+	stopMetrics := func() {}
+	if *metricsAddr != "" {
+		stopMetrics = serveMetrics(*metricsAddr, migrator.metrics)
+	}
+	stopProfiling, err := startProfiling(*pprofAddr, *cpuProfile, *memProfile)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		fatal("failed to start profiling", "error", err)
+	}
+	err = migrator.Run(ctx)
+	stopMetrics()
+	stopProfiling()
+	if err := migrator.summary.print(os.Stdout); err != nil {
+		slog.Warn("could not print summary", "error", err)
 	}
-	defer func() {
-		if err = mongoClient.Disconnect(context.TODO()); err != nil {
-			log.Printf("Error disconnecting from MongoDB: %v", err)
+	if *summaryFile != "" {
+		if err := migrator.summary.write(*summaryFile, err); err != nil {
+			slog.Error("could not write summary", "path", *summaryFile, "error", err)
 		}
-	}()
-
-	mdb := mongoClient.Database(mongoDBName)
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			fatal("migration interrupted", "error", err)
+		}
+		// The counts show how far the failed steps got, e.g. a cursor that died midway
+		if _, err := reconcile(ctx, mdb, mysql, opts.Collections, migrator.reconcileScope()); err != nil {
+			slog.Warn("reconciliation failed", "error", err)
+		}
+		fatal("migration failed", "error", err)
+	}
 
-	// Connect to MySQL
-	mysql, err := models.NewDatabase(mysqlUser, mysqlPass, mysqlAddr, mysqlDBName, tz)
+	matched, err := reconcile(ctx, mdb, mysql, opts.Collections, migrator.reconcileScope())
 	if err != nil {
-		log.Fatalf("Failed to connect to MySQL: %v", err)
+		fatal("reconciliation failed", "error", err)
+	}
+	if reason := partialCountsReason(opts); !matched && reason != "" {
+		slog.Warn("row counts differ from the source, expected " + reason)
+	} else if !matched {
+		slog.Error("migration completed but row counts differ from the source")
+		os.Exit(exitCountMismatch)
 	}
 
-	// Run migrations
-	if err := mysql.Migrate(); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+	if *verifySample > 0 {
+		mismatched, err := verify(ctx, mdb, mysql, opts, *verifySample)
+		if err != nil {
+			fatal("verification failed", "error", err)
+		}
+		if mismatched > *verifyMaxMismatches {
+			slog.Error("migrated rows differ from their source documents", "mismatched", mismatched, "allowed", *verifyMaxMismatches)
+			os.Exit(exitVerifyMismatch)
+		}
 	}
 
-	// Migrate data
-	ctx := context.Background()
-	if err := migrateAll(ctx, mdb, mysql); err != nil {
-		log.Fatalf("Migration failed: %v", err)
+	if *orphanScan {
+		if err := scanOrphans(ctx, mysql); err != nil {
+			fatal("orphan scan failed", "error", err)
+		}
 	}
 
-	log.Println("Migration completed successfully!")
+	slog.Info("migration completed successfully")
+}
+
+// readPreferences are the accepted -mongo-read-preference values
+var readPreferences = []readpref.Mode{
+	readpref.PrimaryMode,
+	readpref.PrimaryPreferredMode,
+	readpref.SecondaryMode,
+	readpref.SecondaryPreferredMode,
+	readpref.NearestMode,
+}
+
+// parseReadPreference returns the read preference named mode
+func parseReadPreference(mode string) (*readpref.ReadPref, error) {
+	names := make([]string, len(readPreferences))
+	for i, m := range readPreferences {
+		if m.String() == mode {
+			return readpref.New(m)
+		}
+		names[i] = m.String()
+	}
+	return nil, fmt.Errorf("invalid read preference %q, expected one of %s", mode, strings.Join(names, ", "))
+}
+
+// mongoClientOptions layers the TLS, auth source, read preference and timeout flags
+// onto the options parsed from uri. Settings given in the URI are kept unless a flag
+// overrides them.
+func mongoClientOptions(uri string, useTLS bool, caFile, authSource, readPreference string, connectTimeout time.Duration) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(uri).
+		SetConnectTimeout(connectTimeout).
+		SetServerSelectionTimeout(connectTimeout)
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file %s contains no valid PEM certificates", caFile)
+		}
+		opts.SetTLSConfig(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12})
+	} else if useTLS {
+		opts.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+
+	if authSource != "" {
+		if opts.Auth == nil {
+			return nil, fmt.Errorf("-mongo-auth-source needs credentials in the MongoDB URI")
+		}
+		opts.Auth.AuthSource = authSource
+	}
+
+	if readPreference != "" {
+		rp, err := parseReadPreference(readPreference)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetReadPreference(rp)
+	}
+	return opts, opts.Validate()
+}
+
+// childRowID derives the id of a child row from its parent id and item code, so a
+// re-run produces the same id and the insert conflict drops the duplicate
+func childRowID(parentID string, code int) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("%s/%d", parentID, code))).String()
+}
+
+// parseEnumLabels parses comma-separated value=label pairs on top of
+// models.PaymentMethods
+func parseEnumLabels(spec string) (map[int]string, error) {
+	labels := make(map[int]string, len(models.PaymentMethods))
+	for value, label := range models.PaymentMethods {
+		labels[value] = label
+	}
+	for _, entry := range splitList(spec) {
+		value, label, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || strings.TrimSpace(label) == "" {
+			return nil, fmt.Errorf("expected number=label, got %q", entry)
+		}
+		labels[n] = strings.TrimSpace(label)
+	}
+	return labels, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(spec string) []string {
+	var values []string
+	for _, value := range strings.Split(spec, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
 
 func getEnv(key, defaultValue string) string {
@@ -100,40 +470,43 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func migrateAll(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	// Migrate in dependency order
-	migrations := []struct {
-		name string
-		fn   func(context.Context, *mongo.Database, models.Database) error
-	}{
-		{"services", migrateServices},
-		{"organizations", migrateOrganizations},
-		{"packages", migratePackages},
-		{"bought-packages", migrateBoughtPackages},
-		{"charges", migrateCharges},
-		{"payments", migratePayments},
-		{"payme-transactions", migratePaymeTransactions},
-		{"organization-balance-bindings", migrateOrganizationBalanceBindings},
-		{"credit-updates", migrateCreditUpdates},
-		{"bank-payments-auto-apply-errors", migrateBankPaymentAutoApplyErrors},
-		{"bought-package-is-auto-extend-column", migrateBoughtPackageIsAutoExtendColumn},
-	}
-
-	for _, migration := range migrations {
-		log.Printf("\n\nStarting migration: %s", migration.name)
-		if err := migration.fn(ctx, mdb, mysql); err != nil {
-			return fmt.Errorf("migration %s failed: %w", migration.name, err)
-		}
-		log.Printf("Completed migration: %s", migration.name)
-	}
-
-	return nil
+// exportSchemaSQL writes the DDL of every model to path, or to stdout for "-", without
+// touching a database
+func exportSchemaSQL(path, engine, idCollation string, moneyDecimal bool) error {
+	if path == "-" {
+		return models.ExportSchema(os.Stdout, engine, idCollation, moneyDecimal)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := models.ExportSchema(f, engine, idCollation, moneyDecimal); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-func mongoCount(ctx context.Context, db *mongo.Database, collection string) int64 {
-	count, err := db.Collection(collection).CountDocuments(ctx, bson.M{})
+// writeMapping writes the field mapping spec to path, or to stdout for "-"
+func writeMapping(path string) error {
+	if path == "-" {
+		return dumpMapping(os.Stdout)
+	}
+	f, err := os.Create(path)
 	if err != nil {
-		log.Printf("WARNING: Could not count %s: %v", collection, err)
+		return err
+	}
+	if err := dumpMapping(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func mongoCount(ctx context.Context, coll sourceCollection) int64 {
+	count, err := coll.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		slog.Warn("could not count", "collection", coll.Name(), "error", err)
 		return 0
 	}
 	return count
@@ -142,7 +515,7 @@ func mongoCount(ctx context.Context, db *mongo.Database, collection string) int6
 func mysqlCount(db models.Database, table string) int64 {
 	var count int64
 	if err := db.GetDB().Table(table).Count(&count).Error; err != nil {
-		log.Printf("WARNING: Could not count %s: %v", table, err)
+		slog.Warn("could not count", "table", table, "error", err)
 		return 0
 	}
 	return count
@@ -152,247 +525,377 @@ func mysqlCount(db models.Database, table string) int64 {
 func checkRecordExists(db models.Database, table, id string) bool {
 	var count int64
 	if err := db.GetDB().Table(table).Where("id = ?", id).Count(&count).Error; err != nil {
-		log.Printf("WARNING: Could not check existence of %s with id %s: %v", table, id, err)
+		slog.Warn("could not check existence", "table", table, "id", id, "error", err)
 		return false
 	}
 	return count > 0
 }
 
-// validateDateTime validates and fixes datetime values for MySQL compatibility
-func validateDateTime(t time.Time) *time.Time {
-	// Check for zero time or invalid dates
-	if t.IsZero() || t.Year() < 1970 || t.Year() > 2100 || t.Year() == 0 {
-		return nil
+// existingDemoUseCodes returns the service codes already migrated per organization
+func existingDemoUseCodes(db models.Database, orgIDs map[string]bool) (map[string]map[string]bool, error) {
+	migrated := make(map[string]map[string]bool)
+	if len(orgIDs) == 0 {
+		return migrated, nil
+	}
+	ids := make([]string, 0, len(orgIDs))
+	for id := range orgIDs {
+		ids = append(ids, id)
+	}
+
+	var rows []models.OrganizationServiceDemoUses
+	if err := db.GetDB().Table((&models.OrganizationServiceDemoUses{}).TableName()).
+		Select("organization_id, service_code").Where("organization_id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("could not load service demo uses: %w", err)
+	}
+	for _, row := range rows {
+		if migrated[row.OrganizationId] == nil {
+			migrated[row.OrganizationId] = make(map[string]bool)
+		}
+		migrated[row.OrganizationId][row.ServiceCode] = true
+	}
+	return migrated, nil
+}
+
+// createdAtOrObjectID returns createdAt, or the creation time encoded in id when
+// the document has no created_at
+func createdAtOrObjectID(createdAt time.Time, id primitive.ObjectID) time.Time {
+	if createdAt.IsZero() {
+		return id.Timestamp()
 	}
-	return &t
+	return createdAt
 }
 
-func migrateServices(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("services")
-	srcCount := mongoCount(ctx, mdb, "services")
-	dstBefore := mysqlCount(mysql, (&models.Service{}).TableName())
-	log.Printf("[services] mongo=%d mysql_before=%d", srcCount, dstBefore)
+func (m *Migrator) migrateServices(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("services")
+	if err := checkCollectionShape(ctx, coll, "name", "code"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.Service{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.Service{}).TableName())
+	slog.Info("starting", "collection", "services", "mongo", srcCount, "mysql_before", dstBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := m.find(ctx, "services", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
 	}
-	defer cur.Close(ctx)
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	services := newBatch[models.Service](m, db, "services", (&models.Service{}).TableName())
+	progress := m.newProgress("services", srcCount)
+	flushDue := func() error {
+		if services.full() {
+			return services.save()
+		}
+		return nil
+	}
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("services", cur.Current) {
+			continue
+		}
 
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	for cur.Next(ctx) {
 		var s models.MongoService
-		if err := cur.Decode(&s); err != nil {
-			log.Printf("ERROR decode service: %v", err)
-			return err
+		if err := decodeDocument(cur.Current, &s); err != nil {
+			m.decodeFailed("services", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
 		}
 
-		serviceID := s.ID.Hex()
-
-		// Check if service already exists in MySQL
-		if checkRecordExists(mysql, (&models.Service{}).TableName(), serviceID) {
-			skipped++
-			continue
-		}
+		serviceID := m.rowID(s.ID)
 
 		service := models.Service{
 			ID:        serviceID,
-			CreatedAt: s.CreatedAt,
+			CreatedAt: createdAtOrObjectID(s.CreatedAt, s.ID),
 			Name:      s.Name,
 			Code:      s.Code,
 		}
 
-		if err := db.Create(&service).Error; err != nil {
-			log.Printf("ERROR insert service %s: %v", serviceID, err)
-			return fmt.Errorf("service %s insert failed: %w", serviceID, err)
+		services.add(serviceID, service, cur.Current)
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
 		}
-		moved++
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := services.save(); err != nil {
+		return CollectionStats{}, err
 	}
 
-	dstAfter := mysqlCount(mysql, (&models.Service{}).TableName())
-	log.Printf("[services] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.Service{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "services", Table: (&models.Service{}).TableName(), Source: srcCount,
+		Moved: services.moved, Skipped: services.skipped, Updated: services.updated, Unchanged: services.unchanged, Failed: m.failed["services"], DestAfter: dstAfter})
+	return stats, cursorErr(ctx, cur, "services")
 }
 
-func migrateOrganizations(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("organizations")
-	srcCount := mongoCount(ctx, mdb, "organizations")
-	dstBefore := mysqlCount(mysql, (&models.Organization{}).TableName())
-	demoUsesBefore := mysqlCount(mysql, (&models.OrganizationServiceDemoUses{}).TableName())
-	log.Printf("[organizations] mongo=%d mysql_before=%d", srcCount, dstBefore)
-	log.Printf("[service_demo_uses] mysql_before=%d", demoUsesBefore)
+func (m *Migrator) migrateOrganizations(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("organizations")
+	if err := checkCollectionShape(ctx, coll, "created_at", "name"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.Organization{}, &models.OrganizationServiceDemoUses{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.Organization{}).TableName())
+	demoUsesBefore := mysqlCount(m.mysql, (&models.OrganizationServiceDemoUses{}).TableName())
+	slog.Info("starting", "collection", "organizations", "mongo", srcCount, "mysql_before", dstBefore)
+	slog.Info("starting", "collection", "service_demo_uses", "mysql_before", demoUsesBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := m.find(ctx, "organizations", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
 	}
-	defer cur.Close(ctx)
+	defer cur.Close(context.WithoutCancel(ctx))
 
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
+	db := m.mysql.GetDB()
+	orgs := newBatch[models.Organization](m, db, "organizations", (&models.Organization{}).TableName())
+	demoUses := childRows[models.OrganizationServiceDemoUses]{
+		conflict: []clause.Column{{Name: "organization_id"}, {Name: "service_code"}},
+	}
 	demoUsesMoved := 0
-	for cur.Next(ctx) {
-		var o models.MongoOrganization
-		if err := cur.Decode(&o); err != nil {
-			log.Printf("ERROR decode organization: %v", err)
+	demoUsesSkipped := 0
+	merged, mergedDemoUses := 0, 0
+	queuedDemoUses := make(map[string]bool)
+	var inns *innIndex
+	if m.opts.DedupeInn {
+		inns = newInnIndex()
+	}
+	flush := func() error {
+		_, existing, err := orgs.flush()
+		if err != nil {
 			return err
 		}
-
-		orgID := o.ID.Hex()
-
-		// Check if organization already exists in MySQL
-		if checkRecordExists(mysql, (&models.Organization{}).TableName(), orgID) {
-			skipped++
-			// Still migrate service demo uses for existing organizations
-			for _, s := range o.ServiceDemoUses {
-				demo := models.OrganizationServiceDemoUses{
-					OrganizationId: orgID,
-					ServiceCode:    s.Code,
-					UsedAt:         o.CreatedAt,
-				}
-				if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&demo).Error; err != nil {
-					log.Printf("ERROR insert service_demo_use org=%s service=%s: %v", orgID, s.Code, err)
-					return fmt.Errorf("org %s service_demo_use %s insert failed: %w", orgID, s.Code, err)
-				}
-				demoUsesMoved++
+		// Existing organizations still get their service demo uses,
+		// skipping the ones a previous run already inserted
+		migratedCodes, err := existingDemoUseCodes(m.mysql, existing)
+		if err != nil {
+			return err
+		}
+		n, ignored, err := demoUses.insert(m, db, func(orgID string, demo models.OrganizationServiceDemoUses) bool {
+			if migratedCodes[orgID][demo.ServiceCode] {
+				demoUsesSkipped++
+				return false
 			}
+			return true
+		})
+		if err != nil {
+			slog.Error("batch insert failed", "table", "service_demo_uses", "error", err)
+			return fmt.Errorf("service_demo_uses batch insert failed: %w", err)
+		}
+		demoUsesMoved += n
+		demoUsesSkipped += ignored
+		return orgs.checkpoint()
+	}
+	progress := m.newProgress("organizations", srcCount)
+	flushDue := func() error {
+		if orgs.full() {
+			return flush()
+		}
+		return nil
+	}
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("organizations", cur.Current) {
 			continue
 		}
 
+		var o models.MongoOrganization
+		if err := decodeDocument(cur.Current, &o); err != nil {
+			m.decodeFailed("organizations", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
+		}
+
+		orgID := m.rowID(o.ID)
+
 		org := models.Organization{
 			ID:        orgID,
-			CreatedAt: o.CreatedAt,
+			CreatedAt: createdAtOrObjectID(o.CreatedAt, o.ID),
 			UpdatedAt: o.UpdatedAt,
 			DeletedAt: func() *time.Time {
 				if o.DeletedAt != nil {
-					return validateDateTime(*o.DeletedAt)
+					return m.opts.Dates.Validate(*o.DeletedAt, "organizations", orgID)
 				}
 				return nil
 			}(),
 			IsDeleted:                    o.IsDeleted,
 			Name:                         o.Name,
-			Inn:                          o.Inn,
-			Pinfl:                        o.Pinfl,
+			Inn:                          normalizeOptional(o.Inn),
+			Pinfl:                        normalizeOptional(o.Pinfl),
 			Balance:                      o.Balance,
 			FiscalizationBalance:         o.FiscalizationBalance,
 			ReservedFiscalizationBalance: o.ReservedFiscalizationBalance,
 			TotalPayments:                o.TotalPayments,
 			CreditAmount:                 o.CreditAmount,
 			OrganizationCode:             o.OrganizationCode,
-			ReferralAgentCode:            o.ReferralAgentCode,
+			ReferralAgentCode:            normalizeOptional(o.ReferralAgentCode),
 			WhiteLabel:                   o.WhiteLabel,
 			OfferNumber:                  o.OfferInfo.Number,
 			OfferDate: func() *time.Time {
 				if o.OfferInfo.Date != nil {
-					return validateDateTime(*o.OfferInfo.Date)
+					return m.opts.Dates.Validate(*o.OfferInfo.Date, "organizations", orgID)
 				}
 				return nil
 			}(),
 		}
 
-		if err := db.Create(&org).Error; err != nil {
-			log.Printf("ERROR insert organization %s: %v", orgID, err)
-			return fmt.Errorf("organization %s insert failed: %w", orgID, err)
+		if org.Inn != nil {
+			if _, err := normalizeInn(*org.Inn); err != nil {
+				// Still migrated, inn has no length limit
+				slog.Warn("invalid inn", "collection", "organizations", "id", orgID, "error", err)
+			}
+		}
+		canonicalID := m.canonicalOrg(orgID)
+		if canonicalID == orgID {
+			inns.add(orgID, org.Inn)
+			orgs.add(orgID, org, cur.Current)
+		} else {
+			merged++
 		}
-
-		// Migrate service demo uses
 		for _, s := range o.ServiceDemoUses {
-			demo := models.OrganizationServiceDemoUses{
-				OrganizationId: orgID,
-				ServiceCode:    s.Code,
-				UsedAt:         o.CreatedAt,
-			}
-			if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&demo).Error; err != nil {
-				log.Printf("ERROR insert service_demo_use org=%s service=%s: %v", orgID, s.Code, err)
-				return fmt.Errorf("org %s service_demo_use %s insert failed: %w", orgID, s.Code, err)
+			// A merged duplicate only contributes the demo uses its canonical organization lacks
+			if m.opts.MergeOrgsByINN {
+				key := canonicalID + "/" + s.Code
+				if queuedDemoUses[key] {
+					mergedDemoUses++
+					continue
+				}
+				queuedDemoUses[key] = true
 			}
-			demoUsesMoved++
+			demoUses.add(canonicalID, models.OrganizationServiceDemoUses{
+				OrganizationId: canonicalID,
+				ServiceCode:    s.Code,
+				UsedAt:         createdAtOrObjectID(o.CreatedAt, o.ID),
+			})
 		}
-
-		moved++
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
+		}
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := flush(); err != nil {
+		return CollectionStats{}, err
 	}
 
-	dstAfter := mysqlCount(mysql, (&models.Organization{}).TableName())
-	demoUsesAfter := mysqlCount(mysql, (&models.OrganizationServiceDemoUses{}).TableName())
-	log.Printf("[organizations] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	log.Printf("[service_demo_uses] moved=%d mysql_after=%d", demoUsesMoved, demoUsesAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.Organization{}).TableName())
+	demoUsesAfter := mysqlCount(m.mysql, (&models.OrganizationServiceDemoUses{}).TableName())
+	if merged > 0 {
+		slog.Info("merged duplicate organizations", "collection", "organizations", "merged", merged)
+	}
+	m.countAdjustments[(&models.Organization{}).TableName()] -= merged
+	m.countAdjustments[(&models.OrganizationServiceDemoUses{}).TableName()] -= mergedDemoUses
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "organizations", Table: (&models.Organization{}).TableName(), Source: srcCount,
+		Moved: orgs.moved, Skipped: orgs.skipped, Updated: orgs.updated, Unchanged: orgs.unchanged, Failed: m.failed["organizations"], DestAfter: dstAfter})
+	inns.report()
+	stats.add(MigrationResult{Collection: "organizations", Table: (&models.OrganizationServiceDemoUses{}).TableName(),
+		Moved: demoUsesMoved, Skipped: demoUsesSkipped, DestAfter: demoUsesAfter})
+	return stats, cursorErr(ctx, cur, "organizations")
 }
 
-func migratePackages(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("packages")
-	srcCount := mongoCount(ctx, mdb, "packages")
-	dstBefore := mysqlCount(mysql, (&models.Package{}).TableName())
-	itemsBefore := mysqlCount(mysql, (&models.PackageItem{}).TableName())
-	bonusBefore := mysqlCount(mysql, (&models.PackageActivationBonusPackage{}).TableName())
-	log.Printf("[packages] mongo=%d mysql_before=%d", srcCount, dstBefore)
-	log.Printf("[package_items] mysql_before=%d", itemsBefore)
-	log.Printf("[package_activation_bonus_packages] mysql_before=%d", bonusBefore)
-
-	cur, err := coll.Find(ctx, bson.M{})
+func (m *Migrator) migratePackages(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("packages")
+	if err := checkCollectionShape(ctx, coll, "created_at", "name", "price"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.Package{}, &models.PackageItem{}, &models.PackageActivationBonusPackage{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.Package{}).TableName())
+	itemsBefore := mysqlCount(m.mysql, (&models.PackageItem{}).TableName())
+	bonusBefore := mysqlCount(m.mysql, (&models.PackageActivationBonusPackage{}).TableName())
+	slog.Info("starting", "collection", "packages", "mongo", srcCount, "mysql_before", dstBefore)
+	slog.Info("starting", "collection", "package_items", "mysql_before", itemsBefore)
+	slog.Info("starting", "collection", "package_activation_bonus_packages", "mysql_before", bonusBefore)
+
+	cur, err := m.find(ctx, "packages", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
 	}
-	defer cur.Close(ctx)
-
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	itemsMoved := 0
-	bonusMoved := 0
-	for cur.Next(ctx) {
-		var p models.MongoPackage
-		if err := cur.Decode(&p); err != nil {
-			log.Printf("ERROR decode package: %v", err)
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	pkgs := newBatch[models.Package](m, db, "packages", (&models.Package{}).TableName())
+	var items childRows[models.PackageItem]
+	var bonuses childRows[models.PackageActivationBonusPackage]
+	itemsMoved, itemsSkipped := 0, 0
+	bonusMoved, bonusSkipped := 0, 0
+	// Package items and bonus packages are migrated for existing packages too
+	flush := func() error {
+		if _, _, err := pkgs.flush(); err != nil {
 			return err
 		}
+		n, ignored, err := items.insert(m, db, nil)
+		if err != nil {
+			slog.Error("batch insert failed", "table", "package_items", "error", err)
+			return fmt.Errorf("package_items batch insert failed: %w", err)
+		}
+		itemsMoved += n
+		itemsSkipped += ignored
+		n, ignored, err = bonuses.insert(m, db, nil)
+		if err != nil {
+			slog.Error("batch insert failed", "table", "package_activation_bonus_packages", "error", err)
+			return fmt.Errorf("package_activation_bonus_packages batch insert failed: %w", err)
+		}
+		bonusMoved += n
+		bonusSkipped += ignored
+		return pkgs.checkpoint()
+	}
+	progress := m.newProgress("packages", srcCount)
+	flushDue := func() error {
+		if pkgs.full() {
+			return flush()
+		}
+		return nil
+	}
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("packages", cur.Current) {
+			continue
+		}
 
-		pkgID := p.ID.Hex()
-
-		// Check if package already exists in MySQL
-		if checkRecordExists(mysql, (&models.Package{}).TableName(), pkgID) {
-			skipped++
-			// Still migrate package items and bonus packages for existing packages
-			for _, item := range p.Items {
-				pkgItemID := primitive.NewObjectID().Hex()
-				pkgItem := models.PackageItem{
-					ID:                 pkgItemID,
-					PackageId:          pkgID,
-					Name:               item.Name,
-					Code:               item.Code,
-					IsOverLimitAllowed: item.IsOverLimitAllowed,
-					OverLimitPrice:     item.OverLimitPrice,
-					BRVRate:            item.BRVRate,
-					IsUnlimited:        item.IsUnlimited,
-					Limit:              item.Limit,
-				}
-				if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&pkgItem).Error; err != nil {
-					log.Printf("ERROR insert package_item pkg=%s item=%d: %v", pkgID, item.Code, err)
-					return fmt.Errorf("package %s item %d insert failed: %w", pkgID, item.Code, err)
-				}
-				itemsMoved++
-			}
-
-			for _, bonus := range p.OnActivationBonusPackages {
-				bonusPkg := models.PackageActivationBonusPackage{
-					PackageId:      pkgID,
-					BonusPackageId: bonus.ID.Hex(),
-				}
-				if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&bonusPkg).Error; err != nil {
-					log.Printf("ERROR insert package_activation_bonus pkg=%s bonus=%s: %v", pkgID, bonus.ID.Hex(), err)
-					return fmt.Errorf("package %s bonus %s insert failed: %w", pkgID, bonus.ID.Hex(), err)
-				}
-				bonusMoved++
+		var p models.MongoPackage
+		if err := decodeDocument(cur.Current, &p); err != nil {
+			m.decodeFailed("packages", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
 			}
-			continue
+			return CollectionStats{}, err
 		}
 
+		pkgID := m.rowID(p.ID)
+
 		pkg := models.Package{
 			ID:                          pkgID,
-			CreatedAt:                   p.CreatedAt,
+			CreatedAt:                   createdAtOrObjectID(p.CreatedAt, p.ID),
 			IsDeleted:                   p.IsDeleted,
 			Name:                        p.Name,
 			Price:                       p.Price,
@@ -405,16 +908,10 @@ func migratePackages(ctx context.Context, mdb *mongo.Database, mysql models.Data
 			DefaultSetOnNewOrganization: p.DefaultSetOnNewOrganization,
 		}
 
-		if err := db.Create(&pkg).Error; err != nil {
-			log.Printf("ERROR insert package %s: %v", pkgID, err)
-			return fmt.Errorf("package %s insert failed: %w", pkgID, err)
-		}
-
-		// Migrate package items
+		pkgs.add(pkgID, pkg, cur.Current)
 		for _, item := range p.Items {
-			pkgItemID := primitive.NewObjectID().Hex()
-			pkgItem := models.PackageItem{
-				ID:                 pkgItemID,
+			items.add(pkgID, models.PackageItem{
+				ID:                 childRowID(pkgID, item.Code),
 				PackageId:          pkgID,
 				Name:               item.Name,
 				Code:               item.Code,
@@ -423,66 +920,110 @@ func migratePackages(ctx context.Context, mdb *mongo.Database, mysql models.Data
 				BRVRate:            item.BRVRate,
 				IsUnlimited:        item.IsUnlimited,
 				Limit:              item.Limit,
-			}
-			if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&pkgItem).Error; err != nil {
-				log.Printf("ERROR insert package_item pkg=%s item=%d: %v", pkgID, item.Code, err)
-				return fmt.Errorf("package %s item %d insert failed: %w", pkgID, item.Code, err)
-			}
-			itemsMoved++
+			})
 		}
-
-		// Migrate activation bonus packages
 		for _, bonus := range p.OnActivationBonusPackages {
-			bonusPkg := models.PackageActivationBonusPackage{
+			bonuses.add(pkgID, models.PackageActivationBonusPackage{
 				PackageId:      pkgID,
-				BonusPackageId: bonus.ID.Hex(),
-			}
-			if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&bonusPkg).Error; err != nil {
-				log.Printf("ERROR insert package_activation_bonus pkg=%s bonus=%s: %v", pkgID, bonus.ID.Hex(), err)
-				return fmt.Errorf("package %s bonus %s insert failed: %w", pkgID, bonus.ID.Hex(), err)
-			}
-			bonusMoved++
+				BonusPackageId: m.rowID(bonus.ID),
+			})
 		}
-
-		moved++
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
+		}
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := flush(); err != nil {
+		return CollectionStats{}, err
 	}
 
-	dstAfter := mysqlCount(mysql, (&models.Package{}).TableName())
-	itemsAfter := mysqlCount(mysql, (&models.PackageItem{}).TableName())
-	bonusAfter := mysqlCount(mysql, (&models.PackageActivationBonusPackage{}).TableName())
-	log.Printf("[packages] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	log.Printf("[package_items] moved=%d mysql_after=%d", itemsMoved, itemsAfter)
-	log.Printf("[package_activation_bonus_packages] moved=%d mysql_after=%d", bonusMoved, bonusAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.Package{}).TableName())
+	itemsAfter := mysqlCount(m.mysql, (&models.PackageItem{}).TableName())
+	bonusAfter := mysqlCount(m.mysql, (&models.PackageActivationBonusPackage{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "packages", Table: (&models.Package{}).TableName(), Source: srcCount,
+		Moved: pkgs.moved, Skipped: pkgs.skipped, Updated: pkgs.updated, Unchanged: pkgs.unchanged, Failed: m.failed["packages"], DestAfter: dstAfter})
+	stats.add(MigrationResult{Collection: "packages", Table: (&models.PackageItem{}).TableName(), Moved: itemsMoved, Skipped: itemsSkipped, DestAfter: itemsAfter})
+	stats.add(MigrationResult{Collection: "packages", Table: (&models.PackageActivationBonusPackage{}).TableName(), Moved: bonusMoved, Skipped: bonusSkipped, DestAfter: bonusAfter})
+	return stats, cursorErr(ctx, cur, "packages")
 }
 
-func migrateBoughtPackages(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("boughtPackages")
-	srcCount := mongoCount(ctx, mdb, "boughtPackages")
-	dstBefore := mysqlCount(mysql, (&models.BoughtPackage{}).TableName())
-	itemsBefore := mysqlCount(mysql, (&models.BoughtPackageItem{}).TableName())
-	log.Printf("[bought-packages] mongo=%d mysql_before=%d", srcCount, dstBefore)
-	log.Printf("[bought-package-items] mysql_before=%d", itemsBefore)
+// Sources of the bought package price for -bought-price-source
+const (
+	boughtPriceSourcePaid    = "paid"
+	boughtPriceSourcePackage = "package"
+)
+
+// priceEpsilon is the largest difference between two prices still reported as equal
+const priceEpsilon = 0.005
+
+func (m *Migrator) migrateBoughtPackages(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("boughtPackages")
+	if err := checkCollectionShape(ctx, coll, "organization", "package", "bought_at"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.BoughtPackage{}, &models.BoughtPackageItem{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.BoughtPackage{}).TableName())
+	itemsBefore := mysqlCount(m.mysql, (&models.BoughtPackageItem{}).TableName())
+	slog.Info("starting", "collection", "bought-packages", "mongo", srcCount, "mysql_before", dstBefore)
+	slog.Info("starting", "collection", "bought-package-items", "mysql_before", itemsBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := m.find(ctx, "boughtPackages", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
+	}
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	boughtPkgs := newBatch[models.BoughtPackage](m, db, "boughtPackages", (&models.BoughtPackage{}).TableName())
+	var items childRows[models.BoughtPackageItem]
+	itemsMoved, itemsSkipped := 0, 0
+	// priceDrift counts the documents whose price and package.price differ
+	priceDrift := 0
+	// Items are only migrated together with a newly inserted bought package
+	flush := func() error {
+		inserted, _, err := boughtPkgs.flush()
+		if err != nil {
+			return err
+		}
+		n, ignored, err := items.insert(m, db, func(boughtPkgID string, _ models.BoughtPackageItem) bool {
+			return inserted[boughtPkgID]
+		})
+		if err != nil {
+			slog.Error("batch insert failed", "table", "bought-package-items", "error", err)
+			return fmt.Errorf("bought-package-items batch insert failed: %w", err)
+		}
+		itemsMoved += n
+		itemsSkipped += ignored
+		return boughtPkgs.checkpoint()
+	}
+	progress := m.newProgress("boughtPackages", srcCount)
+	flushDue := func() error {
+		if boughtPkgs.full() {
+			return flush()
+		}
+		return nil
 	}
-	defer cur.Close(ctx)
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("boughtPackages", cur.Current) {
+			continue
+		}
 
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	itemsMoved := 0
-	for cur.Next(ctx) {
 		var bp struct {
 			ID           primitive.ObjectID `bson:"_id"`
-			Organization struct {
-				ID   primitive.ObjectID `bson:"_id"`
-				Name string             `bson:"name"`
-				Inn  string             `bson:"inn"`
-			} `bson:"organization"`
-			Package struct {
+			Organization models.EmbeddedOrg `bson:"organization"`
+			Package      struct {
 				ID           primitive.ObjectID `bson:"_id"`
 				Name         string             `bson:"name"`
 				Price        float64            `bson:"price"`
@@ -503,41 +1044,42 @@ func migrateBoughtPackages(ctx context.Context, mdb *mongo.Database, mysql model
 			IsDeleted    bool      `bson:"is_deleted"`
 			Price        float64   `bson:"price"`
 		}
-		if err := cur.Decode(&bp); err != nil {
-			log.Printf("ERROR decode bought-package: %v", err)
-			return err
+		if err := decodeDocument(cur.Current, &bp); err != nil {
+			m.decodeFailed("boughtPackages", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
 		}
 
-		boughtPkgID := bp.ID.Hex()
-
-		// Check if bought-package already exists in MySQL
-		if checkRecordExists(mysql, (&models.BoughtPackage{}).TableName(), boughtPkgID) {
-			skipped++
+		boughtPkgID := m.rowID(bp.ID)
+		if m.skipMissingRefs("boughtPackages", boughtPkgID, cur.Current, requiredRef{"organization._id", bp.Organization.ID}, requiredRef{"package._id", bp.Package.ID}) {
 			continue
 		}
 
 		boughtPkg := models.BoughtPackage{
 			ID:             boughtPkgID,
-			OrganizationId: bp.Organization.ID.Hex(),
-			PackageId:      bp.Package.ID.Hex(),
+			OrganizationId: m.canonicalOrg(m.rowID(bp.Organization.ID)),
+			PackageId:      m.rowID(bp.Package.ID),
 			BoughtAt:       bp.BoughtAt,
 			ExpiresAt:      bp.ExpiresAt,
 			IsAutoExtend:   bp.IsAutoExtend,
 			IsActive:       !bp.IsDeleted,
-			Price:          bp.Package.Price,
+			Price:          bp.Price,
 		}
-
-		if err := db.Create(&boughtPkg).Error; err != nil {
-			log.Printf("ERROR insert bought-package %s: %v", boughtPkgID, err)
-			return fmt.Errorf("bought-package %s insert failed: %w", boughtPkgID, err)
+		if m.opts.BoughtPriceSource == boughtPriceSourcePackage {
+			boughtPkg.Price = bp.Package.Price
+		}
+		if math.Abs(bp.Price-bp.Package.Price) > priceEpsilon {
+			priceDrift++
+			slog.Debug("paid price differs from the package price", "collection", "boughtPackages", "id", boughtPkgID,
+				"price", bp.Price, "package_price", bp.Package.Price)
 		}
-		moved++
 
-		// Migrate package items for this bought package
+		boughtPkgs.add(boughtPkgID, boughtPkg, cur.Current)
 		for _, item := range bp.Package.PackageItems {
-			boughtPkgItemID := primitive.NewObjectID().Hex()
-			boughtPkgItem := models.BoughtPackageItem{
-				ID:                 boughtPkgItemID,
+			items.add(boughtPkgID, models.BoughtPackageItem{
+				ID:                 childRowID(boughtPkgID, item.Code),
 				BoughtPackageId:    boughtPkgID,
 				Name:               item.Name,
 				Code:               item.Code,
@@ -546,383 +1088,555 @@ func migrateBoughtPackages(ctx context.Context, mdb *mongo.Database, mysql model
 				IsUnlimited:        item.IsUnlimited,
 				LimitValue:         item.LimitValue,
 				UsedCount:          item.UsedCount,
-			}
-
-			if err := db.Create(&boughtPkgItem).Error; err != nil {
-				log.Printf("ERROR insert bought-package-item %s: %v", boughtPkgItemID, err)
-				return fmt.Errorf("bought-package-item %s insert failed: %w", boughtPkgItemID, err)
-			}
-			itemsMoved++
+			})
+		}
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
 		}
 	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := flush(); err != nil {
+		return CollectionStats{}, err
+	}
+
+	if priceDrift > 0 {
+		slog.Warn("bought packages whose paid price differs from the package price", "collection", "boughtPackages",
+			"count", priceDrift, "migrated_price", m.opts.BoughtPriceSource)
+	}
 
-	dstAfter := mysqlCount(mysql, (&models.BoughtPackage{}).TableName())
-	itemsAfter := mysqlCount(mysql, (&models.BoughtPackageItem{}).TableName())
-	log.Printf("[bought-packages] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	log.Printf("[bought-package-items] moved=%d mysql_after=%d", itemsMoved, itemsAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.BoughtPackage{}).TableName())
+	itemsAfter := mysqlCount(m.mysql, (&models.BoughtPackageItem{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "boughtPackages", Table: (&models.BoughtPackage{}).TableName(), Source: srcCount,
+		Moved: boughtPkgs.moved, Skipped: boughtPkgs.skipped, Updated: boughtPkgs.updated, Unchanged: boughtPkgs.unchanged, Failed: m.failed["boughtPackages"], MissingRefs: m.missingRefs["boughtPackages"], DestAfter: dstAfter})
+	stats.add(MigrationResult{Collection: "boughtPackages", Table: (&models.BoughtPackageItem{}).TableName(), Moved: itemsMoved, Skipped: itemsSkipped, DestAfter: itemsAfter})
+	return stats, cursorErr(ctx, cur, "boughtPackages")
 }
 
-func migrateCharges(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("charges")
-	srcCount := mongoCount(ctx, mdb, "charges")
-	dstBefore := mysqlCount(mysql, (&models.Charge{}).TableName())
-	log.Printf("[charges] mongo=%d mysql_before=%d", srcCount, dstBefore)
+// migrateActivePackages inserts the active packages embedded in organizations as
+// active bought packages. Packages already migrated from boughtPackages are left
+// untouched; an embedded package without _id is keyed by its organization and package.
+func (m *Migrator) migrateActivePackages(ctx context.Context) (CollectionStats, error) {
+	if err := m.requireTables(&models.BoughtPackage{}, &models.BoughtPackageItem{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.BoughtPackage{}).TableName())
+	slog.Info("starting", "collection", "active-packages", "mysql_before", dstBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	// Checkpointed apart from the organizations pass, which may have finished already
+	cur, err := m.findAs(ctx, "organizations.active_packages", "organizations", bson.M{"active_packages.0": bson.M{"$exists": true}})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
 	}
-	defer cur.Close(ctx)
-
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	for cur.Next(ctx) {
-		var c struct {
-			ID           primitive.ObjectID `bson:"_id"`
-			CreatedAt    time.Time          `bson:"created_at"`
-			IsDeleted    bool               `bson:"is_deleted"`
-			Organization struct {
-				ID   primitive.ObjectID `bson:"_id"`
-				Name string             `bson:"name"`
-				Inn  string             `bson:"inn"`
-			} `bson:"organization"`
-			Price   float64 `bson:"price"`
-			Package struct {
-				ID   primitive.ObjectID `bson:"_id"`
-				Name string             `bson:"name"`
-				Code int                `bson:"code"`
-			} `bson:"package"`
-			Service struct {
-				Code string `bson:"code"`
-			} `bson:"service"`
-			Item struct {
-				Name               string  `bson:"name"`
-				Code               int     `bson:"code"`
-				IsOverLimitAllowed bool    `bson:"is_over_limit_allowed"`
-				OverLimitPrice     float64 `bson:"over_limit_price"`
-				IsUnlimited        bool    `bson:"is_unlimited"`
-				Limit              int     `bson:"limit"`
-			} `bson:"item"`
-			EDIInvoice                *map[string]interface{} `bson:"edi_invoice"`
-			EDIReturnInvoice          *map[string]interface{} `bson:"edi_return_invoice"`
-			EDIAttorney               *map[string]interface{} `bson:"edi_attorney"`
-			RoamingInvoice            *map[string]interface{} `bson:"roaming_invoice"`
-			RoamingContract           *map[string]interface{} `bson:"roaming_contract"`
-			RoamingWaybill            *map[string]interface{} `bson:"roaming_waybill"`
-			RoamingAct                *map[string]interface{} `bson:"roaming_act"`
-			RoamingVerificationAct    *map[string]interface{} `bson:"roaming_verification_act"`
-			RoamingEmpowerment        *map[string]interface{} `bson:"roaming_empowerment"`
-			RoamingConstructorInvoice *map[string]interface{} `bson:"roaming_constructor_invoice"`
-			RoamingWaybillV2          *map[string]interface{} `bson:"roaming_waybill_v2"`
-			FreeFormDocument          *map[string]interface{} `bson:"free_form_document"`
-			RoamingHybridInvoice      *map[string]interface{} `bson:"roaming_hybrid_invoice"`
-		}
-		if err := cur.Decode(&c); err != nil {
-			log.Printf("ERROR decode charge: %v", err)
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	boughtPkgs := newBatch[models.BoughtPackage](m, db, "organizations.active_packages", (&models.BoughtPackage{}).TableName())
+	var items childRows[models.BoughtPackageItem]
+	itemsMoved, itemsSkipped := 0, 0
+	flush := func() error {
+		inserted, _, err := boughtPkgs.flush()
+		if err != nil {
 			return err
 		}
-
-		chargeID := c.ID.Hex()
-
-		// Check if charge already exists in MySQL
-		if checkRecordExists(mysql, (&models.Charge{}).TableName(), chargeID) {
-			skipped++
+		n, ignored, err := items.insert(m, db, func(boughtPkgID string, _ models.BoughtPackageItem) bool {
+			return inserted[boughtPkgID]
+		})
+		if err != nil {
+			slog.Error("batch insert failed", "table", "bought_package_items", "error", err)
+			return fmt.Errorf("bought_package_items batch insert failed: %w", err)
+		}
+		itemsMoved += n
+		itemsSkipped += ignored
+		return boughtPkgs.checkpoint()
+	}
+	progress := m.newProgress("organizations.active_packages", 0)
+	flushDue := func() error {
+		if boughtPkgs.full() {
+			return flush()
+		}
+		return nil
+	}
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("organizations", cur.Current) {
 			continue
 		}
 
-		// Determine charge type based on which document fields are present
-		chargeType := 0
-		var objectId, number string
-		var date1, date2 *time.Time
-
-		// Check for different document types and set the appropriate type
-		if c.RoamingInvoice != nil {
-			chargeType = RoamingInvoiceType
-			if id, ok := (*c.RoamingInvoice)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.RoamingInvoice)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.RoamingInvoice)["date"].(time.Time); ok {
-				date1 = &date
-			} else {
-				// Try to parse as string if time.Time assertion fails
-				if dateStr, ok := (*c.RoamingInvoice)["date"].(string); ok {
-					if parsedDate, err := time.Parse(time.RFC3339, dateStr); err == nil {
-						date1 = &parsedDate
-					}
-				}
-			}
-		} else if c.RoamingContract != nil {
-			chargeType = RoamingContractType
-			if id, ok := (*c.RoamingContract)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.RoamingContract)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.RoamingContract)["date"].(time.Time); ok {
-				date1 = &date
-			}
-		} else if c.RoamingWaybill != nil {
-			chargeType = RoamingWaybillType
-			if id, ok := (*c.RoamingWaybill)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.RoamingWaybill)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.RoamingWaybill)["date"].(time.Time); ok {
-				date1 = &date
-			}
-		} else if c.RoamingAct != nil {
-			chargeType = RoamingActType
-			if id, ok := (*c.RoamingAct)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.RoamingAct)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.RoamingAct)["date"].(time.Time); ok {
-				date1 = &date
-			}
-		} else if c.RoamingVerificationAct != nil {
-			chargeType = RoamingVerificationActType
-			if id, ok := (*c.RoamingVerificationAct)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.RoamingVerificationAct)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.RoamingVerificationAct)["date"].(time.Time); ok {
-				date1 = &date
-			}
-		} else if c.RoamingEmpowerment != nil {
-			chargeType = RoamingEmpowermentType
-			if id, ok := (*c.RoamingEmpowerment)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.RoamingEmpowerment)["number"].(string); ok {
-				number = num
-			}
-			if startDate, ok := (*c.RoamingEmpowerment)["start_date"].(time.Time); ok {
-				date1 = &startDate
-			}
-			if endDate, ok := (*c.RoamingEmpowerment)["end_date"].(time.Time); ok {
-				date2 = &endDate
-			}
-		} else if c.EDIReturnInvoice != nil {
-			chargeType = EDIReturnInvoiceType
-			if id, ok := (*c.EDIReturnInvoice)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.EDIReturnInvoice)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.EDIReturnInvoice)["date"].(time.Time); ok {
-				date1 = &date
-			}
-		} else if c.EDIAttorney != nil {
-			chargeType = EDIAttorneyType
-			if id, ok := (*c.EDIAttorney)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.EDIAttorney)["number"].(string); ok {
-				number = num
-			}
-			if startDate, ok := (*c.EDIAttorney)["start_date"].(time.Time); ok {
-				date1 = &startDate
-			}
-			if endDate, ok := (*c.EDIAttorney)["end_date"].(time.Time); ok {
-				date2 = &endDate
-			}
-		} else if c.EDIInvoice != nil {
-			chargeType = EDIInvoiceType
-			if id, ok := (*c.EDIInvoice)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.EDIInvoice)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.EDIInvoice)["date"].(time.Time); ok {
-				date1 = &date
-			}
-		} else if c.RoamingConstructorInvoice != nil {
-			chargeType = RoamingConstructionInvoiceType
-			if id, ok := (*c.RoamingConstructorInvoice)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.RoamingConstructorInvoice)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.RoamingConstructorInvoice)["date"].(time.Time); ok {
-				date1 = &date
-			}
-		} else if c.RoamingWaybillV2 != nil {
-			chargeType = RoamingWaybillV2Type
-			if id, ok := (*c.RoamingWaybillV2)["_id"].(string); ok {
-				objectId = id
-			}
-			if num, ok := (*c.RoamingWaybillV2)["number"].(string); ok {
-				number = num
-			}
-			if date, ok := (*c.RoamingWaybillV2)["date"].(time.Time); ok {
-				date1 = &date
-			}
-		} else if c.FreeFormDocument != nil {
-			chargeType = FreeFormDocumentType
-			if id, ok := (*c.FreeFormDocument)["_id"].(string); ok {
-				objectId = id
+		var o models.MongoOrganization
+		if err := decodeDocument(cur.Current, &o); err != nil {
+			m.decodeFailed("organizations", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
 			}
-			if num, ok := (*c.FreeFormDocument)["number"].(string); ok {
-				number = num
+			return CollectionStats{}, err
+		}
+
+		orgID := m.canonicalOrg(m.rowID(o.ID))
+		for _, ap := range o.ActivePackages {
+			packageID := m.rowID(ap.Package.ID)
+			boughtPkgID := m.rowIDHex(ap.ID)
+			if boughtPkgID == "" {
+				boughtPkgID = uuid.NewSHA1(uuid.NameSpaceOID, []byte(orgID+"/"+packageID)).String()
 			}
-			if date, ok := (*c.FreeFormDocument)["date"].(time.Time); ok {
-				date1 = &date
+
+			boughtPkgs.add(boughtPkgID, models.BoughtPackage{
+				ID:             boughtPkgID,
+				OrganizationId: orgID,
+				PackageId:      packageID,
+				BoughtAt:       ap.BoughtAt,
+				ExpiresAt:      ap.ExpiresAt,
+				IsAutoExtend:   ap.IsAutoExtend,
+				IsActive:       true,
+				Price:          ap.Package.Price,
+			}, cur.Current)
+			for _, item := range ap.Package.Items {
+				items.add(boughtPkgID, models.BoughtPackageItem{
+					ID:                 childRowID(boughtPkgID, item.Code),
+					BoughtPackageId:    boughtPkgID,
+					Name:               item.Name,
+					Code:               item.Code,
+					IsOverLimitAllowed: item.IsOverLimitAllowed,
+					OverLimitPrice:     item.OverLimitPrice,
+					IsUnlimited:        item.IsUnlimited,
+					LimitValue:         item.Limit,
+				})
 			}
-		} else if c.RoamingHybridInvoice != nil {
-			chargeType = RoamingHybridInvoiceType
-			if id, ok := (*c.RoamingHybridInvoice)["_id"].(string); ok {
-				objectId = id
+		}
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
+		}
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := flush(); err != nil {
+		return CollectionStats{}, err
+	}
+
+	dstAfter := mysqlCount(m.mysql, (&models.BoughtPackage{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "organizations.active_packages", Table: (&models.BoughtPackage{}).TableName(),
+		Moved: boughtPkgs.moved, Skipped: boughtPkgs.skipped, Updated: boughtPkgs.updated, Unchanged: boughtPkgs.unchanged, DestAfter: dstAfter})
+	stats.add(MigrationResult{Collection: "organizations.active_packages", Table: (&models.BoughtPackageItem{}).TableName(), Moved: itemsMoved, Skipped: itemsSkipped})
+	return stats, cursorErr(ctx, cur, "organizations")
+}
+
+// chargeProjection limits the charge documents to the fields migrateCharges reads.
+// The embedded roaming and EDI documents are by far the largest part of a charge and
+// only their id, number and dates are needed. Fields tracked by -track-presence are
+// kept so their state is still recorded, and -max-doc-size applies to the projected
+// size.
+func (m *Migrator) chargeProjection() bson.M {
+	projection := bson.M{}
+	// organization, package and service are kept whole since legacy documents store
+	// them as a bare value, which a sub-field projection would drop, see legacyShapes
+	for _, field := range []string{"_id", "created_at", "is_deleted", "organization", "price", "package", "service", "item", "items"} {
+		projection[field] = 1
+	}
+	for _, field := range models.ChargeDocumentFields() {
+		projection[field] = 1
+	}
+	for _, field := range m.opts.PresenceFields["charges"] {
+		// A path below a projected field is already included and would collide
+		if root, _, _ := strings.Cut(field, "."); projection[root] == nil {
+			projection[field] = 1
+		}
+	}
+	return projection
+}
+
+// chargeRows is a charges document transformed into its rows
+type chargeRows struct {
+	id   string
+	refs []requiredRef
+	rows []models.Charge
+	// skip is why the document is left out under -long-charge-refs skip
+	skip error
+	// oversized is set instead of decoding a document over -max-doc-size
+	oversized bool
+}
+
+// transformCharge decodes a charges document into its rows. It runs on the
+// -transform-workers goroutines, so it only reads the Migrator.
+func (m *Migrator) transformCharge(doc bson.Raw) (chargeRows, error) {
+	if m.tooLarge(doc) {
+		return chargeRows{oversized: true}, nil
+	}
+	var c struct {
+		ID           primitive.ObjectID `bson:"_id"`
+		CreatedAt    time.Time          `bson:"created_at"`
+		IsDeleted    bool               `bson:"is_deleted"`
+		Organization models.EmbeddedOrg `bson:"organization"`
+		Price        float64            `bson:"price"`
+		Package      struct {
+			ID   primitive.ObjectID `bson:"_id"`
+			Name string             `bson:"name"`
+			Code int                `bson:"code"`
+		} `bson:"package"`
+		Service struct {
+			Code string `bson:"code"`
+		} `bson:"service"`
+		Item  chargeItem   `bson:"item"`
+		Items []chargeItem `bson:"items"`
+	}
+	if err := decodeDocument(doc, &c); err != nil {
+		return chargeRows{}, err
+	}
+	chargeID := m.rowID(c.ID)
+
+	// Determine charge type based on which document fields are present
+	var chargeType models.ChargeType
+	var objectId, number string
+	var date1, date2 *time.Time
+	document, fields, ok, err := models.DetectChargeDocument(doc)
+	if err != nil {
+		return chargeRows{}, err
+	}
+	if ok {
+		chargeType = document.Type
+		objectId, number, date1, date2 = document.Extract(fields)
+	}
+	for _, ref := range []struct {
+		column string
+		value  *string
+	}{{"object_id", &objectId}, {"number", &number}} {
+		if *ref.value, err = fitColumn(*ref.value, ref.column, models.ChargeRefSize, m.opts.LongChargeRefs, "charges", chargeID); err != nil {
+			if m.opts.LongChargeRefs == longRefSkip {
+				return chargeRows{id: chargeID, skip: err}, nil
 			}
-			if num, ok := (*c.RoamingHybridInvoice)["number"].(string); ok {
-				number = num
+			return chargeRows{}, err
+		}
+	}
+	slog.Debug("processing charge", "collection", "charges", "id", chargeID, "type", chargeType, "document", document.Field)
+	// If no dates were found from document fields, use created_at as fallback
+	dateSource := models.ChargeDateDocument
+	if date1 == nil {
+		createdAt := createdAtOrObjectID(c.CreatedAt, c.ID)
+		date1 = &createdAt
+		dateSource = models.ChargeDateCreatedAtFallback
+	}
+
+	charge := models.Charge{
+		ID:                    chargeID,
+		CreatedAt:             createdAtOrObjectID(c.CreatedAt, c.ID),
+		IsDeleted:             c.IsDeleted,
+		OrganizationId:        m.canonicalOrg(m.rowID(c.Organization.ID)),
+		Price:                 c.Price,
+		Type:                  chargeType,
+		BoughtPackageID:       m.rowID(c.Package.ID),
+		BoughtPackageItemCode: c.Item.Code,
+		ServiceCode:           c.Service.Code,
+		ObjectId:              objectId,
+		Number:                number,
+		Date1: func() *time.Time {
+			if date1 != nil {
+				return m.opts.Dates.Validate(*date1, "charges", chargeID)
 			}
-			if date, ok := (*c.RoamingHybridInvoice)["date"].(time.Time); ok {
-				date1 = &date
+			return nil
+		}(),
+		Date2: func() *time.Time {
+			if date2 != nil {
+				return m.opts.Dates.Validate(*date2, "charges", chargeID)
 			}
+			return nil
+		}(),
+	}
+	if charge.Date1 == nil {
+		dateSource = models.ChargeDateNone
+	}
+	charge.DateSource = dateSource
+
+	// A charge may carry a single item, an items array, or both
+	items := chargeItems(c.Item, c.Items)
+	if len(items) > 0 {
+		charge.BoughtPackageItemCode = items[0].Code
+	}
+
+	return chargeRows{
+		id:   chargeID,
+		refs: []requiredRef{{"organization._id", c.Organization.ID}, {"package._id", c.Package.ID}},
+		rows: applyChargeItemsPolicy(charge, items, m.opts.ChargeItems),
+	}, nil
+}
+
+func (m *Migrator) migrateCharges(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("charges")
+	if err := checkCollectionShape(ctx, coll, "created_at", "organization", "price"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.Charge{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.Charge{}).TableName())
+	slog.Info("starting", "collection", "charges", "mongo", srcCount, "mysql_before", dstBefore)
+
+	filters, err := shardFilters(ctx, coll, m.opts.Shards)
+	if err != nil {
+		return CollectionStats{}, fmt.Errorf("could not shard charges: %w", err)
+	}
+	// Opened one after another: find records the -incremental watermark on m
+	curs := make([]*mongo.Cursor, len(filters))
+	for i, filter := range filters {
+		cur, err := m.find(ctx, "charges", filter, options.Find().SetProjection(m.chargeProjection()))
+		if err != nil {
+			return CollectionStats{}, err
 		}
-		// If no dates were found from document fields, use created_at as fallback
-		if date1 == nil {
-			date1 = &c.CreatedAt
-		}
-
-		charge := models.Charge{
-			ID:                    chargeID,
-			CreatedAt:             c.CreatedAt,
-			IsDeleted:             c.IsDeleted,
-			OrganizationId:        c.Organization.ID.Hex(),
-			Price:                 c.Price,
-			Type:                  chargeType,
-			BoughtPackageID:       c.Package.ID.Hex(),
-			BoughtPackageItemCode: c.Item.Code,
-			ServiceCode:           c.Service.Code,
-			ObjectId:              objectId,
-			Number:                number,
-			Date1: func() *time.Time {
-				if date1 != nil {
-					return validateDateTime(*date1)
-				}
-				return nil
-			}(),
-			Date2: func() *time.Time {
-				if date2 != nil {
-					return validateDateTime(*date2)
-				}
-				return nil
-			}(),
+		defer cur.Close(context.WithoutCancel(ctx))
+		curs[i] = cur
+	}
+
+	var charges []*batch[models.Charge]
+	if len(curs) == 1 {
+		b, err := m.migrateChargesFrom(ctx, curs[0], m.newProgress("charges", srcCount))
+		if err != nil {
+			return CollectionStats{}, err
 		}
+		charges = append(charges, b)
+	} else {
+		slog.Info("migrating in shards", "collection", "charges", "shards", len(curs))
+		if charges, err = m.migrateChargeShards(ctx, curs); err != nil {
+			return CollectionStats{}, err
+		}
+	}
 
-		if err := db.Create(&charge).Error; err != nil {
-			log.Printf("ERROR insert charge %s: %v", chargeID, err)
-			return fmt.Errorf("charge %s insert failed: %w", chargeID, err)
+	result := MigrationResult{Collection: "charges", Table: (&models.Charge{}).TableName(), Source: srcCount,
+		Failed: m.failed["charges"], MissingRefs: m.missingRefs["charges"], DestAfter: mysqlCount(m.mysql, (&models.Charge{}).TableName())}
+	for _, b := range charges {
+		result.Moved += b.moved
+		result.Skipped += b.skipped
+		result.Updated += b.updated
+		result.Unchanged += b.unchanged
+	}
+	var stats CollectionStats
+	stats.add(result)
+	for _, cur := range curs {
+		if err := cursorErr(ctx, cur, "charges"); err != nil {
+			return stats, err
 		}
-		moved++
 	}
+	return stats, nil
+}
 
-	dstAfter := mysqlCount(mysql, (&models.Charge{}).TableName())
-	log.Printf("[charges] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	return nil
+// migrateChargesFrom migrates the charges of cur and returns the batch holding their
+// counters
+func (m *Migrator) migrateChargesFrom(ctx context.Context, cur *mongo.Cursor, progress *progressMeter) (*batch[models.Charge], error) {
+	charges := newBatch[models.Charge](m, m.mysql.GetDB(), "charges", (&models.Charge{}).TableName())
+	flushDue := func() error {
+		if charges.full() {
+			return charges.save()
+		}
+		return nil
+	}
+	err := pipeline(ctx, cur, m.opts.TransformWorkers, m.transformCharge, func(doc bson.Raw, c chargeRows, err error) error {
+		progress.tick()
+		if c.oversized {
+			m.skipOversized("charges", doc)
+			return nil
+		}
+		if err != nil {
+			m.decodeFailed("charges", doc, err)
+			if m.opts.SkipErrors {
+				return nil
+			}
+			return err
+		}
+		if c.skip != nil {
+			slog.Warn("skipping charge", "id", c.id, "reason", c.skip)
+			m.recordFailure("charges", c.id, doc, c.skip)
+			return nil
+		}
+		if m.skipMissingRefs("charges", c.id, doc, c.refs...) {
+			return nil
+		}
+		// -charge-items split writes a row per further item
+		m.countAdjustments[(&models.Charge{}).TableName()] += len(c.rows) - 1
+		for _, row := range c.rows {
+			charges.add(row.ID, row, doc)
+		}
+		return flushDue()
+	}, m.opts.CommitInterval, flushDue)
+	if err != nil {
+		return nil, err
+	}
+	return charges, charges.save()
+}
+
+// migrateChargeShards migrates the charges of every cursor of -shards on a goroutine
+// of its own, each with its own batch, and returns the batches once all are done. The
+// first failing shard stops the others, which still write the batch they were
+// reading.
+func (m *Migrator) migrateChargeShards(ctx context.Context, curs []*mongo.Cursor) ([]*batch[models.Charge], error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	shards := make([]*Migrator, len(curs))
+	charges := make([]*batch[models.Charge], len(curs))
+	errs := make([]error, len(curs))
+	var wg sync.WaitGroup
+	for i, cur := range curs {
+		shards[i] = m.shard()
+		wg.Add(1)
+		go func(i int, cur *mongo.Cursor) {
+			defer wg.Done()
+			progress := shards[i].newProgress(fmt.Sprintf("charges shard %d", i+1), 0)
+			if charges[i], errs[i] = shards[i].migrateChargesFrom(ctx, cur, progress); errs[i] != nil {
+				cancel()
+			}
+		}(i, cur)
+	}
+	wg.Wait()
+
+	for _, s := range shards {
+		m.mergeShard(s)
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return charges, nil
 }
 
-func migratePayments(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("payments")
-	srcCount := mongoCount(ctx, mdb, "payments")
-	dstBefore := mysqlCount(mysql, (&models.Payment{}).TableName())
-	log.Printf("[payments] mongo=%d mysql_before=%d", srcCount, dstBefore)
+func (m *Migrator) migratePayments(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("payments")
+	if err := checkCollectionShape(ctx, coll, "created_at", "organization", "amount"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.Payment{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.Payment{}).TableName())
+	slog.Info("starting", "collection", "payments", "mongo", srcCount, "mysql_before", dstBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := m.find(ctx, "payments", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
 	}
-	defer cur.Close(ctx)
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	payments := newBatch[models.Payment](m, db, "payments", (&models.Payment{}).TableName())
+	progress := m.newProgress("payments", srcCount)
+	flushDue := func() error {
+		if payments.full() {
+			return payments.save()
+		}
+		return nil
+	}
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("payments", cur.Current) {
+			continue
+		}
 
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	for cur.Next(ctx) {
 		var p struct {
-			ID           primitive.ObjectID `bson:"_id"`
-			CreatedAt    time.Time          `bson:"created_at"`
-			Amount       float64            `bson:"amount"`
-			Organization struct {
-				ID   primitive.ObjectID `bson:"_id"`
-				Name string             `bson:"name"`
-				Inn  string             `bson:"inn"`
-			} `bson:"organization"`
-			Account struct {
-				ID       primitive.ObjectID `bson:"_id"`
-				Name     string             `bson:"name"`
-				Username string             `bson:"username"`
-			} `bson:"account"`
-			Method            int     `bson:"method"`
-			BankTransactionID *string `bson:"bank_transaction_id"`
-		}
-		if err := cur.Decode(&p); err != nil {
-			log.Printf("ERROR decode payment: %v", err)
-			return err
+			ID                primitive.ObjectID     `bson:"_id"`
+			CreatedAt         time.Time              `bson:"created_at"`
+			Amount            float64                `bson:"amount"`
+			Organization      models.EmbeddedOrg     `bson:"organization"`
+			Account           models.EmbeddedAccount `bson:"account"`
+			Method            int                    `bson:"method"`
+			BankTransactionID *string                `bson:"bank_transaction_id"`
+		}
+		if err := decodeDocument(cur.Current, &p); err != nil {
+			m.decodeFailed("payments", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
 		}
 
-		paymentID := p.ID.Hex()
-
-		// Check if payment already exists in MySQL
-		if checkRecordExists(mysql, (&models.Payment{}).TableName(), paymentID) {
-			skipped++
+		paymentID := m.rowID(p.ID)
+		if m.skipMissingRefs("payments", paymentID, cur.Current, requiredRef{"organization._id", p.Organization.ID}) {
 			continue
 		}
 
 		payment := models.Payment{
 			ID:                paymentID,
-			CreatedAt:         p.CreatedAt,
+			CreatedAt:         createdAtOrObjectID(p.CreatedAt, p.ID),
 			Amount:            p.Amount,
-			OrganizationID:    p.Organization.ID.Hex(),
-			AccountID:         p.Account.ID.Hex(),
+			OrganizationID:    m.canonicalOrg(m.rowID(p.Organization.ID)),
+			AccountID:         m.rowID(p.Account.ID),
 			AccountUsername:   p.Account.Username,
 			Method:            p.Method,
 			BankTransactionID: p.BankTransactionID,
 		}
+		if m.opts.EnumAsString {
+			label := models.EnumLabel(m.opts.PaymentMethods, p.Method)
+			payment.MethodLabel = &label
+		}
 
-		if err := db.Create(&payment).Error; err != nil {
-			log.Printf("ERROR insert payment %s: %v", paymentID, err)
-			return fmt.Errorf("payment %s insert failed: %w", paymentID, err)
+		payments.add(paymentID, payment, cur.Current)
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
 		}
-		moved++
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := payments.save(); err != nil {
+		return CollectionStats{}, err
 	}
 
-	dstAfter := mysqlCount(mysql, (&models.Payment{}).TableName())
-	log.Printf("[payments] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.Payment{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "payments", Table: (&models.Payment{}).TableName(), Source: srcCount,
+		Moved: payments.moved, Skipped: payments.skipped, Updated: payments.updated, Unchanged: payments.unchanged, Failed: m.failed["payments"], MissingRefs: m.missingRefs["payments"], DestAfter: dstAfter})
+	return stats, cursorErr(ctx, cur, "payments")
 }
 
-func migratePaymeTransactions(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("paymeTransactions")
-	srcCount := mongoCount(ctx, mdb, "paymeTransactions")
-	dstBefore := mysqlCount(mysql, (&models.PaymeTransaction{}).TableName())
-	log.Printf("[payme-transactions] mongo=%d mysql_before=%d", srcCount, dstBefore)
+func (m *Migrator) migratePaymeTransactions(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("paymeTransactions")
+	if err := checkCollectionShape(ctx, coll, "payme_transaction_id", "organization", "amount"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.PaymeTransaction{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.PaymeTransaction{}).TableName())
+	slog.Info("starting", "collection", "payme-transactions", "mongo", srcCount, "mysql_before", dstBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := m.find(ctx, "paymeTransactions", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
+	}
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	paymeTransactions := newBatch[models.PaymeTransaction](m, db, "paymeTransactions", (&models.PaymeTransaction{}).TableName())
+	progress := m.newProgress("paymeTransactions", srcCount)
+	flushDue := func() error {
+		if paymeTransactions.full() {
+			return paymeTransactions.save()
+		}
+		return nil
 	}
-	defer cur.Close(ctx)
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("paymeTransactions", cur.Current) {
+			continue
+		}
 
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	for cur.Next(ctx) {
 		var pt struct {
 			ID                 primitive.ObjectID `bson:"_id"`
 			CreatedAt          time.Time          `bson:"created_at"`
@@ -932,230 +1646,304 @@ func migratePaymeTransactions(ctx context.Context, mdb *mongo.Database, mysql mo
 			State              int                `bson:"state"`
 			Amount             float64            `bson:"amount"`
 			PaymentId          *string            `bson:"payment_id"`
-			Organization       struct {
-				ID   primitive.ObjectID `bson:"_id"`
-				Name string             `bson:"name"`
-				Inn  string             `bson:"inn"`
-			} `bson:"organization"`
-			Reason           int        `bson:"reason"`
-			SystemCanceledAt *time.Time `bson:"system_canceled_at"`
-		}
-		if err := cur.Decode(&pt); err != nil {
-			log.Printf("ERROR decode payme-transaction: %v", err)
-			return err
+			Organization       models.EmbeddedOrg `bson:"organization"`
+			Reason             int                `bson:"reason"`
+			SystemCanceledAt   *time.Time         `bson:"system_canceled_at"`
 		}
-
-		paymeTransactionID := pt.ID.Hex()
-
-		// Check if payme-transaction already exists in MySQL
-		if checkRecordExists(mysql, (&models.PaymeTransaction{}).TableName(), paymeTransactionID) {
-			skipped++
-			continue
+		if err := decodeDocument(cur.Current, &pt); err != nil {
+			m.decodeFailed("paymeTransactions", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
 		}
 
+		paymeTransactionID := m.rowID(pt.ID)
+
 		// Validate PaymeCreatedAt - if invalid, use CreatedAt as fallback
-		validatedPaymeCreatedAt := validateDateTime(pt.PaymeCreatedAt)
+		validatedPaymeCreatedAt := m.opts.Dates.Validate(pt.PaymeCreatedAt, "paymeTransactions", paymeTransactionID)
 		if validatedPaymeCreatedAt == nil {
 			// Use CreatedAt as fallback, but validate it too
-			validatedCreatedAt := validateDateTime(pt.CreatedAt)
+			validatedCreatedAt := m.opts.Dates.Validate(pt.CreatedAt, "paymeTransactions", paymeTransactionID)
 			if validatedCreatedAt != nil {
 				validatedPaymeCreatedAt = validatedCreatedAt
 			} else {
-				// If both are invalid, use current time
-				now := time.Now()
-				validatedPaymeCreatedAt = &now
+				// If both are invalid, use the time in the ObjectID: unlike the current
+				// time it is the same every run, so the row_hash is too
+				minted := pt.ID.Timestamp()
+				validatedPaymeCreatedAt = &minted
 			}
 		}
 
 		paymeTransaction := models.PaymeTransaction{
 			ID:                 paymeTransactionID,
-			CreatedAt:          pt.CreatedAt,
+			CreatedAt:          createdAtOrObjectID(pt.CreatedAt, pt.ID),
 			PaymeTransactionID: pt.PaymeTransactionID,
 			PaymeCreatedAt:     *validatedPaymeCreatedAt,
 			SystemCompletedAt: func() *time.Time {
 				if pt.SystemCompletedAt != nil {
-					return validateDateTime(*pt.SystemCompletedAt)
+					return m.opts.Dates.Validate(*pt.SystemCompletedAt, "paymeTransactions", paymeTransactionID)
 				}
 				return nil
 			}(),
 			State:          pt.State,
 			Amount:         pt.Amount,
 			PaymentId:      pt.PaymentId,
-			OrganizationID: pt.Organization.ID.Hex(),
+			OrganizationID: m.canonicalOrg(m.rowID(pt.Organization.ID)),
 			Reason:         pt.Reason,
 			SystemCanceledAt: func() *time.Time {
 				if pt.SystemCanceledAt != nil {
-					return validateDateTime(*pt.SystemCanceledAt)
+					return m.opts.Dates.Validate(*pt.SystemCanceledAt, "paymeTransactions", paymeTransactionID)
 				}
 				return nil
 			}(),
 		}
+		if m.opts.EnumAsString {
+			state := models.EnumLabel(models.PaymeTransactionStates, pt.State)
+			paymeTransaction.StateLabel = &state
+			if pt.Reason != 0 {
+				reason := models.EnumLabel(models.PaymeCancelReasons, pt.Reason)
+				paymeTransaction.ReasonLabel = &reason
+			}
+		}
 
-		if err := db.Create(&paymeTransaction).Error; err != nil {
-			log.Printf("ERROR insert payme-transaction %s: %v", paymeTransactionID, err)
-			return fmt.Errorf("payme-transaction %s insert failed: %w", paymeTransactionID, err)
+		paymeTransactions.add(paymeTransactionID, paymeTransaction, cur.Current)
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
 		}
-		moved++
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := paymeTransactions.save(); err != nil {
+		return CollectionStats{}, err
 	}
 
-	dstAfter := mysqlCount(mysql, (&models.PaymeTransaction{}).TableName())
-	log.Printf("[payme-transactions] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.PaymeTransaction{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "paymeTransactions", Table: (&models.PaymeTransaction{}).TableName(), Source: srcCount,
+		Moved: paymeTransactions.moved, Skipped: paymeTransactions.skipped, Updated: paymeTransactions.updated, Unchanged: paymeTransactions.unchanged, Failed: m.failed["paymeTransactions"], DestAfter: dstAfter})
+	return stats, cursorErr(ctx, cur, "paymeTransactions")
 }
 
-func migrateOrganizationBalanceBindings(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("organizationBalanceBindings")
-	srcCount := mongoCount(ctx, mdb, "organizationBalanceBindings")
-	dstBefore := mysqlCount(mysql, (&models.OrganizationBalanceBinding{}).TableName())
-	log.Printf("[organization-balance-bindings] mongo=%d mysql_before=%d", srcCount, dstBefore)
+func (m *Migrator) migrateOrganizationBalanceBindings(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("organizationBalanceBindings")
+	if err := checkCollectionShape(ctx, coll, "payer_organization", "target_organization"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.OrganizationBalanceBinding{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.OrganizationBalanceBinding{}).TableName())
+	slog.Info("starting", "collection", "organization-balance-bindings", "mongo", srcCount, "mysql_before", dstBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := m.find(ctx, "organizationBalanceBindings", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
 	}
-	defer cur.Close(ctx)
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	bindings := newBatch[models.OrganizationBalanceBinding](m, db, "organizationBalanceBindings", (&models.OrganizationBalanceBinding{}).TableName())
+	progress := m.newProgress("organizationBalanceBindings", srcCount)
+	flushDue := func() error {
+		if bindings.full() {
+			return bindings.save()
+		}
+		return nil
+	}
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("organizationBalanceBindings", cur.Current) {
+			continue
+		}
 
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	for cur.Next(ctx) {
 		var obb struct {
-			ID                primitive.ObjectID `bson:"_id"`
-			CreatedAt         time.Time          `bson:"created_at"`
-			DeletedAt         *time.Time         `bson:"deleted_at"`
-			IsDeleted         bool               `bson:"is_deleted"`
-			PayerOrganization struct {
-				ID   primitive.ObjectID `bson:"id"`
-				Name string             `bson:"name"`
-				Inn  string             `bson:"inn"`
-			} `bson:"payer_organization"`
-			TargetOrganization struct {
-				ID   primitive.ObjectID `bson:"id"`
-				Name string             `bson:"name"`
-				Inn  string             `bson:"inn"`
-			} `bson:"target_organization"`
-		}
-		if err := cur.Decode(&obb); err != nil {
-			log.Printf("ERROR decode organization-balance-binding: %v", err)
-			return err
+			ID                 primitive.ObjectID `bson:"_id"`
+			CreatedAt          time.Time          `bson:"created_at"`
+			DeletedAt          *time.Time         `bson:"deleted_at"`
+			IsDeleted          bool               `bson:"is_deleted"`
+			PayerOrganization  models.EmbeddedOrg `bson:"payer_organization"`
+			TargetOrganization models.EmbeddedOrg `bson:"target_organization"`
+		}
+		if err := decodeDocument(cur.Current, &obb); err != nil {
+			m.decodeFailed("organizationBalanceBindings", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
 		}
 
-		orgBalanceBindingID := obb.ID.Hex()
-
-		// Check if organization-balance-binding already exists in MySQL
-		if checkRecordExists(mysql, (&models.OrganizationBalanceBinding{}).TableName(), orgBalanceBindingID) {
-			skipped++
+		orgBalanceBindingID := m.rowID(obb.ID)
+		if m.skipMissingRefs("organizationBalanceBindings", orgBalanceBindingID, cur.Current, requiredRef{"payer_organization._id", obb.PayerOrganization.ID},
+			requiredRef{"target_organization._id", obb.TargetOrganization.ID}) {
 			continue
 		}
 
 		orgBalanceBinding := models.OrganizationBalanceBinding{
 			ID:        orgBalanceBindingID,
-			CreatedAt: obb.CreatedAt,
+			CreatedAt: createdAtOrObjectID(obb.CreatedAt, obb.ID),
 			DeletedAt: func() *time.Time {
 				if obb.DeletedAt != nil {
-					return validateDateTime(*obb.DeletedAt)
+					return m.opts.Dates.Validate(*obb.DeletedAt, "organizationBalanceBindings", orgBalanceBindingID)
 				}
 				return nil
 			}(),
 			IsDeleted:              obb.IsDeleted,
-			PayerOrganizationID:    obb.PayerOrganization.ID.Hex(),
-			TargetOrganizationID:   obb.TargetOrganization.ID.Hex(),
-			PayerOrganizationName:  obb.PayerOrganization.Name,
-			TargetOrganizationName: obb.TargetOrganization.Name,
+			PayerOrganizationID:    m.canonicalOrg(m.rowID(obb.PayerOrganization.ID)),
+			TargetOrganizationID:   m.canonicalOrg(m.rowID(obb.TargetOrganization.ID)),
+			PayerOrganizationName:  normalizeText(obb.PayerOrganization.Name),
+			TargetOrganizationName: normalizeText(obb.TargetOrganization.Name),
 		}
 
-		if err := db.Create(&orgBalanceBinding).Error; err != nil {
-			log.Printf("ERROR insert organization-balance-binding %s: %v", orgBalanceBindingID, err)
-			return fmt.Errorf("organization-balance-binding %s insert failed: %w", orgBalanceBindingID, err)
+		bindings.add(orgBalanceBindingID, orgBalanceBinding, cur.Current)
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
 		}
-		moved++
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := bindings.save(); err != nil {
+		return CollectionStats{}, err
 	}
 
-	dstAfter := mysqlCount(mysql, (&models.OrganizationBalanceBinding{}).TableName())
-	log.Printf("[organization-balance-bindings] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.OrganizationBalanceBinding{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "organizationBalanceBindings", Table: (&models.OrganizationBalanceBinding{}).TableName(), Source: srcCount,
+		Moved: bindings.moved, Skipped: bindings.skipped, Updated: bindings.updated, Unchanged: bindings.unchanged, Failed: m.failed["organizationBalanceBindings"], MissingRefs: m.missingRefs["organizationBalanceBindings"], DestAfter: dstAfter})
+	return stats, cursorErr(ctx, cur, "organizationBalanceBindings")
 }
 
-func migrateCreditUpdates(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("creditUpdates")
-	srcCount := mongoCount(ctx, mdb, "creditUpdates")
-	dstBefore := mysqlCount(mysql, (&models.CreditUpdates{}).TableName())
-	log.Printf("[credit-updates] mongo=%d mysql_before=%d", srcCount, dstBefore)
+func (m *Migrator) migrateCreditUpdates(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("creditUpdates")
+	if err := checkCollectionShape(ctx, coll, "created_at", "organization", "amount"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.CreditUpdates{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.CreditUpdates{}).TableName())
+	slog.Info("starting", "collection", "credit-updates", "mongo", srcCount, "mysql_before", dstBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := m.find(ctx, "creditUpdates", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
 	}
-	defer cur.Close(ctx)
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	creditUpdates := newBatch[models.CreditUpdates](m, db, "creditUpdates", (&models.CreditUpdates{}).TableName())
+	progress := m.newProgress("creditUpdates", srcCount)
+	flushDue := func() error {
+		if creditUpdates.full() {
+			return creditUpdates.save()
+		}
+		return nil
+	}
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("creditUpdates", cur.Current) {
+			continue
+		}
 
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	for cur.Next(ctx) {
 		var cu struct {
-			ID           primitive.ObjectID `bson:"_id"`
-			CreatedAt    time.Time          `bson:"created_at"`
-			Organization struct {
-				ID   primitive.ObjectID `bson:"_id"`
-				Name string             `bson:"name"`
-				Inn  string             `bson:"inn"`
-			} `bson:"organization"`
-			Amount  float64 `bson:"amount"`
-			Account struct {
-				ID       primitive.ObjectID `bson:"_id"`
-				Name     string             `bson:"name"`
-				Username string             `bson:"username"`
-			} `bson:"account"`
-		}
-		if err := cur.Decode(&cu); err != nil {
-			log.Printf("ERROR decode credit-update: %v", err)
-			return err
+			ID           primitive.ObjectID     `bson:"_id"`
+			CreatedAt    time.Time              `bson:"created_at"`
+			Organization models.EmbeddedOrg     `bson:"organization"`
+			Amount       float64                `bson:"amount"`
+			Account      models.EmbeddedAccount `bson:"account"`
+		}
+		if err := decodeDocument(cur.Current, &cu); err != nil {
+			m.decodeFailed("creditUpdates", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
 		}
 
-		creditUpdateID := cu.ID.Hex()
-
-		// Check if credit-update already exists in MySQL
-		if checkRecordExists(mysql, (&models.CreditUpdates{}).TableName(), creditUpdateID) {
-			skipped++
+		creditUpdateID := m.rowID(cu.ID)
+		if m.skipMissingRefs("creditUpdates", creditUpdateID, cur.Current, requiredRef{"organization._id", cu.Organization.ID}) {
 			continue
 		}
 
 		creditUpdate := models.CreditUpdates{
 			ID:             creditUpdateID,
-			CreatedAt:      cu.CreatedAt,
-			OrganizationID: cu.Organization.ID.Hex(),
+			CreatedAt:      createdAtOrObjectID(cu.CreatedAt, cu.ID),
+			OrganizationID: m.canonicalOrg(m.rowID(cu.Organization.ID)),
 			Amount:         cu.Amount,
-			AccountID:      cu.Account.ID.Hex(),
+			AccountID:      m.rowID(cu.Account.ID),
 		}
 
-		if err := db.Create(&creditUpdate).Error; err != nil {
-			log.Printf("ERROR insert credit-update %s: %v", creditUpdateID, err)
-			return fmt.Errorf("credit-update %s insert failed: %w", creditUpdateID, err)
+		creditUpdates.add(creditUpdateID, creditUpdate, cur.Current)
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
 		}
-		moved++
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := creditUpdates.save(); err != nil {
+		return CollectionStats{}, err
 	}
 
-	dstAfter := mysqlCount(mysql, (&models.CreditUpdates{}).TableName())
-	log.Printf("[credit-updates] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.CreditUpdates{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "creditUpdates", Table: (&models.CreditUpdates{}).TableName(), Source: srcCount,
+		Moved: creditUpdates.moved, Skipped: creditUpdates.skipped, Updated: creditUpdates.updated, Unchanged: creditUpdates.unchanged, Failed: m.failed["creditUpdates"], MissingRefs: m.missingRefs["creditUpdates"], DestAfter: dstAfter})
+	return stats, cursorErr(ctx, cur, "creditUpdates")
 }
 
-func migrateBankPaymentAutoApplyErrors(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("bankPaymentsAutoApplyErrors")
-	srcCount := mongoCount(ctx, mdb, "bankPaymentsAutoApplyErrors")
-	dstBefore := mysqlCount(mysql, (&models.BankPaymentAutoApplyError{}).TableName())
-	log.Printf("[bank-payments-auto-apply-errors] mongo=%d mysql_before=%d", srcCount, dstBefore)
+func (m *Migrator) migrateBankPaymentAutoApplyErrors(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("bankPaymentsAutoApplyErrors")
+	if err := checkCollectionShape(ctx, coll, "transaction_id", "payer_inn", "amount"); err != nil {
+		return CollectionStats{}, err
+	}
+	srcCount := mongoCount(ctx, coll)
+	if err := m.requireTables(&models.BankPaymentAutoApplyError{}); err != nil {
+		return CollectionStats{}, err
+	}
+	dstBefore := mysqlCount(m.mysql, (&models.BankPaymentAutoApplyError{}).TableName())
+	slog.Info("starting", "collection", "bank-payments-auto-apply-errors", "mongo", srcCount, "mysql_before", dstBefore)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := m.find(ctx, "bankPaymentsAutoApplyErrors", bson.M{})
 	if err != nil {
-		return err
+		return CollectionStats{}, err
+	}
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	db := m.mysql.GetDB()
+	autoApplyErrors := newBatch[models.BankPaymentAutoApplyError](m, db, "bankPaymentsAutoApplyErrors", (&models.BankPaymentAutoApplyError{}).TableName())
+	progress := m.newProgress("bankPaymentsAutoApplyErrors", srcCount)
+	flushDue := func() error {
+		if autoApplyErrors.full() {
+			return autoApplyErrors.save()
+		}
+		return nil
 	}
-	defer cur.Close(ctx)
+	docs := m.commitCursor(ctx, cur, flushDue)
+	defer docs.Close()
+	for docs.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("bankPaymentsAutoApplyErrors", cur.Current) {
+			continue
+		}
 
-	db := mysql.GetDB()
-	moved := 0
-	skipped := 0
-	for cur.Next(ctx) {
 		var bpae struct {
 			ID            primitive.ObjectID `bson:"_id"`
 			CreatedAt     time.Time          `bson:"created_at"`
@@ -1167,86 +1955,121 @@ func migrateBankPaymentAutoApplyErrors(ctx context.Context, mdb *mongo.Database,
 			Description   *string            `bson:"description"`
 			Resolved      bool               `bson:"resolved"`
 		}
-		if err := cur.Decode(&bpae); err != nil {
-			log.Printf("ERROR decode bank-payment-auto-apply-error: %v", err)
-			return err
+		if err := decodeDocument(cur.Current, &bpae); err != nil {
+			m.decodeFailed("bankPaymentsAutoApplyErrors", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
 		}
 
-		bankPaymentAutoApplyErrorID := bpae.ID.Hex()
-
-		// Check if bank-payment-auto-apply-error already exists in MySQL
-		if checkRecordExists(mysql, (&models.BankPaymentAutoApplyError{}).TableName(), bankPaymentAutoApplyErrorID) {
-			skipped++
+		bankPaymentAutoApplyErrorID := m.rowID(bpae.ID)
+		payerInn, err := normalizeInn(bpae.PayerInn)
+		if err != nil {
+			// Does not fit payer_inn; with -skip-errors it is quarantined instead of failing the run
+			slog.Warn("invalid payer inn", "collection", "bankPaymentsAutoApplyErrors", "id", bankPaymentAutoApplyErrorID, "error", err)
+			if m.opts.SkipErrors {
+				m.recordFailure("bankPaymentsAutoApplyErrors", bankPaymentAutoApplyErrorID, cur.Current, err)
+				continue
+			}
+			return CollectionStats{}, err
+		}
+		if payerInn == "" && m.opts.EmptyPayerInn == emptyInnSkip {
+			autoApplyErrors.skipped++
 			continue
 		}
 
 		bankPaymentAutoApplyError := models.BankPaymentAutoApplyError{
 			ID:            bankPaymentAutoApplyErrorID,
-			CreatedAt:     bpae.CreatedAt,
+			CreatedAt:     createdAtOrObjectID(bpae.CreatedAt, bpae.ID),
 			ErrorMessage:  bpae.ErrorMessage,
 			Amount:        bpae.Amount,
 			TransactionID: bpae.TransactionID,
-			PayerInn:      bpae.PayerInn,
+			PayerInn:      payerInn,
 			PayerName:     bpae.PayerName,
 			Description:   bpae.Description,
 			Resolved:      bpae.Resolved,
 		}
 
-		if err := db.Create(&bankPaymentAutoApplyError).Error; err != nil {
-			log.Printf("ERROR insert bank-payment-auto-apply-error %s: %v", bankPaymentAutoApplyErrorID, err)
-			return fmt.Errorf("bank-payment-auto-apply-error %s insert failed: %w", bankPaymentAutoApplyErrorID, err)
+		autoApplyErrors.add(bankPaymentAutoApplyErrorID, bankPaymentAutoApplyError, cur.Current)
+		if err := flushDue(); err != nil {
+			return CollectionStats{}, err
 		}
-		moved++
+	}
+	if err := docs.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+	if err := autoApplyErrors.save(); err != nil {
+		return CollectionStats{}, err
 	}
 
-	dstAfter := mysqlCount(mysql, (&models.BankPaymentAutoApplyError{}).TableName())
-	log.Printf("[bank-payments-auto-apply-errors] moved=%d skipped=%d mysql_after=%d", moved, skipped, dstAfter)
-	return nil
+	dstAfter := mysqlCount(m.mysql, (&models.BankPaymentAutoApplyError{}).TableName())
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "bankPaymentsAutoApplyErrors", Table: (&models.BankPaymentAutoApplyError{}).TableName(), Source: srcCount,
+		Moved: autoApplyErrors.moved, Skipped: autoApplyErrors.skipped, Updated: autoApplyErrors.updated, Unchanged: autoApplyErrors.unchanged, Failed: m.failed["bankPaymentsAutoApplyErrors"], DestAfter: dstAfter})
+	return stats, cursorErr(ctx, cur, "bankPaymentsAutoApplyErrors")
 }
 
-func migrateBoughtPackageIsAutoExtendColumn(ctx context.Context, mdb *mongo.Database, mysql models.Database) error {
-	coll := mdb.Collection("organizations")
+func (m *Migrator) migrateBoughtPackageIsAutoExtendColumn(ctx context.Context) (CollectionStats, error) {
+	coll := m.collection("organizations")
 	// count bought packages where is_auto_extend is true
 	var count int64
-	if err := mysql.GetDB().Table("bought_packages").Where("is_auto_extend = ?", true).Count(&count).Error; err != nil {
-		log.Printf("WARNING: Could not count bought packages where is_auto_extend is true: %v", err)
-		return err
+	if err := m.mysql.GetDB().Table((&models.BoughtPackage{}).TableName()).Where("is_auto_extend = ?", true).Count(&count).Error; err != nil {
+		slog.Warn("could not count bought packages where is_auto_extend is true", "error", err)
+		return CollectionStats{}, err
 	}
-	log.Printf("[bought-packages] mysql_before=%d", count)
+	slog.Info("starting", "collection", "bought-packages", "mysql_before", count)
 
-	cur, err := coll.Find(ctx, bson.M{})
+	cur, err := coll.Find(ctx, bson.M{}, m.findOptions())
 	if err != nil {
-		return err
+		return CollectionStats{}, err
 	}
-	defer cur.Close(ctx)
+	defer cur.Close(context.WithoutCancel(ctx))
 
-	db := mysql.GetDB()
+	db := m.mysql.GetDB()
 	moved := 0
 
 	// collect all active packages id where is_auto_extend is true and update bought packages is_auto_extend column to true
 	activePackagesIDCollectionMap := make(map[string]string)
+	progress := m.newProgress("organizations", 0)
 	for cur.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		progress.tick()
+		if m.skipOversized("organizations", cur.Current) {
+			continue
+		}
+
 		var o models.MongoOrganization
-		if err := cur.Decode(&o); err != nil {
-			log.Printf("ERROR decode organization: %v", err)
-			return err
+		if err := decodeDocument(cur.Current, &o); err != nil {
+			m.decodeFailed("organizations", cur.Current, err)
+			if m.opts.SkipErrors {
+				continue
+			}
+			return CollectionStats{}, err
 		}
 
 		for _, ap := range o.ActivePackages {
 			if ap.IsAutoExtend {
-				activePackagesIDCollectionMap[uuid.NewString()] = ap.ID
+				activePackagesIDCollectionMap[uuid.NewString()] = m.rowIDHex(ap.ID)
 			}
 		}
 	}
 
+	if err := cursorErr(ctx, cur, "organizations"); err != nil {
+		return CollectionStats{}, err
+	}
+
 	// update bought packages is_auto_extend column to true where package_id is in activePackagesIDCollectionMap
 	for _, id := range activePackagesIDCollectionMap {
-		if err := db.Table("bought_packages").Where("id = ?", id).Update("is_auto_extend", true).Error; err != nil {
-			log.Printf("ERROR update bought-packages is_auto_extend column: %v", err)
-			return err
+		m.limiter.wait(1)
+		if err := db.Table((&models.BoughtPackage{}).TableName()).Where("id = ?", id).Update("is_auto_extend", true).Error; err != nil {
+			slog.Error("update failed", "table", (&models.BoughtPackage{}).TableName(), "column", "is_auto_extend", "id", id, "error", err)
+			return CollectionStats{}, err
 		}
 		moved++
 	}
-	log.Printf("[bought-packages] moved=%d", moved)
-	return nil
+	slog.Info("migrated", "collection", "bought-packages", "moved", moved)
+	return CollectionStats{}, nil
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"migrate-tool/models"
+	"sync"
+
+	"gorm.io/gorm/schema"
+)
+
+// fieldMapping maps one Mongo source field to one MySQL column. Array elements are
+// written as items[].code; generated or derived values carry a note instead.
+type fieldMapping struct {
+	Source string `json:"source"`
+	Column string `json:"column"`
+	Note   string `json:"note,omitempty"`
+}
+
+// tableMapping is the mapping of one migration from a collection into a table
+type tableMapping struct {
+	Migration  string         `json:"migration"`
+	Collection string         `json:"collection"`
+	Table      string         `json:"table"`
+	Fields     []fieldMapping `json:"fields"`
+
+	model interface{}
+}
+
+func direct(columns ...string) []fieldMapping {
+	fields := make([]fieldMapping, 0, len(columns))
+	for _, column := range columns {
+		fields = append(fields, fieldMapping{Source: column, Column: column})
+	}
+	return fields
+}
+
+func mapped(source, column, note string) fieldMapping {
+	return fieldMapping{Source: source, Column: column, Note: note}
+}
+
+// fieldMappings documents the source field to target column mapping implemented by
+// each migrator. Keep it in sync when a migrator's transform changes. Ids noted as
+// ObjectID hex are the UUIDv5 of that hex string with -id-format uuid.
+var fieldMappings = []tableMapping{
+	{
+		Migration: "services", Collection: "services", model: &models.Service{},
+		Fields: append([]fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+		}, direct("name", "code")...),
+	},
+	{
+		Migration: "organizations", Collection: "organizations", model: &models.Organization{},
+		Fields: append(append([]fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+			mapped("updated_at", "updated_at", ""),
+			mapped("deleted_at", "deleted_at", "NULL outside -min-date..-max-date (default 1970-2100)"),
+			mapped("inn", "inn", "trimmed, blank as NULL"),
+			mapped("pinfl", "pinfl", "trimmed, blank as NULL"),
+			mapped("referral_agent_code", "referral_agent_code", "trimmed, blank as NULL"),
+		}, direct("is_deleted", "name", "balance", "fiscalization_balance", "reserved_fiscalization_balance",
+			"total_payments", "credit_amount", "organization_code")...),
+			mapped("white_label", "white_label", ""),
+			mapped("offer_info.number", "offer_number", ""),
+			mapped("offer_info.date", "offer_date", "NULL outside -min-date..-max-date (default 1970-2100)"),
+		),
+	},
+	{
+		Migration: "organizations", Collection: "organizations", model: &models.OrganizationServiceDemoUses{},
+		Fields: []fieldMapping{
+			mapped("_id", "organization_id", "ObjectID hex"),
+			mapped("service_demo_uses[].code", "service_code", ""),
+			mapped("created_at", "used_at", "organization creation time, _id timestamp when missing"),
+		},
+	},
+	{
+		Migration: "packages", Collection: "packages", model: &models.Package{},
+		Fields: append(append([]fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+		},
+			direct("is_deleted", "name", "price", "brv_rate", "duration_days", "duration_months",
+				"is_demo", "is_public")...),
+			mapped("service.code", "service_code", ""),
+			mapped("default_set_on_new_organization", "default_set_on_new_organization", ""),
+		),
+	},
+	{
+		Migration: "packages", Collection: "packages", model: &models.PackageItem{},
+		Fields: []fieldMapping{
+			mapped("", "id", "UUIDv5 of package id and item code"),
+			mapped("_id", "package_id", "ObjectID hex"),
+			mapped("items[].name", "name", ""),
+			mapped("items[].code", "code", ""),
+			mapped("items[].is_over_limit_allowed", "is_over_limit_allowed", ""),
+			mapped("items[].over_limit_price", "over_limit_price", ""),
+			mapped("items[].brv_rate", "brv_rate", ""),
+			mapped("items[].is_unlimited", "is_unlimited", ""),
+			mapped("items[].limit", "limit", ""),
+		},
+	},
+	{
+		Migration: "packages", Collection: "packages", model: &models.PackageActivationBonusPackage{},
+		Fields: []fieldMapping{
+			mapped("_id", "package_id", "ObjectID hex"),
+			mapped("on_activation_bonus_packages[]._id", "bonus_package_id", "ObjectID hex"),
+		},
+	},
+	{
+		Migration: "bought-packages", Collection: "boughtPackages", model: &models.BoughtPackage{},
+		Fields: []fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("organization._id", "organization_id", "ObjectID hex; organization.id when _id is absent"),
+			mapped("package._id", "package_id", "ObjectID hex"),
+			mapped("bought_at", "bought_at", ""),
+			mapped("expires_at", "expires_at", ""),
+			mapped("is_auto_extend", "is_auto_extend", ""),
+			mapped("is_deleted", "is_active", "negated"),
+			mapped("price", "price", "the paid price; package.price with -bought-price-source package"),
+		},
+	},
+	{
+		Migration: "bought-packages", Collection: "boughtPackages", model: &models.BoughtPackageItem{},
+		Fields: []fieldMapping{
+			mapped("", "id", "UUIDv5 of bought package id and item code"),
+			mapped("_id", "bought_package_id", "ObjectID hex"),
+			mapped("package.package_items[].name", "name", ""),
+			mapped("package.package_items[].code", "code", ""),
+			mapped("package.package_items[].is_over_limit_allowed", "is_over_limit_allowed", ""),
+			mapped("package.package_items[].over_limit_price", "over_limit_price", ""),
+			mapped("package.package_items[].is_unlimited", "is_unlimited", ""),
+			mapped("package.package_items[].limit", "limit_value", ""),
+			mapped("package.package_items[].used_count", "used_count", ""),
+		},
+	},
+	{
+		Migration: "active-packages", Collection: "organizations", model: &models.BoughtPackage{},
+		Fields: []fieldMapping{
+			mapped("active_packages[]._id", "id", "UUIDv5 of organization and package id when missing"),
+			mapped("_id", "organization_id", "ObjectID hex"),
+			mapped("active_packages[].package._id", "package_id", "ObjectID hex"),
+			mapped("active_packages[].bought_at", "bought_at", ""),
+			mapped("active_packages[].expires_at", "expires_at", ""),
+			mapped("active_packages[].is_auto_extend", "is_auto_extend", ""),
+			mapped("", "is_active", "always true"),
+			mapped("active_packages[].package.price", "price", ""),
+		},
+	},
+	{
+		Migration: "active-packages", Collection: "organizations", model: &models.BoughtPackageItem{},
+		Fields: []fieldMapping{
+			mapped("", "id", "UUIDv5 of bought package id and item code"),
+			mapped("active_packages[]._id", "bought_package_id", ""),
+			mapped("active_packages[].package.items[].name", "name", ""),
+			mapped("active_packages[].package.items[].code", "code", ""),
+			mapped("active_packages[].package.items[].is_over_limit_allowed", "is_over_limit_allowed", ""),
+			mapped("active_packages[].package.items[].over_limit_price", "over_limit_price", ""),
+			mapped("active_packages[].package.items[].is_unlimited", "is_unlimited", ""),
+			mapped("active_packages[].package.items[].limit", "limit_value", ""),
+		},
+	},
+	{
+		Migration: "charges", Collection: "charges", model: &models.Charge{},
+		Fields: []fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+			mapped("is_deleted", "is_deleted", ""),
+			mapped("organization._id", "organization_id", "ObjectID hex; organization.id when _id is absent"),
+			mapped("price", "price", ""),
+			mapped("<document>", "type", "charge type of the first embedded document present (roaming_invoice, edi_invoice, ...)"),
+			mapped("package._id", "bought_package_id", "ObjectID hex"),
+			mapped("item.code", "bought_package_item_code", "falls back to items[0].code; -charge-items split adds a row per further item"),
+			mapped("service.code", "service_code", ""),
+			mapped("<document>._id", "object_id", "at most 64 characters, see -long-charge-refs"),
+			mapped("<document>.number", "number", "at most 64 characters, see -long-charge-refs"),
+			mapped("<document>.date", "date1", "start_date for empowerments and attorneys; falls back to created_at"),
+			mapped("<document>.end_date", "date2", "empowerments and attorneys only"),
+			mapped("<document>", "date_source", "document, created_at_fallback when date1 falls back to created_at, or none when date1 is NULL"),
+		},
+	},
+	{
+		Migration: "payments", Collection: "payments", model: &models.Payment{},
+		Fields: []fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+			mapped("amount", "amount", ""),
+			mapped("organization._id", "organization_id", "ObjectID hex; organization.id when _id is absent"),
+			mapped("account._id", "account_id", "ObjectID hex"),
+			mapped("account.username", "account_username", ""),
+			mapped("method", "method", ""),
+			mapped("method", "method_label", "with -enum-as-string, unknown(<n>) when unlabeled"),
+			mapped("bank_transaction_id", "bank_transaction_id", ""),
+		},
+	},
+	{
+		Migration: "payme-transactions", Collection: "paymeTransactions", model: &models.PaymeTransaction{},
+		Fields: []fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+			mapped("payme_transaction_id", "payme_transaction_id", ""),
+			mapped("payme_created_at", "payme_created_at", "falls back to created_at, then current time"),
+			mapped("system_completed_at", "system_completed_at", "NULL outside -min-date..-max-date (default 1970-2100)"),
+			mapped("state", "state", ""),
+			mapped("state", "state_label", "with -enum-as-string"),
+			mapped("amount", "amount", ""),
+			mapped("payment_id", "payment_id", ""),
+			mapped("organization._id", "organization_id", "ObjectID hex; organization.id when _id is absent"),
+			mapped("reason", "reason", ""),
+			mapped("reason", "reason_label", "with -enum-as-string, NULL for reason 0"),
+			mapped("system_canceled_at", "system_canceled_at", "NULL outside -min-date..-max-date (default 1970-2100)"),
+		},
+	},
+	{
+		Migration: "organization-balance-bindings", Collection: "organizationBalanceBindings", model: &models.OrganizationBalanceBinding{},
+		Fields: []fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+			mapped("deleted_at", "deleted_at", "NULL outside -min-date..-max-date (default 1970-2100)"),
+			mapped("is_deleted", "is_deleted", ""),
+			mapped("payer_organization.id", "payer_organization_id", "ObjectID hex; payer_organization._id when present"),
+			mapped("target_organization.id", "target_organization_id", "ObjectID hex; target_organization._id when present"),
+			mapped("payer_organization.name", "payer_organization_name", "trimmed"),
+			mapped("target_organization.name", "target_organization_name", "trimmed"),
+		},
+	},
+	{
+		Migration: "credit-updates", Collection: "creditUpdates", model: &models.CreditUpdates{},
+		Fields: []fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+			mapped("organization._id", "organization_id", "ObjectID hex; organization.id when _id is absent"),
+			mapped("amount", "amount", ""),
+			mapped("account._id", "account_id", "ObjectID hex"),
+		},
+	},
+	{
+		Migration: "bank-payments-auto-apply-errors", Collection: "bankPaymentsAutoApplyErrors", model: &models.BankPaymentAutoApplyError{},
+		Fields: append([]fieldMapping{
+			mapped("_id", "id", "ObjectID hex"),
+			mapped("created_at", "created_at", "_id timestamp when missing"),
+			mapped("payer_inn", "payer_inn", "trimmed; documents whose value is not 9 or 14 digits are quarantined, empty ones follow -empty-payer-inn"),
+		},
+			direct("error_message", "amount", "transaction_id", "payer_name", "description", "resolved")...),
+	},
+	{
+		Migration: "bought-package-is-auto-extend-column", Collection: "organizations", model: &models.BoughtPackage{},
+		Fields: []fieldMapping{
+			mapped("active_packages[]._id", "id", "matches the existing bought package"),
+			mapped("active_packages[].is_auto_extend", "is_auto_extend", "only true values are applied"),
+		},
+	},
+}
+
+// dumpMapping writes fieldMappings as JSON, resolving table names from the models and
+// verifying every mapped column exists on its model.
+func dumpMapping(w io.Writer) error {
+	cache := &sync.Map{}
+	mappings := make([]tableMapping, len(fieldMappings))
+	for i, mapping := range fieldMappings {
+		s, err := schema.Parse(mapping.model, cache, schema.NamingStrategy{})
+		if err != nil {
+			return err
+		}
+		for _, field := range mapping.Fields {
+			if s.LookUpField(field.Column) == nil {
+				return fmt.Errorf("mapping %s: column %s does not exist on %s", mapping.Migration, field.Column, s.Table)
+			}
+		}
+		mapping.Table = s.Table
+		mappings[i] = mapping
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(mappings)
+}
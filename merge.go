@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// planOrganizationMerges picks one canonical organization per INN when
+// -merge-orgs-by-inn is set: the oldest one, ties broken by _id. The other
+// organizations of the INN are not migrated and every row referencing them is
+// re-pointed to the canonical organization through canonicalOrg.
+func (m *Migrator) planOrganizationMerges(ctx context.Context) (CollectionStats, error) {
+	if !m.opts.MergeOrgsByINN {
+		return CollectionStats{}, nil
+	}
+
+	// A deleted organization cannot be the canonical one of an INN
+	filter := bson.M{"inn": bson.M{"$nin": bson.A{nil, ""}}}
+	m.excludeDeleted(ctx, "organizations", filter)
+	cur, err := m.collection("organizations").Find(ctx, filter,
+		options.Find().
+			SetProjection(bson.M{"_id": 1, "inn": 1, "created_at": 1}).
+			SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return CollectionStats{}, err
+	}
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	canonical := make(map[string]string)
+	for cur.Next(ctx) {
+		var o struct {
+			ID        primitive.ObjectID `bson:"_id"`
+			Inn       string             `bson:"inn"`
+			CreatedAt time.Time          `bson:"created_at"`
+		}
+		if err := cur.Decode(&o); err != nil {
+			return CollectionStats{}, err
+		}
+		inn := strings.TrimSpace(o.Inn)
+		if inn == "" {
+			continue
+		}
+		if id, ok := canonical[inn]; ok {
+			m.orgMerges[m.rowID(o.ID)] = id
+			slog.Info("merging organization", "collection", "organizations", "id", m.rowID(o.ID), "into", id, "inn", inn)
+			continue
+		}
+		canonical[inn] = m.rowID(o.ID)
+	}
+	if err := cur.Err(); err != nil {
+		return CollectionStats{}, err
+	}
+
+	slog.Info("checked", "collection", "organizations", "merged_duplicates", len(m.orgMerges))
+	return CollectionStats{}, nil
+}
+
+// canonicalOrg returns the organization id rows referencing id must point to
+func (m *Migrator) canonicalOrg(id string) string {
+	if canonical, ok := m.orgMerges[id]; ok {
+		return canonical
+	}
+	return id
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metrics holds the per-collection counters exposed in the Prometheus text format by
+// -metrics-addr. They are kept even without the endpoint, since updating them is cheap.
+type metrics struct {
+	mu      sync.Mutex
+	moved   map[string]int64
+	skipped map[string]int64
+	failed  map[string]int64
+	current string
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		moved:   make(map[string]int64),
+		skipped: make(map[string]int64),
+		failed:  make(map[string]int64),
+	}
+}
+
+// rows adds moved and skipped rows of collection
+func (x *metrics) rows(collection string, moved, skipped int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.moved[collection] += int64(moved)
+	x.skipped[collection] += int64(skipped)
+}
+
+// fail counts one failed record of collection
+func (x *metrics) fail(collection string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.failed[collection]++
+}
+
+// setCurrent records the running migration, "" when none is running
+func (x *metrics) setCurrent(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.current = name
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (x *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, counter := range []struct {
+		name, help string
+		values     map[string]int64
+	}{
+		{"migrator_rows_moved_total", "Rows inserted into the target database.", x.moved},
+		{"migrator_rows_skipped_total", "Rows skipped because they already existed.", x.skipped},
+		{"migrator_rows_failed_total", "Records that failed to decode or insert.", x.failed},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		collections := make([]string, 0, len(counter.values))
+		for collection := range counter.values {
+			collections = append(collections, collection)
+		}
+		sort.Strings(collections)
+		for _, collection := range collections {
+			fmt.Fprintf(w, "%s{collection=%q} %d\n", counter.name, collection, counter.values[collection])
+		}
+	}
+	fmt.Fprintf(w, "# HELP migrator_current_migration Migration running now.\n# TYPE migrator_current_migration gauge\n")
+	if x.current != "" {
+		fmt.Fprintf(w, "migrator_current_migration{migration=%q} 1\n", x.current)
+	}
+}
+
+// serveMetrics exposes x on addr at /metrics until the returned function is called,
+// which shuts the server down gracefully
+func serveMetrics(addr string, x *metrics) func() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", x)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "addr", addr, "error", err)
+		}
+	}()
+	slog.Info("serving metrics", "addr", addr, "path", "/metrics")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("could not stop metrics server", "error", err)
+		}
+	}
+}
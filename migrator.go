@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"migrate-tool/models"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+// Options configures a Migrator
+type Options struct {
+	// PresenceFields maps a collection to the fields whose null vs missing state is
+	// recorded in field_presence
+	PresenceFields map[string][]string
+	// MaxDocSize skips documents whose raw BSON is larger than this many bytes; 0 disables it
+	MaxDocSize int
+	// DedupKeys maps a collection to the target columns used to detect existing
+	// records; collections without an entry dedup on the primary key
+	DedupKeys map[string][]string
+	// ConflictColumns maps a collection to the unique target columns used as the
+	// ON CONFLICT target of its inserts; collections without an entry use the primary key
+	ConflictColumns map[string][]string
+	// EnumAsString writes the labels of the numeric enums in their *_label columns
+	EnumAsString bool
+	// PaymentMethods labels Payment.Method with EnumAsString, see models.PaymentMethods
+	PaymentMethods map[int]string
+	// IDFormat is idFormatHex (default) or idFormatUUID, the format of every target
+	// id and reference derived from an ObjectID
+	IDFormat string
+	// OnConflict is onConflictSkip (default) or onConflictUpdate, which upserts parent
+	// rows that already exist; child rows are always skipped on conflict
+	OnConflict string
+	// BatchSize is the number of rows accumulated and inserted per CreateInBatches call
+	BatchSize int
+	// CommitInterval also flushes a batch once this long has passed since its last
+	// flush, so slow collections persist their rows (and checkpoint) regularly; 0 only
+	// flushes full batches. A ticker keeps flushing while the cursor stalls, see
+	// commitCursor.
+	CommitInterval time.Duration
+	// ProgressEvery is the number of documents read between progress lines; 0 disables them
+	ProgressEvery int64
+	// Limit reads at most this many documents per collection cursor, for smoke tests;
+	// 0 reads them all
+	Limit int64
+	// MongoBatchSize is the number of documents a cursor fetches per round trip; 0
+	// leaves the server default. Memory per collection is bounded by it plus BatchSize
+	// rows, since batches reuse their slices after each flush.
+	MongoBatchSize int32
+	// TransformWorkers is the number of goroutines decoding and transforming the
+	// charges documents; reads and writes stay on one goroutine each. 1 or less
+	// transforms on the writing goroutine.
+	TransformWorkers int
+	// Shards is the number of created_at ranges the charges are split into and
+	// migrated concurrently, see shardFilters; 1 or less reads them with one cursor
+	Shards int
+	// RateLimit caps the number of records written to MySQL per second; 0 disables it
+	RateLimit int
+	// OutputErrorsToMySQL records every failed record in the migration_errors table
+	OutputErrorsToMySQL bool
+	// SkipErrors records documents that fail to decode or insert in migration_errors
+	// and continues with the next document instead of failing the collection
+	SkipErrors bool
+	// TxPerCollection runs each collection migration in a single transaction so a
+	// failure rolls the whole collection back
+	TxPerCollection bool
+	// CheckpointFile enables resuming from the JSON checkpoint at this path
+	CheckpointFile string
+	// CheckpointInterval is how often the checkpoint file is written, by records or time
+	CheckpointInterval checkpointInterval
+	// Restart ignores an existing checkpoint file
+	Restart bool
+	// MergeOrgsByINN migrates one canonical organization per INN and re-points the
+	// references to its duplicates
+	MergeOrgsByINN bool
+	// DedupeInn reports organizations whose INN an earlier organization already has
+	DedupeInn bool
+	// Reconcile compares the organization totals with their migrated child rows after
+	// the migration, reporting differences above ReconcileTolerance
+	Reconcile          bool
+	ReconcileTolerance float64
+	// Dates converts migrated times to the -tz location and nulls those outside the
+	// -min-date and -max-date bounds
+	Dates DateValidator
+	// Since and Until restrict the migrated documents to created_at in [Since, Until);
+	// zero values leave the bound open
+	Since time.Time
+	Until time.Time
+	// Incremental migrates only the documents created after the watermark of their
+	// collection in sync_state and advances it once the collection is done
+	Incremental bool
+	// CheckRefs verifies per batch that referenced parent rows exist; rows referencing
+	// a missing parent are handled according to OnOrphan
+	CheckRefs bool
+	// EmptyPayerInn is emptyInnKeep or emptyInnSkip, for bank payment errors without
+	// a payer INN
+	EmptyPayerInn string
+	// OnOrphan is onOrphanSkip or onOrphanQuarantine (stored in orphan_records)
+	OnOrphan string
+	// Output writes the mapped rows to <table>.jsonl files in this directory instead of
+	// inserting them; the target database is then expected to be a dry-run one
+	Output string
+	// Only runs just these migrations, by name; empty runs all of them
+	Only []string
+	// Skip leaves out these migrations, by name
+	Skip []string
+	// GenericTables are the flat collections of -tables, migrated by migrateGeneric
+	// after the built-in migrations, each named after its table
+	GenericTables []genericTable
+	// BoughtPriceSource selects the migrated bought package price,
+	// boughtPriceSourcePaid or boughtPriceSourcePackage
+	BoughtPriceSource string
+	// ChargeItems is the multi-item charge policy, chargeItemsPrimary or chargeItemsSplit
+	ChargeItems string
+	// ExcludeDeleted leaves out the documents flagged is_deleted, see
+	// softDeletedCollections
+	ExcludeDeleted bool
+	// LongChargeRefs is the policy for a charge object_id or number longer than
+	// models.ChargeRefSize: longRefTruncate, longRefSkip or longRefFail
+	LongChargeRefs string
+	// MoneyAsDecimal rounds the money columns to cents, for a target created with
+	// models.Config.MoneyAsDecimal
+	MoneyAsDecimal bool
+	// AutoMigrate creates a target table a migrator needs when it does not exist,
+	// instead of failing
+	AutoMigrate bool
+	// Collections maps default source collection names to the names used by the
+	// deployment
+	Collections CollectionNames
+	// ContinueOnError logs a failed migration and runs the remaining ones, skipping
+	// those that depend on it; Run still returns an error at the end
+	ContinueOnError bool
+	// CollectionTimeout bounds each migration, its Mongo cursor and its SQL statements;
+	// 0 disables it. With SkipErrors a migration that times out is recorded as failed
+	// and the run goes on without its dependents; Run still returns an error at the end.
+	CollectionTimeout time.Duration
+}
+
+// targetOnlyMigrations read or update rows already in the target database, which a
+// -output run never writes, so they are skipped by it
+var targetOnlyMigrations = map[string]bool{
+	"bonus-package-references":             true,
+	"overlapping-bought-packages":          true,
+	"bought-package-is-auto-extend-column": true,
+	"organization-totals":                  true,
+}
+
+// migration is one step of Run, selected by name with -only and -skip
+type migration struct {
+	name string
+	fn   func(*Migrator, context.Context) (CollectionStats, error)
+	// needs names the earlier steps whose rows this one reads or references; with
+	// -continue-on-error it is skipped when one of them failed
+	needs []string
+}
+
+// migrations lists every step of Run in dependency order
+var migrations = []migration{
+	{"services", (*Migrator).migrateServices, nil},
+	{"organization-merges", (*Migrator).planOrganizationMerges, nil},
+	{"organizations", (*Migrator).migrateOrganizations, []string{"organization-merges"}},
+	{"packages", (*Migrator).migratePackages, nil},
+	{"bonus-package-references", (*Migrator).checkBonusPackageReferences, []string{"packages"}},
+	{"bought-packages", (*Migrator).migrateBoughtPackages, []string{"organizations", "packages"}},
+	{"active-packages", (*Migrator).migrateActivePackages, []string{"bought-packages"}},
+	{"overlapping-bought-packages", (*Migrator).checkOverlappingBoughtPackages, []string{"bought-packages", "active-packages"}},
+	{"charges", (*Migrator).migrateCharges, []string{"organizations", "bought-packages"}},
+	{"payments", (*Migrator).migratePayments, []string{"organizations"}},
+	{"payme-transactions", (*Migrator).migratePaymeTransactions, []string{"organizations"}},
+	{"organization-balance-bindings", (*Migrator).migrateOrganizationBalanceBindings, []string{"organizations"}},
+	{"credit-updates", (*Migrator).migrateCreditUpdates, []string{"organizations"}},
+	{"bank-payments-auto-apply-errors", (*Migrator).migrateBankPaymentAutoApplyErrors, nil},
+	{"bought-package-is-auto-extend-column", (*Migrator).migrateBoughtPackageIsAutoExtendColumn, []string{"bought-packages", "active-packages"}},
+	{"organization-totals", (*Migrator).reconcileOrganizationTotals, []string{"organizations", "payments", "credit-updates"}},
+}
+
+// allMigrations returns the built-in migrations followed by those of opts.GenericTables
+func (opts Options) allMigrations() []migration {
+	all := append([]migration(nil), migrations...)
+	for _, t := range opts.GenericTables {
+		all = append(all, t.migration())
+	}
+	return all
+}
+
+// selectMigrations returns the migrations of opts named in opts.Only (all when empty)
+// minus those in opts.Skip, keeping the dependency order. Unknown names are an error
+// listing the valid ones.
+func selectMigrations(opts Options) ([]migration, error) {
+	all := opts.allMigrations()
+	only, skip := opts.Only, opts.Skip
+	run := make(map[string]bool, len(all))
+	names := make([]string, 0, len(all))
+	for _, mig := range all {
+		run[mig.name] = len(only) == 0
+		names = append(names, mig.name)
+	}
+	for _, list := range [][]string{only, skip} {
+		for _, name := range list {
+			if _, ok := run[name]; !ok {
+				return nil, fmt.Errorf("unknown migration %q, valid names: %s", name, strings.Join(names, ", "))
+			}
+		}
+	}
+	for _, name := range only {
+		run[name] = true
+	}
+	for _, name := range skip {
+		run[name] = false
+	}
+
+	var selected []migration
+	for _, mig := range all {
+		if run[mig.name] {
+			selected = append(selected, mig)
+		}
+	}
+	return selected, nil
+}
+
+// keepTablesReason returns why a run with opts must keep the existing target tables
+// instead of recreating them, or "" when it may recreate them
+func keepTablesReason(opts Options) string {
+	switch {
+	case len(opts.Only) > 0 || len(opts.Skip) > 0:
+		// Recreating the tables would drop the data of the migrations not run
+		return "only some migrations run"
+	case opts.Incremental:
+		// or the rows synced by earlier runs
+		return "-incremental is set"
+	case opts.dateWindowed():
+		// or the rows outside the window
+		return "-since or -until is set"
+	}
+	return ""
+}
+
+// Migrator copies the billing collections of a MongoDB database into MySQL
+type Migrator struct {
+	source sourceDatabase
+	mysql  models.Database
+	opts   Options
+
+	// failures receives migration_errors rows outside any collection transaction,
+	// so they survive its rollback
+	failures   models.Database
+	limiter    *rateLimiter
+	checkpoint *checkpoint
+	output     *jsonlOutput
+	metrics    *metrics
+	// capture and sample are set by -verify: the documents of sample are mapped into
+	// capture instead of being written
+	capture   *rowCapture
+	sample    map[string][]interface{}
+	oversized map[string]map[string]bool
+	// moneyRounded counts the money values per table rounded by roundMoney
+	moneyRounded map[string]int
+	// orgMerges maps duplicate organization ids to their canonical organization
+	orgMerges map[string]string
+	// orphans counts the rows per collection dropped by -check-refs
+	orphans map[string]int
+	// missingRefs counts the documents per collection skipped for a zero reference
+	missingRefs map[string]int
+	// failed counts the records per collection stored in migration_errors
+	failed map[string]int
+	// countAdjustments counts the rows per table written beyond (split charges) or
+	// short of (merged organizations) one per source document, see reconcile
+	countAdjustments map[string]int
+	summary          *runSummary
+	// tables caches the target tables requireTables found
+	tables map[string]bool
+	// watermarks holds the -incremental watermarks of the running step, saved to
+	// sync_state once it completes
+	watermarks map[string]time.Time
+}
+
+// NewMigratorWithClients creates a Migrator on top of existing connections, so callers
+// can reuse their pooled Mongo and MySQL clients. The schema must already be migrated.
+func NewMigratorWithClients(mdb *mongo.Database, db models.Database, opts Options) *Migrator {
+	return newMigrator(mongoSource{db: mdb}, db, opts)
+}
+
+// newMigrator creates a Migrator reading source
+func newMigrator(source sourceDatabase, db models.Database, opts Options) *Migrator {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.OnOrphan == "" {
+		opts.OnOrphan = onOrphanSkip
+	}
+	if opts.OnConflict == "" {
+		opts.OnConflict = onConflictSkip
+	}
+	if opts.IDFormat == "" {
+		opts.IDFormat = idFormatHex
+	}
+	if opts.BoughtPriceSource == "" {
+		opts.BoughtPriceSource = boughtPriceSourcePaid
+	}
+	if opts.ChargeItems == "" {
+		opts.ChargeItems = chargeItemsPrimary
+	}
+	if opts.LongChargeRefs == "" {
+		opts.LongChargeRefs = longRefFail
+	}
+	return &Migrator{
+		source:           source,
+		mysql:            db,
+		opts:             opts,
+		failures:         db,
+		limiter:          newRateLimiter(opts.RateLimit),
+		metrics:          newMetrics(),
+		oversized:        make(map[string]map[string]bool),
+		moneyRounded:     make(map[string]int),
+		orgMerges:        make(map[string]string),
+		orphans:          make(map[string]int),
+		missingRefs:      make(map[string]int),
+		failed:           make(map[string]int),
+		countAdjustments: make(map[string]int),
+		summary:          &runSummary{},
+		tables:           make(map[string]bool),
+		watermarks:       make(map[string]time.Time),
+	}
+}
+
+// Run migrates every collection in dependency order. When ctx is cancelled the batch
+// being read is still written, then Run stops and returns the context error.
+func (m *Migrator) Run(ctx context.Context) error {
+	m.summary.startedAt = time.Now()
+	if (m.opts.OutputErrorsToMySQL || m.opts.SkipErrors) && m.opts.Output == "" {
+		// Not part of Migrate so failures of previous runs are kept
+		if err := m.mysql.GetDB().AutoMigrate(&models.MigrationError{}); err != nil {
+			return fmt.Errorf("could not create %s: %w", (&models.MigrationError{}).TableName(), err)
+		}
+	}
+
+	if m.opts.CheckRefs && m.opts.OnOrphan == onOrphanQuarantine && m.opts.Output == "" {
+		if err := m.mysql.GetDB().AutoMigrate(&models.OrphanRecord{}); err != nil {
+			return fmt.Errorf("could not create %s: %w", (&models.OrphanRecord{}).TableName(), err)
+		}
+	}
+
+	if m.opts.Incremental {
+		if err := m.mysql.GetDB().AutoMigrate(&models.SyncState{}); err != nil {
+			return fmt.Errorf("could not create %s: %w", (&models.SyncState{}).TableName(), err)
+		}
+	}
+
+	cp, err := loadCheckpoint(m.opts.CheckpointFile, m.opts.CheckpointInterval, m.opts.Restart)
+	if err != nil {
+		return fmt.Errorf("could not load checkpoint: %w", err)
+	}
+	m.checkpoint = cp
+
+	out, err := newJSONLOutput(m.opts.Output)
+	if err != nil {
+		return err
+	}
+	m.output = out
+	// Closes the files of a failed run; a successful one closes them below
+	defer m.output.Close()
+	// Progress is only advanced after writes succeed, so it is saved on failure too
+	defer func() {
+		if err := m.checkpoint.save(); err != nil {
+			slog.Warn("could not save checkpoint", "error", err)
+		}
+	}()
+
+	selected, err := selectMigrations(m.opts)
+	if err != nil {
+		return err
+	}
+
+	// failed and skipped steps of -continue-on-error and steps timed out under
+	// -skip-errors, whose dependents are skipped
+	unfinished := make(map[string]bool)
+	for _, migration := range selected {
+		if m.output != nil && targetOnlyMigrations[migration.name] {
+			slog.Info("skipping migration", "migration", migration.name, "reason", "output")
+			continue
+		}
+		if m.opts.Incremental && undatedMigrations[migration.name] {
+			slog.Info("skipping migration", "migration", migration.name, "reason", "incremental, the collection has no created_at")
+			continue
+		}
+		if need := firstUnfinished(migration.needs, unfinished); need != "" {
+			reason := "depends on " + need + ", which did not complete"
+			slog.Warn("skipping migration", "migration", migration.name, "reason", reason)
+			m.summary.addFailure(migration.name, "skipped", reason)
+			unfinished[migration.name] = true
+			continue
+		}
+		args := []any{"migration", migration.name}
+		if m.opts.Limit > 0 {
+			// Counts of a limited run are not those of a full migration
+			args = append(args, "limit", m.opts.Limit)
+		}
+		slog.Info("starting migration", args...)
+		m.metrics.setCurrent(migration.name)
+		m.summary.startStep()
+		stats, err := m.run(ctx, migration.fn)
+		// A step that fails after its final flush, e.g. interrupted, still reports what
+		// it wrote
+		m.summary.addStats(stats)
+		if err != nil {
+			// The documents read by the failed step are read again by the next run
+			clear(m.watermarks)
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				slog.Error("migration exceeded -collection-timeout", "migration", migration.name, "timeout", m.opts.CollectionTimeout)
+				if m.opts.SkipErrors {
+					m.summary.addFailure(migration.name, "timed out", err.Error())
+					unfinished[migration.name] = true
+					continue
+				}
+			}
+			if !m.opts.ContinueOnError || ctx.Err() != nil {
+				return fmt.Errorf("migration %s failed: %w", migration.name, err)
+			}
+			slog.Error("migration failed, continuing with the next one", "migration", migration.name, "error", err)
+			m.summary.addFailure(migration.name, "failed", err.Error())
+			unfinished[migration.name] = true
+			continue
+		}
+		if err := m.saveWatermarks(ctx); err != nil {
+			return err
+		}
+		slog.Info("completed migration", args...)
+	}
+	m.metrics.setCurrent("")
+
+	m.reportOversized()
+	m.reportMoneyRounding()
+	m.reportOrphans()
+	m.reportMissingRefs()
+	m.reportFailures()
+
+	if err := m.output.Close(); err != nil {
+		return err
+	}
+	if failed := m.summary.failedMigrations(); len(failed) > 0 {
+		return fmt.Errorf("migrations did not complete: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// firstUnfinished returns the first of needs found in unfinished, or ""
+func firstUnfinished(needs []string, unfinished map[string]bool) string {
+	for _, need := range needs {
+		if unfinished[need] {
+			return need
+		}
+	}
+	return ""
+}
+
+// run calls fn, inside a transaction when -tx-per-collection is set, and returns its
+// counters. The migrator passed to fn then reads and writes MySQL through the
+// transaction only.
+//
+// With -collection-timeout both fn's context and its SQL statements expire after the
+// timeout. The statements are not cancelled by an interrupt, so the batch read before
+// it is still written.
+func (m *Migrator) run(ctx context.Context, fn func(*Migrator, context.Context) (CollectionStats, error)) (CollectionStats, error) {
+	db := m.mysql.GetDB()
+	if m.opts.CollectionTimeout > 0 {
+		var cancel, cancelDB context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.opts.CollectionTimeout)
+		defer cancel()
+		var dbCtx context.Context
+		dbCtx, cancelDB = context.WithTimeout(context.WithoutCancel(ctx), m.opts.CollectionTimeout)
+		defer cancelDB()
+		db = db.WithContext(dbCtx)
+	}
+
+	if !m.opts.TxPerCollection {
+		if m.opts.CollectionTimeout == 0 {
+			return fn(m, ctx)
+		}
+		scoped := *m
+		scoped.mysql = txDatabase{Database: m.mysql, tx: db}
+		return fn(&scoped, ctx)
+	}
+	// Checkpoint progress made inside the transaction only counts once it commits
+	staged := m.checkpoint.stage()
+	var stats CollectionStats
+	err := db.Transaction(func(tx *gorm.DB) error {
+		scoped := *m
+		scoped.mysql = txDatabase{Database: m.mysql, tx: tx}
+		scoped.checkpoint = staged
+		var err error
+		stats, err = fn(&scoped, ctx)
+		return err
+	})
+	if err != nil {
+		// Nothing was written
+		return CollectionStats{}, err
+	}
+	return stats, m.checkpoint.commit(staged)
+}
+
+// txDatabase exposes a running transaction, or a session bound to a context, as a
+// models.Database
+type txDatabase struct {
+	models.Database
+	tx *gorm.DB
+}
+
+func (d txDatabase) GetDB() *gorm.DB {
+	return d.tx
+}
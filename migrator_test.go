@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRunBoundsMigrationByCollectionTimeout(t *testing.T) {
+	m, _ := newDryRunMigrator(t, cannedSource{}, Options{CollectionTimeout: 10 * time.Millisecond})
+	_, err := m.run(context.Background(), func(m *Migrator, ctx context.Context) (CollectionStats, error) {
+		if _, ok := m.mysql.GetDB().Statement.Context.Deadline(); !ok {
+			t.Error("the SQL statements have no deadline")
+		}
+		<-ctx.Done()
+		return CollectionStats{}, ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error is %v, expected the deadline to be exceeded", err)
+	}
+}
+
+func TestMigrationStopsOnCancelledContext(t *testing.T) {
+	org := bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}
+	source := cannedSource{"payments": {
+		bson.M{"_id": selfTestID(60), "created_at": time.Now(), "amount": 100.0, "organization": org},
+		bson.M{"_id": selfTestID(61), "created_at": time.Now(), "amount": 200.0, "organization": org},
+	}}
+	m, dir := newOutputMigrator(t, source, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.migratePayments(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("error is %v, expected the cancellation", err)
+	}
+	if rows := outputRows(t, m, dir, "payments"); len(rows) != 0 {
+		t.Errorf("wrote %d payments after the cancellation", len(rows))
+	}
+}
+
+func TestRunRecordsTimedOutMigration(t *testing.T) {
+	var ran []string
+	step := func(name string, slow bool) func(*Migrator, context.Context) (CollectionStats, error) {
+		return func(_ *Migrator, ctx context.Context) (CollectionStats, error) {
+			ran = append(ran, name)
+			if slow {
+				<-ctx.Done()
+				return CollectionStats{}, ctx.Err()
+			}
+			return CollectionStats{}, nil
+		}
+	}
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	migrations = []migration{
+		{"slow", step("slow", true), nil},
+		{"dependent", step("dependent", false), []string{"slow"}},
+		{"independent", step("independent", false), nil},
+	}
+
+	m, _ := newOutputMigrator(t, cannedSource{}, Options{SkipErrors: true, CollectionTimeout: 10 * time.Millisecond})
+	if err := m.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "slow, dependent") {
+		t.Errorf("error is %v, expected slow and dependent to be reported", err)
+	}
+	if strings.Join(ran, ",") != "slow,independent" {
+		t.Errorf("ran %v, expected the dependent of the timed out migration to be skipped", ran)
+	}
+}
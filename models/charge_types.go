@@ -0,0 +1,128 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChargeType identifies the kind of document a charge was made for
+type ChargeType int
+
+const (
+	EDIInvoiceType                 ChargeType = 1
+	EDIReturnInvoiceType           ChargeType = 2
+	EDIAttorneyType                ChargeType = 3
+	RoamingInvoiceType             ChargeType = 4
+	RoamingHybridInvoiceType       ChargeType = 5
+	RoamingConstructionInvoiceType ChargeType = 6
+	RoamingWaybillType             ChargeType = 7
+	RoamingContractType            ChargeType = 8
+	RoamingEmpowermentType         ChargeType = 9
+	RoamingVerificationActType     ChargeType = 10
+	RoamingActType                 ChargeType = 11
+	RoamingWaybillV2Type           ChargeType = 12
+	FreeFormDocumentType           ChargeType = 13
+)
+
+// ChargeDateSource records where the date1 of a charge came from
+type ChargeDateSource string
+
+const (
+	// ChargeDateDocument is the date of the embedded charge document
+	ChargeDateDocument ChargeDateSource = "document"
+	// ChargeDateCreatedAtFallback is the created_at of a charge without a document date
+	ChargeDateCreatedAtFallback ChargeDateSource = "created_at_fallback"
+	// ChargeDateNone leaves date1 NULL, the date being outside the accepted range
+	ChargeDateNone ChargeDateSource = "none"
+)
+
+// ChargeDocument describes an embedded charge document: the field holding it, the
+// charge type it implies and the fields its dates are read from.
+type ChargeDocument struct {
+	Field      string
+	Type       ChargeType
+	Date1Field string
+	Date2Field string
+}
+
+// ChargeDocuments lists the embedded documents in detection order; a charge holding
+// several of them gets the type of the first one.
+var ChargeDocuments = []ChargeDocument{
+	{Field: "roaming_invoice", Type: RoamingInvoiceType, Date1Field: "date"},
+	{Field: "roaming_contract", Type: RoamingContractType, Date1Field: "date"},
+	{Field: "roaming_waybill", Type: RoamingWaybillType, Date1Field: "date"},
+	{Field: "roaming_act", Type: RoamingActType, Date1Field: "date"},
+	{Field: "roaming_verification_act", Type: RoamingVerificationActType, Date1Field: "date"},
+	{Field: "roaming_empowerment", Type: RoamingEmpowermentType, Date1Field: "start_date", Date2Field: "end_date"},
+	{Field: "edi_return_invoice", Type: EDIReturnInvoiceType, Date1Field: "date"},
+	{Field: "edi_attorney", Type: EDIAttorneyType, Date1Field: "start_date", Date2Field: "end_date"},
+	{Field: "edi_invoice", Type: EDIInvoiceType, Date1Field: "date"},
+	{Field: "roaming_constructor_invoice", Type: RoamingConstructionInvoiceType, Date1Field: "date"},
+	{Field: "roaming_waybill_v2", Type: RoamingWaybillV2Type, Date1Field: "date"},
+	{Field: "free_form_document", Type: FreeFormDocumentType, Date1Field: "date"},
+	{Field: "roaming_hybrid_invoice", Type: RoamingHybridInvoiceType, Date1Field: "date"},
+}
+
+// ChargeDocumentFields returns the paths of the embedded document fields read by
+// DetectChargeDocument and Extract, for a projection that leaves the rest of the
+// (large) embedded documents on the server
+func ChargeDocumentFields() []string {
+	var fields []string
+	for _, d := range ChargeDocuments {
+		fields = append(fields, d.Field+"._id", d.Field+".number")
+		for _, date := range []string{d.Date1Field, d.Date2Field} {
+			if date != "" {
+				fields = append(fields, d.Field+"."+date)
+			}
+		}
+	}
+	return fields
+}
+
+// DetectChargeDocument returns the descriptor and decoded content of the first
+// embedded document present in charge. ok is false when the charge has none.
+func DetectChargeDocument(charge bson.Raw) (d ChargeDocument, doc map[string]interface{}, ok bool, err error) {
+	for _, d := range ChargeDocuments {
+		value, lookupErr := charge.LookupErr(d.Field)
+		if lookupErr != nil || value.Type == bson.TypeNull {
+			continue
+		}
+		if err := value.Unmarshal(&doc); err != nil {
+			return d, nil, false, err
+		}
+		return d, doc, true, nil
+	}
+	return ChargeDocument{}, nil, false, nil
+}
+
+// Extract reads the object id, number and dates of an embedded document described by d
+func (d ChargeDocument) Extract(doc map[string]interface{}) (objectID, number string, date1, date2 *time.Time) {
+	objectID, _ = doc["_id"].(string)
+	number, _ = doc["number"].(string)
+	if d.Date1Field != "" {
+		date1 = extractTime(doc, d.Date1Field)
+	}
+	if d.Date2Field != "" {
+		date2 = extractTime(doc, d.Date2Field)
+	}
+	return objectID, number, date1, date2
+}
+
+// extractTime reads the date at key of a decoded embedded document. Dates decode to
+// primitive.DateTime inside maps, but time.Time and RFC 3339 strings are accepted too.
+func extractTime(m map[string]interface{}, key string) *time.Time {
+	switch v := m[key].(type) {
+	case primitive.DateTime:
+		t := v.Time().UTC()
+		return &t
+	case time.Time:
+		return &v
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
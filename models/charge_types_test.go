@@ -0,0 +1,60 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDetectChargeDocumentDates(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	end := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		charge       bson.M
+		typ          ChargeType
+		date1, date2 *time.Time
+	}{
+		{"BSON date", bson.M{"roaming_invoice": bson.M{"_id": "INV-1", "number": "42", "date": start}}, RoamingInvoiceType, &start, nil},
+		{"start and end dates", bson.M{"edi_attorney": bson.M{"_id": "A-1", "start_date": start, "end_date": end}}, EDIAttorneyType, &start, &end},
+		{"RFC 3339 string", bson.M{"roaming_act": bson.M{"_id": "ACT-1", "date": "2024-03-01T09:30:00Z"}}, RoamingActType, &start, nil},
+		{"missing date", bson.M{"roaming_contract": bson.M{"_id": "C-1"}}, RoamingContractType, nil, nil},
+		{"unparsable date", bson.M{"roaming_waybill": bson.M{"_id": "W-1", "date": "yesterday"}}, RoamingWaybillType, nil, nil},
+		{"first document wins", bson.M{"edi_invoice": bson.M{"date": end}, "roaming_invoice": bson.M{"date": start}}, RoamingInvoiceType, &start, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := bson.Marshal(tt.charge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, doc, ok, err := DetectChargeDocument(raw)
+			if err != nil || !ok {
+				t.Fatalf("no document detected: %v", err)
+			}
+			if d.Type != tt.typ {
+				t.Errorf("type is %d, expected %d", d.Type, tt.typ)
+			}
+			_, _, date1, date2 := d.Extract(doc)
+			for _, date := range []struct {
+				name      string
+				got, want *time.Time
+			}{{"date1", date1, tt.date1}, {"date2", date2, tt.date2}} {
+				if (date.got == nil) != (date.want == nil) || (date.got != nil && !date.got.Equal(*date.want)) {
+					t.Errorf("%s is %v, expected %v", date.name, date.got, date.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectChargeDocumentNone(t *testing.T) {
+	raw, err := bson.Marshal(bson.M{"price": 500.0, "roaming_invoice": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := DetectChargeDocument(raw); ok || err != nil {
+		t.Errorf("detected a document in a charge without one: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// maxDuplicateExamples is the number of duplicate keys a DuplicateKeysError shows per
+// index
+const maxDuplicateExamples = 5
+
+// DuplicateKeys are the rows of an existing table that share a key of a unique index
+// Migrate is about to add
+type DuplicateKeys struct {
+	Table, Index string
+	Columns      []string
+	// Keys is the number of duplicated keys and Examples a few of them, with their
+	// row counts
+	Keys     int64
+	Examples []string
+}
+
+// DuplicateKeysError is returned by Migrate when a unique index cannot be added to an
+// existing table without Config.AutoDedupe
+type DuplicateKeysError struct {
+	Duplicates []DuplicateKeys
+}
+
+func (e *DuplicateKeysError) Error() string {
+	parts := make([]string, len(e.Duplicates))
+	for i, d := range e.Duplicates {
+		parts[i] = fmt.Sprintf("%s has %d duplicate (%s) keys blocking unique index %s, e.g. %s",
+			d.Table, d.Keys, strings.Join(d.Columns, ", "), d.Index, strings.Join(d.Examples, "; "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// checkUniqueIndexes looks for duplicate keys in the existing tables of models whose
+// unique indexes do not exist yet, before AutoMigrate fails half way through adding
+// them. With dedupe the duplicates are deleted, keeping the row with the lowest id of
+// every key; otherwise they are returned as a *DuplicateKeysError. Rows with a NULL
+// key column never conflict and are left alone.
+func checkUniqueIndexes(db *gorm.DB, dedupe bool, models ...interface{}) error {
+	migrator := db.Migrator()
+	var found []DuplicateKeys
+	for _, model := range models {
+		if !migrator.HasTable(model) {
+			continue
+		}
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		for _, index := range stmt.Schema.ParseIndexes() {
+			if index.Class != "UNIQUE" || migrator.HasIndex(model, index.Name) {
+				continue
+			}
+			dup, err := duplicateKeys(db, stmt, index)
+			if err != nil {
+				return err
+			}
+			if dup.Keys == 0 {
+				continue
+			}
+			if !dedupe {
+				found = append(found, dup)
+				continue
+			}
+			deleted, err := deleteDuplicates(db, stmt, index)
+			if err != nil {
+				return err
+			}
+			slog.Warn("deleted duplicate keys before adding a unique index", "table", dup.Table, "index", dup.Index,
+				"keys", dup.Keys, "rows_deleted", deleted)
+		}
+	}
+	if len(found) > 0 {
+		return &DuplicateKeysError{Duplicates: found}
+	}
+	return nil
+}
+
+// keyColumns returns the columns of index quoted for SQL, with a condition excluding
+// rows where any of them is NULL
+func keyColumns(stmt *gorm.Statement, index schema.Index) (names []string, columns, notNull string) {
+	quoted := make([]string, len(index.Fields))
+	conditions := make([]string, len(index.Fields))
+	for i, f := range index.Fields {
+		names = append(names, f.DBName)
+		quoted[i] = stmt.Quote(f.DBName)
+		conditions[i] = quoted[i] + " IS NOT NULL"
+	}
+	return names, strings.Join(quoted, ", "), strings.Join(conditions, " AND ")
+}
+
+// duplicateKeys counts the keys of index shared by more than one row of its table
+func duplicateKeys(db *gorm.DB, stmt *gorm.Statement, index schema.Index) (DuplicateKeys, error) {
+	names, columns, notNull := keyColumns(stmt, index)
+	dup := DuplicateKeys{Table: stmt.Schema.Table, Index: index.Name, Columns: names}
+	groups := fmt.Sprintf("SELECT %s, COUNT(*) AS duplicate_rows FROM %s WHERE %s GROUP BY %s HAVING COUNT(*) > 1",
+		columns, stmt.Quote(stmt.Schema.Table), notNull, columns)
+
+	if err := db.Raw("SELECT COUNT(*) FROM (" + groups + ") AS duplicate_keys").Scan(&dup.Keys).Error; err != nil {
+		return dup, fmt.Errorf("could not check %s for duplicate keys: %w", dup.Table, err)
+	}
+	if dup.Keys == 0 {
+		return dup, nil
+	}
+	var examples []map[string]interface{}
+	if err := db.Raw(fmt.Sprintf("%s LIMIT %d", groups, maxDuplicateExamples)).Scan(&examples).Error; err != nil {
+		return dup, fmt.Errorf("could not read the duplicate keys of %s: %w", dup.Table, err)
+	}
+	for _, example := range examples {
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = fmt.Sprintf("%v", example[name])
+			if b, ok := example[name].([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		dup.Examples = append(dup.Examples, fmt.Sprintf("(%s) x%v", strings.Join(values, ", "), example["duplicate_rows"]))
+	}
+	return dup, nil
+}
+
+// deleteDuplicates deletes every row of a duplicated key of index but the one with the
+// lowest primary key and returns the number of rows deleted
+func deleteDuplicates(db *gorm.DB, stmt *gorm.Statement, index schema.Index) (int64, error) {
+	pk := stmt.Schema.PrioritizedPrimaryField
+	if pk == nil {
+		return 0, fmt.Errorf("cannot dedupe %s: it has no primary key", stmt.Schema.Table)
+	}
+	_, columns, notNull := keyColumns(stmt, index)
+	table, id := stmt.Quote(stmt.Schema.Table), stmt.Quote(pk.DBName)
+	// The derived table lets MySQL read the table it deletes from
+	result := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s AND %s NOT IN (SELECT id FROM (SELECT MIN(%s) AS id FROM %s WHERE %s GROUP BY %s) AS kept)",
+		table, notNull, id, id, table, notNull, columns))
+	if result.Error != nil {
+		return 0, fmt.Errorf("could not dedupe %s: %w", stmt.Schema.Table, result.Error)
+	}
+	return result.RowsAffected, nil
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// scriptedAnswer is the result a scriptedConn returns for queries containing match
+type scriptedAnswer struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+}
+
+// scriptedConn is a database/sql connection that answers queries from a script and
+// records every statement, standing in for a MySQL server holding seeded rows
+type scriptedConn struct {
+	answers  []scriptedAnswer
+	affected int64
+	executed []string
+}
+
+func (c *scriptedConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *scriptedConn) Driver() driver.Driver                        { return nil }
+func (c *scriptedConn) Prepare(string) (driver.Stmt, error)          { return nil, errors.New("not supported") }
+func (c *scriptedConn) Close() error                                 { return nil }
+func (c *scriptedConn) Begin() (driver.Tx, error)                    { return nil, errors.New("not supported") }
+
+func (c *scriptedConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.executed = append(c.executed, query)
+	for _, a := range c.answers {
+		if strings.Contains(query, a.match) {
+			return &scriptedRows{columns: a.columns, rows: a.rows}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected query %s", query)
+}
+
+func (c *scriptedConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.executed = append(c.executed, query)
+	return driver.RowsAffected(c.affected), nil
+}
+
+type scriptedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *scriptedRows) Columns() []string { return r.columns }
+func (r *scriptedRows) Close() error      { return nil }
+
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// seededPackageItems scripts a package_items table without its unique index that holds
+// two rows of package p1 with code 101
+func seededPackageItems(t *testing.T) (*gorm.DB, *scriptedConn) {
+	t.Helper()
+	conn := &scriptedConn{affected: 1, answers: []scriptedAnswer{
+		{"SCHEMATA", []string{"SCHEMA_NAME"}, [][]driver.Value{{"billing"}}},
+		{"DATABASE()", []string{"DATABASE()"}, [][]driver.Value{{"billing"}}},
+		{"information_schema.tables", []string{"count(*)"}, [][]driver.Value{{int64(1)}}},
+		{"information_schema.statistics", []string{"count(*)"}, [][]driver.Value{{int64(0)}}},
+		{"AS duplicate_keys", []string{"COUNT(*)"}, [][]driver.Value{{int64(1)}}},
+		{"HAVING COUNT(*) > 1 LIMIT", []string{"package_id", "code", "duplicate_rows"}, [][]driver.Value{{[]byte("p1"), int64(101), int64(2)}}},
+	}}
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: sql.OpenDB(conn), SkipInitializeWithVersion: true}),
+		&gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, conn
+}
+
+func TestCheckUniqueIndexesReportsDuplicates(t *testing.T) {
+	db, conn := seededPackageItems(t)
+	err := checkUniqueIndexes(db, false, &PackageItem{})
+	var dup *DuplicateKeysError
+	if !errors.As(err, &dup) {
+		t.Fatalf("error is %v, expected a *DuplicateKeysError", err)
+	}
+	want := "package_items has 1 duplicate (package_id, code) keys blocking unique index idx_package_items_code, e.g. (p1, 101) x2"
+	if err.Error() != want {
+		t.Errorf("error is %q, expected %q", err, want)
+	}
+	for _, q := range conn.executed {
+		if strings.HasPrefix(q, "DELETE") {
+			t.Errorf("deleted rows without -auto-dedupe: %s", q)
+		}
+	}
+}
+
+func TestCheckUniqueIndexesDedupes(t *testing.T) {
+	db, conn := seededPackageItems(t)
+	if err := checkUniqueIndexes(db, true, &PackageItem{}); err != nil {
+		t.Fatal(err)
+	}
+	want := "DELETE FROM `package_items` WHERE `package_id` IS NOT NULL AND `code` IS NOT NULL AND `id` NOT IN " +
+		"(SELECT id FROM (SELECT MIN(`id`) AS id FROM `package_items` WHERE `package_id` IS NOT NULL AND `code` IS NOT NULL " +
+		"GROUP BY `package_id`, `code`) AS kept)"
+	if last := conn.executed[len(conn.executed)-1]; last != want {
+		t.Errorf("ran %s, expected %s", last, want)
+	}
+}
+
+func TestCheckUniqueIndexesSkipsExistingIndex(t *testing.T) {
+	db, conn := seededPackageItems(t)
+	conn.answers[3].rows = [][]driver.Value{{int64(1)}}
+	if err := checkUniqueIndexes(db, false, &PackageItem{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range conn.executed {
+		if strings.Contains(q, "GROUP BY") {
+			t.Errorf("checked a table whose unique index exists: %s", q)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EmbeddedOrg is an organization embedded in a source document. Most collections
+// store its id under _id, organizationBalanceBindings under id; both are read, _id
+// first, so neither spelling decodes as a zero ObjectID.
+type EmbeddedOrg struct {
+	ID   primitive.ObjectID
+	Name string
+	Inn  string
+}
+
+// UnmarshalBSON decodes an embedded organization document. A null value, which the
+// driver passes as no data, leaves the zero organization.
+func (o *EmbeddedOrg) UnmarshalBSON(data []byte) error {
+	if len(data) == 0 {
+		*o = EmbeddedOrg{}
+		return nil
+	}
+	var doc struct {
+		UnderscoreID primitive.ObjectID `bson:"_id"`
+		ID           primitive.ObjectID `bson:"id"`
+		Name         string             `bson:"name"`
+		Inn          string             `bson:"inn"`
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	o.ID = doc.UnderscoreID
+	if o.ID.IsZero() {
+		o.ID = doc.ID
+	}
+	o.Name, o.Inn = doc.Name, doc.Inn
+	return nil
+}
+
+// EmbeddedAccount is the user account embedded in payments and credit updates
+type EmbeddedAccount struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Name     string             `bson:"name"`
+	Username string             `bson:"username"`
+}
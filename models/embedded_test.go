@@ -0,0 +1,72 @@
+package models
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEmbeddedOrgIDSpellings(t *testing.T) {
+	first := primitive.NewObjectID()
+	second := primitive.NewObjectID()
+	tests := []struct {
+		name string
+		org  interface{}
+		want EmbeddedOrg
+	}{
+		{"_id", bson.M{"_id": first, "name": "Alpha LLC", "inn": "123456789"}, EmbeddedOrg{first, "Alpha LLC", "123456789"}},
+		{"id", bson.M{"id": first, "name": "Alpha LLC"}, EmbeddedOrg{ID: first, Name: "Alpha LLC"}},
+		{"_id before id", bson.M{"_id": first, "id": second}, EmbeddedOrg{ID: first}},
+		{"no id", bson.M{"name": "Alpha LLC"}, EmbeddedOrg{Name: "Alpha LLC"}},
+		{"null", nil, EmbeddedOrg{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := bson.Marshal(bson.M{"organization": tt.org})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var doc struct {
+				Organization EmbeddedOrg `bson:"organization"`
+			}
+			doc.Organization = EmbeddedOrg{ID: second, Name: "stale"}
+			if err := bson.Unmarshal(data, &doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc.Organization != tt.want {
+				t.Errorf("decoded %+v, expected %+v", doc.Organization, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedAccountDecode(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name    string
+		account interface{}
+		want    EmbeddedAccount
+	}{
+		{"complete", bson.M{"_id": id, "name": "Operator", "username": "operator"}, EmbeddedAccount{id, "Operator", "operator"}},
+		{"without username", bson.M{"_id": id, "name": "Operator"}, EmbeddedAccount{ID: id, Name: "Operator"}},
+		{"absent", nil, EmbeddedAccount{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := bson.Marshal(bson.M{"account": tt.account})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var doc struct {
+				Account EmbeddedAccount `bson:"account"`
+			}
+			if err := bson.Unmarshal(data, &doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc.Account != tt.want {
+				t.Errorf("decoded %+v, expected %+v", doc.Account, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package models
+
+import "fmt"
+
+// PaymeTransactionStates labels PaymeTransaction.State, the transaction states of the
+// Payme merchant API
+var PaymeTransactionStates = map[int]string{
+	1:  "created",
+	2:  "performed",
+	-1: "cancelled",
+	-2: "cancelled_after_perform",
+}
+
+// PaymeCancelReasons labels PaymeTransaction.Reason, the cancel reasons of the Payme
+// merchant API. A transaction that was not cancelled has reason 0 and no label.
+var PaymeCancelReasons = map[int]string{
+	1:  "receiver_not_found",
+	2:  "debit_operation_error",
+	3:  "transaction_error",
+	4:  "timeout",
+	5:  "refund",
+	10: "unknown_error",
+}
+
+// PaymentMethods labels Payment.Method. The billing service defines the values and
+// they are not documented in the source data, so the labels are supplied per
+// deployment with -payment-method-labels; unlisted methods get "unknown(<n>)".
+var PaymentMethods = map[int]string{}
+
+// EnumLabel returns the label of value in labels, or "unknown(<value>)" so unmapped
+// values stay visible in the label column
+func EnumLabel(labels map[int]string, value int) string {
+	if label, ok := labels[value]; ok {
+		return label
+	}
+	return fmt.Sprintf("unknown(%d)", value)
+}
@@ -0,0 +1,30 @@
+package models
+
+import "testing"
+
+func TestEnumLabel(t *testing.T) {
+	tests := []struct {
+		labels map[int]string
+		value  int
+		want   string
+	}{
+		{PaymeTransactionStates, 1, "created"},
+		{PaymeTransactionStates, 2, "performed"},
+		{PaymeTransactionStates, -1, "cancelled"},
+		{PaymeTransactionStates, -2, "cancelled_after_perform"},
+		{PaymeTransactionStates, 3, "unknown(3)"},
+		{PaymeCancelReasons, 1, "receiver_not_found"},
+		{PaymeCancelReasons, 2, "debit_operation_error"},
+		{PaymeCancelReasons, 3, "transaction_error"},
+		{PaymeCancelReasons, 4, "timeout"},
+		{PaymeCancelReasons, 5, "refund"},
+		{PaymeCancelReasons, 10, "unknown_error"},
+		{PaymeCancelReasons, 7, "unknown(7)"},
+		{PaymentMethods, 1, "unknown(1)"},
+	}
+	for _, tt := range tests {
+		if got := EnumLabel(tt.labels, tt.value); got != tt.want {
+			t.Errorf("EnumLabel(%d) = %q, expected %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ForeignKey is a constraint from a child table column to the id of its parent table.
+// The models declare no associations, so GORM does not create these by itself.
+type ForeignKey struct {
+	Model  interface{}
+	Name   string
+	Column string
+	Parent interface{ TableName() string }
+}
+
+// ForeignKeys lists the constraints added by Migrate with Config.WithFKs. Only child
+// rows that are always inserted after their parent are constrained; references that
+// may dangle in the source, e.g. bonus packages, are left out.
+var ForeignKeys = []ForeignKey{
+	{&OrganizationServiceDemoUses{}, "fk_organization_service_demo_uses_organization", "organization_id", &Organization{}},
+	{&PackageItem{}, "fk_package_items_package", "package_id", &Package{}},
+	{&PackageActivationBonusPackage{}, "fk_package_activation_bonus_packages_package", "package_id", &Package{}},
+	{&BoughtPackageItem{}, "fk_bought_package_items_bought_package", "bought_package_id", &BoughtPackage{}},
+}
+
+// addForeignKeys creates the missing constraints of ForeignKeys
+func addForeignKeys(db *gorm.DB) error {
+	for _, fk := range ForeignKeys {
+		// Constraint names are unique per database, like table names
+		name := tablePrefix + fk.Name
+		if db.Migrator().HasConstraint(fk.Model, name) {
+			continue
+		}
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(fk.Model); err != nil {
+			return err
+		}
+		err := db.Exec("ALTER TABLE ? ADD CONSTRAINT ? FOREIGN KEY (?) REFERENCES ? (?)",
+			clause.Table{Name: stmt.Schema.Table}, clause.Column{Name: name}, clause.Column{Name: fk.Column},
+			clause.Table{Name: fk.Parent.TableName()}, clause.Column{Name: "id"}).Error
+		if err != nil {
+			return fmt.Errorf("could not add foreign key %s: %w", name, err)
+		}
+	}
+	return nil
+}
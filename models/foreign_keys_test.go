@@ -0,0 +1,35 @@
+package models
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm/schema"
+)
+
+func TestChildTablesIndexParentColumns(t *testing.T) {
+	var ddl bytes.Buffer
+	if err := ExportSchema(&ddl, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, fk := range ForeignKeys {
+		s, err := schema.Parse(fk.Model, &sync.Map{}, schema.NamingStrategy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexed := false
+		for _, index := range s.ParseIndexes() {
+			if len(index.Fields) > 0 && index.Fields[0].DBName == fk.Column {
+				indexed = true
+				if !strings.Contains(ddl.String(), "INDEX `"+index.Name+"`") {
+					t.Errorf("the DDL of %s does not create %s", s.Table, index.Name)
+				}
+			}
+		}
+		if !indexed {
+			t.Errorf("%s.%s leads no index", s.Table, fk.Column)
+		}
+	}
+}
@@ -1,23 +1,50 @@
 package models
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 )
 
+// tablePrefix is prepended to the name of every table, see SetTablePrefix
+var tablePrefix string
+
+// SetTablePrefix prefixes the name of every table with prefix, e.g. "tenantA_" so the
+// tables of several source databases can share one target database. Call it before
+// the first table name is taken: GORM caches the parsed models and package-level
+// lists hold table names.
+func SetTablePrefix(prefix string) { tablePrefix = prefix }
+
+// TablePrefix returns the prefix set by SetTablePrefix
+func TablePrefix() string { return tablePrefix }
+
 // MySQL Models
+//
+// The tables migrated from a collection carry a row_hash column holding a hash of the
+// other columns of the row, so an -on-conflict update run only rewrites rows whose
+// source changed. Monetary columns are tagged money, see MoneyDecimalType.
 type Service struct {
 	ID        string    `gorm:"primaryKey;column:id;size:36;not null"`
 	CreatedAt time.Time `gorm:"column:created_at;not null"`
 	Name      string    `gorm:"column:name;size:255;not null"`
 	Code      string    `gorm:"column:code;size:36;not null;uniqueIndex"`
+	RowHash   string    `gorm:"column:row_hash;size:64"`
 }
 
-func (Service) TableName() string { return "services" }
+func (Service) TableName() string { return tablePrefix + "services" }
 
 type Organization struct {
 	ID                           string     `gorm:"primaryKey;column:id;size:36;not null"`
@@ -28,34 +55,39 @@ type Organization struct {
 	Name                         string     `gorm:"column:name; not null"`
 	Inn                          *string    `gorm:"column:inn"`
 	Pinfl                        *string    `gorm:"column:pinfl"`
-	Balance                      float64    `gorm:"column:balance"`
-	FiscalizationBalance         float64    `gorm:"column:fiscalization_balance"`
-	ReservedFiscalizationBalance float64    `gorm:"column:reserved_fiscalization_balance"`
-	TotalPayments                float64    `gorm:"column:total_payments"`
-	CreditAmount                 float64    `gorm:"column:credit_amount"`
+	Balance                      float64    `gorm:"column:balance;money"`
+	FiscalizationBalance         float64    `gorm:"column:fiscalization_balance;money"`
+	ReservedFiscalizationBalance float64    `gorm:"column:reserved_fiscalization_balance;money"`
+	TotalPayments                float64    `gorm:"column:total_payments;money"`
+	CreditAmount                 float64    `gorm:"column:credit_amount;money"`
 	OrganizationCode             string     `gorm:"column:organization_code"`
 	ReferralAgentCode            *string    `gorm:"column:referral_agent_code"`
-	WhiteLabel                   string     `gorm:"column:white-label"`
+	WhiteLabel                   string     `gorm:"column:white_label"`
 	OfferNumber                  string     `gorm:"column:offer_number"`
 	OfferDate                    *time.Time `gorm:"column:offer_date"`
+	RowHash                      string     `gorm:"column:row_hash;size:64"`
 }
 
-func (Organization) TableName() string { return "organizations" }
+func (Organization) TableName() string { return tablePrefix + "organizations" }
 
+// OrganizationServiceDemoUses has no id; a demo use is keyed by its organization and
+// service code, which makes re-inserting one a conflict
 type OrganizationServiceDemoUses struct {
-	OrganizationId string    `gorm:"column:organization_id;size:36;not null"`
-	ServiceCode    string    `gorm:"column:service_code;size:36;not null"`
+	OrganizationId string    `gorm:"column:organization_id;size:36;not null;uniqueIndex:idx_organization_service_demo_uses_code,priority:1"`
+	ServiceCode    string    `gorm:"column:service_code;size:36;not null;uniqueIndex:idx_organization_service_demo_uses_code,priority:2"`
 	UsedAt         time.Time `gorm:"column:used_at;"`
 }
 
-func (OrganizationServiceDemoUses) TableName() string { return "organization_service_demo_uses" }
+func (OrganizationServiceDemoUses) TableName() string {
+	return tablePrefix + "organization_service_demo_uses"
+}
 
 type Package struct {
 	ID                          string    `gorm:"primaryKey;column:id;size:36;not null"`
 	CreatedAt                   time.Time `gorm:"column:created_at;not null"`
 	IsDeleted                   bool      `gorm:"column:is_deleted"`
 	Name                        string    `gorm:"column:name; not null"`
-	Price                       float64   `gorm:"column:price"`
+	Price                       float64   `gorm:"column:price;money"`
 	BRVRate                     float64   `gorm:"column:brv_rate"`
 	DurationDays                int       `gorm:"column:duration_days"`
 	DurationMonths              int       `gorm:"column:duration_months"`
@@ -63,88 +95,103 @@ type Package struct {
 	IsPublic                    bool      `gorm:"column:is_public"`
 	ServiceCode                 string    `gorm:"column:service_code;size:36"`
 	DefaultSetOnNewOrganization bool      `gorm:"column:default_set_on_new_organization"`
+	RowHash                     string    `gorm:"column:row_hash;size:64"`
 }
 
-func (Package) TableName() string { return "packages" }
+func (Package) TableName() string { return tablePrefix + "packages" }
 
 type PackageItem struct {
 	ID                 string  `gorm:"primaryKey;column:id;size:36;not null"`
-	PackageId          string  `gorm:"column:package_id;size:36;not null"`
+	PackageId          string  `gorm:"column:package_id;size:36;not null;uniqueIndex:idx_package_items_code,priority:1"`
 	Name               string  `gorm:"column:name;size:255;not null"`
-	Code               int     `gorm:"column:code;not null"`
+	Code               int     `gorm:"column:code;not null;uniqueIndex:idx_package_items_code,priority:2"`
 	IsOverLimitAllowed bool    `gorm:"column:is_over_limit_allowed"`
-	OverLimitPrice     float64 `gorm:"column:over_limit_price"`
+	OverLimitPrice     float64 `gorm:"column:over_limit_price;money"`
 	BRVRate            float64 `gorm:"column:brv_rate"`
 	IsUnlimited        bool    `gorm:"column:is_unlimited"`
 	Limit              int     `gorm:"column:limit"`
 }
 
-func (PackageItem) TableName() string { return "package_items" }
+func (PackageItem) TableName() string { return tablePrefix + "package_items" }
 
 type PackageActivationBonusPackage struct {
-	PackageId      string `gorm:"column:package_id;size:36;not null"`
-	BonusPackageId string `gorm:"column:bonus_package_id;size:36;not null"`
+	PackageId      string `gorm:"column:package_id;size:36;not null;index"`
+	BonusPackageId string `gorm:"column:bonus_package_id;size:36;not null;index"`
 }
 
-func (PackageActivationBonusPackage) TableName() string { return "package_activation_bonus_packages" }
+func (PackageActivationBonusPackage) TableName() string {
+	return tablePrefix + "package_activation_bonus_packages"
+}
 
 type BoughtPackage struct {
 	ID             string    `gorm:"primaryKey;column:id;size:36;not null"`
-	OrganizationId string    `gorm:"column:organization_id;size:36"`
-	PackageId      string    `gorm:"column:package_id;size:36"`
+	OrganizationId string    `gorm:"column:organization_id;size:36;index"`
+	PackageId      string    `gorm:"column:package_id;size:36;index"`
 	BoughtAt       time.Time `gorm:"column:bought_at;not null"`
 	ExpiresAt      time.Time `gorm:"column:expires_at;not null"`
 	IsAutoExtend   bool      `gorm:"column:is_auto_extend"`
 	IsActive       bool      `gorm:"column:is_active"`
-	Price          float64   `gorm:"column:price;not null"`
+	Price          float64   `gorm:"column:price;not null;money"`
+	RowHash        string    `gorm:"column:row_hash;size:64"`
 }
 
-func (BoughtPackage) TableName() string { return "bought_packages" }
+func (BoughtPackage) TableName() string { return tablePrefix + "bought_packages" }
 
 type BoughtPackageItem struct {
 	ID                 string  `gorm:"primaryKey;column:id;size:36;not null"`
-	BoughtPackageId    string  `gorm:"column:bought_package_id;size:36"`
+	BoughtPackageId    string  `gorm:"column:bought_package_id;size:36;uniqueIndex:idx_bought_package_items_code,priority:1"`
 	Name               string  `gorm:"column:name;size:255;not null"`
-	Code               int     `gorm:"column:code;not null"`
+	Code               int     `gorm:"column:code;not null;uniqueIndex:idx_bought_package_items_code,priority:2"`
 	IsOverLimitAllowed bool    `gorm:"column:is_over_limit_allowed"`
-	OverLimitPrice     float64 `gorm:"column:over_limit_price"`
+	OverLimitPrice     float64 `gorm:"column:over_limit_price;money"`
 	IsUnlimited        bool    `gorm:"column:is_unlimited"`
 	LimitValue         int     `gorm:"column:limit_value"`
 	UsedCount          int     `gorm:"column:used_count"`
 }
 
-func (BoughtPackageItem) TableName() string { return "bought_package_items" }
+func (BoughtPackageItem) TableName() string { return tablePrefix + "bought_package_items" }
+
+// ChargeRefSize is the size of the object_id and number columns of charges
+const ChargeRefSize = 64
 
 type Charge struct {
 	ID                    string     `gorm:"primaryKey;column:id;size:36;not null"`
 	CreatedAt             time.Time  `gorm:"column:created_at;not null"`
 	IsDeleted             bool       `gorm:"column:is_deleted"`
-	OrganizationId        string     `gorm:"column:organization_id;size:36"`
-	Price                 float64    `gorm:"column:price;not null"`
-	Type                  int        `gorm:"column:type"`
-	BoughtPackageID       string     `gorm:"column:bought_package_id;size:36;not null"`
+	OrganizationId        string     `gorm:"column:organization_id;size:36;index"`
+	Price                 float64    `gorm:"column:price;not null;money"`
+	Type                  ChargeType `gorm:"column:type"`
+	BoughtPackageID       string     `gorm:"column:bought_package_id;size:36;not null;index"`
 	BoughtPackageItemCode int        `gorm:"column:bought_package_item_code;not null"`
 	ServiceCode           string     `gorm:"column:service_code;size:36"`
-	ObjectId              string     `gorm:"column:object_id;size:36"`
-	Number                string     `gorm:"column:number;size:36"`
-	Date1                 *time.Time `gorm:"column:date1"`
-	Date2                 *time.Time `gorm:"column:date2"`
+	// ObjectId and Number hold ChargeRefSize characters: roaming document ids and
+	// invoice numbers do not always fit the 36 of an id
+	ObjectId string     `gorm:"column:object_id;size:64"`
+	Number   string     `gorm:"column:number;size:64"`
+	Date1    *time.Time `gorm:"column:date1"`
+	Date2    *time.Time `gorm:"column:date2"`
+	// DateSource tells whether Date1 is the document date or inferred, see ChargeDateSource
+	DateSource ChargeDateSource `gorm:"column:date_source;size:32;not null;default:'none'"`
+	RowHash    string           `gorm:"column:row_hash;size:64"`
 }
 
-func (Charge) TableName() string { return "charges" }
+func (Charge) TableName() string { return tablePrefix + "charges" }
 
 type Payment struct {
-	ID                string    `gorm:"primaryKey;column:id;size:36;not null"`
-	CreatedAt         time.Time `gorm:"column:created_at;not null"`
-	Amount            float64   `gorm:"column:amount;not null"`
-	OrganizationID    string    `gorm:"column:organization_id;size:36;not null"`
-	AccountID         string    `gorm:"column:account_id;size:36"`
-	AccountUsername   string    `gorm:"column:account_username;size:255"`
-	Method            int       `gorm:"column:method;not null"`
-	BankTransactionID *string   `gorm:"column:bank_transaction_id;size:36"`
+	ID              string    `gorm:"primaryKey;column:id;size:36;not null"`
+	CreatedAt       time.Time `gorm:"column:created_at;not null"`
+	Amount          float64   `gorm:"column:amount;not null;money"`
+	OrganizationID  string    `gorm:"column:organization_id;size:36;not null;index"`
+	AccountID       string    `gorm:"column:account_id;size:36"`
+	AccountUsername string    `gorm:"column:account_username;size:255"`
+	Method          int       `gorm:"column:method;not null"`
+	// MethodLabel is set with -enum-as-string, see PaymentMethods
+	MethodLabel       *string `gorm:"column:method_label;size:64"`
+	BankTransactionID *string `gorm:"column:bank_transaction_id;size:36"`
+	RowHash           string  `gorm:"column:row_hash;size:64"`
 }
 
-func (Payment) TableName() string { return "payments" }
+func (Payment) TableName() string { return tablePrefix + "payments" }
 
 type PaymeTransaction struct {
 	ID                 string     `gorm:"primaryKey;column:id;size:36;not null"`
@@ -153,51 +200,116 @@ type PaymeTransaction struct {
 	PaymeCreatedAt     time.Time  `gorm:"column:payme_created_at;not null"`
 	SystemCompletedAt  *time.Time `gorm:"column:system_completed_at"`
 	State              int        `gorm:"column:state"`
-	Amount             float64    `gorm:"column:amount;not null"`
-	PaymentId          *string    `gorm:"column:payment_id"`
-	OrganizationID     string     `gorm:"column:organization_id;size:36;not null"`
-	Reason             int        `gorm:"column:reason"`
-	SystemCanceledAt   *time.Time `gorm:"column:system_canceled_at"`
+	// StateLabel and ReasonLabel are set with -enum-as-string
+	StateLabel       *string    `gorm:"column:state_label;size:64"`
+	Amount           float64    `gorm:"column:amount;not null;money"`
+	PaymentId        *string    `gorm:"column:payment_id"`
+	OrganizationID   string     `gorm:"column:organization_id;size:36;not null;index"`
+	Reason           int        `gorm:"column:reason"`
+	ReasonLabel      *string    `gorm:"column:reason_label;size:64"`
+	SystemCanceledAt *time.Time `gorm:"column:system_canceled_at"`
+	RowHash          string     `gorm:"column:row_hash;size:64"`
 }
 
-func (PaymeTransaction) TableName() string { return "payme_transactions" }
+func (PaymeTransaction) TableName() string { return tablePrefix + "payme_transactions" }
 
 type OrganizationBalanceBinding struct {
 	ID                     string     `gorm:"primaryKey;column:id;size:36;not null"`
 	CreatedAt              time.Time  `gorm:"column:created_at;not null"`
 	DeletedAt              *time.Time `gorm:"column:deleted_at"`
 	IsDeleted              bool       `gorm:"column:is_deleted"`
-	PayerOrganizationID    string     `gorm:"column:payer_organization_id;size:36"`
-	TargetOrganizationID   string     `gorm:"column:target_organization_id;size:36"`
+	PayerOrganizationID    string     `gorm:"column:payer_organization_id;size:36;index"`
+	TargetOrganizationID   string     `gorm:"column:target_organization_id;size:36;index"`
 	PayerOrganizationName  string     `gorm:"column:payer_organization_name"`
 	TargetOrganizationName string     `gorm:"column:target_organization_name"`
+	RowHash                string     `gorm:"column:row_hash;size:64"`
 }
 
-func (OrganizationBalanceBinding) TableName() string { return "organization_balance_bindings" }
+func (OrganizationBalanceBinding) TableName() string {
+	return tablePrefix + "organization_balance_bindings"
+}
 
 type CreditUpdates struct {
 	ID             string    `gorm:"primaryKey;column:id;size:36;not null"`
 	CreatedAt      time.Time `gorm:"column:created_at;not null"`
 	OrganizationID string    `gorm:"column:organization_id;size:36;not null;index:idx_organization-id,priority:1"`
-	Amount         float64   `gorm:"column:amount;not null"`
+	Amount         float64   `gorm:"column:amount;not null;money"`
 	AccountID      string    `gorm:"column:account_id;size:36"`
+	RowHash        string    `gorm:"column:row_hash;size:64"`
 }
 
-func (CreditUpdates) TableName() string { return "credit_updates" }
+func (CreditUpdates) TableName() string { return tablePrefix + "credit_updates" }
 
 type BankPaymentAutoApplyError struct {
 	ID            string    `gorm:"primaryKey;column:id;size:36"`
 	CreatedAt     time.Time `gorm:"column:created_at;not null"`
 	ErrorMessage  string    `gorm:"column:error_message;type:text"`
-	Amount        float64   `gorm:"column:amount;not null"`
+	Amount        float64   `gorm:"column:amount;not null;money"`
 	TransactionID string    `gorm:"column:transaction_id;size:36;index:idx_transaction_id;not null"`
 	PayerInn      string    `gorm:"column:payer_inn;size:14;not null"`
 	PayerName     string    `gorm:"column:payer_name;size:255;not null"`
 	Description   *string   `gorm:"column:description;type:text"`
 	Resolved      bool      `gorm:"column:resolved;default:false"`
+	RowHash       string    `gorm:"column:row_hash;size:64"`
+}
+
+func (BankPaymentAutoApplyError) TableName() string {
+	return tablePrefix + "bank_payments_auto_apply_errors"
+}
+
+// Field presence states recorded for tracked nullable fields
+const (
+	FieldNull    = "null"
+	FieldMissing = "missing"
+)
+
+// FieldPresence records whether a tracked field was explicitly null or absent in the
+// source document, which both decode to nil.
+type FieldPresence struct {
+	Table    string `gorm:"column:table_name;size:64;not null;index:idx_field_presence_record,priority:1"`
+	RecordID string `gorm:"column:record_id;size:36;not null;index:idx_field_presence_record,priority:2"`
+	Field    string `gorm:"column:field;size:255;not null"`
+	State    string `gorm:"column:state;size:16;not null"`
 }
 
-func (BankPaymentAutoApplyError) TableName() string { return "bank_payments_auto_apply_errors" }
+func (FieldPresence) TableName() string { return tablePrefix + "field_presence" }
+
+// MigrationError records a source document that failed to migrate
+type MigrationError struct {
+	ID         uint      `gorm:"primaryKey;column:id;autoIncrement"`
+	CreatedAt  time.Time `gorm:"column:created_at;not null"`
+	Collection string    `gorm:"column:collection;size:64;not null;index:idx_migration_errors_record,priority:1"`
+	RecordID   string    `gorm:"column:record_id;size:36;index:idx_migration_errors_record,priority:2"`
+	Error      string    `gorm:"column:error;type:text;not null"`
+	// Document is the source document as extended JSON, empty when it was not kept
+	Document string `gorm:"column:document;type:text"`
+}
+
+func (MigrationError) TableName() string { return tablePrefix + "migration_errors" }
+
+// OrphanRecord keeps a mapped row that was not inserted because a referenced parent
+// row does not exist
+type OrphanRecord struct {
+	ID         uint      `gorm:"primaryKey;column:id;autoIncrement"`
+	CreatedAt  time.Time `gorm:"column:created_at;not null"`
+	Collection string    `gorm:"column:collection;size:64;not null;index:idx_orphan_records_record,priority:1"`
+	RecordID   string    `gorm:"column:record_id;size:36;not null;index:idx_orphan_records_record,priority:2"`
+	Column     string    `gorm:"column:column_name;size:64;not null"`
+	MissingID  string    `gorm:"column:missing_id;size:36;not null"`
+	Row        string    `gorm:"column:row;type:text;not null"`
+}
+
+func (OrphanRecord) TableName() string { return tablePrefix + "orphan_records" }
+
+// SyncState is the high watermark of -incremental: the latest created_at of a source
+// collection that was migrated
+type SyncState struct {
+	Collection string    `gorm:"primaryKey;column:collection;size:64;not null"`
+	Watermark  time.Time `gorm:"column:watermark;not null"`
+	UpdatedAt  time.Time `gorm:"column:updated_at;not null"`
+}
+
+func (SyncState) TableName() string { return tablePrefix + "sync_state" }
 
 // MongoDB Models (for decoding)
 type MongoService struct {
@@ -279,35 +391,310 @@ type MongoPackage struct {
 
 // Database interface
 type Database interface {
-	Migrate() error
+	Migrate(dropTables bool) error
+	// ValidateSchema compares the existing tables with the models, see SchemaDiff
+	ValidateSchema() (SchemaDiff, error)
 	GetDB() *gorm.DB
 }
 
 type database struct {
-	db *gorm.DB
+	db           *gorm.DB
+	tableOptions string
+	idCollation  string
+	moneyDecimal bool
+	autoDedupe   bool
+	withFKs      bool
 }
 
 func (d *database) GetDB() *gorm.DB {
 	return d.db
 }
 
-func NewDatabase(username, password, addr, databaseName, timezone string) (Database, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=%s",
-		username, password, addr, databaseName, timezone)
+// Target drivers accepted by NewDatabase
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+)
+
+// Config describes the target database
+type Config struct {
+	// Driver is DriverMySQL (default) or DriverPostgres
+	Driver   string
+	Username string
+	Password string
+	// Addr is host:port
+	Addr     string
+	Database string
+	Timezone string
+	// Engine is appended to every CREATE TABLE issued by Migrate on MySQL; a bare
+	// engine name such as "InnoDB" is expanded to "ENGINE=InnoDB"
+	Engine string
+	// IDCollation, when set, is the collation of every id and *_id column
+	IDCollation string
+	// WithFKs makes Migrate add the foreign keys of the child tables, see ForeignKeys
+	WithFKs bool
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime tune the connection pool; zero
+	// values leave the database/sql defaults
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// Params is a URL query string of extra DSN parameters, e.g. "tls=true&timeout=30s";
+	// they override the defaults set by MySQLDSN and PostgresDSN
+	Params string
+	// CreateDB makes NewDatabase create the MySQL database when it does not exist
+	CreateDB bool
+	// MoneyAsDecimal makes Migrate create the money columns as MoneyDecimalType
+	MoneyAsDecimal bool
+	// AutoDedupe makes Migrate delete the rows of kept tables that duplicate the key
+	// of a unique index it adds, instead of failing with a *DuplicateKeysError
+	AutoDedupe bool
+}
 
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+// NewDatabase connects to the target database. The models work on both drivers; table
+// options are only applied on MySQL.
+func NewDatabase(cfg Config) (Database, error) {
+	var dialector gorm.Dialector
+	switch cfg.Driver {
+	case "", DriverMySQL:
+		if cfg.CreateDB {
+			if err := createDatabase(cfg); err != nil {
+				return nil, err
+			}
+		}
+		dsn, err := MySQLDSN(cfg)
+		if err != nil {
+			return nil, err
+		}
+		dialector = mysql.Open(dsn)
+	case DriverPostgres:
+		if cfg.CreateDB {
+			return nil, fmt.Errorf("creating the database is only supported on MySQL")
+		}
+		dsn, err := PostgresDSN(cfg)
+		if err != nil {
+			return nil, err
+		}
+		dialector = postgres.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unsupported target driver %q", cfg.Driver)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{
 		SkipDefaultTransaction: true,
+		NamingStrategy:         schema.NamingStrategy{TablePrefix: tablePrefix},
 	})
+	var mysqlErr *mysqldriver.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errUnknownDatabase {
+		return nil, fmt.Errorf("database %s does not exist, create it or rerun with -create-db: %w", cfg.Database, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
+	configurePool(sqlDB, cfg)
 
-	return &database{db: db}, nil
+	d := &database{db: db, idCollation: cfg.IDCollation, moneyDecimal: cfg.MoneyAsDecimal, autoDedupe: cfg.AutoDedupe, withFKs: cfg.WithFKs}
+	if cfg.Driver != DriverPostgres {
+		d.tableOptions = tableOptions(cfg.Engine)
+	}
+	return d, nil
+}
+
+// configurePool applies the connection pool settings of cfg to sqlDB
+func configurePool(sqlDB *sql.DB, cfg Config) {
+	if cfg.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
 }
 
-func (d *database) Migrate() error {
-	// Drop and recreate tables to ensure schema is correct
-	tables := []interface{}{
+// NewDryRunDatabase returns a Database of cfg.Driver that never connects: statements
+// are built but not executed, so reads find nothing and writes are discarded. It backs
+// runs that only export rows, see ExportSchema for the same trick.
+func NewDryRunDatabase(cfg Config) (Database, error) {
+	var dialector gorm.Dialector
+	switch cfg.Driver {
+	case "", DriverMySQL:
+		dialector = mysql.New(mysql.Config{SkipInitializeWithVersion: true})
+	case DriverPostgres:
+		dialector = postgres.New(postgres.Config{})
+	default:
+		return nil, fmt.Errorf("unsupported target driver %q", cfg.Driver)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{
+		DryRun:                 true,
+		DisableAutomaticPing:   true,
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+		NamingStrategy:         schema.NamingStrategy{TablePrefix: tablePrefix},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &database{db: db, idCollation: cfg.IDCollation, moneyDecimal: cfg.MoneyAsDecimal}, nil
+}
+
+// errUnknownDatabase is the MySQL error number of a connection to a missing database
+const errUnknownDatabase = 1049
+
+// databaseName matches the database names createDatabase accepts, which are used
+// unescaped in CREATE DATABASE
+var databaseName = regexp.MustCompile(`^[A-Za-z0-9_$]{1,64}$`)
+
+// createDatabase creates the MySQL database of cfg with the utf8mb4 character set
+// when it does not exist, over a connection that selects no database
+func createDatabase(cfg Config) error {
+	if !databaseName.MatchString(cfg.Database) {
+		return fmt.Errorf("invalid database name %q, only letters, digits, _ and $ are allowed", cfg.Database)
+	}
+	server := cfg
+	server.Database = ""
+	dsn, err := MySQLDSN(server)
+	if err != nil {
+		return err
+	}
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return err
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	if err := db.Exec("CREATE DATABASE IF NOT EXISTS `" + cfg.Database + "` CHARACTER SET utf8mb4").Error; err != nil {
+		return fmt.Errorf("could not create database %s: %w", cfg.Database, err)
+	}
+	return nil
+}
+
+// MySQLDSN builds the go-sql-driver DSN of cfg
+func MySQLDSN(cfg Config) (string, error) {
+	query := url.Values{}
+	query.Set("charset", "utf8mb4")
+	query.Set("parseTime", "True")
+	query.Set("loc", cfg.Timezone)
+	if err := mergeParams(query, cfg.Params); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s)/%s?%s", cfg.Username, cfg.Password, cfg.Addr, cfg.Database, query.Encode()), nil
+}
+
+// mergeParams sets the parameters of the query string params in query, replacing
+// those already set
+func mergeParams(query url.Values, params string) error {
+	extra, err := url.ParseQuery(params)
+	if err != nil {
+		return fmt.Errorf("invalid DSN parameters %q: %w", params, err)
+	}
+	for name, values := range extra {
+		query[name] = values
+	}
+	return nil
+}
+
+// PostgresDSN builds the pgx connection URL of cfg; Addr defaults to port 5432
+func PostgresDSN(cfg Config) (string, error) {
+	host, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		host, port = cfg.Addr, "5432"
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid Postgres address %q", cfg.Addr)
+	}
+	query := url.Values{}
+	if cfg.Timezone != "" {
+		query.Set("TimeZone", cfg.Timezone)
+	}
+	if err := mergeParams(query, cfg.Params); err != nil {
+		return "", err
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(host, port),
+		Path:     "/" + cfg.Database,
+		RawQuery: query.Encode(),
+	}
+	if cfg.Username != "" {
+		dsn.User = url.UserPassword(cfg.Username, cfg.Password)
+	}
+	return dsn.String(), nil
+}
+
+func tableOptions(engine string) string {
+	engine = strings.TrimSpace(engine)
+	if engine == "" || strings.Contains(engine, "=") {
+		return engine
+	}
+	return "ENGINE=" + engine
+}
+
+// applyIDCollation overrides the column type of every string id and *_id column of the
+// models with the same type plus COLLATE collation, so joins on string keys never mix
+// collations. The override is made on the schemas cached by db.
+func applyIDCollation(db *gorm.DB, collation string, models ...interface{}) error {
+	if collation == "" {
+		return nil
+	}
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.GORMDataType != schema.String || (field.DBName != "id" && !strings.HasSuffix(field.DBName, "_id")) {
+				continue
+			}
+			if strings.Contains(string(field.DataType), " COLLATE ") {
+				continue
+			}
+			field.DataType = schema.DataType(db.Dialector.DataTypeOf(field) + " COLLATE " + collation)
+		}
+	}
+	return nil
+}
+
+// MoneyDecimalType is the column type of the money columns with
+// Config.MoneyAsDecimal, exact to the cent unlike the default double
+const MoneyDecimalType = "decimal(20,2)"
+
+// IsMoney reports whether field is a money column, tagged money in its model
+func IsMoney(field *schema.Field) bool {
+	_, ok := field.TagSettings["MONEY"]
+	return ok
+}
+
+// applyMoneyDecimal overrides the column type of every money column of the models
+// with MoneyDecimalType when enabled. Like applyIDCollation it changes the schemas
+// cached by db.
+func applyMoneyDecimal(db *gorm.DB, enabled bool, models ...interface{}) error {
+	if !enabled {
+		return nil
+	}
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		for _, field := range stmt.Schema.Fields {
+			if IsMoney(field) {
+				field.DataType = MoneyDecimalType
+			}
+		}
+	}
+	return nil
+}
+
+// Models returns every MySQL model in dependency order.
+func Models() []interface{} {
+	return []interface{}{
 		&Service{},
 		&Organization{},
 		&OrganizationServiceDemoUses{},
@@ -322,13 +709,47 @@ func (d *database) Migrate() error {
 		&OrganizationBalanceBinding{},
 		&CreditUpdates{},
 		&BankPaymentAutoApplyError{},
+		&FieldPresence{},
 	}
+}
 
-	for _, table := range tables {
-		if err := d.db.Migrator().DropTable(table); err != nil {
-			// Ignore errors if table doesn't exist
+// Migrate creates the schema. With dropTables the tables are dropped and recreated to
+// ensure the schema is correct; otherwise existing tables are only altered to add
+// missing columns, leaving columns unknown to the models (e.g. an external
+// auto-increment surrogate key) intact, and their unique indexes are only added once
+// checkUniqueIndexes found no duplicate keys.
+func (d *database) Migrate(dropTables bool) error {
+	tables := Models()
+
+	if dropTables {
+		// Children first, so foreign keys of -with-fks never block a drop
+		for i := len(tables) - 1; i >= 0; i-- {
+			if err := d.db.Migrator().DropTable(tables[i]); err != nil {
+				// Ignore errors if table doesn't exist
+			}
 		}
+	} else if err := renameColumns(d.db); err != nil {
+		return err
+	} else if err := checkUniqueIndexes(d.db, d.autoDedupe, tables...); err != nil {
+		return err
 	}
 
-	return d.db.AutoMigrate(tables...)
+	if err := applyIDCollation(d.db, d.idCollation, tables...); err != nil {
+		return err
+	}
+	if err := applyMoneyDecimal(d.db, d.moneyDecimal, tables...); err != nil {
+		return err
+	}
+
+	db := d.db
+	if d.tableOptions != "" {
+		db = db.Set("gorm:table_options", d.tableOptions)
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		return err
+	}
+	if d.withFKs {
+		return addForeignKeys(d.db)
+	}
+	return nil
 }
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+func TestMySQLDSN(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{Username: "root", Password: "secret", Addr: "127.0.0.1:3306", Database: "billing", Timezone: "UTC"},
+			"root:secret@tcp(127.0.0.1:3306)/billing?charset=utf8mb4&loc=UTC&parseTime=True"},
+		{Config{Username: "root", Addr: "mysql:3306", Database: "billing", Timezone: "UTC", Params: "tls=true&charset=utf8"},
+			"root:@tcp(mysql:3306)/billing?charset=utf8&loc=UTC&parseTime=True&tls=true"},
+		{Config{Username: "root", Addr: "mysql:3306", Database: "billing", Timezone: "UTC", Params: "tls=skip-verify&readTimeout=1m&loc=Local"},
+			"root:@tcp(mysql:3306)/billing?charset=utf8mb4&loc=Local&parseTime=True&readTimeout=1m&tls=skip-verify"},
+	}
+	for _, tt := range tests {
+		got, err := MySQLDSN(tt.cfg)
+		if err != nil || got != tt.want {
+			t.Errorf("MySQLDSN(%+v) = %q, %v, expected %q", tt.cfg, got, err, tt.want)
+		}
+	}
+	if _, err := MySQLDSN(Config{Params: "tls=%zz"}); err == nil {
+		t.Error("malformed parameters accepted")
+	}
+}
+
+func TestPostgresDSN(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want string
+		err  bool
+	}{
+		{Config{Username: "postgres", Password: "p@ss", Addr: "db:5433", Database: "billing", Timezone: "UTC"},
+			"postgres://postgres:p%40ss@db:5433/billing?TimeZone=UTC", false},
+		{Config{Addr: "db", Database: "billing", Params: "sslmode=disable"},
+			"postgres://db:5432/billing?sslmode=disable", false},
+		{Config{Addr: ":5432", Database: "billing"}, "", true},
+		{Config{Addr: "db", Database: "billing", Params: "%zz"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := PostgresDSN(tt.cfg)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("PostgresDSN(%+v) = %q, %v, expected %q", tt.cfg, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewDatabaseUnsupportedDriver(t *testing.T) {
+	if _, err := NewDatabase(Config{Driver: "sqlite"}); err == nil {
+		t.Error("connected with an unsupported driver")
+	}
+	if _, err := NewDatabase(Config{Driver: DriverPostgres, Addr: "db", CreateDB: true}); err == nil {
+		t.Error("-create-db accepted on Postgres")
+	}
+}
+
+// The models must create on Postgres too, whose identifiers a hyphen would break
+func TestModelsCreateOnPostgres(t *testing.T) {
+	recorder := &statementRecorder{}
+	db, err := gorm.Open(postgres.New(postgres.Config{}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               recorder,
+		NamingStrategy:       schema.NamingStrategy{TablePrefix: tablePrefix},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().CreateTable(Models()...); err != nil {
+		t.Fatal(err)
+	}
+	ddl := strings.Join(recorder.statements, ";\n")
+	if !strings.Contains(ddl, `"white_label"`) {
+		t.Error("organizations has no white_label column")
+	}
+	if strings.Contains(ddl, "white-label") {
+		t.Error("a column name still has a hyphen")
+	}
+}
+
+func TestConfigurePool(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want int
+	}{
+		{Config{MaxOpenConns: 4, MaxIdleConns: 4, ConnMaxLifetime: 30 * time.Minute}, 4},
+		// Zero leaves the database/sql default, unlimited
+		{Config{}, 0},
+	}
+	for _, tt := range tests {
+		dsn, err := MySQLDSN(Config{Username: "root", Addr: "127.0.0.1:3306", Database: "billing", Timezone: "UTC"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Opening does not connect
+		sqlDB, err := sql.Open("mysql", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configurePool(sqlDB, tt.cfg)
+		if got := sqlDB.Stats().MaxOpenConnections; got != tt.want {
+			t.Errorf("%+v: %d open connections at most, expected %d", tt.cfg, got, tt.want)
+		}
+		sqlDB.Close()
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ColumnRename is a model column whose name changed after tables were created with
+// the old one
+type ColumnRename struct {
+	Model    interface{}
+	Old, New string
+}
+
+// ColumnRenames lists the renamed columns Migrate carries over on preserved tables, so
+// their data is kept instead of AutoMigrate adding an empty column next to it
+var ColumnRenames = []ColumnRename{
+	// The hyphen needed quoting in every statement
+	{&Organization{}, "white-label", "white_label"},
+}
+
+// renameColumns renames the old columns of ColumnRenames still present in the target
+func renameColumns(db *gorm.DB) error {
+	migrator := db.Migrator()
+	for _, r := range ColumnRenames {
+		if !migrator.HasTable(r.Model) || !migrator.HasColumn(r.Model, r.Old) || migrator.HasColumn(r.Model, r.New) {
+			continue
+		}
+		if err := migrator.RenameColumn(r.Model, r.Old, r.New); err != nil {
+			return fmt.Errorf("could not rename column %s to %s: %w", r.Old, r.New, err)
+		}
+	}
+	return nil
+}
+
+// renamedFrom returns the old name of column of table, or "" when it was not renamed
+func renamedFrom(db *gorm.DB, table, column string) string {
+	for _, r := range ColumnRenames {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(r.Model); err != nil {
+			continue
+		}
+		if stmt.Schema.Table == table && r.New == column {
+			return r.Old
+		}
+	}
+	return ""
+}
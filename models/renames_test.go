@@ -0,0 +1,65 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestOrganizationWhiteLabelColumn(t *testing.T) {
+	tests := []struct {
+		driver    string
+		dialector gorm.Dialector
+		column    string
+	}{
+		{DriverMySQL, mysql.New(mysql.Config{SkipInitializeWithVersion: true}), "`white_label`"},
+		{DriverPostgres, postgres.New(postgres.Config{}), `"white_label"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			recorder := &statementRecorder{}
+			db, err := gorm.Open(tt.dialector, &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true, Logger: recorder})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Migrator().CreateTable(&Organization{}); err != nil {
+				t.Fatal(err)
+			}
+			org := Organization{ID: "org-1", CreatedAt: time.Now(), Name: "Alpha LLC", WhiteLabel: "acme"}
+			tx := db.Create(&org)
+			if tx.Error != nil {
+				t.Fatal(tx.Error)
+			}
+			stmt := tx.Statement
+			for _, sql := range []string{recorder.statements[0], stmt.SQL.String()} {
+				if !strings.Contains(sql, tt.column) || strings.Contains(sql, "white-label") {
+					t.Errorf("statement does not use %s: %s", tt.column, sql)
+				}
+			}
+			found := false
+			for _, v := range stmt.Vars {
+				found = found || v == "acme"
+			}
+			if !found {
+				t.Errorf("INSERT does not bind the white label: %v", stmt.Vars)
+			}
+		})
+	}
+}
+
+func TestRenamedFrom(t *testing.T) {
+	db, err := gorm.Open(mysql.New(mysql.Config{SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old := renamedFrom(db, (&Organization{}).TableName(), "white_label"); old != "white-label" {
+		t.Errorf("white_label renamed from %q, expected white-label", old)
+	}
+	if old := renamedFrom(db, (&Organization{}).TableName(), "name"); old != "" {
+		t.Errorf("name renamed from %q, expected no rename", old)
+	}
+}
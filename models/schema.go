@@ -0,0 +1,65 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// statementRecorder is a GORM logger that collects the SQL of every traced statement.
+type statementRecorder struct {
+	statements []string
+}
+
+func (r *statementRecorder) LogMode(logger.LogLevel) logger.Interface      { return r }
+func (r *statementRecorder) Info(context.Context, string, ...interface{})  {}
+func (r *statementRecorder) Warn(context.Context, string, ...interface{})  {}
+func (r *statementRecorder) Error(context.Context, string, ...interface{}) {}
+
+func (r *statementRecorder) Trace(_ context.Context, _ time.Time, fc func() (string, int64), _ error) {
+	sql, _ := fc()
+	r.statements = append(r.statements, sql)
+}
+
+// ExportSchema writes the CREATE TABLE statements for all models to w. It runs the
+// GORM migrator in dry-run mode, so no MySQL server is needed.
+func ExportSchema(w io.Writer, engine, idCollation string, moneyDecimal bool) error {
+	recorder := &statementRecorder{}
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               recorder,
+		NamingStrategy:       schema.NamingStrategy{TablePrefix: tablePrefix},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := applyIDCollation(db, idCollation, Models()...); err != nil {
+		return err
+	}
+	if err := applyMoneyDecimal(db, moneyDecimal, Models()...); err != nil {
+		return err
+	}
+	if options := tableOptions(engine); options != "" {
+		db = db.Set("gorm:table_options", options)
+	}
+	if err := db.Migrator().CreateTable(Models()...); err != nil {
+		return err
+	}
+
+	for _, statement := range recorder.statements {
+		if _, err := fmt.Fprintf(w, "%s;\n\n", statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
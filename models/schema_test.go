@@ -0,0 +1,37 @@
+package models
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTablePrefix(t *testing.T) {
+	SetTablePrefix("tenantA_")
+	t.Cleanup(func() { SetTablePrefix("") })
+
+	if got := (&Charge{}).TableName(); got != "tenantA_charges" {
+		t.Errorf("charges table is %s, expected tenantA_charges", got)
+	}
+	var ddl bytes.Buffer
+	if err := ExportSchema(&ddl, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"tenantA_charges", "tenantA_organizations", "tenantA_package_items"} {
+		if !strings.Contains(ddl.String(), "CREATE TABLE `"+table+"`") {
+			t.Errorf("the DDL does not create %s", table)
+		}
+	}
+	if strings.Contains(ddl.String(), "CREATE TABLE `charges`") {
+		t.Error("the DDL creates an unprefixed table")
+	}
+
+	db, err := NewDryRunDatabase(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := db.GetDB().Create(&Payment{ID: "p1"}).Statement
+	if sql := stmt.SQL.String(); !strings.HasPrefix(sql, "INSERT INTO `tenantA_payments`") {
+		t.Errorf("inserted with %s", sql)
+	}
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// SchemaDiff lists how the existing target tables differ from the models. Columns
+// are written as table.column.
+type SchemaDiff struct {
+	// MissingTables do not exist yet; Migrate creates them without touching data
+	MissingTables []string
+	// MissingColumns are model columns absent from an existing table, which would
+	// make inserts fail
+	MissingColumns []string
+	// ExtraColumns exist in a table but not in its model
+	ExtraColumns []string
+}
+
+// SchemaMismatchError is returned when existing tables lack model columns
+type SchemaMismatchError struct {
+	Missing []string
+}
+
+func (e *SchemaMismatchError) Error() string {
+	return fmt.Sprintf("target tables lack model columns: %s", strings.Join(e.Missing, ", "))
+}
+
+// ValidateSchema compares every model with its table. It returns the differences and
+// a *SchemaMismatchError when an existing table misses a model column.
+func (d *database) ValidateSchema() (SchemaDiff, error) {
+	return validateSchema(d.db)
+}
+
+func validateSchema(db *gorm.DB) (SchemaDiff, error) {
+	var diff SchemaDiff
+	migrator := db.Migrator()
+	for _, model := range Models() {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return diff, err
+		}
+		table := stmt.Schema.Table
+		if !migrator.HasTable(model) {
+			diff.MissingTables = append(diff.MissingTables, table)
+			continue
+		}
+
+		columns, err := migrator.ColumnTypes(model)
+		if err != nil {
+			return diff, fmt.Errorf("could not read the columns of %s: %w", table, err)
+		}
+		existing := make(map[string]bool, len(columns))
+		for _, column := range columns {
+			existing[column.Name()] = true
+		}
+		for _, name := range stmt.Schema.DBNames {
+			if old := renamedFrom(db, table, name); !existing[name] && old != "" && existing[old] {
+				// Migrate renames it
+				delete(existing, old)
+				continue
+			}
+			if !existing[name] {
+				diff.MissingColumns = append(diff.MissingColumns, table+"."+name)
+			}
+			delete(existing, name)
+		}
+		for _, column := range columns {
+			if existing[column.Name()] {
+				diff.ExtraColumns = append(diff.ExtraColumns, table+"."+column.Name())
+			}
+		}
+	}
+	if len(diff.MissingColumns) > 0 {
+		return diff, &SchemaMismatchError{Missing: diff.MissingColumns}
+	}
+	return diff, nil
+}
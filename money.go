@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"migrate-tool/models"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// moneyNoise is the largest difference from a whole cent taken as the binary noise of
+// a double, e.g. 0.1+0.2, rather than a fraction of a cent in the source
+const moneyNoise = 1e-9
+
+// roundMoney rounds the money columns of rows to cents with -money-as-decimal, which
+// stores them as models.MoneyDecimalType. A value holding a fraction of a cent is
+// logged and counted per table in m.moneyRounded, since the DECIMAL column would
+// round it anyway, only silently.
+func roundMoney[T any](m *Migrator, db *gorm.DB, rows []T) error {
+	if !m.opts.MoneyAsDecimal || len(rows) == 0 {
+		return nil
+	}
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(new(T)); err != nil {
+		return err
+	}
+	var money []*schema.Field
+	for _, field := range stmt.Schema.Fields {
+		if models.IsMoney(field) {
+			money = append(money, field)
+		}
+	}
+	if len(money) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	for i := range rows {
+		value := reflect.ValueOf(&rows[i]).Elem()
+		for _, field := range money {
+			v, _ := field.ValueOf(ctx, value)
+			amount, ok := moneyAmount(v)
+			if !ok {
+				continue
+			}
+			rounded := math.Round(amount*100) / 100
+			if math.Abs(rounded-amount) <= moneyNoise {
+				continue
+			}
+			var id interface{}
+			if pk := stmt.Schema.PrioritizedPrimaryField; pk != nil {
+				id, _ = pk.ValueOf(ctx, value)
+			}
+			slog.Debug("rounded money value", "table", stmt.Schema.Table, "id", id, "column", field.DBName, "value", amount, "rounded", rounded)
+			m.moneyRounded[stmt.Schema.Table]++
+			if err := field.Set(ctx, value, rounded); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// moneyAmount returns the amount held by a money field, float64 or *float64
+func moneyAmount(v interface{}) (float64, bool) {
+	switch amount := v.(type) {
+	case float64:
+		return amount, true
+	case *float64:
+		if amount != nil {
+			return *amount, true
+		}
+	}
+	return 0, false
+}
+
+// reportMoneyRounding logs how many money values per table lost a fraction of a cent
+func (m *Migrator) reportMoneyRounding() {
+	for table, n := range m.moneyRounded {
+		slog.Warn("rounded money values to cents", "table", table, "values", n)
+	}
+}
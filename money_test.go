@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"migrate-tool/models"
+	"strings"
+	"testing"
+)
+
+func TestRoundMoney(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  float64
+		want    float64
+		rounded int
+	}{
+		{"whole cents", 250000.5, 250000.5, 0},
+		{"binary noise", 0.1 + 0.2, 0.1 + 0.2, 0},
+		{"large amount", 123456789012.34, 123456789012.34, 0},
+		{"fraction of a cent", 12.345, 12.35, 1},
+		{"negative fraction", -0.004, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newDryRunMigrator(t, cannedSource{}, Options{MoneyAsDecimal: true})
+			rows := []models.Payment{{ID: "p1", Amount: tt.amount}}
+			if err := roundMoney(m, m.mysql.GetDB(), rows); err != nil {
+				t.Fatal(err)
+			}
+			if rows[0].Amount != tt.want {
+				t.Errorf("amount is %v, expected %v", rows[0].Amount, tt.want)
+			}
+			if got := m.moneyRounded[(&models.Payment{}).TableName()]; got != tt.rounded {
+				t.Errorf("counted %d rounded values, expected %d", got, tt.rounded)
+			}
+		})
+	}
+}
+
+func TestRoundMoneyOnlyWithDecimal(t *testing.T) {
+	m, _ := newDryRunMigrator(t, cannedSource{}, Options{})
+	rows := []models.Payment{{ID: "p1", Amount: 12.345}}
+	if err := roundMoney(m, m.mysql.GetDB(), rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Amount != 12.345 {
+		t.Errorf("amount is %v, expected it kept without -money-as-decimal", rows[0].Amount)
+	}
+}
+
+func TestMoneyColumnsAsDecimal(t *testing.T) {
+	var ddl bytes.Buffer
+	if err := models.ExportSchema(&ddl, "", "", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"`balance`", "`credit_amount`", "`amount`", "`price`"} {
+		if !strings.Contains(ddl.String(), column+" "+models.MoneyDecimalType) {
+			t.Errorf("%s is not created as %s", column, models.MoneyDecimalType)
+		}
+	}
+}
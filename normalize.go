@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+)
+
+// normalizeText trims the surrounding whitespace of a free-text source value
+func normalizeText(s string) string {
+	return strings.TrimSpace(s)
+}
+
+// normalizeOptional trims an optional source value and maps a missing, null or blank
+// value to nil, so empty strings and nulls end up as the same NULL column
+func normalizeOptional(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	v := normalizeText(*s)
+	if v == "" {
+		return nil
+	}
+	return &v
+}
+
+// Taxpayer number lengths: a company INN has 9 digits, an individual's PINFL 14
+const (
+	innLength   = 9
+	pinflLength = 14
+)
+
+// Policies of -empty-payer-inn for bank payment errors without a payer INN
+const (
+	emptyInnKeep = "keep"
+	emptyInnSkip = "skip"
+)
+
+// normalizeInn trims inn and checks that it is an INN or PINFL: 9 or 14 digits. An
+// empty value is returned as is without an error; callers decide what it means.
+func normalizeInn(inn string) (string, error) {
+	inn = normalizeText(inn)
+	if inn == "" {
+		return "", nil
+	}
+	if len(inn) != innLength && len(inn) != pinflLength {
+		return inn, fmt.Errorf("inn %q has %d characters, expected %d or %d digits", inn, len(inn), innLength, pinflLength)
+	}
+	for _, r := range inn {
+		if r < '0' || r > '9' {
+			return inn, fmt.Errorf("inn %q is not numeric", inn)
+		}
+	}
+	return inn, nil
+}
+
+// innIndex tracks the organizations seen per INN for -dedupe-inn, which reports the
+// organizations sharing an INN instead of migrating them silently
+type innIndex struct {
+	first      map[string]string
+	duplicates int
+}
+
+func newInnIndex() *innIndex {
+	return &innIndex{first: make(map[string]string)}
+}
+
+// add records organization id with inn, logging it when another organization already
+// has that INN. A nil index or INN is ignored.
+func (x *innIndex) add(id string, inn *string) {
+	if x == nil || inn == nil {
+		return
+	}
+	if first, ok := x.first[*inn]; ok {
+		x.duplicates++
+		slog.Warn("duplicate inn", "collection", "organizations", "id", id, "inn", *inn, "first_id", first)
+		return
+	}
+	x.first[*inn] = id
+}
+
+// report logs how many organizations repeated an INN
+func (x *innIndex) report() {
+	if x == nil {
+		return
+	}
+	slog.Info("checked", "collection", "organizations", "duplicate_inn_organizations", x.duplicates, "distinct_inns", len(x.first))
+}
+
+// Policies of -long-charge-refs for a charge object_id or number longer than its
+// column
+const (
+	longRefTruncate = "truncate"
+	longRefSkip     = "skip"
+	longRefFail     = "fail"
+)
+
+// fitColumn checks that value fits a column of size characters, which MySQL counts
+// in runes. With longRefTruncate a longer value is cut to size and logged; with the
+// other policies it is returned with an error naming the column.
+func fitColumn(value, column string, size int, policy, collection, id string) (string, error) {
+	n := utf8.RuneCountInString(value)
+	if n <= size {
+		return value, nil
+	}
+	if policy != longRefTruncate {
+		return value, fmt.Errorf("%s has %d characters, more than the %d of its column", column, n, size)
+	}
+	slog.Warn("truncated value longer than its column", "collection", collection, "id", id, "column", column,
+		"length", n, "size", size, "value", value)
+	return string([]rune(value)[:size]), nil
+}
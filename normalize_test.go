@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNormalizeInn(t *testing.T) {
+	tests := []struct {
+		inn  string
+		want string
+		err  bool
+	}{
+		{"123456789", "123456789", false},
+		{" 12345678901234 ", "12345678901234", false},
+		{"", "", false},
+		{"   ", "", false},
+		{"123456789012", "123456789012", true},
+		{"12345678", "12345678", true},
+		{"12345678a", "12345678a", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeInn(tt.inn)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("normalizeInn(%q) = %q, %v", tt.inn, got, err)
+		}
+	}
+}
+
+func TestBankPaymentErrorsInvalidPayerInn(t *testing.T) {
+	source := cannedSource{"bankPaymentsAutoApplyErrors": {
+		bson.M{"_id": selfTestID(1), "transaction_id": "t1", "payer_inn": "123456789", "amount": 10.0},
+		bson.M{"_id": selfTestID(2), "transaction_id": "t2", "payer_inn": "123456789012", "amount": 20.0},
+		bson.M{"_id": selfTestID(3), "transaction_id": "t3", "payer_inn": "", "amount": 30.0},
+	}}
+	tests := []struct {
+		name       string
+		opts       Options
+		err        bool
+		moved      int
+		skipped    int
+		quarantine int
+	}{
+		{"fails without -skip-errors", Options{EmptyPayerInn: emptyInnKeep}, true, 0, 0, 0},
+		{"quarantined with -skip-errors", Options{EmptyPayerInn: emptyInnKeep, SkipErrors: true}, false, 2, 0, 1},
+		{"empty skipped by policy", Options{EmptyPayerInn: emptyInnSkip, SkipErrors: true}, false, 1, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, target := newMemoryTarget(t)
+			m := newMemoryMigrator(t, db, source, tt.opts)
+			stats, err := m.migrateBankPaymentAutoApplyErrors(context.Background())
+			if (err != nil) != tt.err {
+				t.Fatalf("error is %v, expected one: %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			r := stats.Tables[0]
+			if r.Moved != tt.moved || r.Skipped != tt.skipped || r.Failed != tt.quarantine {
+				t.Errorf("moved %d skipped %d failed %d, expected %d, %d and %d", r.Moved, r.Skipped, r.Failed, tt.moved, tt.skipped, tt.quarantine)
+			}
+			if n := len(target.rows((&models.MigrationError{}).TableName())); n != tt.quarantine {
+				t.Errorf("%d rows in migration_errors, expected %d", n, tt.quarantine)
+			}
+		})
+	}
+}
+
+func TestFitColumn(t *testing.T) {
+	long := strings.Repeat("A", 70)
+	// 64 Cyrillic letters take 128 bytes but fit the 64 characters of the column
+	cyrillic := strings.Repeat("Я", 64)
+	tests := []struct {
+		value  string
+		policy string
+		want   string
+		err    bool
+	}{
+		{"INV-1", longRefFail, "INV-1", false},
+		{cyrillic, longRefFail, cyrillic, false},
+		{long, longRefTruncate, long[:64], false},
+		{cyrillic + "Я", longRefTruncate, cyrillic, false},
+		{long, longRefSkip, long, true},
+		{long, longRefFail, long, true},
+	}
+	for _, tt := range tests {
+		got, err := fitColumn(tt.value, "number", 64, tt.policy, "charges", "c1")
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("fitColumn(%q, %s) = %q, %v", tt.value, tt.policy, got, err)
+		}
+	}
+}
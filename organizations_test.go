@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestServiceDemoUsesStableAcrossRuns(t *testing.T) {
+	org := func(codes ...string) cannedSource {
+		var uses bson.A
+		for _, code := range codes {
+			uses = append(uses, bson.M{"_id": selfTestID(30), "name": code, "code": code})
+		}
+		return cannedSource{"organizations": {bson.M{"_id": selfTestID(10), "created_at": time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC), "name": "Alpha LLC", "service_demo_uses": uses}}}
+	}
+	tests := []struct {
+		name string
+		runs []cannedSource
+		// moved is the number of demo uses each run inserts and rows the number the
+		// table holds after the last one
+		moved []int
+		rows  int
+	}{
+		{"same organization twice", []cannedSource{org("roaming", "edi"), org("roaming", "edi")}, []int{2, 0}, 2},
+		{"demo use added since", []cannedSource{org("roaming"), org("roaming", "edi")}, []int{1, 1}, 2},
+		{"code repeated in a document", []cannedSource{org("roaming", "roaming"), org("roaming", "roaming")}, []int{1, 0}, 1},
+		{"three runs", []cannedSource{org("sms"), org("sms"), org("sms")}, []int{1, 0, 0}, 1},
+	}
+	table := (&models.OrganizationServiceDemoUses{}).TableName()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, target := newMemoryTarget(t)
+			for i, source := range tt.runs {
+				m := newMemoryMigrator(t, db, source, Options{})
+				stats, err := m.migrateOrganizations(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range stats.Tables {
+					if r.Table == table && r.Moved != tt.moved[i] {
+						t.Errorf("run %d moved %d demo uses, expected %d", i+1, r.Moved, tt.moved[i])
+					}
+				}
+			}
+			if rows := target.rows(table); len(rows) != tt.rows {
+				t.Errorf("%d demo uses, expected %d: %v", len(rows), tt.rows, rows)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"migrate-tool/models"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gorm.io/gorm"
+)
+
+// orphanExamples is how many example rows -scan-orphans prints per relationship
+const orphanExamples = 5
+
+// relationship is a column of table pointing at the id of parent
+type relationship struct {
+	table  string
+	column string
+	parent string
+	// key identifies the example rows; tables without an id of their own use the
+	// column naming their owner
+	key string
+}
+
+// relationships returns every foreign key column scanned by -scan-orphans
+func relationships() []relationship {
+	return []relationship{
+		{(&models.OrganizationServiceDemoUses{}).TableName(), "organization_id", (&models.Organization{}).TableName(), "organization_id"},
+		{(&models.PackageItem{}).TableName(), "package_id", (&models.Package{}).TableName(), "id"},
+		{(&models.PackageActivationBonusPackage{}).TableName(), "package_id", (&models.Package{}).TableName(), "package_id"},
+		{(&models.PackageActivationBonusPackage{}).TableName(), "bonus_package_id", (&models.Package{}).TableName(), "package_id"},
+		{(&models.BoughtPackage{}).TableName(), "organization_id", (&models.Organization{}).TableName(), "id"},
+		{(&models.BoughtPackage{}).TableName(), "package_id", (&models.Package{}).TableName(), "id"},
+		{(&models.BoughtPackageItem{}).TableName(), "bought_package_id", (&models.BoughtPackage{}).TableName(), "id"},
+		{(&models.Charge{}).TableName(), "organization_id", (&models.Organization{}).TableName(), "id"},
+		{(&models.Charge{}).TableName(), "bought_package_id", (&models.BoughtPackage{}).TableName(), "id"},
+		{(&models.Payment{}).TableName(), "organization_id", (&models.Organization{}).TableName(), "id"},
+		{(&models.PaymeTransaction{}).TableName(), "organization_id", (&models.Organization{}).TableName(), "id"},
+		{(&models.PaymeTransaction{}).TableName(), "payment_id", (&models.Payment{}).TableName(), "id"},
+		{(&models.OrganizationBalanceBinding{}).TableName(), "payer_organization_id", (&models.Organization{}).TableName(), "id"},
+		{(&models.OrganizationBalanceBinding{}).TableName(), "target_organization_id", (&models.Organization{}).TableName(), "id"},
+		{(&models.CreditUpdates{}).TableName(), "organization_id", (&models.Organization{}).TableName(), "id"},
+	}
+}
+
+// scanOrphans prints, for every relationship, how many rows reference a parent
+// missing from the target and the keys of a few of them. Empty and zero references
+// are not counted. It only reports; nothing is deleted.
+func scanOrphans(ctx context.Context, mysql models.Database) error {
+	db := mysql.GetDB().WithContext(ctx)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tCOLUMN\tPARENT\tORPHANS\tEXAMPLES")
+
+	for _, r := range relationships() {
+		orphans := db.Table(r.table+" AS c").
+			Joins("LEFT JOIN "+r.parent+" AS p ON p.id = c."+r.column).
+			Where("p.id IS NULL").
+			Where("c."+r.column+" IS NOT NULL").
+			Where("c."+r.column+" NOT IN ?", []string{"", zeroObjectIDHex, zeroUUID}).
+			Session(&gorm.Session{})
+
+		var count int64
+		if err := orphans.Count(&count).Error; err != nil {
+			return fmt.Errorf("could not scan %s.%s: %w", r.table, r.column, err)
+		}
+		var examples []string
+		if count > 0 {
+			if err := orphans.Limit(orphanExamples).Pluck("c."+r.key, &examples).Error; err != nil {
+				return fmt.Errorf("could not scan %s.%s: %w", r.table, r.column, err)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", r.table, r.column, r.parent, count, strings.Join(examples, ", "))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"migrate-tool/models"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+// jsonlOutput writes the mapped rows to one <table>.jsonl file per target table
+// instead of inserting them, see -output. Rows go through the same batches as the
+// database path, so a file holds exactly the rows that would have been inserted.
+type jsonlOutput struct {
+	mu    sync.Mutex
+	dir   string
+	files map[string]*jsonlFile
+}
+
+type jsonlFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// newJSONLOutput creates dir if needed. It returns nil when dir is empty.
+func newJSONLOutput(dir string) (*jsonlOutput, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create output directory: %w", err)
+	}
+	return &jsonlOutput{dir: dir, files: make(map[string]*jsonlFile)}, nil
+}
+
+// file returns the writer of table, truncating the file on first use in this run
+func (o *jsonlOutput) file(table string) (*jsonlFile, error) {
+	if f, ok := o.files[table]; ok {
+		return f, nil
+	}
+	f, err := os.Create(filepath.Join(o.dir, table+".jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	file := &jsonlFile{f: f, w: bufio.NewWriter(f)}
+	o.files[table] = file
+	return file, nil
+}
+
+// Close flushes and closes every file, returning the first error
+func (o *jsonlOutput) Close() error {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var first error
+	for table, file := range o.files {
+		if err := file.w.Flush(); err != nil && first == nil {
+			first = fmt.Errorf("could not write %s.jsonl: %w", table, err)
+		}
+		if err := file.f.Close(); err != nil && first == nil {
+			first = fmt.Errorf("could not write %s.jsonl: %w", table, err)
+		}
+		delete(o.files, table)
+	}
+	return first
+}
+
+// writeJSONL appends rows to the file of their table, one JSON object per line keyed
+// by column name
+func writeJSONL[T any](o *jsonlOutput, db *gorm.DB, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(new(T)); err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	file, err := o.file(stmt.Schema.Table)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file.w)
+	for i := range rows {
+		value := reflect.ValueOf(&rows[i]).Elem()
+		record := make(map[string]interface{}, len(stmt.Schema.DBNames))
+		for _, column := range stmt.Schema.DBNames {
+			record[column], _ = stmt.Schema.FieldsByDBName[column].ValueOf(context.Background(), value)
+		}
+		if err := enc.Encode(record); err != nil {
+			return fmt.Errorf("could not write %s.jsonl: %w", stmt.Schema.Table, err)
+		}
+	}
+	return nil
+}
+
+// writeRows appends column maps to the file of table, like writeJSONL
+func (o *jsonlOutput) writeRows(table string, rows []map[string]interface{}) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	file, err := o.file(table)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file.w)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return fmt.Errorf("could not write %s.jsonl: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// exportJSONL runs the migrators against a dry-run target so every mapped row is
+// written to the -output directory. Nothing is read from the target, so rows are not
+// deduplicated against a previous run.
+func exportJSONL(mdb *mongo.Database, cfg models.Config, opts Options) error {
+	target, err := models.NewDryRunDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return NewMigratorWithClients(mdb, target, opts).Run(ctx)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"testing"
+)
+
+func TestMigratePackagesTwiceKeepsItems(t *testing.T) {
+	db, target := newMemoryTarget(t)
+	source := selfTestDocuments()
+	items := (&models.PackageItem{}).TableName()
+	var ids []string
+	for run := 1; run <= 2; run++ {
+		m := newMemoryMigrator(t, db, source, Options{})
+		if _, err := m.migratePackages(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		rows := target.rows(items)
+		if len(rows) != 2 {
+			t.Fatalf("run %d: %s has %d rows, expected 2", run, items, len(rows))
+		}
+		if run == 1 {
+			for _, row := range rows {
+				ids = append(ids, row["id"].(string))
+			}
+		}
+	}
+	// The primary key is derived from the package and the item code
+	for i, code := range []int{101, 102} {
+		if want := childRowID(selfTestID(2).Hex(), code); ids[i] != want {
+			t.Errorf("item %d has id %s, expected %s", code, ids[i], want)
+		}
+	}
+}
+
+func TestMigratePackagesKeepsItemsOfEarlierIDs(t *testing.T) {
+	db, target := newMemoryTarget(t)
+	// Inserted before the ids were derived, under an id of its own
+	legacy := models.PackageItem{ID: "legacy-item", PackageId: selfTestID(2).Hex(), Name: "Invoices", Code: 101}
+	if err := db.GetDB().Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+	m := newMemoryMigrator(t, db, selfTestDocuments(), Options{})
+	if _, err := m.migratePackages(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rows := target.rows(legacy.TableName())
+	if len(rows) != 2 {
+		t.Fatalf("%s has %d rows, expected 2", legacy.TableName(), len(rows))
+	}
+	if rows[0]["id"] != legacy.ID || rows[1]["code"] != 102 {
+		t.Errorf("rows are %v, expected the earlier item and item 102", rows)
+	}
+}
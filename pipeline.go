@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// pipelined is one source document with the result of transforming it; seq is its
+// position in the cursor
+type pipelined[T any] struct {
+	seq   int
+	doc   bson.Raw
+	value T
+	err   error
+}
+
+// pipeline reads the documents of cur on one goroutine, transforms them on workers
+// goroutines and hands every document, its transformed value and the transform error
+// to write on the calling goroutine, in cursor order. Batches, checkpoints, counters
+// and the transaction of a run are only touched by write, so transform must not use
+// them. With one worker or fewer it runs inline. With a commit interval, flush is
+// also called on the calling goroutine every interval while no document is written,
+// as by a commitCursor. It only returns the errors of write and flush; the caller
+// checks how the cursor ended with cursorErr.
+func pipeline[T any](ctx context.Context, cur *mongo.Cursor, workers int, transform func(bson.Raw) (T, error), write func(doc bson.Raw, value T, err error) error,
+	interval time.Duration, flush func() error) error {
+	if workers <= 1 {
+		docs := newCommitCursor(ctx, cur, interval, flush)
+		defer docs.Close()
+		for docs.Next(ctx) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			value, err := transform(cur.Current)
+			if err := write(cur.Current, value, err); err != nil {
+				return err
+			}
+		}
+		return docs.Err()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan pipelined[T], 2*workers)
+	results := make(chan pipelined[T], 2*workers)
+
+	// The cursor reuses its buffer, so every document is copied before handing it over
+	go func() {
+		defer close(jobs)
+		for seq := 0; cur.Next(ctx); seq++ {
+			select {
+			case jobs <- pipelined[T]{seq: seq, doc: append(bson.Raw(nil), cur.Current...)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job.value, job.err = transform(job.doc)
+				select {
+				case results <- job:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	fail := func(err error) error {
+		cancel()
+		for range results {
+		}
+		return err
+	}
+	// Workers finish out of order; results wait here until every earlier one is written
+	pending := make(map[int]pipelined[T])
+	next := 0
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				return nil
+			}
+			pending[result.seq] = result
+			for {
+				p, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				if err := write(p.doc, p.value, p.err); err != nil {
+					return fail(err)
+				}
+			}
+		case <-tick:
+			if err := flush(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+}
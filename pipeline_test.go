@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestPipelineWritesInCursorOrder(t *testing.T) {
+	var docs []interface{}
+	for i := 0; i < 50; i++ {
+		docs = append(docs, bson.M{"_id": selfTestID(i + 1), "n": i})
+	}
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			cur, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Earlier documents take longer, so the workers finish them out of order
+			transform := func(doc bson.Raw) (int32, error) {
+				n := doc.Lookup("n").Int32()
+				time.Sleep(time.Duration(len(docs)-int(n)) * 50 * time.Microsecond)
+				return n, nil
+			}
+			var written []int32
+			err = pipeline(context.Background(), cur, workers, transform, func(doc bson.Raw, n int32, err error) error {
+				written = append(written, n)
+				return err
+			}, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(written) != len(docs) {
+				t.Fatalf("wrote %d documents, expected %d", len(written), len(docs))
+			}
+			for i, n := range written {
+				if int(n) != i {
+					t.Fatalf("document %d written at position %d", n, i)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateChargesSkipsOversizedBeforeDecoding(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	charge := func(n int) bson.M {
+		return bson.M{
+			"_id": selfTestID(n), "created_at": created, "price": 500.0,
+			"organization": bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}, "package": bson.M{"_id": selfTestID(40)},
+		}
+	}
+	var docs []interface{}
+	for n := 1; n <= 8; n++ {
+		docs = append(docs, charge(n))
+	}
+	// Would fail to decode, so it must be skipped for its size before the transform
+	oversized := charge(9)
+	oversized["price"] = strings.Repeat("x", 4096)
+	docs = append(docs[:4], append([]interface{}{oversized}, docs[4:]...)...)
+
+	m, dir := newOutputMigrator(t, cannedSource{"charges": docs}, Options{TransformWorkers: 4, MaxDocSize: 2048})
+	stats, err := m.migrateCharges(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := stats.Tables[0]; r.Moved != 8 || r.Failed != 0 {
+		t.Errorf("moved %d failed %d, expected 8 and 0", r.Moved, r.Failed)
+	}
+	if len(m.oversized["charges"]) != 1 {
+		t.Errorf("%d oversized charges, expected 1", len(m.oversized["charges"]))
+	}
+	rows := outputRows(t, m, dir, "charges")
+	if len(rows) != 8 {
+		t.Fatalf("wrote %d charges, expected 8", len(rows))
+	}
+	for i, row := range rows {
+		if want := selfTestID(i + 1).Hex(); row["id"] != want {
+			t.Errorf("row %d is %v, expected %s", i, row["id"], want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"migrate-tool/models"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"gorm.io/gorm"
+)
+
+// parsePresenceFields parses a comma-separated collection.field list. The field part
+// may itself be a dotted path such as organizations.offer_info.date.
+func parsePresenceFields(spec string) map[string][]string {
+	fields := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		collection, field, ok := strings.Cut(entry, ".")
+		if !ok || collection == "" || field == "" {
+			continue
+		}
+		fields[collection] = append(fields[collection], field)
+	}
+	return fields
+}
+
+// recordPresence replaces the field_presence rows of the record with one for every
+// tracked field of the collection that is null or missing in doc. Both decode to nil,
+// so the raw document is inspected; fields holding a value are not recorded, and the
+// rows of an earlier run for fields that have a value by now are deleted.
+func (m *Migrator) recordPresence(db *gorm.DB, collection, table, id string, doc bson.Raw) error {
+	fields := m.opts.PresenceFields[collection]
+	if len(fields) == 0 {
+		return nil
+	}
+	var rows []models.FieldPresence
+	for _, field := range fields {
+		state := models.FieldNull
+		value, err := doc.LookupErr(strings.Split(field, ".")...)
+		if err != nil {
+			state = models.FieldMissing
+		} else if value.Type != bson.TypeNull {
+			continue
+		}
+		rows = append(rows, models.FieldPresence{
+			Table:    table,
+			RecordID: id,
+			Field:    field,
+			State:    state,
+		})
+	}
+
+	err := db.Where("table_name = ? AND record_id = ?", table, id).Delete(&models.FieldPresence{}).Error
+	if err != nil {
+		return fmt.Errorf("%s %s field_presence delete failed: %w", table, id, err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		return fmt.Errorf("%s %s field_presence insert failed: %w", table, id, err)
+	}
+	return nil
+}
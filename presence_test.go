@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRecordPresenceReplacesRowsOfRecord(t *testing.T) {
+	m, statements := newDryRunMigrator(t, cannedSource{}, Options{
+		PresenceFields: map[string][]string{"organizations": {"inn", "offer_info.date"}},
+	})
+	db := m.mysql.GetDB()
+	id := selfTestID(10).Hex()
+
+	tests := []struct {
+		name    string
+		doc     bson.M
+		inserts int
+	}{
+		{"null and missing", bson.M{"inn": nil}, 1},
+		{"unchanged re-run", bson.M{"inn": nil}, 1},
+		{"fields set since", bson.M{"inn": "123456789", "offer_info": bson.M{"date": "2024-03-01"}}, 0},
+	}
+	for _, tt := range tests {
+		*statements = (*statements)[:0]
+		doc, err := bson.Marshal(tt.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.recordPresence(db, "organizations", "organizations", id, doc); err != nil {
+			t.Fatal(err)
+		}
+		if len(*statements) != 1+tt.inserts {
+			t.Fatalf("%s: ran %d statements, expected %d: %q", tt.name, len(*statements), 1+tt.inserts, *statements)
+		}
+		if !strings.HasPrefix((*statements)[0], "DELETE") || !strings.Contains((*statements)[0], "record_id = ?") {
+			t.Errorf("%s: the rows of the record are not deleted first: %s", tt.name, (*statements)[0])
+		}
+		if tt.inserts > 0 && strings.Count((*statements)[1], "(?,?,?,?)") != 2 {
+			t.Errorf("%s: expected the null and the missing field: %s", tt.name, (*statements)[1])
+		}
+	}
+}
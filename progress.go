@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// defaultProgressEvery is the number of documents read between progress lines unless
+// -progress-every is set
+const defaultProgressEvery = 10000
+
+// progressMeter logs a progress line with rate and ETA every few documents read from
+// one collection. A nil meter reports nothing.
+type progressMeter struct {
+	collection string
+	total      int64
+	every      int64
+	processed  int64
+	start      time.Time
+}
+
+// newProgress starts the meter of collection, total being the document count from
+// mongoCount (0 when unknown). It returns nil when -progress-every is 0.
+func (m *Migrator) newProgress(collection string, total int64) *progressMeter {
+	if m.opts.ProgressEvery <= 0 {
+		return nil
+	}
+	return &progressMeter{collection: collection, total: total, every: m.opts.ProgressEvery, start: time.Now()}
+}
+
+// tick counts one document read from the cursor
+func (p *progressMeter) tick() {
+	if p == nil {
+		return
+	}
+	p.processed++
+	if p.processed%p.every != 0 {
+		return
+	}
+
+	elapsed := time.Since(p.start)
+	rate := float64(p.processed) / elapsed.Seconds()
+	args := []any{"collection", p.collection, "processed", p.processed, "rate", int64(rate)}
+	// The total is counted before the checkpoint and -since/-until filter documents
+	// out, so it is an upper bound; documents inserted meanwhile may exceed it
+	if p.total > 0 && p.processed < p.total {
+		args = append(args,
+			"total", p.total,
+			"percent", int(p.processed*100/p.total),
+			"eta", time.Duration(float64(p.total-p.processed)/rate*float64(time.Second)).Round(time.Second),
+		)
+	}
+	slog.Info("progress", args...)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"migrate-tool/models"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// exitCountMismatch is the exit status of a run whose reconciliation found a table
+// whose row count differs from the source
+const exitCountMismatch = 3
+
+// countExpectation registers how many rows a table is expected to hold after a run
+type countExpectation struct {
+	table      string
+	collection string
+	// array, when set, is the embedded array whose elements are counted instead of
+	// the documents of collection
+	array string
+	// migration writes the rows, so a run leaving it out by -only or -skip does not
+	// expect them
+	migration string
+	// counter, when set, counts the source of the rows instead
+	counter func(ctx context.Context, mdb *mongo.Database, names CollectionNames) (int64, error)
+}
+
+// source names the counted collection or array in the report
+func (e countExpectation) source() string {
+	if e.array == "" {
+		return e.collection
+	}
+	return e.collection + "." + e.array
+}
+
+// countExpectations returns every migrated table. Child tables have no collection of
+// their own, so their expectation is derived from the embedded arrays. A table
+// written by several migrations, like bought_packages, has an expectation per
+// migration.
+func countExpectations() []countExpectation {
+	return []countExpectation{
+		{table: (&models.Service{}).TableName(), collection: "services", migration: "services"},
+		{table: (&models.Organization{}).TableName(), collection: "organizations", migration: "organizations"},
+		{table: (&models.OrganizationServiceDemoUses{}).TableName(), collection: "organizations", array: "service_demo_uses", migration: "organizations"},
+		{table: (&models.Package{}).TableName(), collection: "packages", migration: "packages"},
+		{table: (&models.PackageItem{}).TableName(), collection: "packages", array: "items", migration: "packages"},
+		{table: (&models.PackageActivationBonusPackage{}).TableName(), collection: "packages", array: "on_activation_bonus_packages", migration: "packages"},
+		{table: (&models.BoughtPackage{}).TableName(), collection: "boughtPackages", migration: "bought-packages"},
+		{table: (&models.BoughtPackageItem{}).TableName(), collection: "boughtPackages", array: "package.package_items", migration: "bought-packages"},
+		{table: (&models.BoughtPackage{}).TableName(), collection: "organizations", array: "active_packages",
+			migration: "active-packages", counter: activePackagesCounter("")},
+		{table: (&models.BoughtPackageItem{}).TableName(), collection: "organizations", array: "active_packages.package.items",
+			migration: "active-packages", counter: activePackagesCounter("package.items")},
+		{table: (&models.Charge{}).TableName(), collection: "charges", migration: "charges"},
+		{table: (&models.Payment{}).TableName(), collection: "payments", migration: "payments"},
+		{table: (&models.PaymeTransaction{}).TableName(), collection: "paymeTransactions", migration: "payme-transactions"},
+		{table: (&models.OrganizationBalanceBinding{}).TableName(), collection: "organizationBalanceBindings", migration: "organization-balance-bindings"},
+		{table: (&models.CreditUpdates{}).TableName(), collection: "creditUpdates", migration: "credit-updates"},
+		{table: (&models.BankPaymentAutoApplyError{}).TableName(), collection: "bankPaymentsAutoApplyErrors", migration: "bank-payments-auto-apply-errors"},
+	}
+}
+
+// count returns the number of source documents or array elements of e
+func (e countExpectation) count(ctx context.Context, mdb *mongo.Database, names CollectionNames) (int64, error) {
+	if e.counter != nil {
+		n, err := e.counter(ctx, mdb, names)
+		if err != nil {
+			return 0, fmt.Errorf("could not count %s: %w", e.source(), err)
+		}
+		return n, nil
+	}
+	coll := mdb.Collection(names.resolve(e.collection))
+	if e.array == "" {
+		return mongoCount(ctx, coll), nil
+	}
+	n, err := arrayLengthSum(ctx, coll, e.array)
+	if err != nil {
+		return 0, fmt.Errorf("could not count %s: %w", e.source(), err)
+	}
+	return n, nil
+}
+
+// arrayLengthSum counts the elements of the array at field over all documents of
+// coll, the same total as $unwind followed by $count without materializing one
+// document per element. A missing, null or non-array field counts as empty, as the
+// migrators decode it, instead of failing $size.
+func arrayLengthSum(ctx context.Context, coll *mongo.Collection, field string) (int64, error) {
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id": nil,
+			"total": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$isArray": "$" + field}, bson.M{"$size": "$" + field}, 0,
+			}}},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var result struct {
+		Total int64 `bson:"total"`
+	}
+	if cur.Next(ctx) {
+		if err := cur.Decode(&result); err != nil {
+			return 0, err
+		}
+	}
+	return result.Total, cur.Err()
+}
+
+// activePackagesCounter counts the active packages of organizations that have no
+// boughtPackages document of the same _id, which migrateActivePackages adds to
+// bought_packages, or with items set the elements of that array of theirs, which
+// become their bought_package_items
+func activePackagesCounter(items string) func(context.Context, *mongo.Database, CollectionNames) (int64, error) {
+	return func(ctx context.Context, mdb *mongo.Database, names CollectionNames) (int64, error) {
+		var count interface{} = 1
+		if items != "" {
+			field := "$active_packages." + items
+			count = bson.M{"$cond": bson.A{bson.M{"$isArray": field}, bson.M{"$size": field}, 0}}
+		}
+		cur, err := mdb.Collection(names.resolve("organizations")).Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"active_packages.0": bson.M{"$exists": true}}}},
+			{{Key: "$unwind", Value: "$active_packages"}},
+			{{Key: "$lookup", Value: bson.M{
+				"from":         names.resolve("boughtPackages"),
+				"localField":   "active_packages._id",
+				"foreignField": "_id",
+				"as":           "bought",
+			}}},
+			{{Key: "$match", Value: bson.M{"bought.0": bson.M{"$exists": false}}}},
+			{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": count}}}},
+		})
+		if err != nil {
+			return 0, err
+		}
+		defer cur.Close(ctx)
+
+		var result struct {
+			Total int64 `bson:"total"`
+		}
+		if cur.Next(ctx) {
+			if err := cur.Decode(&result); err != nil {
+				return 0, err
+			}
+		}
+		return result.Total, cur.Err()
+	}
+}
+
+// partialCountsReason returns why the target of a run with opts is expected to hold
+// fewer rows than the source counts, or "" when it should hold them all
+func partialCountsReason(opts Options) string {
+	switch {
+	case opts.Limit > 0:
+		return fmt.Sprintf("with -limit %d", opts.Limit)
+	case opts.ExcludeDeleted:
+		return "with -exclude-deleted as the source counts include deleted documents"
+	case opts.Incremental:
+		return "with -incremental when older documents were never synced"
+	case opts.dateWindowed():
+		return "with -since/-until as the source counts include documents outside the window"
+	}
+	return ""
+}
+
+// reconcileScope narrows a reconciliation to what a run wrote
+type reconcileScope struct {
+	// migrations are the names of the migrations run, all when nil
+	migrations map[string]bool
+	// adjustments are the rows per table the run wrote beyond or short of the source
+	// counts on purpose, see Migrator.countAdjustments
+	adjustments map[string]int
+}
+
+// tableCount is the source count of a table summed over its expectations
+type tableCount struct {
+	table   string
+	sources []string
+	count   int64
+}
+
+// countTables counts the source of every table of expectations, in their order
+func countTables(ctx context.Context, mdb *mongo.Database, names CollectionNames, expectations []countExpectation) ([]*tableCount, error) {
+	var tables []*tableCount
+	byTable := make(map[string]*tableCount)
+	for _, e := range expectations {
+		n, err := e.count(ctx, mdb, names)
+		if err != nil {
+			return nil, err
+		}
+		t := byTable[e.table]
+		if t == nil {
+			t = &tableCount{table: e.table}
+			byTable[e.table] = t
+			tables = append(tables, t)
+		}
+		t.sources = append(t.sources, e.source())
+		t.count += n
+	}
+	return tables, nil
+}
+
+// expectations returns the expectations of the migrations of s
+func (s reconcileScope) expectations() []countExpectation {
+	var expectations []countExpectation
+	for _, e := range countExpectations() {
+		if s.migrations == nil || s.migrations[e.migration] {
+			expectations = append(expectations, e)
+		}
+	}
+	return expectations
+}
+
+// reconcile prints the source count, the adjustment of scope, the destination count
+// and the delta of every registered table and reports whether all deltas are zero.
+// Skipped documents show up as deltas; the charges split by -charge-items split and
+// the organizations merged by -merge-orgs-by-inn are adjustments when scope comes
+// from the run.
+func reconcile(ctx context.Context, mdb *mongo.Database, mysql models.Database, names CollectionNames, scope reconcileScope) (bool, error) {
+	tables, err := countTables(ctx, mdb, names, scope.expectations())
+	if err != nil {
+		return false, err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tSOURCE\tSOURCE COUNT\tADJUSTMENT\tMYSQL COUNT\tDELTA")
+
+	ok := true
+	for _, t := range tables {
+		adjustment := int64(scope.adjustments[t.table])
+		expected := t.count + adjustment
+		actual := mysqlCount(mysql, t.table)
+		if actual != expected {
+			ok = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%+d\t%d\t%+d\n", t.table, strings.Join(t.sources, " + "), t.count, adjustment, actual, actual-expected)
+	}
+	return ok, w.Flush()
+}
+
+// countSource prints, for list -counts, the number of source documents or array
+// elements behind every table and their total, the rows a full run would insert
+// before skips, splits and merges
+func countSource(ctx context.Context, mdb *mongo.Database, names CollectionNames) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tSOURCE\tESTIMATED ROWS")
+
+	var total int64
+	for _, e := range countExpectations() {
+		n, err := e.count(ctx, mdb, names)
+		if err != nil {
+			return err
+		}
+		total += n
+		fmt.Fprintf(w, "%s\t%s\t%d\n", e.table, e.source(), n)
+	}
+	fmt.Fprintf(w, "TOTAL\t\t%d\n", total)
+	return w.Flush()
+}
+
+// reconcileScope returns the scope reconciling the run of m
+func (m *Migrator) reconcileScope() reconcileScope {
+	scope := reconcileScope{adjustments: m.countAdjustments}
+	if len(m.opts.Only) > 0 || len(m.opts.Skip) > 0 {
+		selected, _ := selectMigrations(m.opts)
+		scope.migrations = make(map[string]bool, len(selected))
+		for _, mig := range selected {
+			scope.migrations[mig.name] = true
+		}
+	}
+	return scope
+}
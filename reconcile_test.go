@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCountAdjustmentsOfMergedOrganizations(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	org := func(n int, inn string, codes ...string) bson.M {
+		var uses bson.A
+		for _, code := range codes {
+			uses = append(uses, bson.M{"_id": selfTestID(100 + n), "name": code, "code": code})
+		}
+		return bson.M{"_id": selfTestID(n), "created_at": created.Add(time.Duration(n) * time.Hour), "name": "Org", "inn": inn, "service_demo_uses": uses}
+	}
+	source := cannedSource{
+		"organizations": {
+			org(1, "123456789", "roaming", "edi"),
+			org(2, "123456789", "roaming", "sms"),
+			org(3, "123456789", "edi"),
+			org(4, "987654321", "roaming"),
+		},
+	}
+	m, dir := newOutputMigrator(t, source, Options{MergeOrgsByINN: true})
+	ctx := context.Background()
+	for _, step := range []func(*Migrator, context.Context) (CollectionStats, error){
+		(*Migrator).planOrganizationMerges, (*Migrator).migrateOrganizations,
+	} {
+		if _, err := step(m, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		table  string
+		source int
+		want   int
+	}{
+		// Organizations 2 and 3 merge into 1
+		{(&models.Organization{}).TableName(), 4, -2},
+		// roaming of 2 and edi of 3 repeat demo uses of 1, sms is new
+		{(&models.OrganizationServiceDemoUses{}).TableName(), 6, -2},
+	}
+	scope := m.reconcileScope()
+	for _, tt := range tests {
+		if got := scope.adjustments[tt.table]; got != tt.want {
+			t.Errorf("adjustment of %s is %d, expected %d", tt.table, got, tt.want)
+		}
+		if rows := outputRows(t, m, dir, tt.table); len(rows) != tt.source+tt.want {
+			t.Errorf("%s has %d rows, expected %d%+d", tt.table, len(rows), tt.source, tt.want)
+		}
+	}
+}
+
+func TestCountAdjustmentsOfSplitCharges(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	charge := func(n int, items ...int) bson.M {
+		var array bson.A
+		for _, code := range items {
+			array = append(array, bson.M{"code": code})
+		}
+		return bson.M{"_id": selfTestID(n), "created_at": created, "organization": bson.M{"_id": selfTestID(1)}, "price": 10.0,
+			"package": bson.M{"_id": selfTestID(40)}, "service": bson.M{"code": "roaming"}, "items": array}
+	}
+	source := cannedSource{"charges": {charge(50, 101), charge(51, 101, 102, 103), charge(52)}}
+
+	tests := []struct {
+		policy string
+		want   int
+	}{
+		{chargeItemsPrimary, 0},
+		// Charge 51 splits into 3 rows
+		{chargeItemsSplit, 2},
+	}
+	table := (&models.Charge{}).TableName()
+	for _, tt := range tests {
+		m, dir := newOutputMigrator(t, source, Options{ChargeItems: tt.policy})
+		if _, err := m.migrateCharges(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.reconcileScope().adjustments[table]; got != tt.want {
+			t.Errorf("%s: adjustment is %d, expected %d", tt.policy, got, tt.want)
+		}
+		if rows := outputRows(t, m, dir, table); len(rows) != 3+tt.want {
+			t.Errorf("%s: %d rows, expected %d", tt.policy, len(rows), 3+tt.want)
+		}
+	}
+}
+
+func TestReconcileScopeOfSelectedMigrations(t *testing.T) {
+	bought := (&models.BoughtPackage{}).TableName()
+	tests := []struct {
+		name string
+		opts Options
+		// tables lists the expectations, by table, of the scope
+		tables []string
+	}{
+		{"only payments", Options{Only: []string{"payments"}}, []string{(&models.Payment{}).TableName()}},
+		{"only bought packages", Options{Only: []string{"bought-packages"}},
+			[]string{bought, (&models.BoughtPackageItem{}).TableName()}},
+		{"only active packages", Options{Only: []string{"active-packages", "charges"}},
+			[]string{bought, (&models.BoughtPackageItem{}).TableName(), (&models.Charge{}).TableName()}},
+	}
+	for _, tt := range tests {
+		m := newMigrator(cannedSource{}, nil, tt.opts)
+		var tables []string
+		for _, e := range m.reconcileScope().expectations() {
+			tables = append(tables, e.table)
+		}
+		if strings.Join(tables, ",") != strings.Join(tt.tables, ",") {
+			t.Errorf("%s: expects %v, expected %v", tt.name, tables, tt.tables)
+		}
+	}
+
+	m := newMigrator(cannedSource{}, nil, Options{Skip: []string{"charges"}})
+	for _, e := range m.reconcileScope().expectations() {
+		if e.migration == "charges" {
+			t.Error("-skip charges still expects the charges")
+		}
+	}
+	if got, all := len(newMigrator(cannedSource{}, nil, Options{}).reconcileScope().expectations()), len(countExpectations()); got != all {
+		t.Errorf("a full run expects %d tables, expected %d", got, all)
+	}
+}
+
+func TestCountExpectationsNameMigrations(t *testing.T) {
+	names := make(map[string]bool)
+	for _, mig := range migrations {
+		names[mig.name] = true
+	}
+	for _, e := range countExpectations() {
+		if !names[e.migration] {
+			t.Errorf("%s expects rows of unknown migration %q", e.source(), e.migration)
+		}
+	}
+}
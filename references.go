@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"migrate-tool/models"
+)
+
+// checkBonusPackageReferences reports package_activation_bonus_packages rows whose
+// bonus package was not migrated, e.g. because it was deleted in the source.
+func (m *Migrator) checkBonusPackageReferences(ctx context.Context) (CollectionStats, error) {
+	bonusTable := (&models.PackageActivationBonusPackage{}).TableName()
+	packageTable := (&models.Package{}).TableName()
+
+	var dangling []models.PackageActivationBonusPackage
+	if err := m.mysql.GetDB().WithContext(ctx).Table(bonusTable + " AS b").
+		Select("b.package_id, b.bonus_package_id").
+		Joins("LEFT JOIN " + packageTable + " AS p ON p.id = b.bonus_package_id").
+		Where("p.id IS NULL").
+		Scan(&dangling).Error; err != nil {
+		return CollectionStats{}, err
+	}
+
+	for _, ref := range dangling {
+		slog.Warn("bonus package does not exist", "package_id", ref.PackageId, "bonus_package_id", ref.BonusPackageId)
+	}
+	slog.Info("checked", "collection", "package_activation_bonus_packages", "dangling_bonus_references", len(dangling))
+	return CollectionStats{}, nil
+}
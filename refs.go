@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"migrate-tool/models"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gorm.io/gorm"
+)
+
+// Orphan policies of -on-orphan
+const (
+	onOrphanSkip       = "skip"
+	onOrphanQuarantine = "quarantine"
+)
+
+// zeroObjectIDHex is the id written for an absent embedded reference
+const zeroObjectIDHex = "000000000000000000000000"
+
+// reference is a column that must point at an existing row of table
+type reference struct {
+	column string
+	table  string
+}
+
+// references returns the parent references checked by -check-refs per collection
+func references() map[string][]reference {
+	return map[string][]reference{
+		"boughtPackages": {
+			{"organization_id", (&models.Organization{}).TableName()},
+			{"package_id", (&models.Package{}).TableName()},
+		},
+		"charges": {
+			{"organization_id", (&models.Organization{}).TableName()},
+			{"bought_package_id", (&models.BoughtPackage{}).TableName()},
+		},
+		"payments": {
+			{"organization_id", (&models.Organization{}).TableName()},
+		},
+		"paymeTransactions": {
+			{"organization_id", (&models.Organization{}).TableName()},
+			{"payment_id", (&models.Payment{}).TableName()},
+		},
+		"organizationBalanceBindings": {
+			{"payer_organization_id", (&models.Organization{}).TableName()},
+			{"target_organization_id", (&models.Organization{}).TableName()},
+		},
+		"creditUpdates": {
+			{"organization_id", (&models.Organization{}).TableName()},
+		},
+	}
+}
+
+// orphan is a row whose reference column points at a missing parent
+type orphan struct {
+	column    string
+	missingID string
+}
+
+// findOrphans returns, by id, the rows of a batch referencing a parent row missing from
+// MySQL. Every reference column is checked with one id IN (...) query per batch;
+// empty and zero ObjectID references are not checked.
+func findOrphans[T any](m *Migrator, collection string, ids []string, rows []T) (map[string]orphan, error) {
+	refs := references()[collection]
+	if !m.opts.CheckRefs || len(refs) == 0 || len(rows) == 0 {
+		return nil, nil
+	}
+
+	db := m.mysql.GetDB()
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&rows[0]); err != nil {
+		return nil, err
+	}
+
+	orphans := make(map[string]orphan)
+	for _, ref := range refs {
+		field := stmt.Schema.LookUpField(ref.column)
+		if field == nil {
+			return nil, fmt.Errorf("unknown reference column %s of %s", ref.column, collection)
+		}
+
+		values := make([]string, len(rows))
+		var lookup []string
+		for i := range rows {
+			value, zero := field.ValueOf(context.Background(), reflect.ValueOf(&rows[i]).Elem())
+			if zero {
+				continue
+			}
+			if ptr, ok := value.(*string); ok {
+				value = *ptr
+			}
+			if id := fmt.Sprint(value); id != "" && id != zeroObjectIDHex && id != zeroUUID {
+				values[i] = id
+				lookup = append(lookup, id)
+			}
+		}
+		if len(lookup) == 0 {
+			continue
+		}
+
+		found, err := existingIDs(db, ref.table, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%s reference check failed: %w", ref.column, err)
+		}
+		for i, id := range values {
+			if id == "" || found[id] {
+				continue
+			}
+			if _, ok := orphans[ids[i]]; !ok {
+				orphans[ids[i]] = orphan{column: ref.column, missingID: id}
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// handleOrphan counts an orphaned row and stores it in orphan_records when the
+// quarantine policy is selected
+func (m *Migrator) handleOrphan(collection, id string, o orphan, row interface{}) error {
+	m.orphans[collection]++
+	slog.Debug("orphaned row", "collection", collection, "id", id, "column", o.column, "missing_id", o.missingID)
+	if m.opts.OnOrphan != onOrphanQuarantine {
+		return nil
+	}
+
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	record := models.OrphanRecord{
+		CreatedAt:  time.Now(),
+		Collection: collection,
+		RecordID:   id,
+		Column:     o.column,
+		MissingID:  o.missingID,
+		Row:        string(data),
+	}
+	if err := m.failures.GetDB().Create(&record).Error; err != nil {
+		return fmt.Errorf("could not quarantine %s %s: %w", collection, id, err)
+	}
+	return nil
+}
+
+// reportOrphans logs how many rows per collection referenced missing parents
+func (m *Migrator) reportOrphans() {
+	for collection, count := range m.orphans {
+		slog.Warn("rows with missing parents", "collection", collection, "orphans", count, "policy", m.opts.OnOrphan)
+	}
+}
+
+// requiredRef is an embedded reference a row cannot be migrated without
+type requiredRef struct {
+	field string
+	id    primitive.ObjectID
+}
+
+// skipMissingRefs reports whether one of refs is the zero ObjectID decoded from an
+// absent or id-less embedded document. Such a document is skipped instead of being
+// migrated with a reference to the all-zeros id; it is counted apart from failed
+// documents and, like them, recorded in migration_errors with -output-errors-to-mysql
+// or -skip-errors.
+func (m *Migrator) skipMissingRefs(collection, id string, doc bson.Raw, refs ...requiredRef) bool {
+	for _, ref := range refs {
+		if !ref.id.IsZero() {
+			continue
+		}
+		m.missingRefs[collection]++
+		slog.Debug("missing reference", "collection", collection, "id", id, "field", ref.field)
+		m.storeFailure(collection, id, doc, fmt.Errorf("missing required reference %s", ref.field))
+		return true
+	}
+	return false
+}
+
+// reportMissingRefs logs how many documents per collection skipMissingRefs skipped
+func (m *Migrator) reportMissingRefs() {
+	for collection, count := range m.missingRefs {
+		slog.Warn("skipped documents missing a required reference", "collection", collection, "skipped", count)
+	}
+}
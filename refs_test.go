@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMissingReferencesSkipped(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	org := bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}
+	pkg := bson.M{"_id": selfTestID(2), "name": "Start", "price": 120000.0}
+	tests := []struct {
+		collection string
+		migrate    func(*Migrator, context.Context) (CollectionStats, error)
+		complete   bson.M
+		missing    bson.M
+		field      string
+	}{
+		{
+			"payments", (*Migrator).migratePayments,
+			bson.M{"_id": selfTestID(60), "created_at": created, "amount": 100.0, "organization": org},
+			bson.M{"_id": selfTestID(61), "created_at": created, "amount": 100.0},
+			"organization._id",
+		},
+		{
+			"creditUpdates", (*Migrator).migrateCreditUpdates,
+			bson.M{"_id": selfTestID(90), "created_at": created, "amount": 100.0, "organization": org},
+			bson.M{"_id": selfTestID(91), "created_at": created, "amount": 100.0, "organization": bson.M{"name": "Alpha LLC"}},
+			"organization._id",
+		},
+		{
+			"boughtPackages", (*Migrator).migrateBoughtPackages,
+			bson.M{"_id": selfTestID(40), "bought_at": created, "organization": org, "package": pkg},
+			bson.M{"_id": selfTestID(41), "bought_at": created, "organization": org, "package": nil},
+			"package._id",
+		},
+		{
+			"organizationBalanceBindings", (*Migrator).migrateOrganizationBalanceBindings,
+			bson.M{"_id": selfTestID(80), "created_at": created, "payer_organization": bson.M{"id": selfTestID(10)}, "target_organization": bson.M{"id": selfTestID(11)}},
+			bson.M{"_id": selfTestID(81), "created_at": created, "payer_organization": bson.M{"id": selfTestID(10)}, "target_organization": bson.M{}},
+			"target_organization._id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.collection, func(t *testing.T) {
+			db, target := newMemoryTarget(t)
+			m := newMemoryMigrator(t, db, cannedSource{tt.collection: {tt.complete, tt.missing}}, Options{SkipErrors: true})
+			stats, err := tt.migrate(m, context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := stats.Tables[0]
+			if r.Moved != 1 || r.MissingRefs != 1 || r.Failed != 0 {
+				t.Errorf("moved %d missing refs %d failed %d, expected 1, 1 and 0", r.Moved, r.MissingRefs, r.Failed)
+			}
+			hex := func(doc bson.M) string { return doc["_id"].(primitive.ObjectID).Hex() }
+			if rows := target.rows(r.Table); len(rows) != 1 || rows[0]["id"] != hex(tt.complete) {
+				t.Errorf("%s holds %v, expected only %s", r.Table, rows, hex(tt.complete))
+			}
+			failures := target.rows((&models.MigrationError{}).TableName())
+			if len(failures) != 1 || failures[0]["record_id"] != hex(tt.missing) ||
+				!strings.Contains(failures[0]["error"].(string), tt.field) {
+				t.Errorf("recorded failures %v, expected one about %s", failures, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// rowHashColumn is the column holding the hash of the other columns of a row
+const rowHashColumn = "row_hash"
+
+// setRowHashes stores the hash of every row in its row_hash field and returns the
+// hashes in the order of rows, or nil when the model has no row_hash column
+func setRowHashes[T any](db *gorm.DB, rows []T) ([]string, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(new(T)); err != nil {
+		return nil, err
+	}
+	hashField := stmt.Schema.LookUpField(rowHashColumn)
+	if hashField == nil {
+		return nil, nil
+	}
+
+	hashes := make([]string, len(rows))
+	for i := range rows {
+		value := reflect.ValueOf(&rows[i]).Elem()
+		h := sha256.New()
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" || field == hashField {
+				continue
+			}
+			fieldValue, _ := field.ValueOf(context.Background(), value)
+			fmt.Fprintf(h, "%s=%s\x00", field.DBName, hashValue(fieldValue))
+		}
+		hashes[i] = hex.EncodeToString(h.Sum(nil))
+		if err := hashField.Set(context.Background(), value, hashes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// hashValue renders a column value for hashing the same way in every run: times in
+// UTC, so the -tz location does not change the hash, and NULL apart from any value
+func hashValue(v interface{}) string {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return "\x01null"
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return "\x01null"
+	}
+	if t, ok := rv.Interface().(time.Time); ok {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%v", rv.Interface())
+}
+
+// storedHashes returns the row_hash of the rows of table with the given ids
+func storedHashes(db *gorm.DB, table string, ids []string) (map[string]string, error) {
+	var rows []struct {
+		ID      string
+		RowHash string
+	}
+	if err := db.Table(table).Select("id, "+rowHashColumn).Where("id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("could not read %s of %s: %w", rowHashColumn, table, err)
+	}
+	hashes := make(map[string]string, len(rows))
+	for _, row := range rows {
+		hashes[row.ID] = row.RowHash
+	}
+	return hashes, nil
+}
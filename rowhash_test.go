@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"migrate-tool/models"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSetRowHashes(t *testing.T) {
+	m, _ := newDryRunMigrator(t, cannedSource{}, Options{})
+	db := m.mysql.GetDB()
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	empty := ""
+	payment := models.Payment{ID: "p1", CreatedAt: created, Amount: 100, OrganizationID: "o1", Method: 1}
+
+	same := payment
+	same.CreatedAt = created.In(time.FixedZone("Asia/Tashkent", 5*60*60))
+	same.RowHash = "stale"
+	changed := payment
+	changed.Amount = 200
+	labelled := payment
+	labelled.MethodLabel = &empty
+
+	rows := []models.Payment{payment, same, changed, labelled}
+	hashes, err := setRowHashes(db, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		if len(hashes[i]) != 64 || row.RowHash != hashes[i] {
+			t.Errorf("row %d holds hash %q, returned %q", i, row.RowHash, hashes[i])
+		}
+	}
+	if hashes[1] != hashes[0] {
+		t.Error("the -tz location or a stale row_hash changed the hash")
+	}
+	if hashes[2] == hashes[0] {
+		t.Error("a changed amount kept the hash")
+	}
+	if hashes[3] == hashes[0] {
+		t.Error("an empty label hashes like NULL")
+	}
+}
+
+func TestSetRowHashesWithoutColumn(t *testing.T) {
+	m, _ := newDryRunMigrator(t, cannedSource{}, Options{})
+	hashes, err := setRowHashes(m.mysql.GetDB(), []models.MigrationError{{Collection: "charges", RecordID: "c1"}})
+	if err != nil || hashes != nil {
+		t.Errorf("got %v, %v, expected no hashes for a table without %s", hashes, err, rowHashColumn)
+	}
+}
+
+func TestPaymeTransactionWithoutValidDatesHashesTheSame(t *testing.T) {
+	minted := time.Date(2021, 7, 15, 12, 0, 0, 0, time.UTC)
+	ancient := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	source := cannedSource{"paymeTransactions": {bson.M{"_id": primitive.NewObjectIDFromTimestamp(minted),
+		"created_at": ancient, "payme_created_at": ancient, "payme_transaction_id": "tx1", "amount": 100.0,
+		"organization": bson.M{"_id": selfTestID(10)}}}}
+	var hashes []interface{}
+	for run := 0; run < 2; run++ {
+		m, dir := newOutputMigrator(t, source, Options{})
+		if _, err := m.migratePaymeTransactions(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		rows := outputRows(t, m, dir, "payme_transactions")
+		if len(rows) != 1 {
+			t.Fatalf("wrote %d transactions, expected 1", len(rows))
+		}
+		if got := rows[0]["payme_created_at"]; got != minted.Format(time.RFC3339) {
+			t.Errorf("payme_created_at is %v, expected the ObjectID time %v", got, minted)
+		}
+		hashes = append(hashes, rows[0][rowHashColumn])
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("row_hash changed between runs: %v", hashes)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"migrate-tool/models"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// cannedCollection is a source collection of fixed documents. Filters, sorts and
+// limits are ignored: every read returns all documents, so -self-test runs without
+// the options that filter the source.
+type cannedCollection struct {
+	name string
+	docs []interface{}
+}
+
+func (c *cannedCollection) Name() string { return c.name }
+
+func (c *cannedCollection) Find(context.Context, interface{}, ...*options.FindOptions) (*mongo.Cursor, error) {
+	return mongo.NewCursorFromDocuments(c.docs, nil, nil)
+}
+
+func (c *cannedCollection) FindOne(context.Context, interface{}, ...*options.FindOneOptions) *mongo.SingleResult {
+	if len(c.docs) == 0 {
+		return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+	}
+	return mongo.NewSingleResultFromDocument(c.docs[0], nil, nil)
+}
+
+func (c *cannedCollection) CountDocuments(context.Context, interface{}, ...*options.CountOptions) (int64, error) {
+	return int64(len(c.docs)), nil
+}
+
+func (c *cannedCollection) Aggregate(context.Context, interface{}, ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	return mongo.NewCursorFromDocuments(nil, nil, nil)
+}
+
+// cannedSource is a source database of canned collections; missing ones are empty
+type cannedSource map[string][]interface{}
+
+func (s cannedSource) collection(name string) sourceCollection {
+	return &cannedCollection{name: name, docs: s[name]}
+}
+
+// selfTestID returns the n-th fixed ObjectID of the canned documents
+func selfTestID(n int) primitive.ObjectID {
+	id, _ := primitive.ObjectIDFromHex(fmt.Sprintf("%024x", n))
+	return id
+}
+
+// selfTestDocuments returns one or two documents per source collection, covering
+// the embedded arrays that become child tables
+func selfTestDocuments() cannedSource {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	service := bson.M{"_id": selfTestID(1), "name": "Roaming", "code": "roaming"}
+	item := bson.M{"name": "Invoices", "code": 101, "is_over_limit_allowed": true, "over_limit_price": 500.0, "limit": 100}
+	pkg := bson.M{
+		"_id": selfTestID(2), "created_at": created, "name": "Start", "price": 120000.0, "duration_months": 1,
+		"service":                      service,
+		"items":                        bson.A{item, bson.M{"name": "Contracts", "code": 102, "is_unlimited": true}},
+		"on_activation_bonus_packages": bson.A{bson.M{"_id": selfTestID(2)}},
+	}
+	orgA := bson.M{"_id": selfTestID(10), "name": "Alpha LLC", "inn": "123456789"}
+	orgB := bson.M{"_id": selfTestID(11), "name": "Beta LLC", "inn": "987654321"}
+	account := bson.M{"_id": selfTestID(20), "name": "Operator", "username": "operator"}
+
+	return cannedSource{
+		"services": {service},
+		"organizations": {
+			bson.M{
+				"_id": orgA["_id"], "created_at": created, "name": orgA["name"], "inn": orgA["inn"], "balance": 250000.5,
+				"service_demo_uses": bson.A{bson.M{"_id": selfTestID(30), "name": "Roaming", "code": "roaming"}},
+				"active_packages": bson.A{bson.M{
+					"bought_at": created, "expires_at": created.AddDate(0, 1, 0),
+					"package": bson.M{"_id": selfTestID(2), "name": "Start", "price": 120000.0, "items": bson.A{item}},
+				}},
+			},
+			bson.M{"_id": orgB["_id"], "created_at": created, "name": orgB["name"], "inn": orgB["inn"]},
+		},
+		"packages": {pkg},
+		"boughtPackages": {bson.M{
+			"_id": selfTestID(40), "organization": orgB, "bought_at": created, "expires_at": created.AddDate(0, 1, 0),
+			"price":   99000.0,
+			"package": bson.M{"_id": selfTestID(2), "name": "Start", "price": 120000.0, "package_items": bson.A{item}},
+		}},
+		"charges": {bson.M{
+			"_id": selfTestID(50), "created_at": created, "organization": orgB, "price": 500.0,
+			"package": bson.M{"_id": selfTestID(40)}, "service": bson.M{"code": "roaming"}, "item": bson.M{"code": 101},
+			"roaming_invoice": bson.M{"_id": "INV-1", "number": "42", "date": created},
+		}},
+		"payments": {bson.M{
+			"_id": selfTestID(60), "created_at": created, "amount": 150000.0, "organization": orgA, "account": account, "method": 1,
+		}},
+		"paymeTransactions": {bson.M{
+			"_id": selfTestID(70), "created_at": created, "payme_transaction_id": "payme-1", "payme_created_at": created,
+			"state": 2, "amount": 50000.0, "organization": orgA,
+		}},
+		"organizationBalanceBindings": {bson.M{
+			"_id": selfTestID(80), "created_at": created,
+			"payer_organization":  bson.M{"id": orgA["_id"], "name": orgA["name"], "inn": orgA["inn"]},
+			"target_organization": bson.M{"id": orgB["_id"], "name": orgB["name"], "inn": orgB["inn"]},
+		}},
+		"creditUpdates": {bson.M{
+			"_id": selfTestID(90), "created_at": created, "organization": orgB, "amount": 30000.0, "account": account,
+		}},
+		"bankPaymentsAutoApplyErrors": {bson.M{
+			"_id": selfTestID(100), "created_at": created, "error_message": "no matching organization", "amount": 7000.0,
+			"transaction_id": "bank-1", "payer_inn": "123456789", "payer_name": "Alpha LLC",
+		}},
+	}
+}
+
+// selfTestExpectation is the number of rows a table holds after migrating the
+// canned documents, and column values of the row whose columns hold match
+type selfTestExpectation struct {
+	table  string
+	rows   int
+	match  map[string]interface{}
+	values map[string]interface{}
+}
+
+// selfTestExpectations documents what the canned documents are expected to become
+func selfTestExpectations() []selfTestExpectation {
+	id := func(n int) string { return selfTestID(n).Hex() }
+	byID := func(n int) map[string]interface{} { return map[string]interface{}{"id": id(n)} }
+	return []selfTestExpectation{
+		{(&models.Service{}).TableName(), 1, byID(1), map[string]interface{}{"code": "roaming", "name": "Roaming"}},
+		{(&models.Organization{}).TableName(), 2, byID(10), map[string]interface{}{
+			"name": "Alpha LLC", "inn": "123456789", "balance": 250000.5, "created_at": "2024-03-01T09:30:00Z", "is_deleted": false,
+		}},
+		{(&models.OrganizationServiceDemoUses{}).TableName(), 1, map[string]interface{}{"organization_id": id(10)}, map[string]interface{}{
+			"service_code": "roaming", "used_at": "2024-03-01T09:30:00Z",
+		}},
+		{(&models.Package{}).TableName(), 1, byID(2), map[string]interface{}{"name": "Start", "price": 120000.0, "service_code": "roaming"}},
+		{(&models.PackageItem{}).TableName(), 2, map[string]interface{}{"package_id": id(2), "code": 102.0}, map[string]interface{}{
+			"name": "Contracts", "is_unlimited": true, "limit": 0.0,
+		}},
+		{(&models.PackageActivationBonusPackage{}).TableName(), 1, map[string]interface{}{"package_id": id(2)}, map[string]interface{}{
+			"bonus_package_id": id(2),
+		}},
+		{(&models.BoughtPackage{}).TableName(), 2, byID(40), map[string]interface{}{"organization_id": id(11), "package_id": id(2), "price": 99000.0}},
+		{(&models.BoughtPackageItem{}).TableName(), 2, map[string]interface{}{"bought_package_id": id(40)}, map[string]interface{}{
+			"code": 101.0, "name": "Invoices", "limit_value": 100.0, "over_limit_price": 500.0, "is_over_limit_allowed": true, "used_count": 0.0,
+		}},
+		{(&models.Charge{}).TableName(), 1, byID(50), map[string]interface{}{
+			"type": int(models.RoamingInvoiceType), "object_id": "INV-1", "number": "42", "bought_package_id": id(40), "date_source": string(models.ChargeDateDocument),
+			"organization_id": id(11), "bought_package_item_code": 101.0, "date1": "2024-03-01T09:30:00Z",
+		}},
+		{(&models.Payment{}).TableName(), 1, byID(60), map[string]interface{}{"organization_id": id(10), "amount": 150000.0, "account_username": "operator"}},
+		{(&models.PaymeTransaction{}).TableName(), 1, byID(70), map[string]interface{}{"payme_transaction_id": "payme-1", "amount": 50000.0}},
+		{(&models.OrganizationBalanceBinding{}).TableName(), 1, byID(80), map[string]interface{}{"payer_organization_id": id(10), "target_organization_id": id(11)}},
+		{(&models.CreditUpdates{}).TableName(), 1, byID(90), map[string]interface{}{"organization_id": id(11), "amount": 30000.0}},
+		{(&models.BankPaymentAutoApplyError{}).TableName(), 1, byID(100), map[string]interface{}{"transaction_id": "bank-1", "payer_inn": "123456789"}},
+	}
+}
+
+// selfTest migrates the canned documents of selfTestDocuments into -output files in
+// a temporary directory, with neither MongoDB nor a target database, and checks the
+// rows against selfTestExpectations. It prints one line per table and returns an
+// error when any of them differs.
+func selfTest(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "migrate-tool-self-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	target, err := models.NewDryRunDatabase(models.Config{})
+	if err != nil {
+		return err
+	}
+	m := newMigrator(selfTestDocuments(), target, Options{Output: dir})
+	if err := m.Run(ctx); err != nil {
+		return fmt.Errorf("migrating the canned documents failed: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tROWS\tEXPECTED\tRESULT")
+	failed := 0
+	for _, e := range selfTestExpectations() {
+		rows, err := readJSONLRows(filepath.Join(dir, e.table+".jsonl"))
+		if err != nil {
+			return err
+		}
+		result := "ok"
+		if problem := e.check(rows); problem != "" {
+			result = problem
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", e.table, len(rows), e.rows, result)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d tables differ from the expected rows", failed)
+	}
+	return nil
+}
+
+// check returns what differs between rows and e, or "" when nothing does
+func (e selfTestExpectation) check(rows []map[string]interface{}) string {
+	if len(rows) != e.rows {
+		return fmt.Sprintf("expected %d rows", e.rows)
+	}
+	for _, row := range rows {
+		if !rowHas(row, e.match) {
+			continue
+		}
+		for column, want := range e.values {
+			if got := row[column]; fmt.Sprint(got) != fmt.Sprint(want) {
+				return fmt.Sprintf("%s of %v is %v, expected %v", column, e.match, got, want)
+			}
+		}
+		return ""
+	}
+	return fmt.Sprintf("no row %v", e.match)
+}
+
+// rowHas reports whether row holds all of values
+func rowHas(row, values map[string]interface{}) bool {
+	for column, want := range values {
+		if fmt.Sprint(row[column]) != fmt.Sprint(want) {
+			return false
+		}
+	}
+	return true
+}
+
+// readJSONLRows reads the rows of an -output file; a missing file has no rows
+func readJSONLRows(path string) ([]map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFailureDocument*4)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, fmt.Errorf("invalid row in %s: %w", path, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
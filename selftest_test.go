@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	if err := selfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfTestExpectationCheck(t *testing.T) {
+	e := selfTestExpectation{
+		table:  "package_items",
+		rows:   2,
+		match:  map[string]interface{}{"package_id": "p1", "code": 102.0},
+		values: map[string]interface{}{"name": "Contracts", "is_unlimited": true},
+	}
+	row := func(code float64, name string, unlimited bool) map[string]interface{} {
+		return map[string]interface{}{"package_id": "p1", "code": code, "name": name, "is_unlimited": unlimited}
+	}
+	tests := []struct {
+		name    string
+		rows    []map[string]interface{}
+		problem string
+	}{
+		{"matching", []map[string]interface{}{row(101, "Invoices", false), row(102, "Contracts", true)}, ""},
+		{"row count", []map[string]interface{}{row(102, "Contracts", true)}, "expected 2 rows"},
+		{"column value", []map[string]interface{}{row(101, "Invoices", false), row(102, "Contracts", false)}, "is_unlimited"},
+		{"no matching row", []map[string]interface{}{row(101, "Invoices", false), row(103, "Contracts", true)}, "no row"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problem := e.check(tt.rows)
+			if (tt.problem == "") != (problem == "") || !strings.Contains(problem, tt.problem) {
+				t.Errorf("check is %q, expected %q", problem, tt.problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// shapeSampleSize is the number of documents inspected by checkCollectionShape
+const shapeSampleSize = 5
+
+// checkCollectionShape samples the first documents of coll and verifies the expected
+// root fields are present. Decoding a document of a different shape silently yields
+// zero values, so a collection where no sampled document has every expected field is
+// rejected before anything is inserted. Fields may use dotted paths.
+func checkCollectionShape(ctx context.Context, coll sourceCollection, fields ...string) error {
+	cur, err := coll.Find(ctx, bson.M{}, options.Find().SetLimit(shapeSampleSize))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	sampled := 0
+	complete := 0
+	missingCounts := make(map[string]int)
+	for cur.Next(ctx) {
+		sampled++
+		missing := 0
+		for _, field := range fields {
+			if _, err := cur.Current.LookupErr(strings.Split(field, ".")...); err != nil {
+				missingCounts[field]++
+				missing++
+			}
+		}
+		if missing == 0 {
+			complete++
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	if sampled == 0 || complete == sampled {
+		return nil
+	}
+
+	var missing []string
+	for _, field := range fields {
+		if n := missingCounts[field]; n > 0 {
+			missing = append(missing, fmt.Sprintf("%s (%d/%d)", field, n, sampled))
+		}
+	}
+	if complete == 0 {
+		return fmt.Errorf("collection %s does not look like the expected shape, sampled documents are missing: %s",
+			coll.Name(), strings.Join(missing, ", "))
+	}
+	slog.Warn("some sampled documents are missing expected fields", "collection", coll.Name(), "fields", strings.Join(missing, ", "))
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// shardFilters splits coll by created_at into n contiguous half-open ranges
+// [from, to) between the oldest and the newest created_at, so every dated document
+// falls in exactly one of them. The first range also takes the documents without a
+// date created_at. The bounds are whole milliseconds, the precision of a BSON date.
+// It returns a single empty filter when n is 1 or less or coll has no dated document.
+func shardFilters(ctx context.Context, coll sourceCollection, n int) ([]bson.M, error) {
+	if n <= 1 {
+		return []bson.M{{}}, nil
+	}
+	oldest, err := createdAtEdge(ctx, coll, 1)
+	if err != nil {
+		return nil, err
+	}
+	newest, err := createdAtEdge(ctx, coll, -1)
+	if err != nil {
+		return nil, err
+	}
+	if oldest.IsZero() {
+		return []bson.M{{}}, nil
+	}
+
+	from, span := oldest.UnixMilli(), newest.UnixMilli()+1-oldest.UnixMilli()
+	filters := make([]bson.M, n)
+	for i := range filters {
+		window := bson.M{"created_at": bson.M{
+			"$gte": time.UnixMilli(from + span*int64(i)/int64(n)),
+			"$lt":  time.UnixMilli(from + span*int64(i+1)/int64(n)),
+		}}
+		// $or leaves the created_at key to -since/-until and -incremental
+		branches := bson.A{window}
+		if i == 0 {
+			branches = append(branches, bson.M{"created_at": bson.M{"$not": bson.M{"$type": "date"}}})
+		}
+		filters[i] = bson.M{"$or": branches}
+	}
+	return filters, nil
+}
+
+// shard returns a copy of m for one goroutine of a sharded migration. The counters
+// kept in maps start empty, to be added back by mergeShard once the shard is done;
+// the checkpoint is left out since shards do not read in _id order.
+func (m *Migrator) shard() *Migrator {
+	s := *m
+	s.checkpoint = nil
+	s.oversized = make(map[string]map[string]bool)
+	s.failed = make(map[string]int)
+	s.orphans = make(map[string]int)
+	s.missingRefs = make(map[string]int)
+	s.moneyRounded = make(map[string]int)
+	s.countAdjustments = make(map[string]int)
+	return &s
+}
+
+// mergeShard adds the counters of a finished shard to m
+func (m *Migrator) mergeShard(s *Migrator) {
+	for collection, ids := range s.oversized {
+		if m.oversized[collection] == nil {
+			m.oversized[collection] = make(map[string]bool)
+		}
+		for id := range ids {
+			m.oversized[collection][id] = true
+		}
+	}
+	for _, counts := range []struct{ to, from map[string]int }{
+		{m.failed, s.failed},
+		{m.orphans, s.orphans},
+		{m.missingRefs, s.missingRefs},
+		{m.moneyRounded, s.moneyRounded},
+		{m.countAdjustments, s.countAdjustments},
+	} {
+		for key, n := range counts.from {
+			counts.to[key] += n
+		}
+	}
+}
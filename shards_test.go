@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// windowedSource is a canned source whose collections apply the created_at windows of
+// shardFilters and answer the created_at edge queries
+type windowedSource struct {
+	cannedSource
+}
+
+func (s windowedSource) collection(name string) sourceCollection {
+	return &windowedCollection{cannedCollection{name: name, docs: s.cannedSource[name]}}
+}
+
+type windowedCollection struct {
+	cannedCollection
+}
+
+// Find returns the documents matching the $or of a shard filter; other conditions
+// are ignored as by cannedCollection
+func (c *windowedCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	branches, ok := filter.(bson.M)["$or"].(bson.A)
+	if !ok {
+		return c.cannedCollection.Find(ctx, filter, opts...)
+	}
+	var docs []interface{}
+	for _, doc := range c.docs {
+		for _, branch := range branches {
+			if inWindow(doc.(bson.M), branch.(bson.M)["created_at"].(bson.M)) {
+				docs = append(docs, doc)
+				break
+			}
+		}
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+// FindOne returns the oldest or newest dated document, by the sort of the options
+func (c *windowedCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	var edge bson.M
+	for _, doc := range c.docs {
+		created, ok := doc.(bson.M)["created_at"].(time.Time)
+		if !ok {
+			continue
+		}
+		newest := opts[0].Sort.(bson.D)[0].Value == -1
+		if edge == nil || created.After(edge["created_at"].(time.Time)) == newest {
+			edge = doc.(bson.M)
+		}
+	}
+	if edge == nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+	}
+	return mongo.NewSingleResultFromDocument(edge, nil, nil)
+}
+
+// CountDocuments counts the documents meeting the created_at condition of filter
+func (c *windowedCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	cond, ok := filter.(bson.M)["created_at"].(bson.M)
+	if !ok {
+		return c.cannedCollection.CountDocuments(ctx, filter, opts...)
+	}
+	var n int64
+	for _, doc := range c.docs {
+		if inWindow(doc.(bson.M), cond) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// inWindow reports whether the created_at of doc meets cond, a [$gte, $lt) window or
+// the test for a missing date
+func inWindow(doc, cond bson.M) bool {
+	created, dated := doc["created_at"].(time.Time)
+	if _, ok := cond["$not"]; ok {
+		return !dated
+	}
+	return dated && !created.Before(cond["$gte"].(time.Time)) && created.Before(cond["$lt"].(time.Time))
+}
+
+// shardedCharges are charges spread unevenly over a year, with two on the same
+// millisecond, one on the newest edge and one without a created_at
+func shardedCharges() windowedSource {
+	org := bson.M{"_id": selfTestID(10), "name": "Alpha LLC"}
+	pkg := bson.M{"_id": selfTestID(2), "name": "Start"}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var docs []interface{}
+	for i, offset := range []time.Duration{0, time.Millisecond, 24 * time.Hour, 24 * time.Hour, 40 * 24 * time.Hour,
+		121*24*time.Hour + 333*time.Millisecond, 200 * 24 * time.Hour, 365 * 24 * time.Hour} {
+		docs = append(docs, bson.M{"_id": selfTestID(100 + i), "created_at": start.Add(offset), "price": 500.0, "organization": org, "package": pkg})
+	}
+	docs = append(docs, bson.M{"_id": selfTestID(200), "price": 500.0, "organization": org, "package": pkg})
+	return windowedSource{cannedSource{"charges": docs}}
+}
+
+func TestShardFiltersCoverEveryDocumentOnce(t *testing.T) {
+	source := shardedCharges()
+	coll := source.collection("charges")
+	for _, n := range []int{2, 3, 7, 20} {
+		filters, err := shardFilters(context.Background(), coll, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filters) != n {
+			t.Fatalf("%d shards: got %d filters", n, len(filters))
+		}
+		for _, doc := range source.cannedSource["charges"] {
+			matched := 0
+			for _, filter := range filters {
+				for _, branch := range filter["$or"].(bson.A) {
+					if inWindow(doc.(bson.M), branch.(bson.M)["created_at"].(bson.M)) {
+						matched++
+					}
+				}
+			}
+			if matched != 1 {
+				t.Errorf("%d shards: %v falls in %d windows", n, doc.(bson.M)["created_at"], matched)
+			}
+		}
+	}
+}
+
+func TestShardFiltersSingleShard(t *testing.T) {
+	for _, source := range []windowedSource{shardedCharges(), {cannedSource{}}} {
+		filters, err := shardFilters(context.Background(), source.collection("charges"), 1)
+		if err != nil || len(filters) != 1 || len(filters[0]) != 0 {
+			t.Errorf("got %v, %v, expected a single empty filter", filters, err)
+		}
+	}
+	filters, err := shardFilters(context.Background(), windowedSource{cannedSource{}}.collection("charges"), 4)
+	if err != nil || len(filters) != 1 || len(filters[0]) != 0 {
+		t.Errorf("empty collection: got %v, %v, expected a single empty filter", filters, err)
+	}
+}
+
+func TestShardedChargesMatchSingleThreaded(t *testing.T) {
+	migrate := func(shards int) (int, []string) {
+		m, dir := newOutputMigrator(t, shardedCharges(), Options{Shards: shards})
+		stats, err := m.migrateCharges(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, row := range outputRows(t, m, dir, "charges") {
+			ids = append(ids, row["id"].(string))
+		}
+		sort.Strings(ids)
+		return stats.Tables[0].Moved, ids
+	}
+	moved, ids := migrate(1)
+	if moved != 9 || len(ids) != 9 {
+		t.Fatalf("single-threaded run moved %d and wrote %d charges, expected 9", moved, len(ids))
+	}
+	for _, shards := range []int{2, 4} {
+		shardedMoved, shardedIDs := migrate(shards)
+		if shardedMoved != moved {
+			t.Errorf("%d shards moved %d, expected %d", shards, shardedMoved, moved)
+		}
+		if len(shardedIDs) != len(ids) {
+			t.Fatalf("%d shards wrote %v, expected %v", shards, shardedIDs, ids)
+		}
+		for i := range ids {
+			if shardedIDs[i] != ids[i] {
+				t.Errorf("%d shards wrote %v, expected %v", shards, shardedIDs, ids)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sourceCollection is the part of a MongoDB collection the migrators read. It is
+// satisfied by *mongo.Collection and, for -self-test, by cannedCollection.
+type sourceCollection interface {
+	Name() string
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+}
+
+// sourceDatabase opens the source collections of a Migrator by their actual name
+type sourceDatabase interface {
+	collection(name string) sourceCollection
+}
+
+// mongoSource reads the collections of a MongoDB database
+type mongoSource struct {
+	db *mongo.Database
+}
+
+func (s mongoSource) collection(name string) sourceCollection {
+	return s.db.Collection(name)
+}
@@ -0,0 +1,39 @@
+package main
+
+// splitRoute sends the documents matching a predicate to one table
+type splitRoute[T any] struct {
+	table string
+	match func(T) bool
+}
+
+// splitter routes each decoded document of a collection to the table of the first
+// route whose predicate matches, so one collection can populate several tables by
+// rule, e.g. on a discriminator field. Documents matching no route go to the
+// fallback table.
+type splitter[T any] struct {
+	routes   []splitRoute[T]
+	fallback string
+}
+
+func newSplitter[T any](fallback string, routes ...splitRoute[T]) *splitter[T] {
+	return &splitter[T]{routes: routes, fallback: fallback}
+}
+
+// route returns the table doc is written to
+func (s *splitter[T]) route(doc T) string {
+	for _, route := range s.routes {
+		if route.match(doc) {
+			return route.table
+		}
+	}
+	return s.fallback
+}
+
+// tables returns the fallback table followed by the tables of the routes
+func (s *splitter[T]) tables() []string {
+	tables := []string{s.fallback}
+	for _, route := range s.routes {
+		tables = append(tables, route.table)
+	}
+	return tables
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// MigrationResult is the outcome of one target table of a migration. Child tables
+// filled from an embedded array have no source count and no failures of their own;
+// those are reported on the row of their parent table.
+type MigrationResult struct {
+	// Collection is the source collection, by its default name
+	Collection string `json:"collection"`
+	Table      string `json:"table"`
+	Source     int64  `json:"source"`
+	Moved      int    `json:"moved"`
+	Skipped    int    `json:"skipped"`
+	// Updated and Unchanged split, with -on-conflict update, the moved rows that
+	// replaced an existing row and the skipped ones whose source had not changed
+	Updated   int `json:"updated,omitempty"`
+	Unchanged int `json:"unchanged,omitempty"`
+	Failed    int `json:"failed"`
+	// MissingRefs counts the documents skipped for a missing required reference
+	MissingRefs int   `json:"missing_refs,omitempty"`
+	DestAfter   int64 `json:"dest_after"`
+	// DurationMS is the time taken by the whole migration step the table belongs to
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// migrationFailure is a migration that failed, or was skipped because one it depends
+// on did not complete, with -continue-on-error
+type migrationFailure struct {
+	Migration string `json:"migration"`
+	// Status is "failed" or "skipped"
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// runSummary collects the results of a run for -summary-file. Migrators copied for a
+// transaction share it with the Migrator they were copied from.
+type runSummary struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	// stepStart is when the running migration step started
+	stepStart time.Time
+	results   []MigrationResult
+	failures  []migrationFailure
+}
+
+// startStep marks the start of the next migration step
+func (s *runSummary) startStep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stepStart = time.Now()
+}
+
+// addFailure records a migration that did not complete
+func (s *runSummary) addFailure(migration, status, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, migrationFailure{Migration: migration, Status: status, Reason: reason})
+}
+
+// failedMigrations returns the names of the migrations that did not complete
+func (s *runSummary) failedMigrations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, len(s.failures))
+	for i, f := range s.failures {
+		names[i] = f.Migration
+	}
+	return names
+}
+
+// CollectionStats are the counters a migration step returns, one result per target
+// table it wrote in the order they were migrated. Steps that only check or update
+// existing rows return none.
+type CollectionStats struct {
+	Tables []MigrationResult
+}
+
+// add appends the result of a table
+func (c *CollectionStats) add(r MigrationResult) {
+	c.Tables = append(c.Tables, r)
+}
+
+// addStats logs and records the results of the step that just ended
+func (s *runSummary) addStats(stats CollectionStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range stats.Tables {
+		args := []any{"collection", r.Collection, "table", r.Table, "moved", r.Moved, "skipped", r.Skipped}
+		if r.Updated > 0 || r.Unchanged > 0 {
+			args = append(args, "updated", r.Updated, "unchanged", r.Unchanged)
+		}
+		if r.Failed > 0 {
+			args = append(args, "failed", r.Failed)
+		}
+		if r.MissingRefs > 0 {
+			args = append(args, "missing_refs", r.MissingRefs)
+		}
+		slog.Info("migrated", append(args, "mysql_after", r.DestAfter)...)
+		r.DurationMS = time.Since(s.stepStart).Milliseconds()
+		s.results = append(s.results, r)
+	}
+}
+
+// write stores the summary as JSON at path. runErr, the error Run returned, marks the
+// run as failed, in which case the results cover the tables finished before it.
+func (s *runSummary) write(path string, runErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := struct {
+		Status      string             `json:"status"`
+		Error       string             `json:"error,omitempty"`
+		StartedAt   time.Time          `json:"started_at"`
+		FinishedAt  time.Time          `json:"finished_at"`
+		Totals      runTotals          `json:"totals"`
+		Collections []MigrationResult  `json:"collections"`
+		Incomplete  []migrationFailure `json:"incomplete_migrations,omitempty"`
+	}{
+		Status:      "completed",
+		StartedAt:   s.startedAt,
+		FinishedAt:  time.Now(),
+		Totals:      s.totals(),
+		Collections: s.results,
+		Incomplete:  s.failures,
+	}
+	if runErr != nil {
+		summary.Status = "failed"
+		summary.Error = runErr.Error()
+	}
+	if summary.Collections == nil {
+		summary.Collections = []MigrationResult{}
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("could not write summary: %w", err)
+	}
+	return nil
+}
+
+// runTotals add up the results of every table of a run
+type runTotals struct {
+	Source  int64 `json:"source"`
+	Moved   int   `json:"moved"`
+	Skipped int   `json:"skipped"`
+	Failed  int   `json:"failed"`
+}
+
+// totals adds up the results; the caller holds s.mu
+func (s *runSummary) totals() runTotals {
+	var t runTotals
+	for _, r := range s.results {
+		t.Source += r.Source
+		t.Moved += r.Moved
+		t.Skipped += r.Skipped
+		t.Failed += r.Failed
+	}
+	return t
+}
+
+// print writes the results as a table to w. It is not a log record, so the final
+// summary is printed with -quiet as well.
+func (s *runSummary) print(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tTABLE\tSOURCE\tMOVED\tSKIPPED\tFAILED\tDEST AFTER")
+	for _, r := range s.results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\n", r.Collection, r.Table, r.Source, r.Moved, r.Skipped, r.Failed, r.DestAfter)
+	}
+	t := s.totals()
+	fmt.Fprintf(tw, "TOTAL\t\t%d\t%d\t%d\t%d\t\n", t.Source, t.Moved, t.Skipped, t.Failed)
+	if err := tw.Flush(); err != nil || len(s.failures) == 0 {
+		return err
+	}
+
+	fmt.Fprintln(tw, "\nMIGRATION\tSTATUS\tREASON")
+	for _, f := range s.failures {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Migration, f.Status, f.Reason)
+	}
+	return tw.Flush()
+}
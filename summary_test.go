@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRunSummaryPrintSurvivesQuiet(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	if err := setupLogger("text", "info", true); err != nil {
+		t.Fatal(err)
+	}
+	if slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+		t.Fatal("-quiet left info records enabled")
+	}
+
+	var s runSummary
+	s.startStep()
+	var stats CollectionStats
+	stats.add(MigrationResult{Collection: "payments", Table: "payments", Source: 10, Moved: 7, Skipped: 2, Failed: 1, DestAfter: 9})
+	stats.add(MigrationResult{Collection: "charges", Table: "charges", Source: 5, Moved: 5, DestAfter: 5})
+	s.addStats(stats)
+	s.addFailure("credit-updates", "failed", "cursor died")
+
+	var out bytes.Buffer
+	if err := s.print(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	tests := []struct {
+		line   int
+		fields []string
+	}{
+		{0, []string{"COLLECTION", "TABLE", "SOURCE", "MOVED", "SKIPPED", "FAILED", "DEST", "AFTER"}},
+		{1, []string{"payments", "payments", "10", "7", "2", "1", "9"}},
+		{2, []string{"charges", "charges", "5", "5", "0", "0", "5"}},
+		{3, []string{"TOTAL", "15", "12", "2", "1"}},
+		{6, []string{"credit-updates", "failed", "cursor", "died"}},
+	}
+	for _, tt := range tests {
+		if tt.line >= len(lines) {
+			t.Fatalf("summary has %d lines, want line %d:\n%s", len(lines), tt.line, out.String())
+		}
+		if got := strings.Fields(lines[tt.line]); strings.Join(got, " ") != strings.Join(tt.fields, " ") {
+			t.Errorf("line %d = %q, want %q", tt.line, got, tt.fields)
+		}
+	}
+}
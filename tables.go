@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// requireTables checks once per run that the tables of models exist, so a migrator
+// on a target whose schema was never migrated fails at once instead of logging a
+// warning for every count and existence check. With Options.AutoMigrate a missing
+// table is created instead.
+func (m *Migrator) requireTables(models ...interface{}) error {
+	if m.output != nil {
+		// A -output run has no target tables
+		return nil
+	}
+	db := m.mysql.GetDB()
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		if m.tables[table] {
+			continue
+		}
+		if !db.Migrator().HasTable(model) {
+			if !m.opts.AutoMigrate {
+				return fmt.Errorf("table %s does not exist, migrate the schema first or rerun with -auto-migrate", table)
+			}
+			if err := db.AutoMigrate(model); err != nil {
+				return fmt.Errorf("could not create %s: %w", table, err)
+			}
+		}
+		m.tables[table] = true
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"migrate-tool/models"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// memoryTarget keeps the rows inserted into a dry-run database so the queries of a
+// later run see them. INSERTs ignore the rows whose primary key or unique index
+// already holds the same values, like the conflict clause of MySQL, and report the
+// others as affected. Queries understand no condition but "<column> IN ?" and the
+// tuple "(<column>, ...) IN ?" of the dedup key checks.
+type memoryTarget struct {
+	mu     sync.Mutex
+	tables map[string][]map[string]interface{}
+}
+
+// inCondition and tupleInCondition match the only WHERE expressions memoryTarget
+// evaluates
+var (
+	inCondition      = regexp.MustCompile(`^(\w+) IN \?$`)
+	tupleInCondition = regexp.MustCompile("^\\(([`\\w, ]+)\\) IN \\?$")
+)
+
+// newMemoryTarget returns a dry-run database whose inserted rows are kept in memory
+func newMemoryTarget(t *testing.T) (models.Database, *memoryTarget) {
+	t.Helper()
+	db, err := models.NewDryRunDatabase(models.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &memoryTarget{tables: make(map[string][]map[string]interface{})}
+	callbacks := db.GetDB().Callback()
+	if err := callbacks.Create().After("gorm:create").Register("test:memory_insert", target.insert); err != nil {
+		t.Fatal(err)
+	}
+	if err := callbacks.Query().After("gorm:query").Register("test:memory_query", target.query); err != nil {
+		t.Fatal(err)
+	}
+	return db, target
+}
+
+// newMemoryMigrator returns a migrator over source writing into target, whose tables
+// are taken as migrated
+func newMemoryMigrator(t *testing.T, target models.Database, source sourceDatabase, opts Options) *Migrator {
+	t.Helper()
+	m := newMigrator(source, target, opts)
+	for _, model := range models.Models() {
+		stmt := &gorm.Statement{DB: target.GetDB()}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		m.tables[stmt.Schema.Table] = true
+	}
+	return m
+}
+
+// rows returns the rows of table
+func (mt *memoryTarget) rows(table string) []map[string]interface{} {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.tables[table]
+}
+
+// statementRows returns the column values of the rows of an INSERT
+func statementRows(stmt *gorm.Statement) []map[string]interface{} {
+	value := reflect.Indirect(reflect.ValueOf(stmt.Dest))
+	var elems []reflect.Value
+	if value.Kind() == reflect.Slice || value.Kind() == reflect.Array {
+		for i := 0; i < value.Len(); i++ {
+			elems = append(elems, reflect.Indirect(value.Index(i)))
+		}
+	} else {
+		elems = append(elems, value)
+	}
+
+	var rows []map[string]interface{}
+	for _, elem := range elems {
+		row := make(map[string]interface{})
+		if m, ok := elem.Interface().(map[string]interface{}); ok {
+			for column, v := range m {
+				row[column] = v
+			}
+		} else {
+			for _, field := range stmt.Schema.Fields {
+				if field.DBName == "" {
+					continue
+				}
+				v, _ := field.ValueOf(context.Background(), elem)
+				if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr {
+					if rv.IsNil() {
+						v = nil
+					} else {
+						v = rv.Elem().Interface()
+					}
+				}
+				row[field.DBName] = v
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// uniqueKeys returns the column sets of the primary key and unique indexes of stmt
+func uniqueKeys(stmt *gorm.Statement) [][]string {
+	var keys [][]string
+	var primary []string
+	for _, field := range stmt.Schema.PrimaryFields {
+		primary = append(primary, field.DBName)
+	}
+	if len(primary) > 0 {
+		keys = append(keys, primary)
+	}
+	for _, index := range stmt.Schema.ParseIndexes() {
+		if index.Class != "UNIQUE" {
+			continue
+		}
+		var columns []string
+		for _, option := range index.Fields {
+			columns = append(columns, option.DBName)
+		}
+		keys = append(keys, columns)
+	}
+	return keys
+}
+
+// keyOf returns the values of columns in row as one string
+func keyOf(row map[string]interface{}, columns []string) string {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		values[i] = row[column]
+	}
+	return fmt.Sprint(values...)
+}
+
+func (mt *memoryTarget) insert(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	table := db.Statement.Table
+	keys := uniqueKeys(db.Statement)
+	var affected int64
+	for _, row := range statementRows(db.Statement) {
+		duplicate := false
+		for _, existing := range mt.tables[table] {
+			for _, columns := range keys {
+				if keyOf(existing, columns) == keyOf(row, columns) {
+					duplicate = true
+				}
+			}
+		}
+		if !duplicate {
+			mt.tables[table] = append(mt.tables[table], row)
+			affected++
+		}
+	}
+	db.RowsAffected = affected
+}
+
+func (mt *memoryTarget) query(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	var matched []map[string]interface{}
+	for _, row := range mt.tables[db.Statement.Table] {
+		ok, err := matches(db.Statement, row)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+
+	dest := reflect.Indirect(reflect.ValueOf(db.Statement.Dest))
+	switch {
+	case dest.Kind() == reflect.Int64:
+		// Count
+		dest.SetInt(int64(len(matched)))
+	case dest.Kind() == reflect.Slice && dest.Type().Elem().Kind() == reflect.String:
+		// Pluck of one column
+		column := "id"
+		if sel, ok := db.Statement.Clauses["SELECT"].Expression.(clause.Select); ok && len(sel.Columns) == 1 {
+			column = sel.Columns[0].Name
+		}
+		for _, row := range matched {
+			dest.Set(reflect.Append(dest, reflect.ValueOf(fmt.Sprint(row[column]))))
+		}
+	case dest.Type() == reflect.TypeOf([]map[string]interface{}{}):
+		for _, row := range matched {
+			dest.Set(reflect.Append(dest, reflect.ValueOf(row)))
+		}
+	case dest.Kind() == reflect.Slice && dest.Type().Elem().Kind() == reflect.Struct:
+		s, err := schema.Parse(reflect.New(dest.Type().Elem()).Interface(), &sync.Map{}, db.NamingStrategy)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		for _, row := range matched {
+			elem := reflect.New(dest.Type().Elem()).Elem()
+			for _, field := range s.Fields {
+				if v, ok := row[field.DBName]; ok && v != nil {
+					if err := field.Set(context.Background(), elem, v); err != nil {
+						db.AddError(err)
+						return
+					}
+				}
+			}
+			dest.Set(reflect.Append(dest, elem))
+		}
+	default:
+		db.AddError(fmt.Errorf("memory target cannot read into %s", dest.Type()))
+		return
+	}
+	db.RowsAffected = int64(len(matched))
+}
+
+// matches reports whether row satisfies the WHERE clause of stmt
+func matches(stmt *gorm.Statement, row map[string]interface{}) (bool, error) {
+	where, ok := stmt.Clauses["WHERE"].Expression.(clause.Where)
+	if !ok {
+		return true, nil
+	}
+	for _, expr := range where.Exprs {
+		e, ok := expr.(clause.Expr)
+		if !ok || len(e.Vars) != 1 {
+			return false, fmt.Errorf("memory target cannot evaluate %#v", expr)
+		}
+		var columns []string
+		if match := inCondition.FindStringSubmatch(e.SQL); match != nil {
+			columns = []string{match[1]}
+		} else if match := tupleInCondition.FindStringSubmatch(e.SQL); match != nil {
+			for _, column := range strings.Split(match[1], ",") {
+				columns = append(columns, strings.Trim(strings.TrimSpace(column), "`"))
+			}
+		} else {
+			return false, fmt.Errorf("memory target cannot evaluate %#v", expr)
+		}
+		values := reflect.ValueOf(e.Vars[0])
+		found := false
+		for i := 0; i < values.Len(); i++ {
+			var value string
+			if tuple, ok := values.Index(i).Interface().([]interface{}); ok {
+				value = fmt.Sprint(tuple...)
+			} else {
+				value = fmt.Sprint(values.Index(i).Interface())
+			}
+			if value == keyOf(row, columns) {
+				found = true
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"migrate-tool/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// truncateTables empties every model table, children first, keeping the schema. MySQL
+// tables are truncated with foreign key checks disabled on the connection; Postgres
+// refuses to truncate a referenced table, so its rows are deleted instead.
+func truncateTables(target models.Database) error {
+	return target.GetDB().Connection(func(db *gorm.DB) error {
+		postgres := db.Dialector.Name() == models.DriverPostgres
+		if !postgres {
+			if err := db.Exec("SET FOREIGN_KEY_CHECKS = 0").Error; err != nil {
+				return err
+			}
+			defer func() {
+				if err := db.Exec("SET FOREIGN_KEY_CHECKS = 1").Error; err != nil {
+					slog.Warn("could not re-enable foreign key checks", "error", err)
+				}
+			}()
+		}
+
+		tables := models.Models()
+		for i := len(tables) - 1; i >= 0; i-- {
+			stmt := &gorm.Statement{DB: db}
+			if err := stmt.Parse(tables[i]); err != nil {
+				return err
+			}
+			table := stmt.Schema.Table
+			if !db.Migrator().HasTable(table) {
+				continue
+			}
+
+			var rows int64
+			if err := db.Table(table).Count(&rows).Error; err != nil {
+				return fmt.Errorf("could not count %s: %w", table, err)
+			}
+			var err error
+			if postgres {
+				err = db.Exec("DELETE FROM ?", clause.Table{Name: table}).Error
+			} else {
+				err = db.Exec("TRUNCATE TABLE ?", clause.Table{Name: table}).Error
+			}
+			if err != nil {
+				return fmt.Errorf("could not truncate %s: %w", table, err)
+			}
+			slog.Info("truncated", "table", table, "rows", rows)
+		}
+		return nil
+	})
+}
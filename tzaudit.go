@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"migrate-tool/models"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mysqlDateTimeLayout matches how DATETIME(3) values are written by the driver
+const mysqlDateTimeLayout = "2006-01-02 15:04:05.000"
+
+// timezoneAuditTarget is a collection whose created_at is audited against its table
+type timezoneAuditTarget struct {
+	collection string
+	table      string
+}
+
+// timezoneAuditTargets returns the collections whose created_at is audited
+func timezoneAuditTargets() []timezoneAuditTarget {
+	return []timezoneAuditTarget{
+		{"services", (&models.Service{}).TableName()},
+		{"organizations", (&models.Organization{}).TableName()},
+		{"packages", (&models.Package{}).TableName()},
+		{"charges", (&models.Charge{}).TableName()},
+		{"payments", (&models.Payment{}).TableName()},
+		{"paymeTransactions", (&models.PaymeTransaction{}).TableName()},
+		{"organizationBalanceBindings", (&models.OrganizationBalanceBinding{}).TableName()},
+		{"creditUpdates", (&models.CreditUpdates{}).TableName()},
+		{"bankPaymentsAutoApplyErrors", (&models.BankPaymentAutoApplyError{}).TableName()},
+	}
+}
+
+// timezoneAudit prints, for a sample of documents per collection, the original UTC
+// created_at, the configured timezone, the value the MySQL driver writes for it and
+// the value currently stored in MySQL when the record was already migrated.
+func timezoneAudit(ctx context.Context, mdb *mongo.Database, mysql models.Database, opts Options, tz string, sample int64) error {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", tz, err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTION\tID\tSOURCE (UTC)\tTZ\tWRITTEN\tSTORED")
+	for _, target := range timezoneAuditTargets() {
+		cur, err := mdb.Collection(opts.Collections.resolve(target.collection)).Find(ctx, bson.M{},
+			options.Find().SetLimit(sample).SetProjection(bson.M{"created_at": 1}))
+		if err != nil {
+			return err
+		}
+
+		for cur.Next(ctx) {
+			var doc struct {
+				ID        primitive.ObjectID `bson:"_id"`
+				CreatedAt time.Time          `bson:"created_at"`
+			}
+			if err := cur.Decode(&doc); err != nil {
+				cur.Close(ctx)
+				return err
+			}
+
+			stored := "-"
+			var values []string
+			if err := mysql.GetDB().Table(target.table).Where("id = ?", formatRowID(opts.IDFormat, doc.ID)).
+				Pluck("CAST(created_at AS CHAR)", &values).Error; err == nil && len(values) > 0 {
+				stored = values[0]
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", target.collection, doc.ID.Hex(),
+				doc.CreatedAt.UTC().Format(time.RFC3339Nano), loc, doc.CreatedAt.In(loc).Format(mysqlDateTimeLayout), stored)
+		}
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"migrate-tool/models"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// exitVerifyMismatch is the exit status when -verify finds more mismatched rows than
+// -verify-max-mismatches
+const exitVerifyMismatch = 4
+
+// verifiedCollections maps the migrations whose rows -verify compares to their source
+// collection. Child tables are covered through their parents' documents only.
+var verifiedCollections = map[string]string{
+	"services":                        "services",
+	"organizations":                   "organizations",
+	"packages":                        "packages",
+	"bought-packages":                 "boughtPackages",
+	"charges":                         "charges",
+	"payments":                        "payments",
+	"payme-transactions":              "paymeTransactions",
+	"organization-balance-bindings":   "organizationBalanceBindings",
+	"credit-updates":                  "creditUpdates",
+	"bank-payments-auto-apply-errors": "bankPaymentsAutoApplyErrors",
+}
+
+// rowCapture collects the rows a migrator would insert instead of writing them. The
+// rows come out of the regular migrators, so -verify and -diff compare against exactly
+// the transform the migration applied.
+type rowCapture struct {
+	rows []interface{}
+	// flushed, when set, is handed the rows of every batch as it is flushed, which are
+	// then dropped instead of collected; -diff sets it to go over whole collections
+	flushed func(rows []interface{}) error
+}
+
+// captureRows copies rows into c; the batch reuses its slice after a flush
+func captureRows[T any](c *rowCapture, rows []T) error {
+	for i := range rows {
+		row := rows[i]
+		c.rows = append(c.rows, &row)
+	}
+	if c.flushed == nil {
+		return nil
+	}
+	defer func() {
+		c.rows = c.rows[:0]
+	}()
+	return c.flushed(c.rows)
+}
+
+// verifyOptions returns the options of the migration being verified with everything
+// that would write or narrow the sampled reads turned off. -incremental is dropped
+// since the watermark of a run verified afterwards has already been advanced past
+// every sampled document.
+func verifyOptions(opts Options) Options {
+	opts.CheckRefs = false
+	opts.OutputErrorsToMySQL = false
+	opts.CheckpointFile = ""
+	opts.Output = ""
+	opts.Shards = 1
+	opts.Limit = 0
+	opts.Incremental = false
+	return opts
+}
+
+// verify samples up to sample documents per collection, maps them again and compares
+// every column with the migrated row. It returns the number of mismatched rows.
+func verify(ctx context.Context, mdb *mongo.Database, db models.Database, opts Options, sample int) (int, error) {
+	opts = verifyOptions(opts)
+	v := NewMigratorWithClients(mdb, db, opts)
+	v.sample = make(map[string][]interface{})
+	selected, err := selectMigrations(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, mig := range selected {
+		if mig.name == "organization-merges" {
+			// Re-pointed organization ids must match the migration
+			if _, err := mig.fn(v, ctx); err != nil {
+				return total, err
+			}
+			continue
+		}
+		collection, ok := verifiedCollections[mig.name]
+		if !ok {
+			continue
+		}
+
+		ids, err := v.sampleIDs(ctx, collection, sample)
+		if err != nil {
+			return total, fmt.Errorf("could not sample %s: %w", collection, err)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		v.sample[collection] = ids
+		v.capture = &rowCapture{}
+		if _, err := mig.fn(v, ctx); err != nil {
+			return total, fmt.Errorf("could not map %s: %w", collection, err)
+		}
+
+		mismatched := 0
+		for _, row := range v.capture.rows {
+			diffs, err := compareRow(ctx, db.GetDB(), row)
+			if err != nil {
+				return total, err
+			}
+			if len(diffs) > 0 {
+				mismatched++
+			}
+			for _, d := range diffs {
+				slog.Warn("verify mismatch", "collection", collection, "table", d.table, "id", d.id,
+					"field", d.column, "source", d.source, "target", d.target)
+			}
+		}
+		slog.Info("verified", "collection", collection, "sampled", len(ids), "rows", len(v.capture.rows), "mismatched", mismatched)
+		total += mismatched
+	}
+	return total, ctx.Err()
+}
+
+// sampleIDs returns the _id of up to size random documents of collection, within the
+// -since/-until window and without the deleted ones of -exclude-deleted
+func (m *Migrator) sampleIDs(ctx context.Context, collection string, size int) ([]interface{}, error) {
+	match := bson.M{}
+	m.applyDateWindow(collection, match)
+	m.excludeDeleted(ctx, collection, match)
+	cur, err := m.collection(collection).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sample", Value: bson.M{"size": size}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.WithoutCancel(ctx))
+
+	var ids []interface{}
+	for cur.Next(ctx) {
+		ids = append(ids, cur.Current.Lookup("_id"))
+	}
+	return ids, cur.Err()
+}
+
+// rowDiff is one column whose migrated value differs from the value mapped again
+type rowDiff struct {
+	table, id, column string
+	source, target    interface{}
+}
+
+// compareRow loads the row with the primary key of row and returns the columns that
+// differ, or a single "row" diff when the row is missing
+func compareRow(ctx context.Context, db *gorm.DB, row interface{}) ([]rowDiff, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(row); err != nil {
+		return nil, err
+	}
+	source := reflect.ValueOf(row).Elem()
+	idValue, _ := stmt.Schema.PrioritizedPrimaryField.ValueOf(ctx, source)
+	id := fmt.Sprint(idValue)
+
+	stored := reflect.New(source.Type())
+	err := db.WithContext(ctx).Table(stmt.Schema.Table).
+		Where(stmt.Schema.PrioritizedPrimaryField.DBName+" = ?", id).Take(stored.Interface()).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return []rowDiff{{table: stmt.Schema.Table, id: id, column: "row", source: "present", target: "missing"}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load %s %s: %w", stmt.Schema.Table, id, err)
+	}
+
+	return columnDiffs(ctx, stmt.Schema, id, source, stored.Elem()), nil
+}
+
+// columnDiffs returns the columns of sch whose value in the mapped row source differs
+// from the stored row
+func columnDiffs(ctx context.Context, sch *schema.Schema, id string, source, stored reflect.Value) []rowDiff {
+	var diffs []rowDiff
+	for _, column := range sch.DBNames {
+		field := sch.FieldsByDBName[column]
+		want, _ := field.ValueOf(ctx, source)
+		got, _ := field.ValueOf(ctx, stored)
+		if !sameValue(want, got) {
+			diffs = append(diffs, rowDiff{table: sch.Table, id: id, column: column, source: want, target: got})
+		}
+	}
+	return diffs
+}
+
+// sameValue compares two column values, treating times as equal when they are the
+// same instant to the millisecond the target columns store
+func sameValue(a, b interface{}) bool {
+	a, b = deref(a), deref(b)
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		if !ok {
+			return false
+		}
+		diff := ta.Sub(tb)
+		return diff > -time.Millisecond && diff < time.Millisecond
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// deref returns the value a non-nil pointer points to, and nil for a nil pointer
+func deref(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer {
+		return v
+	}
+	if rv.IsNil() {
+		return nil
+	}
+	return rv.Elem().Interface()
+}
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestVerifyOptions(t *testing.T) {
+	opts := verifyOptions(Options{Incremental: true, Limit: 10, Shards: 4, CheckRefs: true, OutputErrorsToMySQL: true,
+		CheckpointFile: "checkpoint.json", Output: "out", SkipErrors: true})
+	if opts.Incremental || opts.Limit != 0 || opts.Shards != 1 || opts.CheckRefs || opts.OutputErrorsToMySQL ||
+		opts.CheckpointFile != "" || opts.Output != "" {
+		t.Errorf("verification runs with %+v", opts)
+	}
+	if !opts.SkipErrors {
+		t.Error("the mapping options of the verified migration were dropped")
+	}
+}
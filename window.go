@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// undatedCollections have no created_at field and ignore -since/-until
+var undatedCollections = map[string]bool{
+	"boughtPackages": true,
+}
+
+// dateWindowed reports whether -since or -until is set
+func (opts Options) dateWindowed() bool {
+	return !opts.Since.IsZero() || !opts.Until.IsZero()
+}
+
+// applyDateWindow restricts filter to documents created in [Options.Since,
+// Options.Until) when either bound is set, logging the window applied to collection
+func (m *Migrator) applyDateWindow(collection string, filter bson.M) {
+	if !m.opts.dateWindowed() {
+		return
+	}
+	since, until := m.opts.Since, m.opts.Until
+	if undatedCollections[collection] {
+		slog.Warn("collection has no created_at, migrating it in full", "collection", collection)
+		return
+	}
+
+	window := bson.M{}
+	if !since.IsZero() {
+		window["$gte"] = since
+	}
+	if !until.IsZero() {
+		window["$lt"] = until
+	}
+	filter["created_at"] = window
+	slog.Info("date window", "collection", collection, "since", formatBound(since), "until", formatBound(until))
+}
+
+func formatBound(t time.Time) string {
+	if t.IsZero() {
+		return "unbounded"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDateWindowKeepsTablesAndPartialCounts(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		opts    Options
+		keep    bool
+		partial bool
+	}{
+		{"full run", Options{}, false, false},
+		{"since", Options{Since: day}, true, true},
+		{"until", Options{Until: day}, true, true},
+		{"since and until", Options{Since: day, Until: day.AddDate(0, 1, 0)}, true, true},
+		{"only", Options{Only: []string{"payments"}}, true, false},
+		{"incremental", Options{Incremental: true}, true, true},
+		{"limit", Options{Limit: 10}, false, true},
+	}
+	for _, tt := range tests {
+		if keep := keepTablesReason(tt.opts) != ""; keep != tt.keep {
+			t.Errorf("%s: keeps tables %v, expected %v", tt.name, keep, tt.keep)
+		}
+		if partial := partialCountsReason(tt.opts) != ""; partial != tt.partial {
+			t.Errorf("%s: partial counts %v, expected %v", tt.name, partial, tt.partial)
+		}
+	}
+}
+
+func TestApplyDateWindow(t *testing.T) {
+	since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		opts       Options
+		collection string
+		want       bson.M
+	}{
+		{"no window", Options{}, "payments", bson.M{}},
+		{"since", Options{Since: since}, "payments", bson.M{"created_at": bson.M{"$gte": since}}},
+		{"until", Options{Until: until}, "charges", bson.M{"created_at": bson.M{"$lt": until}}},
+		{"since and until", Options{Since: since, Until: until}, "charges", bson.M{"created_at": bson.M{"$gte": since, "$lt": until}}},
+		{"undated collection", Options{Since: since, Until: until}, "boughtPackages", bson.M{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := bson.M{}
+			newMigrator(cannedSource{}, nil, tt.opts).applyDateWindow(tt.collection, filter)
+			if !reflect.DeepEqual(filter, tt.want) {
+				t.Errorf("filter is %v, expected %v", filter, tt.want)
+			}
+		})
+	}
+}